@@ -0,0 +1,380 @@
+// Package auth keeps the users, API keys and per-database role grants that the
+// HTTP server enforces. Everything lives in a single JSON file next to the
+// databases (./files/auth.json by default).
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Role is a permission that can be granted on a database.
+type Role string
+
+const (
+	RoleRead           Role = "read"
+	RoleWrite          Role = "write"
+	RoleAdmin          Role = "admin"
+	RoleVersionControl Role = "version-control"
+)
+
+// AllDatabases grants a role on every database, including ones created later.
+const AllDatabases = "*"
+
+// keyPrefix marks API keys so they can be told apart from JWTs.
+const keyPrefix = "nut_"
+
+var (
+	ErrUnauthenticated = errors.New("missing or invalid credentials")
+	ErrUnknownUser     = errors.New("unknown user")
+)
+
+// ParseRole validates a role name.
+func ParseRole(s string) (Role, error) {
+	switch r := Role(s); r {
+	case RoleRead, RoleWrite, RoleAdmin, RoleVersionControl:
+		return r, nil
+	}
+	return "", fmt.Errorf("unknown role %q (want read, write, admin or version-control)", s)
+}
+
+// Implies reports whether holding r is enough for required. admin implies every
+// role; write and version-control both imply read.
+func (r Role) Implies(required Role) bool {
+	switch r {
+	case RoleAdmin:
+		return true
+	case RoleWrite, RoleVersionControl:
+		return required == r || required == RoleRead
+	}
+	return r == required
+}
+
+// APIKey is a stored key. Only the SHA-256 of the secret is kept.
+type APIKey struct {
+	ID      string `json:"id"`
+	Hash    string `json:"hash"`
+	Created string `json:"created"`
+}
+
+// User holds a user's grants (database ID or "*" to roles) and API keys.
+type User struct {
+	Name   string            `json:"name"`
+	Grants map[string][]Role `json:"grants"`
+	Keys   []APIKey          `json:"keys"`
+}
+
+// Store is the on-disk auth database. It reloads itself when the file changes
+// so keys created with the CLI take effect on a running server.
+type Store struct {
+	mu      sync.RWMutex
+	path    string
+	modTime time.Time
+	data    storeData
+}
+
+type storeData struct {
+	// Secret signs JWT bearer tokens.
+	Secret string           `json:"secret"`
+	Users  map[string]*User `json:"users"`
+}
+
+// DefaultPath is where the CLI and server keep the store.
+func DefaultPath(root string) string {
+	return filepath.Join(root, "auth.json")
+}
+
+// Open loads the store at path, starting empty when the file does not exist.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, data: storeData{Users: map[string]*User{}}}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) load() error {
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	raw, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to read auth store: %v", err)
+	}
+	var data storeData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return fmt.Errorf("failed to parse auth store: %v", err)
+	}
+	if data.Users == nil {
+		data.Users = map[string]*User{}
+	}
+	s.data = data
+	s.modTime = info.ModTime()
+	return nil
+}
+
+// refresh reloads the file if it changed since the last load.
+func (s *Store) refresh() {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return
+	}
+
+	s.mu.RLock()
+	stale := info.ModTime().After(s.modTime)
+	s.mu.RUnlock()
+	if !stale {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reloading auth store: %v\n", err)
+	}
+}
+
+// Save writes the store with owner-only permissions.
+func (s *Store) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.save()
+}
+
+func (s *Store) save() error {
+	if s.data.Secret == "" {
+		secret, err := randomHex(32)
+		if err != nil {
+			return err
+		}
+		s.data.Secret = secret
+	}
+
+	raw, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal auth store: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(s.path, raw, 0600); err != nil {
+		return fmt.Errorf("failed to write auth store: %v", err)
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// Enabled reports whether any user exists. The server only enforces
+// authentication once the first user has been added.
+func (s *Store) Enabled() bool {
+	s.refresh()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.data.Users) > 0
+}
+
+// AddUser creates a user with no grants.
+func (s *Store) AddUser(name string) error {
+	if name == "" || strings.ContainsAny(name, " \t\n") {
+		return fmt.Errorf("invalid user name %q", name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data.Users[name]; ok {
+		return fmt.Errorf("user %q already exists", name)
+	}
+	s.data.Users[name] = &User{Name: name, Grants: map[string][]Role{}}
+	return s.save()
+}
+
+// RemoveUser deletes a user together with its keys.
+func (s *Store) RemoveUser(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data.Users[name]; !ok {
+		return ErrUnknownUser
+	}
+	delete(s.data.Users, name)
+	return s.save()
+}
+
+// Users returns the users sorted by name.
+func (s *Store) Users() []User {
+	s.refresh()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := make([]User, 0, len(s.data.Users))
+	for _, u := range s.data.Users {
+		users = append(users, *u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users
+}
+
+// Grant gives user role on dbID ("*" for every database).
+func (s *Store) Grant(name, dbID string, role Role) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.data.Users[name]
+	if !ok {
+		return ErrUnknownUser
+	}
+	for _, r := range u.Grants[dbID] {
+		if r == role {
+			return nil
+		}
+	}
+	u.Grants[dbID] = append(u.Grants[dbID], role)
+	return s.save()
+}
+
+// Revoke removes role from user on dbID, or every role when role is empty.
+func (s *Store) Revoke(name, dbID string, role Role) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.data.Users[name]
+	if !ok {
+		return ErrUnknownUser
+	}
+	var kept []Role
+	for _, r := range u.Grants[dbID] {
+		if role != "" && r != role {
+			kept = append(kept, r)
+		}
+	}
+	if len(kept) == 0 {
+		delete(u.Grants, dbID)
+	} else {
+		u.Grants[dbID] = kept
+	}
+	return s.save()
+}
+
+// CreateKey issues a new API key for user. The returned secret is shown once
+// and cannot be recovered later.
+func (s *Store) CreateKey(name string) (string, APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.data.Users[name]
+	if !ok {
+		return "", APIKey{}, ErrUnknownUser
+	}
+
+	id, err := randomHex(6)
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	secret, err := randomHex(24)
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	token := keyPrefix + id + "_" + secret
+	key := APIKey{ID: id, Hash: hashKey(token), Created: time.Now().Format(time.RFC3339)}
+	u.Keys = append(u.Keys, key)
+	return token, key, s.save()
+}
+
+// RevokeKey deletes one of user's API keys.
+func (s *Store) RevokeKey(name, keyID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.data.Users[name]
+	if !ok {
+		return ErrUnknownUser
+	}
+	for i, k := range u.Keys {
+		if k.ID == keyID {
+			u.Keys = append(u.Keys[:i], u.Keys[i+1:]...)
+			return s.save()
+		}
+	}
+	return fmt.Errorf("key %q not found for user %q", keyID, name)
+}
+
+// Authenticate resolves an API key or JWT bearer token to its user.
+func (s *Store) Authenticate(token string) (*User, error) {
+	if token == "" {
+		return nil, ErrUnauthenticated
+	}
+	s.refresh()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var name string
+	if strings.HasPrefix(token, keyPrefix) {
+		parts := strings.SplitN(strings.TrimPrefix(token, keyPrefix), "_", 2)
+		if len(parts) != 2 {
+			return nil, ErrUnauthenticated
+		}
+		hash := hashKey(token)
+		for _, u := range s.data.Users {
+			for _, k := range u.Keys {
+				if k.ID == parts[0] && subtle.ConstantTimeCompare([]byte(k.Hash), []byte(hash)) == 1 {
+					name = u.Name
+				}
+			}
+		}
+	} else {
+		claims, err := verifyJWT(token, s.data.Secret, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		name = claims.Subject
+	}
+
+	u, ok := s.data.Users[name]
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+	copied := *u
+	return &copied, nil
+}
+
+// Allowed reports whether u may exercise role on dbID. An empty dbID refers to
+// server-wide operations such as creating databases, which need a "*" grant.
+func (s *Store) Allowed(u *User, dbID string, role Role) bool {
+	scopes := []string{AllDatabases}
+	if dbID != "" {
+		scopes = append(scopes, dbID)
+	}
+	for _, scope := range scopes {
+		for _, r := range u.Grants[scope] {
+			if r.Implies(role) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func hashKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate random bytes: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
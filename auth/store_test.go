@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeysTokensAndGrants(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.json")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	if store.Enabled() {
+		t.Fatalf("empty store should not enforce auth")
+	}
+
+	if err := store.AddUser("alice"); err != nil {
+		t.Fatalf("Failed to add user: %v", err)
+	}
+	if err := store.Grant("alice", "db_1", RoleWrite); err != nil {
+		t.Fatalf("Failed to grant role: %v", err)
+	}
+	key, _, err := store.CreateKey("alice")
+	if err != nil {
+		t.Fatalf("Failed to create key: %v", err)
+	}
+
+	// A second handle sees the changes through the file.
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	user, err := reopened.Authenticate(key)
+	if err != nil || user.Name != "alice" {
+		t.Fatalf("Authenticate(key) = %v, %v; want alice", user, err)
+	}
+	if _, err := reopened.Authenticate(key[:len(key)-1] + "x"); err == nil {
+		t.Errorf("tampered key was accepted")
+	}
+
+	checks := []struct {
+		db   string
+		role Role
+		want bool
+	}{
+		{"db_1", RoleRead, true},
+		{"db_1", RoleWrite, true},
+		{"db_1", RoleVersionControl, false},
+		{"db_2", RoleRead, false},
+		{"", RoleAdmin, false},
+	}
+	for _, c := range checks {
+		if got := reopened.Allowed(user, c.db, c.role); got != c.want {
+			t.Errorf("Allowed(%q, %s) = %v; want %v", c.db, c.role, got, c.want)
+		}
+	}
+
+	token, err := store.IssueToken("alice", time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+	if user, err := store.Authenticate(token); err != nil || user.Name != "alice" {
+		t.Errorf("Authenticate(jwt) = %v, %v; want alice", user, err)
+	}
+	parts := strings.Split(token, ".")
+	if _, err := store.Authenticate(parts[0] + "." + parts[1] + ".AAAA"); err == nil {
+		t.Errorf("JWT with a bad signature was accepted")
+	}
+	if _, err := verifyJWT(token, store.data.Secret, time.Now().Add(2*time.Hour)); err == nil {
+		t.Errorf("expired JWT was accepted")
+	}
+}
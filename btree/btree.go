@@ -66,9 +66,11 @@ func LoadBTree(collectionName, pageDir string) (*BTree, error) {
 	return bt, nil
 }
 
+// saveMetadata writes RootID, Order and NextID. Callers hold metadata or the
+// exclusive tree lock so RootID cannot change underneath it.
 func (bt *BTree) saveMetadata() error {
-	bt.metadata.RLock()
-	defer bt.metadata.RUnlock()
+	bt.idMu.Lock()
+	defer bt.idMu.Unlock()
 
 	metadataPath := filepath.Join(bt.PageDir, "metadata.json")
 	data, err := json.MarshalIndent(bt, "", "  ")
@@ -76,7 +78,7 @@ func (bt *BTree) saveMetadata() error {
 		return fmt.Errorf("failed to marshal metadata: %v", err)
 	}
 
-	err = os.WriteFile(metadataPath, data, 0644)
+	err = writeFileAtomic(metadataPath, data)
 	if err != nil {
 		return fmt.Errorf("failed to write metadata file: %v", err)
 	}
@@ -84,14 +86,30 @@ func (bt *BTree) saveMetadata() error {
 	return nil
 }
 
+// Quiesce waits for the writes in flight to finish, blocks new reads and
+// writes, and saves the metadata, so the page files on disk form a complete
+// tree until resume is called. It is meant for copying or hashing the pages.
+func (bt *BTree) Quiesce() (resume func(), err error) {
+	bt.treeLock.Lock()
+	if err := bt.saveMetadata(); err != nil {
+		bt.treeLock.Unlock()
+		return nil, fmt.Errorf("failed to save metadata: %v", err)
+	}
+	return bt.treeLock.Unlock, nil
+}
+
 func (bt *BTree) Close() error {
+	bt.treeLock.Lock()
+	defer bt.treeLock.Unlock()
 
 	err := bt.saveMetadata()
 	if err != nil {
 		return fmt.Errorf("failed to save metadata: %v", err)
 	}
 
+	bt.cacheMu.Lock()
 	bt.nodeCache = make(map[int]*Node)
+	bt.cacheMu.Unlock()
 
 	return nil
 }
@@ -0,0 +1,340 @@
+package btree
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestConcurrentAccess hammers one small-order tree with parallel inserts,
+// updates, deletes, point reads and scans, then checks that no write was lost.
+// Run it with -race.
+func TestConcurrentAccess(t *testing.T) {
+	bt, err := NewBTree(3, "stress", t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create tree: %v", err)
+	}
+
+	const writers, readers, perWriter = 6, 3, 60
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(w)))
+			for i := 0; i < perWriter; i++ {
+				key := fmt.Sprintf("w%d-%04d", w, i)
+				if err := bt.Insert(key, "v0"); err != nil {
+					t.Errorf("Insert(%s): %v", key, err)
+					return
+				}
+				if _, err := bt.Update(key, "v1"); err != nil {
+					t.Errorf("Update(%s): %v", key, err)
+					return
+				}
+				// Every tenth key is deleted again; those must be gone at the end.
+				if i%10 == 0 {
+					if _, err := bt.Delete(key); err != nil {
+						t.Errorf("Delete(%s): %v", key, err)
+						return
+					}
+				}
+				if j := rng.Intn(i + 1); j%10 != 0 {
+					if _, found, err := bt.Find(fmt.Sprintf("w%d-%04d", w, j)); err != nil || !found {
+						t.Errorf("Find(w%d-%04d) = %v, %v; want an earlier write", w, j, found, err)
+						return
+					}
+				}
+			}
+		}(w)
+	}
+
+	var readerWG sync.WaitGroup
+	for r := 0; r < readers; r++ {
+		readerWG.Add(1)
+		go func() {
+			defer readerWG.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				prev := ""
+				err := bt.Scan(func(kv KeyValue) bool {
+					if kv.Key <= prev {
+						t.Errorf("Scan out of order: %q after %q", kv.Key, prev)
+						return false
+					}
+					prev = kv.Key
+					return true
+				})
+				if err != nil {
+					t.Errorf("Scan: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(stop)
+	readerWG.Wait()
+
+	count := 0
+	if err := bt.Scan(func(KeyValue) bool { count++; return true }); err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if want := writers * (perWriter - perWriter/10); count != want {
+		t.Errorf("tree holds %d keys; want %d", count, want)
+	}
+	for w := 0; w < writers; w++ {
+		for i := 0; i < perWriter; i++ {
+			key := fmt.Sprintf("w%d-%04d", w, i)
+			val, found, err := bt.Find(key)
+			if err != nil {
+				t.Fatalf("Find(%s): %v", key, err)
+			}
+			if deleted := i%10 == 0; found == deleted || (found && val != "v1") {
+				t.Errorf("Find(%s) = %v, %v; deleted=%v", key, val, found, deleted)
+			}
+		}
+	}
+}
+
+// TestSnapshotIsolation checks that a snapshot keeps seeing the tree as it
+// was while writes and deletes continue, and that Vacuum cleans up after it.
+func TestSnapshotIsolation(t *testing.T) {
+	bt, err := NewBTree(3, "mvcc", t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create tree: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := bt.Insert(fmt.Sprintf("k%02d", i), "old"); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	}
+
+	snap := bt.Snapshot()
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("k%02d", i)
+		if i%2 == 0 {
+			if _, err := bt.Delete(key); err != nil {
+				t.Fatalf("Failed to delete %s: %v", key, err)
+			}
+		} else if _, err := bt.Update(key, "new"); err != nil {
+			t.Fatalf("Failed to update %s: %v", key, err)
+		}
+	}
+	if err := bt.Insert("k99", "new"); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+
+	count := 0
+	err = snap.Scan(func(kv KeyValue) bool {
+		if kv.Value != "old" {
+			t.Errorf("snapshot saw %s = %v; want old", kv.Key, kv.Value)
+		}
+		count++
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Failed to scan snapshot: %v", err)
+	}
+	if count != 20 {
+		t.Errorf("snapshot holds %d keys; want 20", count)
+	}
+	if val, found, err := snap.Find("k00"); err != nil || !found || val != "old" {
+		t.Errorf("snapshot Find(k00) = %v, %v, %v; want old", val, found, err)
+	}
+	if _, found, _ := bt.Find("k00"); found {
+		t.Errorf("deleted key is still visible outside the snapshot")
+	}
+	if val, _, _ := bt.Find("k01"); val != "new" {
+		t.Errorf("Find(k01) = %v; want new", val)
+	}
+
+	if removed, err := bt.Vacuum(); err != nil || removed != 0 {
+		t.Errorf("Vacuum with an open snapshot removed %d keys (%v); want 0", removed, err)
+	}
+	snap.Release()
+	if removed, err := bt.Vacuum(); err != nil || removed != 10 {
+		t.Errorf("Vacuum removed %d keys (%v); want 10", removed, err)
+	}
+	if _, _, err := bt.FindAt("k01", snap.Timestamp()); err != ErrSnapshotTooOld {
+		t.Errorf("FindAt after release = %v; want ErrSnapshotTooOld", err)
+	}
+	if all := bt.FindAll(); len(all) != 11 {
+		t.Errorf("tree holds %d keys after vacuum; want 11", len(all))
+	}
+}
+
+// TestCheck builds a tree deep enough to have internal pages, confirms Check
+// finds nothing wrong, then breaks it on disk in several ways.
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	bt, err := NewBTree(3, "check", dir)
+	if err != nil {
+		t.Fatalf("Failed to create tree: %v", err)
+	}
+	for i := 0; i < 60; i++ {
+		if err := bt.Insert(fmt.Sprintf("k%03d", i), i); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	}
+	for i := 0; i < 60; i += 3 {
+		if _, err := bt.Delete(fmt.Sprintf("k%03d", i)); err != nil {
+			t.Fatalf("Failed to delete: %v", err)
+		}
+	}
+	if problems, err := bt.Check(); err != nil || len(problems) != 0 {
+		t.Fatalf("Check on a healthy tree = %v, %v; want no problems", problems, err)
+	}
+
+	root, err := bt.loadNode(bt.RootID)
+	if err != nil || root.IsLeaf {
+		t.Fatalf("Failed to load an internal root: %v", err)
+	}
+	child, err := bt.loadNode(root.Children[0])
+	if err != nil {
+		t.Fatalf("Failed to load child: %v", err)
+	}
+
+	// Swap two keys out of order and add a page nothing points at.
+	child.Keys[0], child.Keys[1] = child.Keys[1], child.Keys[0]
+	if err := bt.saveNode(child); err != nil {
+		t.Fatalf("Failed to save page: %v", err)
+	}
+	if err := bt.saveNode(&Node{ID: 999, IsLeaf: true}); err != nil {
+		t.Fatalf("Failed to save page: %v", err)
+	}
+
+	problems, err := bt.Check()
+	if err != nil {
+		t.Fatalf("Failed to check: %v", err)
+	}
+	var order, orphan, nextID bool
+	for _, p := range problems {
+		switch {
+		case p.Page == child.ID && strings.Contains(p.Message, "is not after"):
+			order = true
+		case p.Page == 999 && strings.Contains(p.Message, "orphaned"):
+			orphan = true
+		}
+		if strings.Contains(p.Message, "next_id") {
+			nextID = true
+		}
+	}
+	if !order || !orphan || nextID {
+		t.Errorf("Check = %v; want the misordered keys and the orphan, nothing about next_id", problems)
+	}
+
+	// A child that vanished from disk is reported against its own page ID.
+	missing := root.Children[len(root.Children)-1]
+	if err := bt.deleteNode(missing); err != nil {
+		t.Fatalf("Failed to delete page: %v", err)
+	}
+	problems, _ = bt.Check()
+	found := false
+	for _, p := range problems {
+		if p.Page == missing && strings.Contains(p.Message, "failed to read") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Check = %v; want page %d reported missing", problems, missing)
+	}
+}
+
+// TestScanDoesNotBlockWriters blocks a scan inside its callback and checks
+// that inserts, updates and deletes still finish, and that the scan then
+// carries on in order across batches.
+func TestScanDoesNotBlockWriters(t *testing.T) {
+	bt, err := NewBTree(3, "scan", t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create tree: %v", err)
+	}
+	const n = 3 * scanBatchSize
+	for i := 0; i < n; i++ {
+		if err := bt.Insert(fmt.Sprintf("k%04d", i), "v"); err != nil {
+			t.Fatalf("Insert: %v", err)
+		}
+	}
+
+	for _, name := range []string{"Scan", "snapshot Scan"} {
+		blocked, unblock := make(chan struct{}), make(chan struct{})
+		var keys []string
+		scanned := make(chan error)
+		go func() {
+			fn := func(kv KeyValue) bool {
+				if len(keys) == 10 {
+					close(blocked)
+					<-unblock
+				}
+				keys = append(keys, kv.Key)
+				return true
+			}
+			if name == "Scan" {
+				scanned <- bt.Scan(fn)
+				return
+			}
+			snap := bt.Snapshot()
+			defer snap.Release()
+			scanned <- snap.Scan(fn)
+		}()
+		<-blocked
+
+		wrote := make(chan error)
+		go func() {
+			err := bt.Insert("k9999-"+name, "new")
+			if err == nil {
+				_, err = bt.Update("k0005", "changed")
+			}
+			if err == nil {
+				_, err = bt.Delete("k0200")
+			}
+			wrote <- err
+		}()
+		select {
+		case err := <-wrote:
+			if err != nil {
+				t.Fatalf("%s: write during scan: %v", name, err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: writes waited for a scan blocked in its callback", name)
+		}
+		close(unblock)
+		if err := <-scanned; err != nil {
+			t.Fatalf("%s = %v", name, err)
+		}
+
+		for i := 1; i < len(keys); i++ {
+			if keys[i] <= keys[i-1] {
+				t.Fatalf("%s: %s after %s", name, keys[i], keys[i-1])
+			}
+		}
+		// Both writes land ahead of where the scan stopped, so a plain scan
+		// sees them and a snapshot scan sees neither.
+		seen := map[string]bool{}
+		for _, k := range keys {
+			seen[k] = true
+		}
+		live := name == "Scan"
+		if len(keys) != n || seen["k9999-"+name] != live || seen["k0200"] == live {
+			t.Errorf("%s read %d keys (new key %v, deleted key %v); want %d, %v, %v",
+				name, len(keys), seen["k9999-"+name], seen["k0200"], n, live, !live)
+		}
+		// Put the tree back the way the next scan expects it.
+		if _, err := bt.Delete("k9999-" + name); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if err := bt.Insert("k0200", "v"); err != nil {
+			t.Fatalf("Insert: %v", err)
+		}
+	}
+}
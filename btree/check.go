@@ -0,0 +1,136 @@
+package btree
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Problem is one broken invariant found by Check.
+type Problem struct {
+	Page    int    `json:"page"`
+	Message string `json:"message"`
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("page %d: %s", p.Page, p.Message)
+}
+
+// treeCheck carries the state of one Check walk.
+type treeCheck struct {
+	bt        *BTree
+	nextID    int
+	seen      map[int]bool
+	leafDepth int
+	problems  []Problem
+}
+
+func (c *treeCheck) report(page int, format string, args ...interface{}) {
+	c.problems = append(c.problems, Problem{Page: page, Message: fmt.Sprintf(format, args...)})
+}
+
+// Check walks every page reachable from the root and reports broken
+// invariants: missing or unreadable pages, pages reached twice, page IDs not
+// below NextID, keys out of order or outside the range set by the parent's
+// separators, nodes holding more than 2*Order-1 keys, internal nodes whose
+// child count is not one more than their key count, and leaves at different
+// depths. Page files the walk never reaches are reported as orphans. Check
+// only reads; the error is for failing to list the page directory.
+func (bt *BTree) Check() ([]Problem, error) {
+	bt.treeLock.Lock()
+	defer bt.treeLock.Unlock()
+
+	c := &treeCheck{bt: bt, nextID: bt.NextID, seen: make(map[int]bool), leafDepth: -1}
+	c.walk(bt.RootID, 0, nil, nil)
+
+	entries, err := os.ReadDir(bt.PageDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pages: %v", err)
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, "page_") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "page_"), ".json"))
+		if err != nil || !c.seen[id] {
+			c.report(id, "orphaned page file %s is not reachable from the root", name)
+		}
+	}
+
+	sort.SliceStable(c.problems, func(i, j int) bool { return c.problems[i].Page < c.problems[j].Page })
+	return c.problems, nil
+}
+
+// walk checks page id, whose keys must all lie strictly between lo and hi
+// when those are set.
+func (c *treeCheck) walk(id, depth int, lo, hi *string) {
+	if c.seen[id] {
+		c.report(id, "reached more than once")
+		return
+	}
+	c.seen[id] = true
+	if id >= c.nextID {
+		c.report(id, "page ID is not below next_id %d", c.nextID)
+	}
+
+	// Read the file directly rather than through loadNode so checking never
+	// fills the node cache.
+	data, err := os.ReadFile(filepath.Join(c.bt.PageDir, fmt.Sprintf("page_%d.json", id)))
+	if err != nil {
+		c.report(id, "failed to read node file: %v", err)
+		return
+	}
+	node := &Node{}
+	if err := json.Unmarshal(data, node); err != nil {
+		c.report(id, "failed to parse node: %v", err)
+		return
+	}
+	if node.ID != id {
+		c.report(id, "file holds node %d", node.ID)
+	}
+
+	if max := 2*c.bt.Order - 1; len(node.Keys) > max {
+		c.report(id, "holds %d keys, more than %d", len(node.Keys), max)
+	}
+	for i, kv := range node.Keys {
+		if i > 0 && node.Keys[i-1].Key >= kv.Key {
+			c.report(id, "key %q is not after %q", kv.Key, node.Keys[i-1].Key)
+		}
+		if lo != nil && kv.Key <= *lo {
+			c.report(id, "key %q is not after the parent's separator %q", kv.Key, *lo)
+		}
+		if hi != nil && kv.Key >= *hi {
+			c.report(id, "key %q is not before the parent's separator %q", kv.Key, *hi)
+		}
+	}
+
+	if node.IsLeaf {
+		if len(node.Children) > 0 {
+			c.report(id, "leaf has %d children", len(node.Children))
+		}
+		if c.leafDepth == -1 {
+			c.leafDepth = depth
+		} else if depth != c.leafDepth {
+			c.report(id, "leaf at depth %d, other leaves are at depth %d", depth, c.leafDepth)
+		}
+		return
+	}
+	if len(node.Children) != len(node.Keys)+1 {
+		c.report(id, "has %d keys but %d children", len(node.Keys), len(node.Children))
+	}
+	for i, child := range node.Children {
+		childLo, childHi := lo, hi
+		if i > 0 && i-1 < len(node.Keys) {
+			childLo = &node.Keys[i-1].Key
+		}
+		if i < len(node.Keys) {
+			childHi = &node.Keys[i].Key
+		}
+		c.walk(child, depth+1, childLo, childHi)
+	}
+}
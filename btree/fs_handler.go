@@ -9,7 +9,7 @@ import (
 
 func (bt *BTree) saveNode(node *Node) error {
 
-	bt.nodeCache[node.ID] = node
+	bt.cacheNode(node)
 
 	nodePath := filepath.Join(bt.PageDir, fmt.Sprintf("page_%d.json", node.ID))
 	data, err := json.MarshalIndent(node, "", "  ")
@@ -17,7 +17,7 @@ func (bt *BTree) saveNode(node *Node) error {
 		return fmt.Errorf("failed to marshal node: %v", err)
 	}
 
-	err = os.WriteFile(nodePath, data, 0644)
+	err = writeFileAtomic(nodePath, data)
 	if err != nil {
 		return fmt.Errorf("failed to write node file: %v", err)
 	}
@@ -43,14 +43,22 @@ func (bt *BTree) loadNode(id int) (*Node, error) {
 		return nil, fmt.Errorf("failed to parse node: %v", err)
 	}
 
-	bt.nodeCache[id] = node
+	bt.cacheNode(node)
 
 	return node, nil
 }
 
 func (bt *BTree) deleteNode(id int) error {
 
+	bt.cacheMu.Lock()
 	delete(bt.nodeCache, id)
+	bt.cacheMu.Unlock()
+
+	// Pages are only deleted under the exclusive tree lock, so nobody can be
+	// holding or waiting on this latch.
+	bt.latchMu.Lock()
+	delete(bt.latches, id)
+	bt.latchMu.Unlock()
 
 	nodePath := filepath.Join(bt.PageDir, fmt.Sprintf("page_%d.json", id))
 	err := os.Remove(nodePath)
@@ -60,3 +68,33 @@ func (bt *BTree) deleteNode(id int) error {
 
 	return nil
 }
+
+func (bt *BTree) cacheNode(node *Node) {
+	bt.cacheMu.Lock()
+	defer bt.cacheMu.Unlock()
+	bt.nodeCache[node.ID] = node
+}
+
+// writeFileAtomic replaces path by renaming a fully written temporary file
+// over it, so readers outside the tree's latches (such as a commit walking
+// the pages) never see a half-written page.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -3,10 +3,45 @@ package btree
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 )
 
+// Delete removes key. Rebalancing can touch siblings and the root, so it
+// runs with the tree lock held exclusively. While a Snapshot is open the key
+// must stay readable at older timestamps, so only a tombstone is written and
+// Vacuum removes it later.
 func (bt *BTree) Delete(key string) (bool, error) {
+	if bt.hasSnapshots() {
+		bt.treeLock.RLock()
+		defer bt.treeLock.RUnlock()
+		return bt.tombstone(key)
+	}
+
+	bt.treeLock.Lock()
+	defer bt.treeLock.Unlock()
+
+	// A snapshot may have been opened while we waited for the lock.
+	if bt.hasSnapshots() {
+		return bt.tombstone(key)
+	}
+	bt.notePruned(bt.tick())
+	return bt.deletePhysical(key)
+}
 
+func (bt *BTree) tombstone(key string) (bool, error) {
+	return bt.modify(key, func(kv *KeyValue) bool {
+		if kv.Deleted {
+			return false
+		}
+		bt.writeVersion(kv, nil, true)
+		return true
+	})
+}
+
+// deletePhysical removes key's entry from the pages. It reports whether a live
+// key was removed, so dropping a tombstone reports false. The caller holds the
+// tree lock exclusively.
+func (bt *BTree) deletePhysical(key string) (bool, error) {
 	root, err := bt.loadNode(bt.RootID)
 	if err != nil {
 
@@ -16,10 +51,18 @@ func (bt *BTree) Delete(key string) (bool, error) {
 		return false, fmt.Errorf("failed to load root node: %v", err)
 	}
 
+	latch := bt.latch(root.ID)
+	latch.RLock()
+	kv, found, err := bt.findInNode(root, latch, key)
+	if err != nil || !found {
+		return false, err
+	}
+
 	deleted, err := bt.deleteFromNode(root, key)
 	if err != nil {
 		return false, err
 	}
+	deleted = deleted && !kv.Deleted
 
 	if len(root.Keys) == 0 && !root.IsLeaf && len(root.Children) > 0 {
 		bt.metadata.Lock()
@@ -46,7 +89,7 @@ func (bt *BTree) loadNodeSafe(nodeID int) (*Node, error) {
 	if err != nil {
 		if os.IsNotExist(err) {
 
-			fmt.Printf("Warning: Node %d doesn't exist, ignoring\n", nodeID)
+			fmt.Fprintf(os.Stderr, "Warning: Node %d doesn't exist, ignoring\n", nodeID)
 			return nil, nil
 		}
 		return nil, err
@@ -61,7 +104,7 @@ func (bt *BTree) nodeExists(nodeID int) bool {
 }
 
 func (bt *BTree) getNodeFilename(nodeID int) string {
-	return fmt.Sprintf("files/%s/pages/page_%d.json", bt.DBID, nodeID)
+	return filepath.Join(bt.PageDir, fmt.Sprintf("page_%d.json", nodeID))
 }
 
 func (bt *BTree) deleteFromNode(node *Node, key string) (bool, error) {
@@ -92,59 +135,60 @@ func (bt *BTree) deleteFromNode(node *Node, key string) (bool, error) {
 			return true, bt.saveNode(node)
 		}
 
-		pred, err := bt.getPredecessor(node, i)
-		if err != nil {
-
-			node.Keys = append(node.Keys[:i], node.Keys[i+1:]...)
-			if i < len(node.Children) {
-				node.Children = append(node.Children[:i], node.Children[i+1:]...)
-			}
-			return true, bt.saveNode(node)
-		}
-
-		node.Keys[i] = pred
-
-		childNode, err := bt.loadNodeSafe(node.Children[i])
+		left, err := bt.loadNodeSafe(node.Children[i])
 		if err != nil {
 			return false, fmt.Errorf("failed to load child node: %v", err)
 		}
 
-		if childNode == nil {
-
-			node.Keys = append(node.Keys[:i], node.Keys[i+1:]...)
-			node.Children = append(node.Children[:i], node.Children[i+1:]...)
-			return true, bt.saveNode(node)
-		}
-
-		if len(childNode.Keys) < bt.Order {
-			err = bt.ensureMinKeys(node, i)
+		if left != nil && len(left.Keys) >= bt.Order {
+			pred, err := bt.getPredecessor(node, i)
 			if err != nil {
-
-				fmt.Printf("Warning: Failed to ensure minimum keys: %v\n", err)
+				return false, fmt.Errorf("failed to find predecessor: %v", err)
+			}
+			node.Keys[i] = pred
+			if err := bt.saveNode(node); err != nil {
+				return false, fmt.Errorf("failed to save parent node: %v", err)
 			}
+			if _, err := bt.deleteFromNode(left, pred.Key); err != nil {
+				return false, err
+			}
+			return true, nil
+		}
 
-			childNode, err = bt.loadNodeSafe(node.Children[i])
+		if i+1 < len(node.Children) && bt.nodeExists(node.Children[i+1]) {
+			right, err := bt.loadNode(node.Children[i+1])
 			if err != nil {
-				return false, fmt.Errorf("failed to reload child node: %v", err)
+				return false, fmt.Errorf("failed to load child node: %v", err)
 			}
 
-			if childNode == nil {
-
-				return true, bt.saveNode(node)
+			if len(right.Keys) >= bt.Order {
+				succ, err := bt.getSuccessor(node, i)
+				if err != nil {
+					return false, fmt.Errorf("failed to find successor: %v", err)
+				}
+				node.Keys[i] = succ
+				if err := bt.saveNode(node); err != nil {
+					return false, fmt.Errorf("failed to save parent node: %v", err)
+				}
+				if _, err := bt.deleteFromNode(right, succ.Key); err != nil {
+					return false, err
+				}
+				return true, nil
 			}
-		}
 
-		deleted, err := bt.deleteFromNode(childNode, pred.Key)
-		if err != nil {
-			return false, err
-		}
-
-		err = bt.saveNode(node)
-		if err != nil {
-			return deleted, fmt.Errorf("failed to save parent node: %v", err)
+			if left != nil {
+				// Both neighbours are minimal: pull the key down into a merged
+				// child and delete it from there.
+				if err := bt.mergeNodes(node, i, left, right); err != nil {
+					return false, fmt.Errorf("failed to merge children: %v", err)
+				}
+				return bt.deleteFromNode(left, key)
+			}
 		}
 
-		return deleted, nil
+		node.Keys = append(node.Keys[:i], node.Keys[i+1:]...)
+		node.Children = append(node.Children[:i], node.Children[i+1:]...)
+		return true, bt.saveNode(node)
 	}
 
 	if node.IsLeaf {
@@ -182,10 +226,16 @@ func (bt *BTree) deleteFromNode(node *Node, key string) (bool, error) {
 	}
 
 	if len(childNode.Keys) < bt.Order {
+		childCount := len(node.Children)
 		err = bt.ensureMinKeys(node, i)
 		if err != nil {
 
-			fmt.Printf("Warning: Failed to ensure minimum keys: %v\n", err)
+			fmt.Fprintf(os.Stderr, "Warning: Failed to ensure minimum keys: %v\n", err)
+		}
+
+		// A merge with the left sibling leaves the merged child one slot earlier.
+		if len(node.Children) < childCount && i > 0 {
+			i--
 		}
 
 		if i < len(node.Children) {
@@ -241,7 +291,7 @@ func (bt *BTree) getPredecessor(node *Node, index int) (KeyValue, error) {
 			child.IsLeaf = true
 			err = bt.saveNode(child)
 			if err != nil {
-				fmt.Printf("Warning: Failed to save fixed node: %v\n", err)
+				fmt.Fprintf(os.Stderr, "Warning: Failed to save fixed node: %v\n", err)
 			}
 			break
 		}
@@ -274,6 +324,31 @@ func (bt *BTree) getPredecessor(node *Node, index int) (KeyValue, error) {
 	return child.Keys[len(child.Keys)-1], nil
 }
 
+func (bt *BTree) getSuccessor(node *Node, index int) (KeyValue, error) {
+
+	if index+1 >= len(node.Children) {
+		return KeyValue{}, fmt.Errorf("invalid index for getSuccessor")
+	}
+
+	child, err := bt.loadNode(node.Children[index+1])
+	if err != nil {
+		return KeyValue{}, fmt.Errorf("failed to load child node: %v", err)
+	}
+
+	for !child.IsLeaf && len(child.Children) > 0 {
+		child, err = bt.loadNode(child.Children[0])
+		if err != nil {
+			return KeyValue{}, fmt.Errorf("failed to load child node: %v", err)
+		}
+	}
+
+	if len(child.Keys) == 0 {
+		return KeyValue{}, fmt.Errorf("leaf node has no keys")
+	}
+
+	return child.Keys[0], nil
+}
+
 func (bt *BTree) ensureMinKeys(node *Node, index int) error {
 
 	if index < 0 || index >= len(node.Children) {
@@ -482,6 +557,8 @@ func (bt *BTree) mergeNodes(parent *Node, index int, left *Node, right *Node) er
 }
 
 func (bt *BTree) RepairTree() error {
+	bt.treeLock.Lock()
+	defer bt.treeLock.Unlock()
 
 	root, err := bt.loadNode(bt.RootID)
 	if err != nil {
@@ -525,7 +602,7 @@ func (bt *BTree) repairNode(node *Node) error {
 				if err == nil {
 					err = bt.repairNode(child)
 					if err != nil {
-						fmt.Printf("Warning: Failed to repair child %d: %v\n", childID, err)
+						fmt.Fprintf(os.Stderr, "Warning: Failed to repair child %d: %v\n", childID, err)
 					}
 				}
 			}
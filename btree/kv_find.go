@@ -1,40 +1,194 @@
 package btree
 
-import "fmt"
+import (
+	"sort"
+	"sync"
+)
 
 func (bt *BTree) Find(key string) (interface{}, bool, error) {
+	bt.treeLock.RLock()
+	defer bt.treeLock.RUnlock()
 
-	root, err := bt.loadNode(bt.RootID)
+	return bt.findAt(key, -1)
+}
+
+// FindAt looks key up as it was at read timestamp ts. Only timestamps pinned
+// by an open Snapshot are guaranteed to stay readable; older ones fail with
+// ErrSnapshotTooOld once their versions may have been pruned.
+func (bt *BTree) FindAt(key string, ts int64) (interface{}, bool, error) {
+	if err := bt.checkReadTS(ts); err != nil {
+		return nil, false, err
+	}
+
+	bt.treeLock.RLock()
+	defer bt.treeLock.RUnlock()
+
+	return bt.findAt(key, ts)
+}
+
+func (bt *BTree) findAt(key string, ts int64) (interface{}, bool, error) {
+	root, latch, err := bt.readRoot()
 	if err != nil {
-		return nil, false, fmt.Errorf("failed to load root node: %v", err)
+		return nil, false, err
 	}
 
-	return bt.findInNode(root, key)
+	kv, found, err := bt.findInNode(root, latch, key)
+	if err != nil || !found {
+		return nil, false, err
+	}
+	visible, ok := kv.at(ts)
+	if !ok {
+		return nil, false, nil
+	}
+	return visible.Value, true, nil
 }
 
+// FindAll returns the newest version of every live key.
 func (bt *BTree) FindAll() []KeyValue {
-	root, _ := bt.loadNode((bt.RootID))
+	bt.treeLock.RLock()
+	defer bt.treeLock.RUnlock()
+
 	result := []KeyValue{}
-	if root != nil {
-		bt.findAllNodes(root, &result)
+	root, latch, err := bt.readRoot()
+	if err != nil {
+		return result
 	}
+	defer latch.RUnlock()
+	bt.findAllNodes(root, &result)
 	return result
 }
 
+// findAllNodes holds node's latch (taken by the caller) while visiting its
+// subtree.
 func (bt *BTree) findAllNodes(node *Node, result *([]KeyValue)) {
 	for i := range len(node.Keys) {
-		*result = append(*result, node.Keys[i])
+		if kv, ok := node.Keys[i].at(-1); ok {
+			*result = append(*result, kv)
+		}
 	}
 	if node.IsLeaf {
 		return
 	}
 	for i := range len(node.Children) {
-		child, _ := bt.loadNode(node.Children[i])
+		child, latch, err := bt.readChild(node, i)
+		if err != nil {
+			continue
+		}
 		bt.findAllNodes(child, result)
+		latch.RUnlock()
+	}
+}
+
+// scanBatchSize is how many keys a scan copies out per descent from the
+// root. Latches and treeLock are held only while a batch is copied, never
+// while the scan's callback runs.
+const scanBatchSize = 128
+
+// Scan walks the tree in key order and calls fn for every pair until fn
+// returns false. It reads the tree in batches, so writers never wait for fn,
+// however slow it is; in return a write made during the scan is seen if it
+// lands ahead of the scan and missed if it lands behind. Use a Snapshot for a
+// consistent view.
+func (bt *BTree) Scan(fn func(kv KeyValue) bool) error {
+	return bt.scanAt(-1, fn)
+}
+
+// ScanAt is Scan as of read timestamp ts; see FindAt for which timestamps
+// stay readable. Every batch reads the versions visible at ts, so the scan is
+// consistent as long as a Snapshot pins ts.
+func (bt *BTree) ScanAt(ts int64, fn func(kv KeyValue) bool) error {
+	return bt.scanAt(ts, fn)
+}
+
+// scanBatch is the part of a scan read in one descent.
+type scanBatch struct {
+	kvs  []KeyValue // the visible versions, in key order
+	last string     // the last key read, visible or not
+	seen int        // keys read, visible or not
+}
+
+func (bt *BTree) scanAt(ts int64, fn func(kv KeyValue) bool) error {
+	after, started := "", false
+	for {
+		if ts >= 0 {
+			if err := bt.checkReadTS(ts); err != nil {
+				return err
+			}
+		}
+		b, done, err := bt.readBatch(ts, after, started)
+		if err != nil {
+			return err
+		}
+		for _, kv := range b.kvs {
+			if !fn(kv) {
+				return nil
+			}
+		}
+		if done {
+			return nil
+		}
+		after, started = b.last, true
 	}
 }
 
-func (bt *BTree) findInNode(node *Node, key string) (interface{}, bool, error) {
+// readBatch copies out the next scanBatchSize keys after after (from the
+// first key unless started), crabbing down from the root. done reports that
+// the batch reached the end of the tree.
+func (bt *BTree) readBatch(ts int64, after string, started bool) (*scanBatch, bool, error) {
+	bt.treeLock.RLock()
+	defer bt.treeLock.RUnlock()
+
+	root, latch, err := bt.readRoot()
+	if err != nil {
+		return nil, false, err
+	}
+	defer latch.RUnlock()
+
+	b := &scanBatch{}
+	done, err := bt.batchNode(root, ts, after, started, b)
+	return b, done, err
+}
+
+// batchNode adds the keys of node's subtree after after to b, in order, with
+// node's latch held by the caller. It reports false once b is full.
+func (bt *BTree) batchNode(node *Node, ts int64, after string, started bool, b *scanBatch) (bool, error) {
+	i := 0
+	if started {
+		// Subtrees left of the first key past after hold only older keys.
+		i = sort.Search(len(node.Keys), func(j int) bool { return node.Keys[j].Key > after })
+	}
+	for ; i <= len(node.Keys); i++ {
+		if !node.IsLeaf && i < len(node.Children) {
+			child, latch, err := bt.readChild(node, i)
+			if err != nil {
+				return false, err
+			}
+			more, err := bt.batchNode(child, ts, after, started, b)
+			latch.RUnlock()
+			if !more || err != nil {
+				return false, err
+			}
+		}
+		if i == len(node.Keys) {
+			break
+		}
+		kv := node.Keys[i]
+		b.last = kv.Key
+		b.seen++
+		if v, ok := kv.at(ts); ok {
+			b.kvs = append(b.kvs, v)
+		}
+		if b.seen >= scanBatchSize {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// findInNode releases latch, node's shared latch, before returning. The
+// child's latch is taken before the parent's is released. The entry is
+// returned with its full version history.
+func (bt *BTree) findInNode(node *Node, latch *sync.RWMutex, key string) (KeyValue, bool, error) {
 
 	i := 0
 	for i < len(node.Keys) && key > node.Keys[i].Key {
@@ -42,17 +196,20 @@ func (bt *BTree) findInNode(node *Node, key string) (interface{}, bool, error) {
 	}
 
 	if i < len(node.Keys) && key == node.Keys[i].Key {
-		return node.Keys[i].Value, true, nil
+		latch.RUnlock()
+		return node.Keys[i], true, nil
 	}
 
 	if node.IsLeaf {
-		return nil, false, nil
+		latch.RUnlock()
+		return KeyValue{}, false, nil
 	}
 
-	child, err := bt.loadNode(node.Children[i])
+	child, childLatch, err := bt.readChild(node, i)
+	latch.RUnlock()
 	if err != nil {
-		return nil, false, fmt.Errorf("failed to load child node: %v", err)
+		return KeyValue{}, false, err
 	}
 
-	return bt.findInNode(child, key)
+	return bt.findInNode(child, childLatch, key)
 }
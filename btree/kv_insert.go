@@ -1,11 +1,23 @@
 package btree
 
-import "fmt"
+import (
+	"fmt"
+	"sync"
+)
 
 func (bt *BTree) Insert(key string, value interface{}) error {
+	bt.treeLock.RLock()
+	defer bt.treeLock.RUnlock()
 
+	// Hold metadata exclusively while the root is latched and, if full, split
+	// so that readers never follow a stale RootID.
+	bt.metadata.Lock()
+	latch := bt.latch(bt.RootID)
+	latch.Lock()
 	root, err := bt.loadNode(bt.RootID)
 	if err != nil {
+		latch.Unlock()
+		bt.metadata.Unlock()
 		return fmt.Errorf("failed to load root node: %v", err)
 	}
 
@@ -17,26 +29,26 @@ func (bt *BTree) Insert(key string, value interface{}) error {
 			Keys:     []KeyValue{},
 			Children: []int{root.ID},
 		}
-
-		bt.splitChild(newRoot, 0, root)
-
-		bt.metadata.Lock()
-		bt.RootID = newRoot.ID
-		bt.metadata.Unlock()
-
-		err = bt.saveNode(newRoot)
-		if err != nil {
-			return fmt.Errorf("failed to save new root node: %v", err)
+		newLatch := bt.latch(newRoot.ID)
+		newLatch.Lock()
+
+		err = bt.splitChild(newRoot, 0, root)
+		latch.Unlock()
+		if err == nil {
+			bt.RootID = newRoot.ID
+			err = bt.saveMetadata()
 		}
-		err = bt.saveMetadata()
+		bt.metadata.Unlock()
 		if err != nil {
-			return fmt.Errorf("failed to save metadata: %v", err)
+			newLatch.Unlock()
+			return fmt.Errorf("failed to split root node: %v", err)
 		}
 
-		return bt.insertNonFull(newRoot, key, value)
+		return bt.insertNonFull(newRoot, newLatch, key, value)
 	}
 
-	return bt.insertNonFull(root, key, value)
+	bt.metadata.Unlock()
+	return bt.insertNonFull(root, latch, key, value)
 }
 
 func (bt *BTree) splitChild(parent *Node, index int, child *Node) error {
@@ -84,7 +96,10 @@ func (bt *BTree) splitChild(parent *Node, index int, child *Node) error {
 	return nil
 }
 
-func (bt *BTree) insertNonFull(node *Node, key string, value interface{}) error {
+// insertNonFull releases latch, node's exclusive latch, before returning.
+// Full children are split on the way down, so only node and one child are
+// ever latched at a time.
+func (bt *BTree) insertNonFull(node *Node, latch *sync.RWMutex, key string, value interface{}) error {
 
 	i := len(node.Keys) - 1
 	for i >= 0 && key < node.Keys[i].Key {
@@ -93,7 +108,8 @@ func (bt *BTree) insertNonFull(node *Node, key string, value interface{}) error
 	i++
 
 	if i > 0 && i <= len(node.Keys) && node.Keys[i-1].Key == key {
-		node.Keys[i-1].Value = value
+		bt.writeVersion(&node.Keys[i-1], value, false)
+		defer latch.Unlock()
 		return bt.saveNode(node)
 	}
 
@@ -101,46 +117,49 @@ func (bt *BTree) insertNonFull(node *Node, key string, value interface{}) error
 
 		node.Keys = append(node.Keys, KeyValue{})
 		copy(node.Keys[i+1:], node.Keys[i:])
-		node.Keys[i] = KeyValue{Key: key, Value: value}
+		node.Keys[i] = KeyValue{Key: key, Value: value, Version: bt.tick()}
 
+		defer latch.Unlock()
 		return bt.saveNode(node)
 	}
 
-	child, err := bt.loadNode(node.Children[i])
+	child, childLatch, err := bt.writeChild(node, i)
 	if err != nil {
-		return fmt.Errorf("failed to load child node: %v", err)
+		latch.Unlock()
+		return err
 	}
 
 	if len(child.Keys) == 2*bt.Order-1 {
 		err = bt.splitChild(node, i, child)
 		if err != nil {
+			childLatch.Unlock()
+			latch.Unlock()
 			return fmt.Errorf("failed to split child: %v", err)
 		}
 
 		if key > node.Keys[i].Key {
-			child, err = bt.loadNode(node.Children[i+1])
+			childLatch.Unlock()
+			child, childLatch, err = bt.writeChild(node, i+1)
 			if err != nil {
-				return fmt.Errorf("failed to load child node: %v", err)
+				latch.Unlock()
+				return err
 			}
 		} else if key == node.Keys[i].Key {
 
-			node.Keys[i].Value = value
+			childLatch.Unlock()
+			bt.writeVersion(&node.Keys[i], value, false)
+			defer latch.Unlock()
 			return bt.saveNode(node)
-		} else {
-
-			child, err = bt.loadNode(node.Children[i])
-			if err != nil {
-				return fmt.Errorf("failed to load child node: %v", err)
-			}
 		}
 	}
 
-	return bt.insertNonFull(child, key, value)
+	latch.Unlock()
+	return bt.insertNonFull(child, childLatch, key, value)
 }
 
 func (bt *BTree) allocateNodeID() int {
-	bt.metadata.Lock()
-	defer bt.metadata.Unlock()
+	bt.idMu.Lock()
+	defer bt.idMu.Unlock()
 
 	id := bt.NextID
 	bt.NextID++
@@ -1,18 +1,45 @@
 package btree
 
-import "fmt"
+import (
+	"fmt"
+	"sync"
+)
 
+// Update replaces the value of an existing key. Deleted keys are not
+// resurrected; it reports false for them as for missing keys.
 func (bt *BTree) Update(key string, value interface{}) (bool, error) {
+	bt.treeLock.RLock()
+	defer bt.treeLock.RUnlock()
 
+	return bt.modify(key, func(kv *KeyValue) bool {
+		if kv.Deleted {
+			return false
+		}
+		bt.writeVersion(kv, value, false)
+		return true
+	})
+}
+
+// modify applies fn to key's entry under its page's exclusive latch and saves
+// the page if fn reports a change. The caller holds treeLock.
+func (bt *BTree) modify(key string, fn func(kv *KeyValue) bool) (bool, error) {
+	// Updates never change the shape of the tree, so RootID only has to stay
+	// put until the root is latched.
+	bt.metadata.RLock()
+	latch := bt.latch(bt.RootID)
+	latch.Lock()
 	root, err := bt.loadNode(bt.RootID)
+	bt.metadata.RUnlock()
 	if err != nil {
+		latch.Unlock()
 		return false, fmt.Errorf("failed to load root node: %v", err)
 	}
 
-	return bt.updateInNode(root, key, value)
+	return bt.updateInNode(root, latch, key, fn)
 }
 
-func (bt *BTree) updateInNode(node *Node, key string, value interface{}) (bool, error) {
+// updateInNode releases latch, node's exclusive latch, before returning.
+func (bt *BTree) updateInNode(node *Node, latch *sync.RWMutex, key string, fn func(kv *KeyValue) bool) (bool, error) {
 
 	i := 0
 	for i < len(node.Keys) && key > node.Keys[i].Key {
@@ -21,18 +48,25 @@ func (bt *BTree) updateInNode(node *Node, key string, value interface{}) (bool,
 
 	if i < len(node.Keys) && key == node.Keys[i].Key {
 
-		node.Keys[i].Value = value
-		return true, bt.saveNode(node)
+		if !fn(&node.Keys[i]) {
+			latch.Unlock()
+			return false, nil
+		}
+		err := bt.saveNode(node)
+		latch.Unlock()
+		return true, err
 	}
 
 	if node.IsLeaf {
+		latch.Unlock()
 		return false, nil
 	}
 
-	child, err := bt.loadNode(node.Children[i])
+	child, childLatch, err := bt.writeChild(node, i)
+	latch.Unlock()
 	if err != nil {
-		return false, fmt.Errorf("failed to load child node: %v", err)
+		return false, err
 	}
 
-	return bt.updateInNode(child, key, value)
+	return bt.updateInNode(child, childLatch, key, fn)
 }
@@ -0,0 +1,62 @@
+package btree
+
+import (
+	"fmt"
+	"sync"
+)
+
+// latch returns the read/write latch of page id.
+func (bt *BTree) latch(id int) *sync.RWMutex {
+	bt.latchMu.Lock()
+	defer bt.latchMu.Unlock()
+
+	if bt.latches == nil {
+		bt.latches = make(map[int]*sync.RWMutex)
+	}
+	l, ok := bt.latches[id]
+	if !ok {
+		l = &sync.RWMutex{}
+		bt.latches[id] = l
+	}
+	return l
+}
+
+// readRoot loads the root with its latch held shared. Holding metadata until
+// the latch is taken keeps a concurrent root split from slipping in between.
+func (bt *BTree) readRoot() (*Node, *sync.RWMutex, error) {
+	bt.metadata.RLock()
+	defer bt.metadata.RUnlock()
+
+	l := bt.latch(bt.RootID)
+	l.RLock()
+	root, err := bt.loadNode(bt.RootID)
+	if err != nil {
+		l.RUnlock()
+		return nil, nil, fmt.Errorf("failed to load root node: %v", err)
+	}
+	return root, l, nil
+}
+
+// readChild loads child i of node with its latch held shared.
+func (bt *BTree) readChild(node *Node, i int) (*Node, *sync.RWMutex, error) {
+	l := bt.latch(node.Children[i])
+	l.RLock()
+	child, err := bt.loadNode(node.Children[i])
+	if err != nil {
+		l.RUnlock()
+		return nil, nil, fmt.Errorf("failed to load child node: %v", err)
+	}
+	return child, l, nil
+}
+
+// writeChild loads child i of node with its latch held exclusively.
+func (bt *BTree) writeChild(node *Node, i int) (*Node, *sync.RWMutex, error) {
+	l := bt.latch(node.Children[i])
+	l.Lock()
+	child, err := bt.loadNode(node.Children[i])
+	if err != nil {
+		l.Unlock()
+		return nil, nil, fmt.Errorf("failed to load child node: %v", err)
+	}
+	return child, l, nil
+}
@@ -0,0 +1,229 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrSnapshotTooOld is returned by FindAt and ScanAt for read timestamps whose
+// versions may already have been garbage-collected.
+var ErrSnapshotTooOld = errors.New("read timestamp is older than the garbage-collection horizon")
+
+// Version is an older value of a key, kept while a snapshot may still read it.
+type Version struct {
+	Value   interface{} `json:"value"`
+	Version int64       `json:"version"`
+	Deleted bool        `json:"deleted,omitempty"`
+}
+
+// at returns the version of kv visible at ts, or the newest one when ts < 0.
+// Entries written before versioning have Version 0 and are visible at every
+// timestamp.
+func (kv KeyValue) at(ts int64) (KeyValue, bool) {
+	if ts < 0 || kv.Version <= ts {
+		return KeyValue{Key: kv.Key, Value: kv.Value, Version: kv.Version}, !kv.Deleted
+	}
+	for _, v := range kv.History {
+		if v.Version <= ts {
+			return KeyValue{Key: kv.Key, Value: v.Value, Version: v.Version}, !v.Deleted
+		}
+	}
+	return KeyValue{}, false
+}
+
+// tick allocates a write timestamp. Timestamps are Unix nanoseconds, forced to
+// be strictly increasing so versions of a key are totally ordered even if the
+// wall clock stalls or a restart reloads an older Clock.
+func (bt *BTree) tick() int64 {
+	bt.idMu.Lock()
+	defer bt.idMu.Unlock()
+
+	now := time.Now().UnixNano()
+	if now <= bt.Clock {
+		now = bt.Clock + 1
+	}
+	bt.Clock = now
+	return now
+}
+
+// horizon is the oldest timestamp any reader may still ask for: the oldest
+// active snapshot, or the current clock when there is none.
+func (bt *BTree) horizon() int64 {
+	bt.snapMu.Lock()
+	defer bt.snapMu.Unlock()
+
+	oldest := int64(-1)
+	for ts := range bt.snapshots {
+		if oldest < 0 || ts < oldest {
+			oldest = ts
+		}
+	}
+	if oldest >= 0 {
+		return oldest
+	}
+
+	bt.idMu.Lock()
+	defer bt.idMu.Unlock()
+	return bt.Clock
+}
+
+func (bt *BTree) hasSnapshots() bool {
+	bt.snapMu.Lock()
+	defer bt.snapMu.Unlock()
+	return len(bt.snapshots) > 0
+}
+
+// notePruned records that versions older than horizon may be gone.
+func (bt *BTree) notePruned(horizon int64) {
+	bt.idMu.Lock()
+	defer bt.idMu.Unlock()
+	if horizon > bt.Pruned {
+		bt.Pruned = horizon
+	}
+}
+
+func (bt *BTree) checkReadTS(ts int64) error {
+	bt.idMu.Lock()
+	defer bt.idMu.Unlock()
+	if ts < bt.Pruned {
+		return ErrSnapshotTooOld
+	}
+	return nil
+}
+
+// writeVersion makes value (or a tombstone) the newest version of kv and drops
+// the history no reader can see any more.
+func (bt *BTree) writeVersion(kv *KeyValue, value interface{}, deleted bool) {
+	ts := bt.tick()
+	kv.History = append([]Version{{Value: kv.Value, Version: kv.Version, Deleted: kv.Deleted}}, kv.History...)
+	kv.Value, kv.Version, kv.Deleted = value, ts, deleted
+	bt.prune(kv, bt.horizon())
+}
+
+// prune keeps the versions newer than horizon plus the newest one at or before
+// it, which is what a read at the horizon sees. It reports whether kv changed.
+func (bt *BTree) prune(kv *KeyValue, horizon int64) bool {
+	before := len(kv.History)
+	if kv.Version <= horizon {
+		kv.History = nil
+	} else {
+		for i, v := range kv.History {
+			if v.Version <= horizon {
+				kv.History = kv.History[:i+1]
+				break
+			}
+		}
+		// A tombstone as the oldest version reads the same as no version.
+		if n := len(kv.History); n > 0 && kv.History[n-1].Deleted {
+			kv.History = kv.History[:n-1]
+		}
+		if len(kv.History) == 0 {
+			kv.History = nil
+		}
+	}
+	bt.notePruned(horizon)
+	return len(kv.History) != before
+}
+
+// Snapshot is a consistent, read-only view of the tree as of the moment it was
+// taken. Writes made afterwards are invisible to it. While any snapshot is
+// open, superseded versions and deleted keys are kept, so Release it promptly.
+type Snapshot struct {
+	bt   *BTree
+	ts   int64
+	once sync.Once
+}
+
+// Snapshot opens a snapshot at the current time.
+func (bt *BTree) Snapshot() *Snapshot {
+	// Waiting for in-flight operations guarantees that every write stamped
+	// before ts is already visible, so repeated reads agree.
+	bt.treeLock.Lock()
+	defer bt.treeLock.Unlock()
+	bt.snapMu.Lock()
+	defer bt.snapMu.Unlock()
+
+	ts := bt.tick()
+	if bt.snapshots == nil {
+		bt.snapshots = make(map[int64]int)
+	}
+	bt.snapshots[ts]++
+	return &Snapshot{bt: bt, ts: ts}
+}
+
+// Timestamp is the snapshot's read timestamp in Unix nanoseconds.
+func (s *Snapshot) Timestamp() int64 {
+	return s.ts
+}
+
+// Find looks key up as of the snapshot.
+func (s *Snapshot) Find(key string) (interface{}, bool, error) {
+	return s.bt.FindAt(key, s.ts)
+}
+
+// Scan walks the snapshot in key order until fn returns false.
+func (s *Snapshot) Scan(fn func(kv KeyValue) bool) error {
+	return s.bt.ScanAt(s.ts, fn)
+}
+
+// Release closes the snapshot so the versions it pinned can be collected.
+func (s *Snapshot) Release() {
+	s.once.Do(func() {
+		s.bt.snapMu.Lock()
+		defer s.bt.snapMu.Unlock()
+		if s.bt.snapshots[s.ts]--; s.bt.snapshots[s.ts] <= 0 {
+			delete(s.bt.snapshots, s.ts)
+		}
+	})
+}
+
+// Vacuum prunes version history older than the GC horizon and physically
+// removes tombstones no snapshot can see. It returns how many keys it removed.
+func (bt *BTree) Vacuum() (int, error) {
+	bt.treeLock.Lock()
+	defer bt.treeLock.Unlock()
+
+	horizon := bt.horizon()
+	var dead []string
+	if err := bt.vacuumNode(bt.RootID, horizon, &dead); err != nil {
+		return 0, err
+	}
+	for _, key := range dead {
+		if _, err := bt.deletePhysical(key); err != nil {
+			return 0, fmt.Errorf("failed to remove tombstone %s: %v", key, err)
+		}
+	}
+	return len(dead), nil
+}
+
+func (bt *BTree) vacuumNode(id int, horizon int64, dead *[]string) error {
+	node, err := bt.loadNode(id)
+	if err != nil {
+		return fmt.Errorf("failed to load node %d: %v", id, err)
+	}
+
+	changed := false
+	for i := range node.Keys {
+		kv := &node.Keys[i]
+		if bt.prune(kv, horizon) {
+			changed = true
+		}
+		if kv.Deleted && kv.Version <= horizon {
+			*dead = append(*dead, kv.Key)
+		}
+	}
+	if changed {
+		if err := bt.saveNode(node); err != nil {
+			return err
+		}
+	}
+
+	for _, child := range node.Children {
+		if err := bt.vacuumNode(child, horizon, dead); err != nil {
+			return err
+		}
+	}
+	return nil
+}
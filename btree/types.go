@@ -6,6 +6,14 @@ import "sync"
 type KeyValue struct {
 	Key   string      `json:"key"`
 	Value interface{} `json:"value"`
+	// Version is the write timestamp of Value in Unix nanoseconds, or 0 for
+	// entries written before versioning.
+	Version int64 `json:"version,omitempty"`
+	// Deleted marks a tombstone kept for snapshots older than the delete.
+	Deleted bool `json:"deleted,omitempty"`
+	// History holds older versions that a snapshot may still read, newest
+	// first. Read APIs never return it.
+	History []Version `json:"history,omitempty"`
 }
 
 // Node represents a node in the B-tree
@@ -17,6 +25,15 @@ type Node struct {
 }
 
 // BTree represents a B-tree
+//
+// Concurrency: Find, Scan, FindAll, Insert and Update hold treeLock shared
+// and coordinate through per-page latches, crabbing from the root down so a
+// page is only read or written while its latch is held. metadata pins RootID
+// until the root is latched. Delete, RepairTree, Vacuum and Close rebalance
+// or reset the whole tree and take treeLock exclusively; while a Snapshot is
+// open Delete only writes a tombstone and takes the shared path instead.
+// Scans take treeLock and the latches one batch at a time and release them
+// before calling back, so writers never wait on a scan's callback.
 type BTree struct {
 	RootID    int    `json:"root_id"`
 	Order     int    `json:"order"`
@@ -25,4 +42,18 @@ type BTree struct {
 	PageDir   string `json:"page_dir"`
 	metadata  *sync.RWMutex
 	nodeCache map[int]*Node
+
+	// Clock is the newest write timestamp handed out; Pruned is the GC
+	// horizon below which versions may already be gone.
+	Clock  int64 `json:"clock,omitempty"`
+	Pruned int64 `json:"pruned,omitempty"`
+
+	treeLock sync.RWMutex
+	cacheMu  sync.Mutex // guards nodeCache
+	idMu     sync.Mutex // guards NextID and writes of metadata.json
+	latchMu  sync.Mutex // guards latches
+	latches  map[int]*sync.RWMutex
+
+	snapMu    sync.Mutex    // guards snapshots
+	snapshots map[int64]int // open snapshot timestamps and their counts
 }
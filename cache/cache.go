@@ -58,8 +58,6 @@ func (cache *Cache) SaveCache(basepath string) error {
 }
 
 func CreateCache(basepath string, collections []string) (*Cache, error) {
-	fmt.Println(collections)
-
 	cache := NewCache(MAX_CACHE_SIZE)
 
 	for i := range collections {
@@ -95,6 +93,10 @@ func (cache *Cache) AddCollection(basepath, collectionName string) error {
 }
 
 func AddCollectionToMemory(basepath, collectionName string) error {
+	l := fileLock(basepath)
+	l.Lock()
+	defer l.Unlock()
+
 	cache, err := LoadCacheFromMemory(basepath)
 	if err != nil {
 		return err
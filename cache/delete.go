@@ -30,6 +30,10 @@ func (cache *Cache) DeleteFromCache(collection, key string) error {
 }
 
 func DeleteFromCacheMemory(basepath, collection, key string) error {
+	l := fileLock(basepath)
+	l.Lock()
+	defer l.Unlock()
+
 	cache, err := LoadCacheFromMemory(basepath)
 	if err != nil {
 		return err
@@ -12,6 +12,10 @@ func (cache *Cache) FindInCache(collection, key string) (string, error) {
 }
 
 func FindInCacheMemory(basepath, collection, key string) (string, error) {
+	l := fileLock(basepath)
+	l.Lock()
+	defer l.Unlock()
+
 	cache, err := LoadCacheFromMemory(basepath)
 	if err != nil {
 		return "", err
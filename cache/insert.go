@@ -5,6 +5,10 @@ func (cache *Cache) InsertInCache(collection, key, value string) error {
 }
 
 func InsertInCacheMemory(basepath, collection, key, value string) error {
+	l := fileLock(basepath)
+	l.Lock()
+	defer l.Unlock()
+
 	cache, err := LoadCacheFromMemory(basepath)
 	if err != nil {
 		return err
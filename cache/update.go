@@ -13,6 +13,10 @@ func (cache *Cache) UpdateInCache(collection, key, value string) error {
 }
 
 func UpdateCacheInMemory(basepath, collection, key, value string) error {
+	l := fileLock(basepath)
+	l.Lock()
+	defer l.Unlock()
+
 	cache, err := LoadCacheFromMemory(basepath)
 	if err != nil {
 		return err
@@ -1,6 +1,39 @@
 package cache
 
-import "container/list"
+import (
+	"container/list"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	fileLocksMu sync.Mutex
+	fileLocks   = map[string]*sync.Mutex{}
+)
+
+// fileLock returns the mutex that serializes the load-modify-save cycles on
+// the cache.json under basepath, so concurrent writers to one database do
+// not drop each other's changes.
+func fileLock(basepath string) *sync.Mutex {
+	path := filepath.Clean(basepath)
+
+	fileLocksMu.Lock()
+	defer fileLocksMu.Unlock()
+	l, ok := fileLocks[path]
+	if !ok {
+		l = &sync.Mutex{}
+		fileLocks[path] = l
+	}
+	return l
+}
+
+// Lock holds off every change to the cache.json under basepath until unlock
+// is called.
+func Lock(basepath string) (unlock func()) {
+	l := fileLock(basepath)
+	l.Lock()
+	return l.Unlock
+}
 
 func (cache *Cache) GetSize() int {
 	cache.RLock()
@@ -0,0 +1,434 @@
+// Package client is a Go SDK for the NutellaDB HTTP API served by
+// `startserver`. Every route registered by server/routes has a typed method;
+// failures come back as *Error values carrying the HTTP status and the server's
+// error message.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultBaseURL is where startserver listens unless configured otherwise.
+const DefaultBaseURL = "http://localhost:3000"
+
+// Error is returned when the server answers with a non-2xx status.
+type Error struct {
+	StatusCode int
+	Message    string
+	// Output holds the CLI output attached to version-control failures.
+	Output string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("nutella: server returned %d", e.StatusCode)
+	}
+	return fmt.Sprintf("nutella: server returned %d: %s", e.StatusCode, e.Message)
+}
+
+// IsNotFound reports whether err is a 404 from the server, such as a missing
+// database, collection or key.
+func IsNotFound(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.StatusCode == http.StatusNotFound
+}
+
+// Client talks to a single NutellaDB server. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	timeout    time.Duration
+	retries    int
+	backoff    time.Duration
+	token      string
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient replaces the underlying *http.Client. The client is used as
+// given; WithTimeout applies per request and does not modify it.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithTimeout bounds every request attempt, including reading the response.
+// Zero leaves attempts bounded only by the context and the *http.Client.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) { c.timeout = d }
+}
+
+// WithRetries retries failed attempts up to n more times, waiting backoff,
+// 2*backoff, 4*backoff, ... between them. GET, HEAD, PUT and DELETE requests,
+// and the pack exchanges, which are safe to repeat, are retried after transport
+// errors and 429, 502, 503 and 504 responses. Other requests, such as inserts
+// and commits, may already have been applied when the connection drops or a
+// gateway gives up, so they are only retried on 429 and 503, which the server
+// sends without acting.
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries = n
+		c.backoff = backoff
+	}
+}
+
+// WithToken sends token, an API key or JWT issued by the CLI, as a bearer
+// credential on every request.
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// New returns a client for the server at baseURL (for example
+// "http://localhost:3000"). By default requests time out after 30 seconds and
+// are retried twice.
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{},
+		timeout:    30 * time.Second,
+		retries:    2,
+		backoff:    100 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// ListDatabases returns the IDs of every database under the server's data root.
+func (c *Client) ListDatabases(ctx context.Context) ([]string, error) {
+	var out databasesResponse
+	err := c.do(ctx, http.MethodGet, "/databases", nil, nil, &out)
+	return out.Databases, err
+}
+
+// CreateDatabase creates a database with a generated ID and returns that ID.
+func (c *Client) CreateDatabase(ctx context.Context) (string, error) {
+	var out CreateDatabaseResponse
+	err := c.do(ctx, http.MethodGet, "/create-db", nil, nil, &out)
+	return out.DBID, err
+}
+
+// ListCollections returns the collection names of a database.
+func (c *Client) ListCollections(ctx context.Context, dbID string) ([]string, error) {
+	var out collectionsResponse
+	err := c.do(ctx, http.MethodGet, "/collections", url.Values{"dbID": {dbID}}, nil, &out)
+	return out.Collections, err
+}
+
+// CreateCollection creates a collection; the order must be at least 3.
+func (c *Client) CreateCollection(ctx context.Context, req CreateCollectionRequest) error {
+	return c.do(ctx, http.MethodPost, "/create-collection", nil, req, &StatusResponse{})
+}
+
+// Insert stores a key-value pair.
+func (c *Client) Insert(ctx context.Context, req KVRequest) error {
+	return c.do(ctx, http.MethodPost, "/insert", nil, req, &StatusResponse{})
+}
+
+// Update overwrites a key, inserting it when missing.
+func (c *Client) Update(ctx context.Context, req KVRequest) error {
+	return c.do(ctx, http.MethodPost, "/update", nil, req, &StatusResponse{})
+}
+
+// Find returns the value stored under key. A missing key yields an error for
+// which IsNotFound reports true.
+func (c *Client) Find(ctx context.Context, dbID, collection, key string) (interface{}, error) {
+	var out findResponse
+	q := url.Values{"dbID": {dbID}, "collection": {collection}, "key": {key}}
+	err := c.do(ctx, http.MethodGet, "/find", q, nil, &out)
+	return out.Value, err
+}
+
+// FindAll returns every pair in the collection.
+func (c *Client) FindAll(ctx context.Context, dbID, collection string) ([]KeyValue, error) {
+	var out findAllResponse
+	q := url.Values{"dbID": {dbID}, "collection": {collection}}
+	err := c.do(ctx, http.MethodGet, "/find-all", q, nil, &out)
+	return out.Value, err
+}
+
+// Delete removes a key. Deleting a missing key is not an error.
+func (c *Client) Delete(ctx context.Context, dbID, collection, key string) error {
+	q := url.Values{"dbID": {dbID}, "collection": {collection}, "key": {key}}
+	return c.do(ctx, http.MethodDelete, "/delete", q, nil, &StatusResponse{})
+}
+
+// Init initializes the .nutella repository of a database.
+func (c *Client) Init(ctx context.Context, dbID string) (string, error) {
+	var out OutputResponse
+	err := c.do(ctx, http.MethodPost, "/init", nil, dbRequest{DBID: dbID}, &out)
+	return out.Output, err
+}
+
+// CommitAll snapshots the database with the given message.
+func (c *Client) CommitAll(ctx context.Context, req CommitRequest) (string, error) {
+	var out OutputResponse
+	err := c.do(ctx, http.MethodPost, "/commit-all", nil, req, &out)
+	return out.Output, err
+}
+
+// Snapshots lists the database's commits, oldest first.
+func (c *Client) Snapshots(ctx context.Context, dbID string) ([]SnapshotEntry, error) {
+	var out snapshotsResponse
+	err := c.do(ctx, http.MethodGet, "/snapshots", url.Values{"dbID": {dbID}}, nil, &out)
+	return out.Snapshots, err
+}
+
+// Restore calls POST /restore, which resets the database's working tree to commit.
+func (c *Client) Restore(ctx context.Context, dbID, commit string) (string, error) {
+	var out OutputResponse
+	err := c.do(ctx, http.MethodPost, "/restore", nil, restoreRequest{DBID: dbID, Commit: commit}, &out)
+	return out.Output, err
+}
+
+// RestoreTo resets the database's working tree to a commit.
+func (c *Client) RestoreTo(ctx context.Context, req RestoreToRequest) (string, error) {
+	var out OutputResponse
+	err := c.do(ctx, http.MethodPost, "/restore-to", nil, req, &out)
+	return out.Output, err
+}
+
+// Pack bundles the database's loose objects into a packfile.
+func (c *Client) Pack(ctx context.Context, dbID string) (string, error) {
+	var out OutputResponse
+	err := c.do(ctx, http.MethodPost, "/pack", nil, dbRequest{DBID: dbID}, &out)
+	return out.Output, err
+}
+
+// Refs lists the branches and tags of a database's repository.
+func (c *Client) Refs(ctx context.Context, dbID string) (*Refs, error) {
+	var out Refs
+	if err := c.do(ctx, http.MethodGet, dbPath(dbID, "/refs"), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// FetchPack asks the server for a bundle of the objects reachable from
+// req.Want but not from req.Have, as read by the CLI's fetch.
+func (c *Client) FetchPack(ctx context.Context, dbID string, req FetchPackRequest) ([]byte, error) {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("nutella: encoding request: %w", err)
+	}
+	var bundle []byte
+	err = c.exchange(ctx, http.MethodPost, dbPath(dbID, "/fetch-pack"), nil, payload, "application/json", &bundle, true)
+	return bundle, err
+}
+
+// Export downloads the pairs of collection, or of every collection when it
+// is empty, in the format opts selects.
+func (c *Client) Export(ctx context.Context, dbID, collection string, opts TransferOptions) ([]byte, error) {
+	path := dbPath(dbID, "/export")
+	if collection != "" {
+		path = dbPath(dbID, "/collections/"+url.PathEscape(collection)+"/export")
+	}
+	var data []byte
+	err := c.do(ctx, http.MethodGet, path, opts.query(), nil, &data)
+	return data, err
+}
+
+// Import upserts the records in data, written in the format opts selects,
+// into collection. A failed import's error says how many records are in;
+// retry with opts.Skip set to that number to resume.
+func (c *Client) Import(ctx context.Context, dbID, collection string, data []byte, opts TransferOptions) (*ImportResult, error) {
+	q := opts.query()
+	if opts.Skip > 0 {
+		q.Set("skip", strconv.Itoa(opts.Skip))
+	}
+	var out ImportResult
+	path := dbPath(dbID, "/collections/"+url.PathEscape(collection)+"/import")
+	if err := c.send(ctx, http.MethodPost, path, q, data, "application/octet-stream", &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (o TransferOptions) query() url.Values {
+	q := url.Values{}
+	for name, v := range map[string]string{"format": o.Format, "key": o.KeyColumn, "value": o.ValueColumn} {
+		if v != "" {
+			q.Set(name, v)
+		}
+	}
+	return q
+}
+
+// Backup downloads a backup archive of dbID taken while the server keeps
+// running; write it to a file for the CLI's restore-backup.
+func (c *Client) Backup(ctx context.Context, dbID string) ([]byte, error) {
+	var archive []byte
+	err := c.do(ctx, http.MethodGet, dbPath(dbID, "/backup"), nil, nil, &archive)
+	return archive, err
+}
+
+// ReceivePack uploads a bundle written by the CLI's push and returns how many
+// objects the server stored. The server verifies every object before keeping
+// any of them.
+func (c *Client) ReceivePack(ctx context.Context, dbID string, bundle []byte) (int, error) {
+	var out receivePackResponse
+	err := c.exchange(ctx, http.MethodPost, dbPath(dbID, "/receive-pack"), nil, bundle, "application/octet-stream", &out, true)
+	return out.Objects, err
+}
+
+// UpdateRef moves a branch or tag on the server, failing with a 409 when the
+// ref no longer holds req.Old or the update is not a fast-forward and
+// req.Force is not set.
+func (c *Client) UpdateRef(ctx context.Context, dbID string, req RefUpdate) (*RefUpdateResult, error) {
+	var out RefUpdateResult
+	if err := c.do(ctx, http.MethodPost, dbPath(dbID, "/refs"), nil, req, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// dbPath is the /v1 path of a database's sub-resource.
+func dbPath(dbID, rest string) string {
+	return "/v1/dbs/" + url.PathEscape(dbID) + rest
+}
+
+// do sends one API call, retrying according to the client's policy, and
+// decodes a successful JSON response into out.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return fmt.Errorf("nutella: encoding request: %w", err)
+		}
+	}
+	return c.send(ctx, method, path, query, payload, "application/json", out)
+}
+
+// send is do with a payload already encoded as contentType. A *[]byte out
+// receives the response body as is.
+func (c *Client) send(ctx context.Context, method, path string, query url.Values, payload []byte, contentType string, out interface{}) error {
+	return c.exchange(ctx, method, path, query, payload, contentType, out, idempotentMethod(method))
+}
+
+// exchange is send for a request the caller knows to be idempotent, or not,
+// whatever its method; only idempotent requests are retried when the server
+// may have acted on them.
+func (c *Client) exchange(ctx context.Context, method, path string, query url.Values, payload []byte, contentType string, out interface{}, idempotent bool) error {
+	target := c.baseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			wait := c.backoff << (attempt - 1)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+
+		retry, err := c.attempt(ctx, method, target, payload, contentType, out, idempotent)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if !retry || ctx.Err() != nil {
+			break
+		}
+	}
+	return lastErr
+}
+
+func (c *Client) attempt(ctx context.Context, method, target string, payload []byte, contentType string, out interface{}, idempotent bool) (bool, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	var reader io.Reader
+	if payload != nil {
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return false, fmt.Errorf("nutella: building request: %w", err)
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return idempotent, fmt.Errorf("nutella: %s %s: %w", method, req.URL.Path, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return idempotent, fmt.Errorf("nutella: reading response: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := &Error{StatusCode: resp.StatusCode}
+		var e errorResponse
+		var v1 v1ErrorResponse
+		if json.Unmarshal(data, &e) == nil && e.Error != "" {
+			apiErr.Message = e.Error
+			apiErr.Output = e.Output
+		} else if json.Unmarshal(data, &v1) == nil && v1.Error.Message != "" {
+			apiErr.Message = v1.Error.Message
+		} else {
+			apiErr.Message = strings.TrimSpace(string(data))
+		}
+		return retryable(resp.StatusCode, idempotent), apiErr
+	}
+
+	if raw, ok := out.(*[]byte); ok {
+		*raw = data
+		return false, nil
+	}
+	if out == nil || len(data) == 0 {
+		return false, nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return false, fmt.Errorf("nutella: decoding response: %w", err)
+	}
+	return false, nil
+}
+
+// idempotentMethod reports whether repeating a request with method has the
+// same effect as sending it once.
+func idempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// retryable reports whether a response with status is worth retrying. A 502
+// or 504 comes from a gateway that may have passed the request on, so only
+// idempotent requests are retried after one.
+func retryable(status int, idempotent bool) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return idempotent
+	}
+	return false
+}
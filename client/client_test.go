@@ -0,0 +1,213 @@
+package client_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"db/client"
+	"db/dbcli"
+	"db/server/routes"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// startServer runs the real routes on a random local port inside a temporary
+// working directory, since the server keeps its data under ./files.
+func startServer(t *testing.T) *client.Client {
+	t.Helper()
+
+	originalDir, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get current directory: %v", err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatalf("Failed to change directory: %v", err)
+	}
+	t.Cleanup(func() { os.Chdir(originalDir) })
+
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	routes.SetupRoutes(app)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go app.Listener(ln)
+	t.Cleanup(func() { app.Shutdown() })
+
+	return client.New("http://"+ln.Addr().String(), client.WithTimeout(10*time.Second))
+}
+
+func TestMain(m *testing.M) {
+	dbcli.Init()
+	os.Exit(m.Run())
+}
+
+// TestClientAgainstServer drives every data and version-control route through
+// the SDK against an in-process server.
+func TestClientAgainstServer(t *testing.T) {
+	ctx := context.Background()
+	c := startServer(t)
+
+	dbID, err := c.CreateDatabase(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+
+	dbs, err := c.ListDatabases(ctx)
+	if err != nil || len(dbs) != 1 || dbs[0] != dbID {
+		t.Fatalf("ListDatabases = %v, %v; want [%s]", dbs, err, dbID)
+	}
+
+	if err := c.CreateCollection(ctx, client.CreateCollectionRequest{DBID: dbID, Name: "fruits", Order: 3}); err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	colls, err := c.ListCollections(ctx, dbID)
+	if err != nil || len(colls) != 1 || colls[0] != "fruits" {
+		t.Fatalf("ListCollections = %v, %v; want [fruits]", colls, err)
+	}
+
+	for _, kv := range [][2]string{{"apple", "red"}, {"banana", "yellow"}, {"cherry", "red"}} {
+		if err := c.Insert(ctx, client.KVRequest{DBID: dbID, Collection: "fruits", Key: kv[0], Value: kv[1]}); err != nil {
+			t.Fatalf("Failed to insert %s: %v", kv[0], err)
+		}
+	}
+	if err := c.Update(ctx, client.KVRequest{DBID: dbID, Collection: "fruits", Key: "apple", Value: "green"}); err != nil {
+		t.Fatalf("Failed to update apple: %v", err)
+	}
+	if v, err := c.Find(ctx, dbID, "fruits", "apple"); err != nil || v != "green" {
+		t.Errorf("Find(apple) = %v, %v; want green", v, err)
+	}
+
+	if _, err := c.Init(ctx, dbID); err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+	if _, err := c.CommitAll(ctx, client.CommitRequest{DBID: dbID, Message: "three fruits"}); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	snaps, err := c.Snapshots(ctx, dbID)
+	if err != nil || len(snaps) != 1 || snaps[0].Snapshot.Message != "three fruits" {
+		t.Fatalf("Snapshots = %+v, %v; want one snapshot", snaps, err)
+	}
+
+	if err := c.Delete(ctx, dbID, "fruits", "banana"); err != nil {
+		t.Fatalf("Failed to delete banana: %v", err)
+	}
+	if _, err := c.Find(ctx, dbID, "fruits", "banana"); !client.IsNotFound(err) {
+		t.Errorf("Find(banana) after delete error = %v; want not found", err)
+	}
+
+	if _, err := c.RestoreTo(ctx, client.RestoreToRequest{DBID: dbID, CommitHash: snaps[0].Snapshot.Commit}); err != nil {
+		t.Fatalf("Failed to restore: %v", err)
+	}
+	all, err := c.FindAll(ctx, dbID, "fruits")
+	if err != nil || len(all) != 3 {
+		t.Errorf("FindAll after restore = %v, %v; want 3 pairs", all, err)
+	}
+
+	if _, err := c.Pack(ctx, dbID); err != nil {
+		t.Errorf("Failed to pack: %v", err)
+	}
+
+	_, err = c.ListCollections(ctx, "db_missing")
+	if e, ok := err.(*client.Error); !ok || !client.IsNotFound(err) || e.Message == "" {
+		t.Errorf("ListCollections(db_missing) error = %v; want decoded 404", err)
+	}
+}
+
+// TestClientRetries checks that 503 responses are retried and 400 are not.
+func TestClientRetries(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		if r.URL.Path == "/collections" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"dbID required"}`))
+			return
+		}
+		if n < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"databases":["db_1"]}`))
+	}))
+	defer srv.Close()
+
+	c := client.New(srv.URL, client.WithRetries(3, time.Millisecond))
+	dbs, err := c.ListDatabases(context.Background())
+	if err != nil || len(dbs) != 1 {
+		t.Fatalf("ListDatabases = %v, %v; want [db_1] after retries", dbs, err)
+	}
+	if calls != 3 {
+		t.Errorf("server saw %d calls; want 3", calls)
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	_, err = c.ListCollections(context.Background(), "")
+	if e, ok := err.(*client.Error); !ok || e.StatusCode != http.StatusBadRequest || e.Message != "dbID required" {
+		t.Errorf("ListCollections error = %v; want decoded 400", err)
+	}
+	if calls != 1 {
+		t.Errorf("server saw %d calls for a 400; want 1", calls)
+	}
+}
+
+// TestClientDoesNotResendPost drops the connection after a POST arrives; the
+// server may have applied it, so it must not be sent again. A GET is.
+func TestClientDoesNotResendPost(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer srv.Close()
+	c := client.New(srv.URL, client.WithRetries(3, time.Millisecond))
+
+	if err := c.Insert(context.Background(), client.KVRequest{DBID: "db_1", Collection: "c", Key: "k", Value: "v"}); err == nil {
+		t.Fatalf("Insert over a dropped connection succeeded")
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("server saw %d inserts; want 1", n)
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	if _, err := c.ListDatabases(context.Background()); err == nil {
+		t.Fatalf("ListDatabases over a dropped connection succeeded")
+	}
+	if n := atomic.LoadInt32(&calls); n != 4 {
+		t.Errorf("server saw %d list calls; want 4", n)
+	}
+}
+
+// TestClientTimeout checks that WithTimeout bounds attempts whichever order
+// it is given in, without touching the *http.Client passed to WithHTTPClient.
+func TestClientTimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer srv.Close()
+	defer close(unblock)
+
+	shared := &http.Client{}
+	c := client.New(srv.URL, client.WithTimeout(50*time.Millisecond), client.WithHTTPClient(shared), client.WithRetries(0, 0))
+	start := time.Now()
+	if _, err := c.ListDatabases(context.Background()); err == nil {
+		t.Fatalf("ListDatabases against a hung server succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("ListDatabases took %s; want the 50ms timeout to apply", elapsed)
+	}
+	if shared.Timeout != 0 {
+		t.Errorf("WithTimeout set the shared client's Timeout to %s", shared.Timeout)
+	}
+}
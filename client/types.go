@@ -0,0 +1,162 @@
+package client
+
+// CreateCollectionRequest is the body of POST /create-collection.
+type CreateCollectionRequest struct {
+	DBID  string `json:"dbID"`
+	Name  string `json:"name"`
+	Order int    `json:"order"`
+}
+
+// KVRequest is the body of POST /insert and POST /update.
+type KVRequest struct {
+	DBID       string `json:"dbID"`
+	Collection string `json:"collection"`
+	Key        string `json:"key"`
+	Value      string `json:"value"`
+}
+
+// CommitRequest is the body of POST /commit-all.
+type CommitRequest struct {
+	DBID    string `json:"dbID"`
+	Message string `json:"message"`
+}
+
+// RestoreToRequest is the body of POST /restore-to.
+type RestoreToRequest struct {
+	DBID       string `json:"dbID"`
+	CommitHash string `json:"commit_hash"`
+}
+
+// restoreRequest is the body of POST /restore.
+type restoreRequest struct {
+	DBID   string `json:"dbID"`
+	Commit string `json:"commit"`
+}
+
+// dbRequest is the body of the version-control routes that only need a dbID.
+type dbRequest struct {
+	DBID string `json:"dbID"`
+}
+
+// StatusResponse is returned by the data routes that only acknowledge a write.
+type StatusResponse struct {
+	Status string `json:"status"`
+}
+
+// CreateDatabaseResponse is returned by GET /create-db.
+type CreateDatabaseResponse struct {
+	Status string `json:"status"`
+	DBID   string `json:"dbID"`
+}
+
+// OutputResponse carries the CLI output of the version-control routes.
+type OutputResponse struct {
+	Output string `json:"output"`
+}
+
+// KeyValue is one pair returned by FindAll.
+type KeyValue struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+}
+
+// Snapshot mirrors an entry of a database's .nutella/snapshots.json.
+type Snapshot struct {
+	Commit    string `json:"commit"`
+	Message   string `json:"message"`
+	Timestamp string `json:"timestamp"`
+	Auto      bool   `json:"auto,omitempty"`
+}
+
+// SnapshotEntry is one element of the GET /snapshots response, oldest first.
+type SnapshotEntry struct {
+	Key      string
+	Snapshot Snapshot
+}
+
+type databasesResponse struct {
+	Databases []string `json:"databases"`
+}
+
+type collectionsResponse struct {
+	Collections []string `json:"collections"`
+}
+
+type findResponse struct {
+	Value interface{} `json:"value"`
+}
+
+type findAllResponse struct {
+	Value []KeyValue `json:"value"`
+}
+
+type snapshotsResponse struct {
+	Snapshots []SnapshotEntry `json:"snapshots"`
+}
+
+// Refs is the response of GET /v1/dbs/{db}/refs. Head is the ref HEAD points
+// at, or a commit SHA when it is detached; Refs maps every branch and tag,
+// such as "refs/heads/main", to the object it points at.
+type Refs struct {
+	Head string            `json:"head"`
+	Refs map[string]string `json:"refs"`
+}
+
+// FetchPackRequest is the body of POST /v1/dbs/{db}/fetch-pack.
+type FetchPackRequest struct {
+	Want []string `json:"want"`
+	Have []string `json:"have"`
+}
+
+type receivePackResponse struct {
+	Objects int `json:"objects"`
+}
+
+// RefUpdate is the body of POST /v1/dbs/{db}/refs: move Ref from Old, or
+// create it when Old is empty, to New.
+type RefUpdate struct {
+	Ref   string `json:"ref"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+	Force bool   `json:"force,omitempty"`
+}
+
+// RefUpdateResult reports an applied RefUpdate. WorkingTree is set when the
+// ref was the server's checked-out branch and its data now matches New.
+type RefUpdateResult struct {
+	Ref         string `json:"ref"`
+	Old         string `json:"old"`
+	New         string `json:"new"`
+	WorkingTree bool   `json:"working_tree"`
+}
+
+// TransferOptions selects the format of Export and Import: "ndjson" (the
+// default), "csv" or "json", and the fields holding the key and the value,
+// "key" and "value" unless set.
+type TransferOptions struct {
+	Format      string
+	KeyColumn   string
+	ValueColumn string
+	// Skip makes Import pass over that many records, to resume an import
+	// that failed after writing them.
+	Skip int
+}
+
+// ImportResult counts the records an Import wrote and skipped.
+type ImportResult struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+}
+
+type errorResponse struct {
+	Error  string `json:"error"`
+	Output string `json:"output"`
+}
+
+// v1ErrorResponse is the error envelope of the /v1 routes.
+type v1ErrorResponse struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
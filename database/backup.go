@@ -0,0 +1,417 @@
+package database
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Backup archives are gzipped tarballs. The first entry, backup.json, is the
+// BackupInfo; the database's files follow under data/, each carrying its
+// SHA-256 as the PAX record NUTELLA.sha256; the last entry, SHA256SUMS, lists
+// the hash of every entry before it. An archive that lacks the trailer was cut
+// short.
+const (
+	backupFormat    = "nutella-backup"
+	backupVersion   = 1
+	backupInfoName  = "backup.json"
+	backupSumsName  = "SHA256SUMS"
+	backupDataDir   = "data/"
+	backupPAXSHA256 = "NUTELLA.sha256"
+)
+
+var (
+	// ErrInvalidBackup is returned when an archive is not a backup, is
+	// damaged or was cut short.
+	ErrInvalidBackup = errors.New("invalid backup archive")
+	// ErrDatabaseExists is returned when a restore would overwrite a
+	// database.
+	ErrDatabaseExists = errors.New("database already exists")
+)
+
+// BackupInfo describes a backup archive.
+type BackupInfo struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	DBID    string    `json:"db_id"`
+	Created time.Time `json:"created"`
+	Files   int       `json:"files"`
+	Bytes   int64     `json:"bytes"`
+	// WALID and WALSeq name the write-ahead log the database kept and the
+	// last record of it the archive holds; records after WALSeq are what
+	// point-in-time recovery replays. Both are empty without a log.
+	WALID  string `json:"wal_id,omitempty"`
+	WALSeq uint64 `json:"wal_seq,omitempty"`
+}
+
+// RestoreOptions selects the write-ahead log replayed on top of a backup.
+type RestoreOptions struct {
+	// WALDir is the log directory of the backed-up database; empty restores
+	// the archive alone.
+	WALDir string
+	// Until stops the replay at the last write made at or before it; zero
+	// replays the whole log.
+	Until time.Time
+}
+
+// RestoreResult reports what RestoreBackup restored.
+type RestoreResult struct {
+	Backup   BackupInfo `json:"backup"`
+	Replayed int        `json:"replayed"`
+	LastSeq  uint64     `json:"last_seq,omitempty"`
+	LastTime time.Time  `json:"last_time,omitempty"`
+}
+
+// backupFiles lists the files of the database at dir that a backup holds,
+// as slash-separated paths relative to dir: everything but the version
+// control repository and the write-ahead log.
+func backupFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if rel == ".nutella" || rel == walDirName {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() {
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+// Backup writes a consistent archive of the database to w while it stays
+// open: writes wait until the files have been copied into the archive. With
+// a write-ahead log the log moves on to a new segment, so the records to
+// replay on top of this backup start in a segment of their own.
+func (db *Database) Backup(w io.Writer) (*BackupInfo, error) {
+	resume, err := db.Quiesce()
+	if err != nil {
+		return nil, err
+	}
+	defer resume()
+
+	dir := db.Path()
+	files, err := backupFiles(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list database files: %v", err)
+	}
+	info := &BackupInfo{
+		Format:  backupFormat,
+		Version: backupVersion,
+		DBID:    db.ID(),
+		Created: time.Now().UTC(),
+		Files:   len(files),
+	}
+	for _, name := range files {
+		st, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			return nil, err
+		}
+		info.Bytes += st.Size()
+	}
+	wl, err := openLog(dir)
+	if err != nil {
+		return nil, err
+	}
+	if wl != nil {
+		if info.WALSeq, err = wl.rotate(); err != nil {
+			return nil, err
+		}
+		info.WALID = wl.id
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	var sums strings.Builder
+	header, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeBackupEntry(tw, &sums, backupInfoName, header, info.Created); err != nil {
+		return nil, err
+	}
+	for _, name := range files {
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", name, err)
+		}
+		if err := writeBackupEntry(tw, &sums, backupDataDir+name, data, info.Created); err != nil {
+			return nil, err
+		}
+	}
+	if err := writeBackupEntry(tw, nil, backupSumsName, []byte(sums.String()), info.Created); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// writeBackupEntry adds a file to the archive and, unless sums is nil, its
+// line to SHA256SUMS.
+func writeBackupEntry(tw *tar.Writer, sums *strings.Builder, name string, data []byte, mod time.Time) error {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	hdr := &tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       name,
+		Mode:       0644,
+		Size:       int64(len(data)),
+		ModTime:    mod,
+		Format:     tar.FormatPAX,
+		PAXRecords: map[string]string{backupPAXSHA256: hash},
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write backup: %v", err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("failed to write backup: %v", err)
+	}
+	if sums != nil {
+		fmt.Fprintf(sums, "%s  %s\n", hash, name)
+	}
+	return nil
+}
+
+// ReadBackupInfo reads the description at the start of a backup archive
+// without reading the rest.
+func ReadBackupInfo(r io.Reader) (*BackupInfo, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	tr := tar.NewReader(gz)
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != backupInfoName {
+		return nil, fmt.Errorf("%w: %s is not the first entry", ErrInvalidBackup, backupInfoName)
+	}
+	data, err := io.ReadAll(tr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	return parseBackupInfo(data)
+}
+
+func parseBackupInfo(data []byte) (*BackupInfo, error) {
+	var info BackupInfo
+	if err := json.Unmarshal(data, &info); err != nil || info.Format != backupFormat {
+		return nil, fmt.Errorf("%w: not a %s", ErrInvalidBackup, backupFormat)
+	}
+	if info.Version != backupVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidBackup, info.Version)
+	}
+	return &info, nil
+}
+
+// RestoreBackup creates database newDBID under root from the archive r,
+// checking every file against its recorded hash, then replays the write-ahead
+// log chosen by opts. The database is assembled in a temporary directory and
+// renamed into place, so a failed restore leaves nothing behind. It gets a
+// fresh, empty .nutella repository; history is not part of a backup.
+func RestoreBackup(r io.Reader, root, newDBID string, opts RestoreOptions) (*RestoreResult, error) {
+	if err := ValidDBID(newDBID); err != nil {
+		return nil, err
+	}
+	dest := filepath.Join(root, newDBID)
+	if _, err := os.Stat(dest); err == nil {
+		return nil, fmt.Errorf("%s: %w", newDBID, ErrDatabaseExists)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.MkdirTemp(root, "."+newDBID+"-")
+	if err != nil {
+		return nil, fmt.Errorf("error creating staging directory: %v", err)
+	}
+	done := false
+	defer func() {
+		if !done {
+			os.RemoveAll(tmp)
+		}
+	}()
+
+	info, err := extractBackup(r, tmp)
+	if err != nil {
+		return nil, err
+	}
+	result := &RestoreResult{Backup: *info}
+	if opts.WALDir != "" && !opts.Until.IsZero() && opts.Until.Before(info.Created) {
+		return nil, fmt.Errorf("backup was taken at %s, after %s", info.Created.Format(time.RFC3339), opts.Until.Format(time.RFC3339))
+	}
+
+	if err := initRepository(tmp); err != nil {
+		return nil, err
+	}
+	db, err := LoadDatabase(tmp)
+	if err != nil {
+		return nil, err
+	}
+	db.manifest.DBID = newDBID
+	if err := db.SaveManifest(); err != nil {
+		return nil, err
+	}
+	if opts.WALDir != "" {
+		if err := replayBackupWAL(db, info, opts, result); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	if err := db.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(tmp, dest); err != nil {
+		return nil, fmt.Errorf("error moving %s into place: %v", newDBID, err)
+	}
+	done = true
+	return result, nil
+}
+
+// extractBackup unpacks and verifies the archive r into dir.
+func extractBackup(r io.Reader, dir string) (*BackupInfo, error) {
+	gz, err := gzip.NewReader(bufio.NewReader(r))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	tr := tar.NewReader(gz)
+
+	var info *BackupInfo
+	hashes := map[string]string{}
+	files := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: %s is missing, the archive was cut short", ErrInvalidBackup, backupSumsName)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("%w: %s is not a regular file", ErrInvalidBackup, hdr.Name)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+		}
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:])
+
+		if hdr.Name == backupSumsName {
+			if info == nil {
+				return nil, fmt.Errorf("%w: %s is not the first entry", ErrInvalidBackup, backupInfoName)
+			}
+			if err := checkBackupSums(data, hashes); err != nil {
+				return nil, err
+			}
+			if files != info.Files {
+				return nil, fmt.Errorf("%w: holds %d files, %s lists %d", ErrInvalidBackup, files, backupInfoName, info.Files)
+			}
+			return info, nil
+		}
+		if want := hdr.PAXRecords[backupPAXSHA256]; want != hash {
+			return nil, fmt.Errorf("%w: %s does not match its checksum", ErrInvalidBackup, hdr.Name)
+		}
+		hashes[hdr.Name] = hash
+
+		if info == nil {
+			if hdr.Name != backupInfoName {
+				return nil, fmt.Errorf("%w: %s is not the first entry", ErrInvalidBackup, backupInfoName)
+			}
+			if info, err = parseBackupInfo(data); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		name := strings.TrimPrefix(hdr.Name, backupDataDir)
+		clean := path.Clean(name)
+		if !strings.HasPrefix(hdr.Name, backupDataDir) || clean != name || path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return nil, fmt.Errorf("%w: unexpected entry %s", ErrInvalidBackup, hdr.Name)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(clean))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(target, data, 0644); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %v", clean, err)
+		}
+		files++
+	}
+}
+
+// checkBackupSums compares SHA256SUMS with the hashes of the entries read.
+func checkBackupSums(data []byte, hashes map[string]string) error {
+	listed := 0
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		hash, name, ok := strings.Cut(line, "  ")
+		if !ok || hashes[name] != hash {
+			return fmt.Errorf("%w: %s does not match the archive at %q", ErrInvalidBackup, backupSumsName, name)
+		}
+		listed++
+	}
+	if listed != len(hashes) {
+		return fmt.Errorf("%w: %s lists %d entries, the archive holds %d", ErrInvalidBackup, backupSumsName, listed, len(hashes))
+	}
+	return nil
+}
+
+// replayBackupWAL applies the records of opts.WALDir that follow the backup,
+// up to opts.Until, to db.
+func replayBackupWAL(db *Database, info *BackupInfo, opts RestoreOptions, result *RestoreResult) error {
+	if info.WALID == "" {
+		return fmt.Errorf("backup of %s was taken without a write-ahead log", info.DBID)
+	}
+	id, err := readWALID(opts.WALDir)
+	if err != nil {
+		return fmt.Errorf("failed to read write-ahead log: %v", err)
+	}
+	if id != info.WALID {
+		return fmt.Errorf("write-ahead log in %s is not the one the backup was taken with", opts.WALDir)
+	}
+
+	return ReadWAL(opts.WALDir, info.WALSeq, func(rec WALRecord) (bool, error) {
+		if !opts.Until.IsZero() && rec.Time.After(opts.Until) {
+			return false, nil
+		}
+		if err := db.Replay(rec); err != nil {
+			return false, fmt.Errorf("failed to replay record %d: %v", rec.Seq, err)
+		}
+		result.Replayed++
+		result.LastSeq, result.LastTime = rec.Seq, rec.Time
+		return true, nil
+	})
+}
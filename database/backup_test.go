@@ -0,0 +1,175 @@
+package database_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"db/database"
+)
+
+// TestBackupPointInTimeRestore backs up a database that keeps a write-ahead
+// log, keeps writing, and restores the backup alone, up to a moment and with
+// the whole log. Damaged archives must be refused without leaving anything.
+func TestBackupPointInTimeRestore(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "db_src")
+	db, err := database.OpenDatabase(src, "db_src")
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+	if err := database.EnableWAL(src); err != nil {
+		t.Fatalf("Failed to enable the log: %v", err)
+	}
+	if err := db.CreateCollection("fruits", 4); err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	fruits, err := db.GetCollection("fruits")
+	if err != nil {
+		t.Fatalf("Failed to get collection: %v", err)
+	}
+	fruits.Insert("apple", "red")
+
+	var archive bytes.Buffer
+	info, err := db.Backup(&archive)
+	if err != nil {
+		t.Fatalf("Backup = %v", err)
+	}
+	if info.WALID == "" || info.WALSeq != 2 {
+		t.Errorf("backup log position = %q/%d; want the log's ID at record 2", info.WALID, info.WALSeq)
+	}
+
+	fruits.Insert("banana", "yellow")
+	cut := time.Now().UTC()
+	time.Sleep(10 * time.Millisecond)
+	fruits.Update("apple", "green")
+	fruits.Delete("banana")
+
+	restore := func(newDBID string, opts database.RestoreOptions) *database.RestoreResult {
+		t.Helper()
+		res, err := database.RestoreBackup(bytes.NewReader(archive.Bytes()), root, newDBID, opts)
+		if err != nil {
+			t.Fatalf("RestoreBackup(%s) = %v", newDBID, err)
+		}
+		return res
+	}
+	expect := func(dbID string, want map[string]interface{}) {
+		t.Helper()
+		restored, err := database.LoadDatabase(filepath.Join(root, dbID))
+		if err != nil {
+			t.Fatalf("Failed to load %s: %v", dbID, err)
+		}
+		defer restored.Close()
+		if restored.ID() != dbID {
+			t.Errorf("%s: manifest names %s", dbID, restored.ID())
+		}
+		coll, err := restored.GetCollection("fruits")
+		if err != nil {
+			t.Fatalf("%s: %v", dbID, err)
+		}
+		for _, key := range []string{"apple", "banana"} {
+			value, found, _ := coll.Find(key)
+			if want[key] == nil && found {
+				t.Errorf("%s: %s = %v; want it absent", dbID, key, value)
+			} else if want[key] != nil && value != want[key] {
+				t.Errorf("%s: %s = %v, %v; want %v", dbID, key, value, found, want[key])
+			}
+		}
+	}
+
+	restore("plain", database.RestoreOptions{})
+	expect("plain", map[string]interface{}{"apple": "red"})
+	if res := restore("at_cut", database.RestoreOptions{WALDir: database.WALDir(src), Until: cut}); res.Replayed != 1 {
+		t.Errorf("replayed %d writes up to the cut; want 1", res.Replayed)
+	}
+	expect("at_cut", map[string]interface{}{"apple": "red", "banana": "yellow"})
+	if res := restore("latest", database.RestoreOptions{WALDir: database.WALDir(src)}); res.Replayed != 3 || res.LastSeq != 5 {
+		t.Errorf("replayed %d writes ending at %d; want 3 ending at 5", res.Replayed, res.LastSeq)
+	}
+	expect("latest", map[string]interface{}{"apple": "green"})
+
+	if _, err := database.RestoreBackup(bytes.NewReader(archive.Bytes()), root, "plain", database.RestoreOptions{}); !errors.Is(err, database.ErrDatabaseExists) {
+		t.Errorf("restore over an existing database = %v; want ErrDatabaseExists", err)
+	}
+
+	// A crash can leave half a record at the end of the log.
+	segments, _ := filepath.Glob(filepath.Join(database.WALDir(src), "*.log"))
+	f, err := os.OpenFile(segments[len(segments)-1], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open segment: %v", err)
+	}
+	f.WriteString(`0badc0de {"seq":6,"op":"ins`)
+	f.Close()
+	if res := restore("torn", database.RestoreOptions{WALDir: database.WALDir(src)}); res.Replayed != 3 {
+		t.Errorf("replayed %d writes from a log with a torn tail; want 3", res.Replayed)
+	}
+
+	damaged := append([]byte(nil), archive.Bytes()...)
+	damaged[len(damaged)/2] ^= 0xff
+	for name, data := range map[string][]byte{"damaged": damaged, "truncated": archive.Bytes()[:archive.Len()*2/3]} {
+		if _, err := database.RestoreBackup(bytes.NewReader(data), root, name, database.RestoreOptions{}); !errors.Is(err, database.ErrInvalidBackup) {
+			t.Errorf("restore of a %s archive = %v; want ErrInvalidBackup", name, err)
+		}
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatalf("Failed to read root: %v", err)
+	}
+	if len(entries) != 5 {
+		t.Errorf("root holds %d entries after refused restores; want the source and four restores", len(entries))
+	}
+}
+
+// TestFailedWriteIsNotLogged makes a write fail and checks the log holds no
+// record of it, so a point-in-time restore cannot replay it.
+func TestFailedWriteIsNotLogged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db_wal")
+	db, err := database.OpenDatabase(path, "db_wal")
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+	if err := database.EnableWAL(path); err != nil {
+		t.Fatalf("Failed to enable the log: %v", err)
+	}
+	if err := db.CreateCollection("fruits", 4); err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	if err := db.CreateCollection("fruits", 4); err == nil {
+		t.Fatalf("creating fruits twice succeeded")
+	}
+	fruits, err := db.GetCollection("fruits")
+	if err != nil {
+		t.Fatalf("Failed to get collection: %v", err)
+	}
+	fruits.Insert("apple", "red")
+
+	// A file where the pages should be makes every page write fail.
+	pages := filepath.Join(path, "fruits", "pages")
+	if err := os.RemoveAll(pages); err != nil {
+		t.Fatalf("Failed to remove pages: %v", err)
+	}
+	if err := os.WriteFile(pages, nil, 0644); err != nil {
+		t.Fatalf("Failed to block pages: %v", err)
+	}
+	if err := fruits.Insert("banana", "yellow"); err == nil {
+		t.Fatalf("Insert into a collection without pages succeeded")
+	}
+
+	var ops []string
+	err = database.ReadWAL(database.WALDir(path), 0, func(rec database.WALRecord) (bool, error) {
+		ops = append(ops, rec.Op+" "+rec.Key)
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("ReadWAL = %v", err)
+	}
+	want := []string{database.WALCreateCollection + " ", database.WALInsert + " apple"}
+	if len(ops) != len(want) || ops[0] != want[0] || ops[1] != want[1] {
+		t.Errorf("log = %q; want %q", ops, want)
+	}
+}
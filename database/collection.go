@@ -14,30 +14,135 @@ type Collection struct {
 	order   int
 	btree   *btree.BTree
 	baseDir string
+	db      *Database
+}
+
+// Name returns the collection name as recorded in the manifest.
+func (c *Collection) Name() string {
+	return c.name
+}
+
+// Insert stores key in the B-tree and the cache without printing anything.
+func (c *Collection) Insert(key string, value interface{}) error {
+	return c.db.logWrite(WALRecord{Op: WALInsert, Collection: c.name, Key: key, Value: value}, func() error {
+		if err := c.btree.Insert(key, value); err != nil {
+			return fmt.Errorf("failed to insert key %s into collection %s: %v", key, c.name, err)
+		}
+		if s, ok := value.(string); ok {
+			cache.InsertInCacheMemory(filepath.Dir(c.baseDir), c.name, key, s)
+		} else {
+			cache.DeleteFromCacheMemory(filepath.Dir(c.baseDir), c.name, key)
+		}
+		return nil
+	})
+}
+
+// Find looks the key up in the cache first and falls back to the B-tree.
+func (c *Collection) Find(key string) (interface{}, bool, error) {
+	value, err := cache.FindInCacheMemory(filepath.Dir(c.baseDir), c.name, key)
+	if err == nil {
+		return value, true, nil
+	}
+
+	val, found, err := c.btree.Find(key)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to find key %s in collection %s: %v", key, c.name, err)
+	}
+	return val, found, nil
+}
+
+// Update overwrites key, inserting it when it does not exist yet. It reports
+// whether the key was already present.
+func (c *Collection) Update(key string, value interface{}) (bool, error) {
+	var updated bool
+	err := c.db.logWrite(WALRecord{Op: WALUpdate, Collection: c.name, Key: key, Value: value}, func() error {
+		var err error
+		updated, err = c.btree.Update(key, value)
+		if err != nil {
+			return fmt.Errorf("failed to update key %s in collection %s: %v", key, c.name, err)
+		}
+		if !updated {
+			if err := c.btree.Insert(key, value); err != nil {
+				return fmt.Errorf("failed to insert key %s after update attempt: %v", key, err)
+			}
+		}
+		// The cache holds strings only; any other value must not leave an older
+		// string behind to be read instead.
+		if s, ok := value.(string); ok {
+			cache.UpdateCacheInMemory(filepath.Dir(c.baseDir), c.name, key, s)
+		} else {
+			cache.DeleteFromCacheMemory(filepath.Dir(c.baseDir), c.name, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return updated, nil
+}
+
+// Delete removes key from the B-tree and the cache, reporting whether it existed.
+func (c *Collection) Delete(key string) (bool, error) {
+	var deleted bool
+	err := c.db.logWrite(WALRecord{Op: WALDelete, Collection: c.name, Key: key}, func() error {
+		var err error
+		deleted, err = c.btree.Delete(key)
+		if err != nil {
+			return fmt.Errorf("failed to delete key %s in collection %s: %v", key, c.name, err)
+		}
+		cache.DeleteFromCacheMemory(filepath.Dir(c.baseDir), c.name, key)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return deleted, nil
+}
+
+// Scan calls fn for every key in ascending order until fn returns false.
+func (c *Collection) Scan(fn func(kv btree.KeyValue) bool) error {
+	return c.btree.Scan(fn)
+}
+
+// Snapshot opens a consistent read-only view of the collection. Writes made
+// after it was taken are invisible to it; Release it when done.
+func (c *Collection) Snapshot() *btree.Snapshot {
+	return c.btree.Snapshot()
+}
+
+// Vacuum drops version history no snapshot can read any more and removes the
+// keys deleted while snapshots were open, returning how many it removed.
+func (c *Collection) Vacuum() (int, error) {
+	removed, err := c.btree.Vacuum()
+	if err != nil {
+		return 0, fmt.Errorf("failed to vacuum collection %s: %v", c.name, err)
+	}
+	return removed, nil
+}
+
+// Check reports the B-tree invariants the collection's pages break; see
+// btree.BTree.Check.
+func (c *Collection) Check() ([]btree.Problem, error) {
+	problems, err := c.btree.Check()
+	if err != nil {
+		return nil, fmt.Errorf("failed to check collection %s: %v", c.name, err)
+	}
+	return problems, nil
 }
 
 // InsertKV wraps the btree insert
 func (c *Collection) InsertKV(key string, value interface{}) {
-	err := c.btree.Insert(key, value)
-	if err != nil {
+	if err := c.Insert(key, value); err != nil {
 		panic(fmt.Sprintf("Failed to insert key %s into collection %s: %v", key, c.name, err))
 	}
 	fmt.Printf("Inserted key: %s (value: %v) into collection: %s\n", key, value, c.name)
-	cache.InsertInCacheMemory(filepath.Dir(c.baseDir), c.name, key, value.(string))
 }
 
 // FindKey wraps the btree find
 func (c *Collection) FindKey(key string) (interface{}, bool) {
-	value, err := cache.FindInCacheMemory(filepath.Dir(c.baseDir), c.name, key)
-	var val interface{} = value
-	found := false
-	if err == nil {
-		found = true
-	} else {
-		val, found, err = c.btree.Find(key)
-		if err != nil {
-			panic(fmt.Sprintf("Failed to find key %s in collection %s: %v", key, c.name, err))
-		}
+	val, found, err := c.Find(key)
+	if err != nil {
+		panic(err.Error())
 	}
 	if found {
 		fmt.Printf("Found key: %s => %v (in collection: %s)\n", key, val, c.name)
@@ -54,32 +159,26 @@ func (c *Collection) FindAllKV() []btree.KeyValue {
 
 // UpdateKV wraps the btree update
 func (c *Collection) UpdateKV(key string, value interface{}) {
-	updated, err := c.btree.Update(key, value)
+	updated, err := c.Update(key, value)
 	if err != nil {
-		panic(fmt.Sprintf("Failed to update key %s in collection %s: %v", key, c.name, err))
+		panic(err.Error())
 	}
 	if updated {
 		fmt.Printf("Updated key: %s => %v (in collection: %s)\n", key, value, c.name)
 	} else {
 		fmt.Printf("Key not found for update: %s (in collection: %s), inserting...\n", key, c.name)
-		// Insert
-		if err := c.btree.Insert(key, value); err != nil {
-			panic(fmt.Sprintf("Failed to insert key %s after update attempt: %v", key, err))
-		}
 	}
-	cache.UpdateCacheInMemory(filepath.Dir(c.baseDir), c.name, key, value.(string))
 }
 
 // DeleteKey wraps the btree delete
 func (c *Collection) DeleteKey(key string) {
-	deleted, err := c.btree.Delete(key)
+	deleted, err := c.Delete(key)
 	if err != nil {
-		panic(fmt.Sprintf("Failed to delete key %s in collection %s: %v", key, c.name, err))
+		panic(err.Error())
 	}
 	if deleted {
 		fmt.Printf("Deleted key: %s (in collection: %s)\n", key, c.name)
 	} else {
 		fmt.Printf("Key not found for deletion: %s (in collection: %s)\n", key, c.name)
 	}
-	cache.DeleteFromCacheMemory(filepath.Dir(c.baseDir), c.name, key)
 }
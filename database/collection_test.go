@@ -178,3 +178,35 @@ func benchmarkDelete(t *testing.T, collection *database.Collection, count int) {
 	t.Logf("Delete success rate: %d/%d (%.2f%%)",
 		deletionSuccessCount, count, float64(deletionSuccessCount)*100/float64(count))
 }
+
+// TestUpdateReplacesCachedString replaces a cached string with values of other
+// types, which the cache cannot hold, and checks reads do not see the string.
+func TestUpdateReplacesCachedString(t *testing.T) {
+	db, err := database.OpenDatabase(filepath.Join(t.TempDir(), "db_x"), "db_x")
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+	if err := db.CreateCollection("c", 3); err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	coll, err := db.GetCollection("c")
+	if err != nil {
+		t.Fatalf("Failed to get collection: %v", err)
+	}
+
+	if err := coll.Insert("k", "old"); err != nil {
+		t.Fatalf("Insert = %v", err)
+	}
+	if v, _, _ := coll.Find("k"); v != "old" {
+		t.Fatalf("Find = %v; want old", v)
+	}
+	for _, value := range []interface{}{float64(42), map[string]interface{}{"a": "b"}, "new"} {
+		if _, err := coll.Update("k", value); err != nil {
+			t.Fatalf("Update(%v) = %v", value, err)
+		}
+		if v, found, err := coll.Find("k"); err != nil || !found || fmt.Sprint(v) != fmt.Sprint(value) {
+			t.Errorf("Find after Update(%v) = %v, %v, %v", value, v, found, err)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 
 	"db/btree" // your existing B-tree package
@@ -28,17 +29,28 @@ type Database struct {
 }
 
 func handleInitRepository(basePath string) {
+	if err := initRepository(basePath); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+	}
+
+	fmt.Printf("Initialized nutella directory at %s\n", filepath.Join(basePath, ".nutella"))
+}
+
+// initRepository lays out the .nutella folder (objects, refs, HEAD and an empty
+// snapshots.json) inside basePath without printing anything.
+func initRepository(basePath string) error {
 	// Create the .nutella folder within the basePath
 	gitDir := filepath.Join(basePath, ".nutella")
 	dirs := []string{
 		gitDir,
 		filepath.Join(gitDir, "objects"),
 		filepath.Join(gitDir, "refs"),
+		filepath.Join(gitDir, "refs", "heads"),
 	}
 
 	for _, dir := range dirs {
 		if err := os.MkdirAll(dir, 0755); err != nil {
-			fmt.Fprintf(os.Stderr, "Error creating directory %s: %s\n", dir, err)
+			return fmt.Errorf("Error creating directory %s: %s", dir, err)
 		}
 	}
 
@@ -46,7 +58,7 @@ func handleInitRepository(basePath string) {
 	headFileContents := []byte("ref: refs/heads/main\n")
 	headFilePath := filepath.Join(gitDir, "HEAD")
 	if err := os.WriteFile(headFilePath, headFileContents, 0644); err != nil {
-		fmt.Fprintf(os.Stderr, "Error writing HEAD file: %s\n", err)
+		return fmt.Errorf("Error writing HEAD file: %s", err)
 	}
 
 	// Create snapshots.json file inside the .nutella directory
@@ -54,10 +66,10 @@ func handleInitRepository(basePath string) {
 	// Initialize with an empty JSON object.
 	initialJSON := []byte("{}")
 	if err := os.WriteFile(snapshotsFilePath, initialJSON, 0644); err != nil {
-		fmt.Fprintf(os.Stderr, "Error writing snapshots.json file: %s\n", err)
+		return fmt.Errorf("Error writing snapshots.json file: %s", err)
 	}
 
-	fmt.Printf("Initialized nutella directory at %s\n", gitDir)
+	return nil
 }
 
 func getBasepath(dbID string) string {
@@ -110,6 +122,45 @@ func NewDatabase(dbPath string, dbID string) (*Database, error) {
 	return db, nil
 }
 
+// OpenDatabase loads the database stored at dbPath, creating an empty one named
+// dbID when no manifest exists yet. Unlike NewDatabase it never prints and never
+// resets an existing .nutella repository or cache, which makes it suitable for
+// embedding.
+func OpenDatabase(dbPath string, dbID string) (*Database, error) {
+	if _, err := os.Stat(filepath.Join(dbPath, "manifest.json")); err == nil {
+		return LoadDatabase(dbPath)
+	}
+
+	if err := os.MkdirAll(dbPath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create db directory: %v", err)
+	}
+
+	db := &Database{
+		manifestPath: filepath.Join(dbPath, "manifest.json"),
+		manifest: DBManifest{
+			DBID:        dbID,
+			Collections: make(map[string]string),
+		},
+		collections: make(map[string]*Collection),
+	}
+	if err := db.SaveManifest(); err != nil {
+		return nil, fmt.Errorf("failed to create new manifest: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dbPath, ".nutella")); os.IsNotExist(err) {
+		if err := initRepository(dbPath); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dbPath, "cache.json")); os.IsNotExist(err) {
+		if _, err := cache.CreateCache(dbPath, []string{}); err != nil {
+			return nil, fmt.Errorf("failed to create cache: %v", err)
+		}
+	}
+
+	return db, nil
+}
+
 func LoadDatabase(dbPath string) (*Database, error) {
 	manifestPath := filepath.Join(dbPath, "manifest.json")
 	data, err := os.ReadFile(manifestPath)
@@ -137,13 +188,21 @@ func LoadDatabase(dbPath string) (*Database, error) {
 
 // CreateCollection creates a subdir for this collection's B-tree
 func (db *Database) CreateCollection(name string, order int) error {
+	if err := db.createCollection(name, order); err != nil {
+		return err
+	}
+
+	return cache.AddCollectionToMemory(db.Path(), name)
+}
+
+func (db *Database) createCollection(name string, order int) error {
 	db.lock.Lock()
+	defer db.lock.Unlock()
 
 	// Check if it already exists
 	if _, exists := db.manifest.Collections[name]; exists {
 		return fmt.Errorf("collection %q already exists", name)
 	}
-
 	// Make a subdirectory for the collection
 	subDir := filepath.Join(filepath.Dir(db.manifestPath), name)
 	if err := os.MkdirAll(subDir, 0755); err != nil {
@@ -163,6 +222,7 @@ func (db *Database) CreateCollection(name string, order int) error {
 		order:   order,
 		btree:   collBT,
 		baseDir: subDir,
+		db:      db,
 	}
 	db.collections[name] = coll
 
@@ -172,11 +232,19 @@ func (db *Database) CreateCollection(name string, order int) error {
 		return fmt.Errorf("failed to save manifest after creating collection: %v", err)
 	}
 
-	db.lock.Unlock()
+	// Logged only once the collection exists, so a failed create is never
+	// replayed.
+	return db.appendWAL(WALRecord{Op: WALCreateCollection, Collection: name, Order: order})
+}
 
-	err = cache.AddCollectionToMemory(getBasepath(db.manifest.DBID), name)
+// Path returns the directory holding the manifest, collections and cache.
+func (db *Database) Path() string {
+	return filepath.Dir(db.manifestPath)
+}
 
-	return err
+// ID returns the database ID recorded in the manifest.
+func (db *Database) ID() string {
+	return db.manifest.DBID
 }
 
 // GetCollection loads (if not already loaded) or returns a handle to the named collection
@@ -207,6 +275,7 @@ func (db *Database) GetCollection(name string) (*Collection, error) {
 		order:   collBT.Order,
 		btree:   collBT,
 		baseDir: filepath.Join(filepath.Dir(db.manifestPath), subDir),
+		db:      db,
 	}
 	db.collections[name] = coll
 
@@ -250,6 +319,37 @@ func (db *Database) LoadManifest() (DBManifest, error) {
 	return m, nil
 }
 
+// Quiesce holds off writes to the database and flushes what is only in
+// memory: the manifest, the metadata of every loaded collection and the
+// cache. Until resume is called the files under Path are a consistent
+// picture of the database, safe to hash or copy. Collections that are not
+// loaded have no writers in this process.
+func (db *Database) Quiesce() (resume func(), err error) {
+	db.lock.Lock()
+	var resumes []func()
+	resume = func() {
+		for i := len(resumes) - 1; i >= 0; i-- {
+			resumes[i]()
+		}
+		db.lock.Unlock()
+	}
+
+	if err := db.SaveManifest(); err != nil {
+		resume()
+		return nil, err
+	}
+	for _, coll := range db.collections {
+		r, err := coll.btree.Quiesce()
+		if err != nil {
+			resume()
+			return nil, fmt.Errorf("failed to quiesce collection %q: %v", coll.name, err)
+		}
+		resumes = append(resumes, r)
+	}
+	resumes = append(resumes, cache.Lock(db.Path()))
+	return resume, nil
+}
+
 // Close closes all loaded collections
 func (db *Database) Close() error {
 	db.lock.Lock()
@@ -278,7 +378,8 @@ func ListDatabases(root string) ([]string, error) {
 
 	var dbIDs []string
 	for _, e := range entries {
-		if !e.IsDir() {
+		// Dot directories are staging areas, such as a restore in progress.
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
 			continue
 		}
 
@@ -0,0 +1,394 @@
+package database
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"db/btree"
+)
+
+// Formats understood by Export and Import.
+const (
+	FormatNDJSON = "ndjson" // one JSON object per line
+	FormatCSV    = "csv"    // a header row, then one row per pair
+	FormatJSON   = "json"   // one JSON array of objects
+)
+
+// progressEvery is how many records pass between calls to a Progress
+// callback.
+const progressEvery = 1000
+
+// ErrUnknownFormat is returned for a format other than ndjson, csv or json.
+var ErrUnknownFormat = errors.New("unknown format")
+
+// ExportOptions controls Export.
+type ExportOptions struct {
+	Format string
+	// KeyColumn and ValueColumn name the fields, or CSV columns, that hold
+	// the key and the value; they default to "key" and "value". A whole
+	// database export adds a "collection" field in front of them.
+	KeyColumn   string
+	ValueColumn string
+	// Progress, if set, is called with the number of records written so far
+	// every thousand records and once at the end.
+	Progress func(records int)
+}
+
+// ImportOptions controls Import.
+type ImportOptions struct {
+	Format      string
+	KeyColumn   string
+	ValueColumn string
+	// Skip passes over the first Skip records without writing them, to resume
+	// an import that stopped after writing that many.
+	Skip int
+	// Progress, if set, is called with the number of records done so far,
+	// skipped ones included, every thousand records and once at the end. All
+	// of them have been written when it is called.
+	Progress func(records int)
+}
+
+// ImportResult counts the records an import went through.
+type ImportResult struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+}
+
+// ValidFormat rejects formats Export and Import do not understand.
+func ValidFormat(format string) error {
+	switch format {
+	case FormatNDJSON, FormatCSV, FormatJSON:
+		return nil
+	}
+	return fmt.Errorf("%w %q: want ndjson, csv or json", ErrUnknownFormat, format)
+}
+
+func columnNames(key, value string) (string, string) {
+	if key == "" {
+		key = "key"
+	}
+	if value == "" {
+		value = "value"
+	}
+	return key, value
+}
+
+// Export writes the pairs of the named collections to w in key order, one
+// collection after another, and returns how many it wrote. With no names it
+// writes every collection, sorted by name, and tags each record with its
+// collection. Each collection is read from a snapshot, so writes made while
+// it is exported do not show up half-way.
+func (db *Database) Export(w io.Writer, collections []string, opts ExportOptions) (int, error) {
+	if err := ValidFormat(opts.Format); err != nil {
+		return 0, err
+	}
+	tagged := len(collections) == 0
+	if tagged {
+		all, err := db.GetAllCollections()
+		if err != nil {
+			return 0, err
+		}
+		sort.Strings(all)
+		collections = all
+	}
+	snaps := make([]*btree.Snapshot, 0, len(collections))
+	defer func() {
+		for _, s := range snaps {
+			s.Release()
+		}
+	}()
+	for _, name := range collections {
+		coll, err := db.GetCollection(name)
+		if err != nil {
+			return 0, err
+		}
+		snaps = append(snaps, coll.Snapshot())
+	}
+
+	keyCol, valueCol := columnNames(opts.KeyColumn, opts.ValueColumn)
+	bw := bufio.NewWriter(w)
+	enc := newRecordWriter(bw, opts.Format, tagged, keyCol, valueCol)
+	count := 0
+	for i, snap := range snaps {
+		var writeErr error
+		err := snap.Scan(func(kv btree.KeyValue) bool {
+			if writeErr = enc.write(collections[i], kv.Key, kv.Value); writeErr != nil {
+				return false
+			}
+			count++
+			if opts.Progress != nil && count%progressEvery == 0 {
+				opts.Progress(count)
+			}
+			return true
+		})
+		if err == nil {
+			err = writeErr
+		}
+		if err != nil {
+			return count, fmt.Errorf("failed to export collection %s: %v", collections[i], err)
+		}
+	}
+	if err := enc.close(); err != nil {
+		return count, err
+	}
+	if err := bw.Flush(); err != nil {
+		return count, err
+	}
+	if opts.Progress != nil {
+		opts.Progress(count)
+	}
+	return count, nil
+}
+
+// recordWriter encodes exported pairs in one of the formats.
+type recordWriter struct {
+	w        *bufio.Writer
+	csv      *csv.Writer
+	format   string
+	tagged   bool
+	keyCol   string
+	valueCol string
+	started  bool
+}
+
+func newRecordWriter(w *bufio.Writer, format string, tagged bool, keyCol, valueCol string) *recordWriter {
+	rw := &recordWriter{w: w, format: format, tagged: tagged, keyCol: keyCol, valueCol: valueCol}
+	if format == FormatCSV {
+		rw.csv = csv.NewWriter(w)
+	}
+	return rw
+}
+
+func (rw *recordWriter) write(collection, key string, value interface{}) error {
+	if rw.format == FormatCSV {
+		if !rw.started {
+			rw.started = true
+			if err := rw.csv.Write(rw.row("collection", rw.keyCol, rw.valueCol)); err != nil {
+				return err
+			}
+		}
+		cell, ok := value.(string)
+		if !ok {
+			data, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			cell = string(data)
+		}
+		return rw.csv.Write(rw.row(collection, key, cell))
+	}
+
+	// Fields are written in a fixed order rather than through a map, which
+	// would sort them by name.
+	var fields []interface{}
+	if rw.tagged {
+		fields = append(fields, "collection", collection)
+	}
+	fields = append(fields, rw.keyCol, key, rw.valueCol, value)
+	obj := []byte{'{'}
+	for i := 0; i < len(fields); i += 2 {
+		name, _ := json.Marshal(fields[i])
+		data, err := json.Marshal(fields[i+1])
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			obj = append(obj, ',')
+		}
+		obj = append(append(append(obj, name...), ':'), data...)
+	}
+	obj = append(obj, '}')
+
+	switch {
+	case rw.format == FormatNDJSON:
+		obj = append(obj, '\n')
+	case !rw.started:
+		obj = append([]byte("[\n"), obj...)
+	default:
+		obj = append([]byte(",\n"), obj...)
+	}
+	rw.started = true
+	_, err := rw.w.Write(obj)
+	return err
+}
+
+func (rw *recordWriter) row(collection, key, value string) []string {
+	if rw.tagged {
+		return []string{collection, key, value}
+	}
+	return []string{key, value}
+}
+
+func (rw *recordWriter) close() error {
+	switch rw.format {
+	case FormatCSV:
+		if !rw.started {
+			if err := rw.csv.Write(rw.row("collection", rw.keyCol, rw.valueCol)); err != nil {
+				return err
+			}
+		}
+		rw.csv.Flush()
+		return rw.csv.Error()
+	case FormatJSON:
+		end := "\n]\n"
+		if !rw.started {
+			end = "[]\n"
+		}
+		_, err := rw.w.WriteString(end)
+		return err
+	}
+	return nil
+}
+
+// Import reads records from r and writes each one's value under its key,
+// replacing any value already there, as it goes; it never holds the whole
+// input in memory. Fields other than the key and value columns, such as the
+// collection of a whole database export, are ignored. CSV values are stored
+// as strings. On error the result still counts the records written, and the
+// error names the record that failed, counting from 1; rerunning with Skip
+// set to the records done resumes after the last one written.
+func (c *Collection) Import(r io.Reader, opts ImportOptions) (*ImportResult, error) {
+	res := &ImportResult{}
+	if err := ValidFormat(opts.Format); err != nil {
+		return res, err
+	}
+	keyCol, valueCol := columnNames(opts.KeyColumn, opts.ValueColumn)
+
+	n := 0
+	apply := func(key string, value interface{}) error {
+		n++
+		if n <= opts.Skip {
+			res.Skipped++
+		} else {
+			if key == "" {
+				return fmt.Errorf("record %d: %s is empty", n, keyCol)
+			}
+			if _, err := c.Update(key, value); err != nil {
+				return fmt.Errorf("record %d: %v", n, err)
+			}
+			res.Imported++
+		}
+		if opts.Progress != nil && n%progressEvery == 0 {
+			opts.Progress(n)
+		}
+		return nil
+	}
+
+	var err error
+	switch opts.Format {
+	case FormatCSV:
+		err = readCSVRecords(r, keyCol, valueCol, apply)
+	default:
+		err = readJSONRecords(r, opts.Format == FormatJSON, func(obj map[string]json.RawMessage) error {
+			key, value, err := decodeRecord(obj, keyCol, valueCol)
+			if err != nil {
+				return fmt.Errorf("record %d: %v", n+1, err)
+			}
+			return apply(key, value)
+		})
+	}
+	if err != nil {
+		return res, err
+	}
+	if opts.Progress != nil {
+		opts.Progress(n)
+	}
+	return res, nil
+}
+
+func readCSVRecords(r io.Reader, keyCol, valueCol string, apply func(string, interface{}) error) error {
+	cr := csv.NewReader(bufio.NewReader(r))
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read CSV header: %v", err)
+	}
+	keyIdx, valueIdx := -1, -1
+	for i, name := range header {
+		switch name {
+		case keyCol:
+			keyIdx = i
+		case valueCol:
+			valueIdx = i
+		}
+	}
+	if keyIdx < 0 || valueIdx < 0 {
+		return fmt.Errorf("CSV header must have %q and %q columns", keyCol, valueCol)
+	}
+
+	for row := 1; ; row++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("record %d: %v", row, err)
+		}
+		if keyIdx >= len(rec) || valueIdx >= len(rec) {
+			return fmt.Errorf("record %d: has %d columns, want at least %d", row, len(rec), max(keyIdx, valueIdx)+1)
+		}
+		if err := apply(rec[keyIdx], rec[valueIdx]); err != nil {
+			return err
+		}
+	}
+}
+
+// readJSONRecords decodes NDJSON, or a JSON array when array is set, one
+// object at a time.
+func readJSONRecords(r io.Reader, array bool, fn func(map[string]json.RawMessage) error) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	if array {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if delim, ok := tok.(json.Delim); err != nil || !ok || delim != '[' {
+			return fmt.Errorf("JSON input must be an array of objects")
+		}
+	}
+	for array && dec.More() || !array {
+		var obj map[string]json.RawMessage
+		err := dec.Decode(&obj)
+		if !array && err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("invalid JSON record: %v", err)
+		}
+		if err := fn(obj); err != nil {
+			return err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return fmt.Errorf("JSON array is not closed: %v", err)
+	}
+	return nil
+}
+
+func decodeRecord(obj map[string]json.RawMessage, keyCol, valueCol string) (string, interface{}, error) {
+	rawKey, ok := obj[keyCol]
+	if !ok {
+		return "", nil, fmt.Errorf("no %q field", keyCol)
+	}
+	var key string
+	if err := json.Unmarshal(rawKey, &key); err != nil {
+		return "", nil, fmt.Errorf("%q must be a string", keyCol)
+	}
+	rawValue, ok := obj[valueCol]
+	if !ok {
+		return "", nil, fmt.Errorf("no %q field", valueCol)
+	}
+	var value interface{}
+	if err := json.Unmarshal(rawValue, &value); err != nil {
+		return "", nil, err
+	}
+	return key, value, nil
+}
@@ -0,0 +1,130 @@
+package database_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"db/btree"
+	"db/database"
+)
+
+// TestExportImportRoundTrip exports a collection in every format, imports
+// each export into a fresh collection and checks that the pairs survive.
+func TestExportImportRoundTrip(t *testing.T) {
+	db, err := database.OpenDatabase(filepath.Join(t.TempDir(), "db_x"), "db_x")
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+	db.CreateCollection("fruits", 3)
+	db.CreateCollection("veg", 3)
+	fruits, _ := db.GetCollection("fruits")
+	want := map[string]interface{}{
+		"apple":  "red",
+		"banana": map[string]interface{}{"color": "yellow", "count": float64(3)},
+		"cherry": "dark, \"sweet\"",
+	}
+	for k, v := range want {
+		fruits.Insert(k, v)
+	}
+	veg, _ := db.GetCollection("veg")
+	veg.Insert("leek", "green")
+
+	pairs := func(c *database.Collection) map[string]interface{} {
+		got := map[string]interface{}{}
+		c.Scan(func(kv btree.KeyValue) bool {
+			got[kv.Key] = kv.Value
+			return true
+		})
+		return got
+	}
+
+	for _, format := range []string{database.FormatNDJSON, database.FormatCSV, database.FormatJSON} {
+		var buf bytes.Buffer
+		opts := database.ExportOptions{Format: format, KeyColumn: "id", ValueColumn: "doc"}
+		if n, err := db.Export(&buf, []string{"fruits"}, opts); err != nil || n != len(want) {
+			t.Fatalf("%s export = %d, %v; want %d records", format, n, err, len(want))
+		}
+
+		name := "copy_" + format
+		db.CreateCollection(name, 3)
+		copied, _ := db.GetCollection(name)
+		res, err := copied.Import(&buf, database.ImportOptions{Format: format, KeyColumn: "id", ValueColumn: "doc"})
+		if err != nil || res.Imported != len(want) {
+			t.Fatalf("%s import = %+v, %v; want %d records", format, res, err, len(want))
+		}
+		expected := want
+		if format == database.FormatCSV {
+			// CSV carries values as text, so the object comes back as its JSON.
+			expected = map[string]interface{}{"apple": "red", "banana": `{"color":"yellow","count":3}`, "cherry": want["cherry"]}
+		}
+		if got := pairs(copied); !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s round trip = %v; want %v", format, got, expected)
+		}
+	}
+
+	var all bytes.Buffer
+	if n, err := db.Export(&all, nil, database.ExportOptions{Format: database.FormatNDJSON}); err != nil || n != len(want)*4+1 {
+		t.Fatalf("whole database export = %d, %v", n, err)
+	}
+	first := strings.SplitN(all.String(), "\n", 2)[0]
+	if first != `{"collection":"copy_csv","key":"apple","value":"red"}` {
+		t.Errorf("first record of a whole database export = %s", first)
+	}
+	var empty bytes.Buffer
+	db.CreateCollection("empty", 3)
+	db.Export(&empty, []string{"empty"}, database.ExportOptions{Format: database.FormatJSON})
+	var arr []interface{}
+	if err := json.Unmarshal(empty.Bytes(), &arr); err != nil || len(arr) != 0 {
+		t.Errorf("JSON export of an empty collection = %q; want an empty array", empty.String())
+	}
+}
+
+// TestImportResume fails an import part-way and resumes it past the records
+// already written.
+func TestImportResume(t *testing.T) {
+	db, err := database.OpenDatabase(filepath.Join(t.TempDir(), "db_x"), "db_x")
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+	db.CreateCollection("fruits", 3)
+	fruits, _ := db.GetCollection("fruits")
+
+	input := `{"key":"a","value":1}
+{"key":"b","value":2}
+{"key":"c"}
+{"key":"d","value":4}
+`
+	res, err := fruits.Import(strings.NewReader(input), database.ImportOptions{Format: database.FormatNDJSON})
+	if err == nil || !strings.Contains(err.Error(), "record 3") || res.Imported != 2 {
+		t.Fatalf("import with a bad third record = %+v, %v; want 2 imported and an error for record 3", res, err)
+	}
+
+	fixed := strings.Replace(input, `{"key":"c"}`, `{"key":"c","value":3}`, 1)
+	var progress []int
+	res, err = fruits.Import(strings.NewReader(fixed), database.ImportOptions{
+		Format:   database.FormatNDJSON,
+		Skip:     res.Imported,
+		Progress: func(n int) { progress = append(progress, n) },
+	})
+	if err != nil || res.Skipped != 2 || res.Imported != 2 {
+		t.Fatalf("resumed import = %+v, %v; want 2 skipped and 2 imported", res, err)
+	}
+	if len(progress) == 0 || progress[len(progress)-1] != 4 {
+		t.Errorf("progress = %v; want it to end at 4", progress)
+	}
+	for key, want := range map[string]float64{"a": 1, "c": 3, "d": 4} {
+		if got, found, _ := fruits.Find(key); !found || got != want {
+			t.Errorf("%s = %v, %v; want %v", key, got, found, want)
+		}
+	}
+
+	if _, err := fruits.Import(strings.NewReader("name,age\nx,1\n"), database.ImportOptions{Format: database.FormatCSV}); err == nil {
+		t.Errorf("CSV import without key and value columns succeeded")
+	}
+}
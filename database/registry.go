@@ -0,0 +1,305 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrRegistryClosed is returned by Acquire and Create after Close.
+var ErrRegistryClosed = errors.New("database registry is closed")
+
+// Registry shares open Database handles between concurrent users of the
+// databases stored under one root directory. Handles are reference counted;
+// one that nobody holds for longer than the idle timeout is closed, and an
+// invalidated or replaced one is dropped so the next Acquire reloads it from
+// disk.
+type Registry struct {
+	root string
+	idle time.Duration
+
+	mu      sync.Mutex
+	cond    *sync.Cond // signalled when a reference is released or a Replace ends
+	entries map[string]*registryEntry
+	// replacing holds the databases whose files a Replace is rewriting;
+	// Acquire waits for them.
+	replacing map[string]bool
+	hooks     []func(dbID string)
+	closed    bool
+	stop      chan struct{}
+}
+
+type registryEntry struct {
+	db       *Database
+	refs     int
+	lastUsed time.Time
+}
+
+// NewRegistry returns a registry for the databases under root (usually
+// ./files). With a positive idleTimeout a background goroutine closes handles
+// that have been unused for that long; Close stops it.
+func NewRegistry(root string, idleTimeout time.Duration) *Registry {
+	r := &Registry{
+		root:      root,
+		idle:      idleTimeout,
+		entries:   map[string]*registryEntry{},
+		replacing: map[string]bool{},
+		stop:      make(chan struct{}),
+	}
+	r.cond = sync.NewCond(&r.mu)
+	if idleTimeout > 0 {
+		go r.evictLoop()
+	}
+	return r
+}
+
+// Root returns the directory the registry serves databases from.
+func (r *Registry) Root() string {
+	return r.root
+}
+
+// Path returns the directory of database dbID.
+func (r *Registry) Path(dbID string) string {
+	return filepath.Join(r.root, dbID)
+}
+
+// ValidDBID rejects IDs that are empty or would escape the data root.
+func ValidDBID(dbID string) error {
+	if dbID == "" || dbID == "." || dbID == ".." || strings.ContainsAny(dbID, `/\`) {
+		return fmt.Errorf("invalid database ID %q", dbID)
+	}
+	return nil
+}
+
+// Acquire returns the shared handle for dbID, loading it on first use. The
+// caller must call release exactly once when done with the handle. While a
+// Replace of dbID runs, Acquire waits for it to finish.
+func (r *Registry) Acquire(dbID string) (*Database, func(), error) {
+	if err := ValidDBID(dbID); err != nil {
+		return nil, nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for r.replacing[dbID] && !r.closed {
+		r.cond.Wait()
+	}
+	if r.closed {
+		return nil, nil, ErrRegistryClosed
+	}
+
+	e, ok := r.entries[dbID]
+	if !ok {
+		// Loading under the lock keeps two requests from opening the same
+		// database twice.
+		db, err := LoadDatabase(r.Path(dbID))
+		if err != nil {
+			return nil, nil, err
+		}
+		e = &registryEntry{db: db}
+		r.entries[dbID] = e
+	}
+	return e.db, r.acquire(e), nil
+}
+
+// Create makes a new database with a generated db_xxxxxxxx ID and returns it
+// already acquired.
+func (r *Registry) Create() (string, *Database, func(), error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return "", nil, nil, ErrRegistryClosed
+	}
+
+	var dbID string
+	for {
+		dbUUID, err := uuid.NewRandom()
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("failed to generate uuid: %v", err)
+		}
+		dbID = fmt.Sprintf("db_%s", strings.Split(dbUUID.String(), "-")[0])
+		if _, err := os.Stat(r.Path(dbID)); os.IsNotExist(err) {
+			break
+		}
+	}
+
+	db, err := OpenDatabase(r.Path(dbID), dbID)
+	if err != nil {
+		return dbID, nil, nil, err
+	}
+	e := &registryEntry{db: db}
+	r.entries[dbID] = e
+	return dbID, db, r.acquire(e), nil
+}
+
+// acquire takes a reference on e. r.mu must be held.
+func (r *Registry) acquire(e *registryEntry) func() {
+	e.refs++
+	var once sync.Once
+	return func() {
+		once.Do(func() { r.release(e) })
+	}
+}
+
+func (r *Registry) release(e *registryEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e.refs--
+	e.lastUsed = time.Now()
+	r.cond.Broadcast()
+}
+
+// Replace runs replace, which rewrites the files of dbID on disk, such as a
+// restore or checkout, while nobody holds the database. It holds off new
+// Acquires, waits for current holders to release the handle, then flushes and
+// closes it, so pending writes reach the disk before replace runs and nothing
+// cached can be written over the new files afterwards. The next Acquire loads
+// the replaced database. Hooks registered with OnInvalidate run once replace
+// returns, whether or not it failed, since it may have changed some files.
+// The caller must not hold dbID itself.
+func (r *Registry) Replace(dbID string, replace func() error) error {
+	if err := ValidDBID(dbID); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	for r.replacing[dbID] && !r.closed {
+		r.cond.Wait()
+	}
+	if r.closed {
+		r.mu.Unlock()
+		return ErrRegistryClosed
+	}
+	r.replacing[dbID] = true
+	for {
+		e, ok := r.entries[dbID]
+		if !ok || e.refs == 0 {
+			break
+		}
+		r.cond.Wait()
+	}
+	var closeErr error
+	if r.closed {
+		// Close flushed the handle, and the server is going away.
+		closeErr = ErrRegistryClosed
+	} else if e, ok := r.entries[dbID]; ok {
+		delete(r.entries, dbID)
+		closeErr = e.db.Close()
+	}
+	r.mu.Unlock()
+
+	err := closeErr
+	if err == nil {
+		err = replace()
+	}
+
+	r.mu.Lock()
+	delete(r.replacing, dbID)
+	hooks := append([]func(string){}, r.hooks...)
+	r.cond.Broadcast()
+	r.mu.Unlock()
+	if closeErr == nil {
+		for _, hook := range hooks {
+			hook(dbID)
+		}
+	}
+	return err
+}
+
+// Invalidate forgets the handle for dbID because its files were replaced on
+// disk, for example by a restore. The old handle is dropped without flushing,
+// since writing it back would clobber the restored files; holders may finish
+// with it, and the next Acquire loads a fresh one. Hooks registered with
+// OnInvalidate run after the handle is dropped.
+func (r *Registry) Invalidate(dbID string) {
+	r.mu.Lock()
+	delete(r.entries, dbID)
+	hooks := append([]func(string){}, r.hooks...)
+	r.mu.Unlock()
+
+	for _, hook := range hooks {
+		hook(dbID)
+	}
+}
+
+// OnInvalidate registers fn to run whenever a database is invalidated.
+func (r *Registry) OnInvalidate(fn func(dbID string)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hooks = append(r.hooks, fn)
+}
+
+// Len reports how many handles are loaded.
+func (r *Registry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.entries)
+}
+
+// EvictIdle closes handles that nobody holds and that were last used before
+// cutoff. It returns the first Close error. The lock is held while closing so
+// a concurrent Acquire cannot load the database while it is being flushed.
+func (r *Registry) EvictIdle(cutoff time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var victims []*Database
+	for dbID, e := range r.entries {
+		if e.refs == 0 && e.lastUsed.Before(cutoff) {
+			victims = append(victims, e.db)
+			delete(r.entries, dbID)
+		}
+	}
+	return closeAll(victims)
+}
+
+func (r *Registry) evictLoop() {
+	ticker := time.NewTicker(r.idle / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case now := <-ticker.C:
+			if err := r.EvictIdle(now.Add(-r.idle)); err != nil {
+				fmt.Fprintf(os.Stderr, "Error evicting idle database: %v\n", err)
+			}
+		}
+	}
+}
+
+// Close stops eviction and closes every loaded handle, whether or not it is
+// still referenced. Callers should drain their users first.
+func (r *Registry) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	close(r.stop)
+	r.cond.Broadcast()
+
+	var all []*Database
+	for dbID, e := range r.entries {
+		all = append(all, e.db)
+		delete(r.entries, dbID)
+	}
+	return closeAll(all)
+}
+
+func closeAll(dbs []*Database) error {
+	var firstErr error
+	for _, db := range dbs {
+		if err := db.Close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed closing database %q: %v", db.ID(), err)
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,156 @@
+package database_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"db/database"
+)
+
+func TestRegistrySharesAndEvictsHandles(t *testing.T) {
+	reg := database.NewRegistry(t.TempDir(), 0)
+	defer reg.Close()
+
+	dbID, created, release, err := reg.Create()
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	release()
+
+	// Concurrent acquirers must all get the one shared handle.
+	var wg sync.WaitGroup
+	handles := make([]*database.Database, 16)
+	for i := range handles {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			db, release, err := reg.Acquire(dbID)
+			if err != nil {
+				t.Errorf("Failed to acquire database: %v", err)
+				return
+			}
+			defer release()
+			handles[i] = db
+		}(i)
+	}
+	wg.Wait()
+	for _, db := range handles {
+		if db != created {
+			t.Fatalf("Acquire returned a second handle for %s", dbID)
+		}
+	}
+
+	var invalidated []string
+	reg.OnInvalidate(func(id string) { invalidated = append(invalidated, id) })
+	reg.Invalidate(dbID)
+	if len(invalidated) != 1 || invalidated[0] != dbID {
+		t.Errorf("invalidation hooks saw %v; want [%s]", invalidated, dbID)
+	}
+	reloaded, release, err := reg.Acquire(dbID)
+	if err != nil {
+		t.Fatalf("Failed to reacquire database: %v", err)
+	}
+	if reloaded == created {
+		t.Errorf("Acquire after Invalidate returned the stale handle")
+	}
+
+	// A held handle survives eviction; a released one does not.
+	if err := reg.EvictIdle(time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to evict: %v", err)
+	}
+	if reg.Len() != 1 {
+		t.Errorf("held handle was evicted")
+	}
+	release()
+	if err := reg.EvictIdle(time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to evict: %v", err)
+	}
+	if reg.Len() != 0 {
+		t.Errorf("idle handle was not evicted")
+	}
+
+	if _, _, err := reg.Acquire("../" + dbID); err == nil {
+		t.Errorf("Acquire accepted a path outside the root")
+	}
+}
+
+// TestRegistryReplaceWaitsForHolders checks that Replace runs only once the
+// handle is released and flushed, and that Acquire waits for it.
+func TestRegistryReplaceWaitsForHolders(t *testing.T) {
+	reg := database.NewRegistry(t.TempDir(), 0)
+	defer reg.Close()
+
+	dbID, db, release, err := reg.Create()
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	if err := db.CreateCollection("c", 3); err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+
+	started := make(chan struct{})
+	replaced := make(chan error)
+	var lost bool
+	go func() {
+		close(started)
+		replaced <- reg.Replace(dbID, func() error {
+			// The handle must be closed, and its writes on disk, by now.
+			loaded, err := database.LoadDatabase(reg.Path(dbID))
+			if err != nil {
+				return err
+			}
+			defer loaded.Close()
+			names, _ := loaded.GetAllCollections()
+			lost = len(names) != 1
+			return nil
+		})
+	}()
+	<-started
+	select {
+	case err := <-replaced:
+		t.Fatalf("Replace returned %v while the handle was held", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	if err := <-replaced; err != nil {
+		t.Fatalf("Replace = %v", err)
+	}
+	if lost {
+		t.Errorf("replace saw the database without the collection its holder created")
+	}
+
+	reloaded, release, err := reg.Acquire(dbID)
+	if err != nil {
+		t.Fatalf("Failed to reacquire database: %v", err)
+	}
+	if reloaded == db {
+		t.Errorf("Acquire after Replace returned the closed handle")
+	}
+
+	// Acquire must wait while a Replace runs.
+	release()
+	inside := make(chan struct{})
+	finish := make(chan struct{})
+	go reg.Replace(dbID, func() error {
+		close(inside)
+		<-finish
+		return nil
+	})
+	<-inside
+	acquired := make(chan struct{})
+	go func() {
+		_, release, err := reg.Acquire(dbID)
+		if err == nil {
+			release()
+		}
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Errorf("Acquire returned while Replace was rewriting the files")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(finish)
+	<-acquired
+}
@@ -0,0 +1,492 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// walDirName is the directory inside a database that holds its write-ahead
+// log. The log is kept only while the directory exists.
+const walDirName = ".wal"
+
+// walSegmentBytes is the size after which the log moves on to a new segment.
+const walSegmentBytes = 64 << 20
+
+// Operations recorded in the write-ahead log.
+const (
+	WALCreateCollection = "create-collection"
+	WALInsert           = "insert"
+	WALUpdate           = "update"
+	WALDelete           = "delete"
+)
+
+// ErrWALCorrupt is returned when a write-ahead log record that is not the
+// torn tail of the last segment fails its checksum, or records are missing.
+var ErrWALCorrupt = errors.New("write-ahead log is corrupt")
+
+// WALRecord is one write as the log stores it. Seq numbers every record of a
+// log from 1 without gaps; Time is when the write was made, in UTC.
+type WALRecord struct {
+	Seq        uint64      `json:"seq"`
+	Time       time.Time   `json:"time"`
+	Op         string      `json:"op"`
+	Collection string      `json:"collection"`
+	Key        string      `json:"key,omitempty"`
+	Value      interface{} `json:"value"`
+	Order      int         `json:"order,omitempty"`
+}
+
+// WALInfo summarizes a write-ahead log.
+type WALInfo struct {
+	ID        string    `json:"id"`
+	Segments  int       `json:"segments"`
+	Bytes     int64     `json:"bytes"`
+	Records   int       `json:"records"`
+	FirstSeq  uint64    `json:"first_seq,omitempty"`
+	LastSeq   uint64    `json:"last_seq,omitempty"`
+	FirstTime time.Time `json:"first_time,omitempty"`
+	LastTime  time.Time `json:"last_time,omitempty"`
+}
+
+// A log is a directory of segments plus an id file naming the log, so that a
+// backup is never replayed against a log started afresh. Segments are named
+// after the sequence number of their first record, zero padded to 20 digits,
+// and hold one record per line as "<crc32 of the JSON in hex> <JSON>".
+type wal struct {
+	mu   sync.Mutex
+	dir  string
+	id   string
+	f    *os.File
+	size int64
+	next uint64
+}
+
+// Open logs, by directory, shared by every handle on a database in this
+// process so that sequence numbers are handed out once.
+var (
+	walsMu sync.Mutex
+	wals   = map[string]*wal{}
+)
+
+// WALDir returns the write-ahead log directory of the database at dbPath.
+func WALDir(dbPath string) string {
+	return filepath.Join(dbPath, walDirName)
+}
+
+// EnableWAL starts logging every write to the database at dbPath. Enabling
+// it again is a no-op.
+func EnableWAL(dbPath string) error {
+	dir := WALDir(dbPath)
+	if _, err := os.Stat(filepath.Join(dir, "id")); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create write-ahead log: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "id"), []byte(uuid.NewString()+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to create write-ahead log: %v", err)
+	}
+	return nil
+}
+
+// DisableWAL stops logging writes to the database at dbPath and deletes its
+// log.
+func DisableWAL(dbPath string) error {
+	walsMu.Lock()
+	defer walsMu.Unlock()
+	dir := WALDir(dbPath)
+	if w, ok := wals[walKey(dir)]; ok {
+		w.close()
+		delete(wals, walKey(dir))
+	}
+	return os.RemoveAll(dir)
+}
+
+func walKey(dir string) string {
+	if abs, err := filepath.Abs(dir); err == nil {
+		return abs
+	}
+	return filepath.Clean(dir)
+}
+
+// openLog returns the log of the database at dbPath, or nil when it has
+// none. It checks for the directory on every call so that enabling or
+// removing the log takes effect without reopening the database.
+func openLog(dbPath string) (*wal, error) {
+	dir := WALDir(dbPath)
+	_, statErr := os.Stat(dir)
+
+	walsMu.Lock()
+	defer walsMu.Unlock()
+	key := walKey(dir)
+	w := wals[key]
+	if statErr != nil {
+		if w != nil {
+			w.close()
+			delete(wals, key)
+		}
+		if os.IsNotExist(statErr) {
+			return nil, nil
+		}
+		return nil, statErr
+	}
+	if w == nil {
+		var err error
+		if w, err = openWAL(dir); err != nil {
+			return nil, fmt.Errorf("failed to open write-ahead log: %v", err)
+		}
+		wals[key] = w
+	}
+	return w, nil
+}
+
+func readWALID(dir string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "id"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func segmentPath(dir string, first uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d.log", first))
+}
+
+// walSegments returns the first sequence numbers of the segments in dir in
+// ascending order.
+func walSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var firsts []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, ".log"), 10, 64)
+		if err != nil {
+			continue
+		}
+		firsts = append(firsts, first)
+	}
+	sort.Slice(firsts, func(i, j int) bool { return firsts[i] < firsts[j] })
+	return firsts, nil
+}
+
+// openWAL opens the log in dir for appending. A last record that was only
+// partly written when the process died is cut off.
+func openWAL(dir string) (*wal, error) {
+	id, err := readWALID(dir)
+	if err != nil {
+		return nil, err
+	}
+	w := &wal{dir: dir, id: id, next: 1}
+	firsts, err := walSegments(dir)
+	if err != nil || len(firsts) == 0 {
+		return w, err
+	}
+
+	last := firsts[len(firsts)-1]
+	path := segmentPath(dir, last)
+	next, good, err := scanSegment(path, last, true, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Truncate(path, good); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w.f, w.size, w.next = f, good, next
+	return w, nil
+}
+
+// scanSegment reads the segment at path, whose first record is first, and
+// calls fn for each record until fn returns false. It returns the sequence
+// number after the last intact record and the offset where that record
+// ends. When tail is set a damaged record ends the scan, as a crash leaves
+// one at the end of the last segment; otherwise it is ErrWALCorrupt.
+func scanSegment(path string, first uint64, tail bool, fn func(WALRecord) (bool, error)) (uint64, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	next, offset := first, int64(0)
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return next, offset, nil
+		}
+		if err != nil && err != io.EOF {
+			return 0, 0, err
+		}
+		rec, ok := decodeWALLine(line)
+		if !ok || rec.Seq != next {
+			if tail {
+				return next, offset, nil
+			}
+			return 0, 0, fmt.Errorf("%s: record %d: %w", filepath.Base(path), next, ErrWALCorrupt)
+		}
+		next++
+		offset += int64(len(line))
+		if fn != nil {
+			more, err := fn(rec)
+			if err != nil || !more {
+				return next, offset, err
+			}
+		}
+	}
+}
+
+func encodeWALLine(rec *WALRecord) ([]byte, error) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(data), data)), nil
+}
+
+func decodeWALLine(line []byte) (WALRecord, bool) {
+	var rec WALRecord
+	if len(line) < 10 || line[len(line)-1] != '\n' || line[8] != ' ' {
+		return rec, false
+	}
+	sum, err := strconv.ParseUint(string(line[:8]), 16, 32)
+	if err != nil {
+		return rec, false
+	}
+	data := bytes.TrimSuffix(line[9:], []byte("\n"))
+	if crc32.ChecksumIEEE(data) != uint32(sum) {
+		return rec, false
+	}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return rec, false
+	}
+	return rec, true
+}
+
+// append numbers, stamps and durably logs rec.
+func (w *wal) append(rec *WALRecord) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.appendLocked(rec)
+}
+
+// appendLocked is append for a caller that holds w.mu.
+func (w *wal) appendLocked(rec *WALRecord) error {
+	rec.Seq = w.next
+	rec.Time = time.Now().UTC()
+	line, err := encodeWALLine(rec)
+	if err != nil {
+		return fmt.Errorf("failed to encode write-ahead log record: %v", err)
+	}
+	if w.f == nil || w.size >= walSegmentBytes {
+		if err := w.startSegment(); err != nil {
+			return err
+		}
+	}
+	if _, err := w.f.Write(line); err != nil {
+		return fmt.Errorf("failed to write write-ahead log: %v", err)
+	}
+	if err := w.f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync write-ahead log: %v", err)
+	}
+	w.size += int64(len(line))
+	w.next++
+	return nil
+}
+
+// rotate starts a new segment and returns the sequence number of the last
+// record before it.
+func (w *wal) rotate() (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.startSegment(); err != nil {
+		return 0, err
+	}
+	return w.next - 1, nil
+}
+
+// startSegment closes the current segment and opens the one whose first
+// record will be w.next.
+func (w *wal) startSegment() error {
+	if w.f != nil {
+		w.f.Close()
+		w.f = nil
+	}
+	f, err := os.OpenFile(segmentPath(w.dir, w.next), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create write-ahead log segment: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f, w.size = f, info.Size()
+	return nil
+}
+
+func (w *wal) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f != nil {
+		w.f.Close()
+		w.f = nil
+	}
+}
+
+// ReadWAL calls fn for every record in the log directory dir with a sequence
+// number above after, in order, until fn returns false. The log must still
+// hold record after+1 if it holds any later one.
+func ReadWAL(dir string, after uint64, fn func(WALRecord) (bool, error)) error {
+	firsts, err := walSegments(dir)
+	if err != nil {
+		return err
+	}
+	start := 0
+	for i, first := range firsts {
+		if first <= after+1 {
+			start = i
+		}
+	}
+	if len(firsts) > 0 && firsts[start] > after+1 {
+		return fmt.Errorf("log starts at record %d, after record %d is needed: %w", firsts[start], after+1, ErrWALCorrupt)
+	}
+
+	stopped := false
+	for i := start; i < len(firsts) && !stopped; i++ {
+		last := i == len(firsts)-1
+		next, _, err := scanSegment(segmentPath(dir, firsts[i]), firsts[i], last, func(rec WALRecord) (bool, error) {
+			if rec.Seq <= after {
+				return true, nil
+			}
+			more, err := fn(rec)
+			stopped = !more
+			return more, err
+		})
+		if err != nil {
+			return err
+		}
+		if !last && !stopped && next != firsts[i+1] {
+			return fmt.Errorf("segment %d ends at record %d, the next starts at %d: %w", firsts[i], next, firsts[i+1], ErrWALCorrupt)
+		}
+	}
+	return nil
+}
+
+// StatWAL summarizes the write-ahead log of the database at dbPath.
+func StatWAL(dbPath string) (*WALInfo, error) {
+	dir := WALDir(dbPath)
+	id, err := readWALID(dir)
+	if err != nil {
+		return nil, err
+	}
+	info := &WALInfo{ID: id}
+	firsts, err := walSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	info.Segments = len(firsts)
+	for _, first := range firsts {
+		if st, err := os.Stat(segmentPath(dir, first)); err == nil {
+			info.Bytes += st.Size()
+		}
+	}
+	if len(firsts) == 0 {
+		return info, nil
+	}
+	err = ReadWAL(dir, firsts[0]-1, func(rec WALRecord) (bool, error) {
+		if info.Records == 0 {
+			info.FirstSeq, info.FirstTime = rec.Seq, rec.Time
+		}
+		info.Records++
+		info.LastSeq, info.LastTime = rec.Seq, rec.Time
+		return true, nil
+	})
+	return info, err
+}
+
+// appendWAL logs rec if the database keeps a write-ahead log. The caller
+// holds db.lock, so Quiesce sees either both the record and the write or
+// neither.
+func (db *Database) appendWAL(rec WALRecord) error {
+	w, err := openLog(db.Path())
+	if err != nil || w == nil {
+		return err
+	}
+	return w.append(&rec)
+}
+
+// logWrite runs apply and logs rec once it has succeeded, so that a write
+// which failed is never replayed. While the database keeps a log, writes are
+// applied and logged one at a time to keep the log in the order they were
+// made, and Quiesce is held off until both are done.
+func (db *Database) logWrite(rec WALRecord, apply func() error) error {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	w, err := openLog(db.Path())
+	if err != nil {
+		return err
+	}
+	if w == nil {
+		return apply()
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := apply(); err != nil {
+		return err
+	}
+	return w.appendLocked(&rec)
+}
+
+// Replay applies a logged write. Replaying a write that is already in the
+// database changes nothing: inserts overwrite, deleting a missing key and
+// creating an existing collection are no-ops.
+func (db *Database) Replay(rec WALRecord) error {
+	if rec.Op == WALCreateCollection {
+		db.lock.RLock()
+		_, exists := db.manifest.Collections[rec.Collection]
+		db.lock.RUnlock()
+		if exists {
+			return nil
+		}
+		return db.CreateCollection(rec.Collection, rec.Order)
+	}
+
+	coll, err := db.GetCollection(rec.Collection)
+	if err != nil {
+		return err
+	}
+	switch rec.Op {
+	case WALInsert, WALUpdate:
+		_, err = coll.Update(rec.Key, rec.Value)
+	case WALDelete:
+		_, err = coll.Delete(rec.Key)
+	default:
+		err = fmt.Errorf("record %d: unknown operation %q", rec.Seq, rec.Op)
+	}
+	return err
+}
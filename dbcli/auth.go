@@ -0,0 +1,181 @@
+package dbcli
+
+import (
+	"db/auth"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var tokenTTL time.Duration
+
+func openAuthStore() *auth.Store {
+	store, err := auth.Open(auth.DefaultPath(filepath.Join(".", "files")))
+	if err != nil {
+		log.Fatalf("Error opening auth store: %v", err)
+	}
+	return store
+}
+
+// Commands to manage server users and their per-database roles
+var userCmd = &cobra.Command{
+	Use:   "user",
+	Short: "Manage server users and their roles",
+	Long: "Manage the users the HTTP server accepts. Authentication is enforced as soon as the first user exists.\n" +
+		"Roles are read, write, admin and version-control; grant them on a dbID or on '*' for every database.",
+}
+
+var userAddCmd = &cobra.Command{
+	Use:   "add [name]",
+	Short: "Add a user",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := openAuthStore().AddUser(args[0]); err != nil {
+			log.Fatalf("Error adding user: %v", err)
+		}
+		fmt.Printf("User '%s' added.\n", args[0])
+	},
+}
+
+var userRemoveCmd = &cobra.Command{
+	Use:   "remove [name]",
+	Short: "Remove a user and all of its keys",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := openAuthStore().RemoveUser(args[0]); err != nil {
+			log.Fatalf("Error removing user '%s': %v", args[0], err)
+		}
+		fmt.Printf("User '%s' removed.\n", args[0])
+	},
+}
+
+var userListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List users, their grants and key IDs",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		for _, u := range openAuthStore().Users() {
+			scopes := make([]string, 0, len(u.Grants))
+			for scope := range u.Grants {
+				scopes = append(scopes, scope)
+			}
+			sort.Strings(scopes)
+
+			var grants []string
+			for _, scope := range scopes {
+				roles := make([]string, len(u.Grants[scope]))
+				for i, r := range u.Grants[scope] {
+					roles[i] = string(r)
+				}
+				grants = append(grants, fmt.Sprintf("%s=%s", scope, strings.Join(roles, ",")))
+			}
+			fmt.Printf("%s\tgrants: %s\tkeys: %d\n", u.Name, strings.Join(grants, " "), len(u.Keys))
+		}
+	},
+}
+
+var userGrantCmd = &cobra.Command{
+	Use:   "grant [name] [dbID|*] [role]",
+	Short: "Grant a role on a database",
+	Args:  cobra.ExactArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		role, err := auth.ParseRole(args[2])
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := openAuthStore().Grant(args[0], args[1], role); err != nil {
+			log.Fatalf("Error granting role: %v", err)
+		}
+		fmt.Printf("Granted '%s' on '%s' to '%s'.\n", role, args[1], args[0])
+	},
+}
+
+var userRevokeCmd = &cobra.Command{
+	Use:   "revoke [name] [dbID|*] [role]",
+	Short: "Revoke a role on a database, or every role when none is given",
+	Args:  cobra.RangeArgs(2, 3),
+	Run: func(cmd *cobra.Command, args []string) {
+		var role auth.Role
+		if len(args) == 3 {
+			r, err := auth.ParseRole(args[2])
+			if err != nil {
+				log.Fatal(err)
+			}
+			role = r
+		}
+		if err := openAuthStore().Revoke(args[0], args[1], role); err != nil {
+			log.Fatalf("Error revoking role: %v", err)
+		}
+		fmt.Printf("Revoked access on '%s' from '%s'.\n", args[1], args[0])
+	},
+}
+
+// Commands to manage API keys
+var keyCmd = &cobra.Command{
+	Use:   "key",
+	Short: "Manage API keys for server users",
+}
+
+var keyCreateCmd = &cobra.Command{
+	Use:   "create [user]",
+	Short: "Create an API key; it is printed once and only its hash is stored",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		token, key, err := openAuthStore().CreateKey(args[0])
+		if err != nil {
+			log.Fatalf("Error creating key: %v", err)
+		}
+		fmt.Printf("Key ID: %s\n", key.ID)
+		fmt.Printf("API key: %s\n", token)
+		fmt.Println("Store this key now; it cannot be shown again.")
+	},
+}
+
+var keyListCmd = &cobra.Command{
+	Use:   "list [user]",
+	Short: "List a user's API key IDs",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		for _, u := range openAuthStore().Users() {
+			if u.Name != args[0] {
+				continue
+			}
+			for _, k := range u.Keys {
+				fmt.Printf("%s\tcreated %s\n", k.ID, k.Created)
+			}
+			return
+		}
+		log.Fatalf("Error listing keys: %v", auth.ErrUnknownUser)
+	},
+}
+
+var keyRevokeCmd = &cobra.Command{
+	Use:   "revoke [user] [keyID]",
+	Short: "Revoke an API key",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := openAuthStore().RevokeKey(args[0], args[1]); err != nil {
+			log.Fatalf("Error revoking key: %v", err)
+		}
+		fmt.Printf("Key '%s' revoked.\n", args[1])
+	},
+}
+
+// Command to issue JWT bearer tokens
+var tokenCmd = &cobra.Command{
+	Use:   "token [user]",
+	Short: "Issue a signed JWT bearer token for a user",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		token, err := openAuthStore().IssueToken(args[0], tokenTTL)
+		if err != nil {
+			log.Fatalf("Error issuing token: %v", err)
+		}
+		fmt.Println(token)
+	},
+}
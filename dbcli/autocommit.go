@@ -0,0 +1,295 @@
+package dbcli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"db/database"
+)
+
+// Retention says how many auto-commit snapshots to keep: the newest one in
+// each of the last Hourly hours, Daily days and Weekly ISO weeks that have
+// any. A snapshot kept by one rule is kept whatever the others say, the
+// newest auto snapshot is always kept, and snapshots made by hand are never
+// pruned. The zero value keeps everything.
+type Retention struct {
+	Hourly int
+	Daily  int
+	Weekly int
+}
+
+func (r Retention) enabled() bool {
+	return r.Hourly > 0 || r.Daily > 0 || r.Weekly > 0
+}
+
+// retentionBuckets maps a timestamp to its hour, day and ISO week.
+var retentionBuckets = []func(t time.Time) string{
+	func(t time.Time) string { return t.Format("2006-01-02T15") },
+	func(t time.Time) string { return t.Format("2006-01-02") },
+	func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	},
+}
+
+// PruneSnapshots applies r to the auto snapshots in
+// <basePath>/.nutella/snapshots.json and returns the ones it removed, oldest
+// first. Only the snapshot index is pruned; the commits stay in the branch
+// history.
+func PruneSnapshots(basePath string, r Retention) ([]SnapshotEntry, error) {
+	if !r.enabled() {
+		return nil, nil
+	}
+	snapshots, err := LoadSnapshotsFrom(basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var auto []SnapshotEntry
+	times := make(map[string]time.Time)
+	for _, e := range SortSnapshots(snapshots) {
+		if !e.Snapshot.Auto {
+			continue
+		}
+		// A snapshot whose age is unknown cannot be bucketed; keep it.
+		t, err := time.Parse(time.RFC3339, e.Snapshot.Timestamp)
+		if err != nil {
+			continue
+		}
+		auto = append(auto, e)
+		times[e.Key] = t
+	}
+	if len(auto) == 0 {
+		return nil, nil
+	}
+
+	keep := map[string]bool{auto[len(auto)-1].Key: true}
+	for i, limit := range []int{r.Hourly, r.Daily, r.Weekly} {
+		bucket := retentionBuckets[i]
+		last, kept := "", 0
+		for j := len(auto) - 1; j >= 0 && kept < limit; j-- {
+			if b := bucket(times[auto[j].Key]); b != last {
+				keep[auto[j].Key] = true
+				last = b
+				kept++
+			}
+		}
+	}
+
+	var pruned []SnapshotEntry
+	for _, e := range auto {
+		if !keep[e.Key] {
+			delete(snapshots, e.Key)
+			pruned = append(pruned, e)
+		}
+	}
+	if len(pruned) == 0 {
+		return nil, nil
+	}
+	if err := writeSnapshots(basePath, snapshots); err != nil {
+		return nil, err
+	}
+	return pruned, nil
+}
+
+// AutoCommit commits the working tree of the repository at basePath with
+// message like CommitWorkingTree, recording the snapshot as automatic.
+// Nothing is committed, and the returned commit is nil, when the tree
+// matches HEAD's or a merge is in progress, so a policy can call it as often
+// as it likes.
+func AutoCommit(basePath, message string, db *database.Database) (*Commit, error) {
+	commitMu.Lock()
+	defer commitMu.Unlock()
+
+	if mergeHead, _, err := readMergeState(basePath); err != nil || mergeHead != "" {
+		return nil, err
+	}
+	treeSha, err := hashWorkingTree(basePath, db)
+	if err != nil {
+		return nil, err
+	}
+	_, head, err := readHead(basePath)
+	if err != nil {
+		return nil, err
+	}
+	if head != "" {
+		headTree, err := readCommitTree(basePath, head)
+		if err != nil {
+			return nil, err
+		}
+		if headTree == treeSha {
+			return nil, nil
+		}
+	}
+	return commitTree(basePath, treeSha, message, defaultIdentity(), true)
+}
+
+// AutoCommitPolicy says when the server commits a database on its own.
+type AutoCommitPolicy struct {
+	Interval          time.Duration // commit databases written to since their last auto-commit this often; 0 disables
+	Writes            int           // commit a database after this many writes; 0 disables
+	BeforeDestructive bool          // commit before a restore or checkout replaces the working tree
+	Retention         Retention     // auto snapshots to keep after each auto-commit
+}
+
+// Enabled reports whether the policy ever commits.
+func (p AutoCommitPolicy) Enabled() bool {
+	return p.Interval > 0 || p.Writes > 0 || p.BeforeDestructive
+}
+
+// AutoCommitter applies an AutoCommitPolicy to the databases of a registry. Callers report writes with Wrote and destructive operations with
+// BeforeDestructive; databases without a repository are skipped. A nil
+// *AutoCommitter does nothing, so callers need not check whether auto-commit
+// is configured.
+type AutoCommitter struct {
+	registry *database.Registry
+	policy   AutoCommitPolicy
+	logf     func(format string, args ...interface{})
+
+	mu      sync.Mutex
+	writes  map[string]int // writes since the last auto-commit, by database
+	pending sync.WaitGroup
+	closed  bool
+	stop    chan struct{}
+}
+
+// NewAutoCommitter starts applying policy to the databases of registry,
+// committing through its shared handles so commits see consistent pages.
+// Failed commits are reported through logf. With a positive Interval a
+// background goroutine commits on every tick; Close stops it.
+func NewAutoCommitter(registry *database.Registry, policy AutoCommitPolicy, logf func(format string, args ...interface{})) *AutoCommitter {
+	a := &AutoCommitter{
+		registry: registry,
+		policy:   policy,
+		logf:     logf,
+		writes:   map[string]int{},
+		stop:     make(chan struct{}),
+	}
+	if policy.Interval > 0 {
+		go a.tickLoop()
+	}
+	return a
+}
+
+// Wrote records one write to dbID. Once Writes writes have piled up, dbID
+// is committed in the background.
+func (a *AutoCommitter) Wrote(dbID string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return
+	}
+	a.writes[dbID]++
+	if a.policy.Writes > 0 && a.writes[dbID] >= a.policy.Writes {
+		n := a.writes[dbID]
+		delete(a.writes, dbID)
+		a.pending.Add(1)
+		go func() {
+			defer a.pending.Done()
+			a.commit(dbID, fmt.Sprintf("auto: %d writes since the last auto-commit", n))
+		}()
+	}
+}
+
+// BeforeDestructive commits dbID ahead of op, such as "restore to <sha>", when
+// the policy asks for it. An error means the state could not be saved and op
+// should not go ahead.
+func (a *AutoCommitter) BeforeDestructive(dbID, op string) error {
+	if a == nil || !a.policy.BeforeDestructive {
+		return nil
+	}
+	a.mu.Lock()
+	delete(a.writes, dbID)
+	a.mu.Unlock()
+	if _, err := a.autoCommit(dbID, fmt.Sprintf("auto: before %s", op)); err != nil {
+		return fmt.Errorf("auto-commit before %s failed: %w", op, err)
+	}
+	return nil
+}
+
+// Flush commits every database written to since its last auto-commit.
+func (a *AutoCommitter) Flush() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	dirty := a.writes
+	a.writes = map[string]int{}
+	a.mu.Unlock()
+
+	ids := make([]string, 0, len(dirty))
+	for dbID := range dirty {
+		ids = append(ids, dbID)
+	}
+	sort.Strings(ids)
+	for _, dbID := range ids {
+		a.commit(dbID, fmt.Sprintf("auto: %d writes in the last %s", dirty[dbID], a.policy.Interval))
+	}
+}
+
+// Close stops the ticker and waits for commits already under way.
+func (a *AutoCommitter) Close() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+	a.closed = true
+	close(a.stop)
+	a.mu.Unlock()
+	a.pending.Wait()
+}
+
+func (a *AutoCommitter) tickLoop() {
+	ticker := time.NewTicker(a.policy.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-ticker.C:
+			a.Flush()
+		}
+	}
+}
+
+// commit runs autoCommit for the background triggers, which have nobody to
+// return an error to.
+func (a *AutoCommitter) commit(dbID, message string) {
+	if _, err := a.autoCommit(dbID, message); err != nil && a.logf != nil {
+		a.logf("Auto-commit of %s failed: %v", dbID, err)
+	}
+}
+
+// autoCommit commits dbID and then applies the retention rules. Databases
+// without a repository are skipped. Failing to prune is only logged, since
+// the commit itself was made.
+func (a *AutoCommitter) autoCommit(dbID, message string) (*Commit, error) {
+	basePath := a.registry.Path(dbID)
+	if _, err := os.Stat(filepath.Join(basePath, ".nutella")); err != nil {
+		return nil, nil
+	}
+	db, release, err := a.registry.Acquire(dbID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	commit, err := AutoCommit(basePath, message, db)
+	if err != nil || commit == nil {
+		return nil, err
+	}
+	if _, err := PruneSnapshots(basePath, a.policy.Retention); err != nil && a.logf != nil {
+		a.logf("Pruning auto snapshots of %s failed: %v", dbID, err)
+	}
+	return commit, nil
+}
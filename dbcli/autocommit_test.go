@@ -0,0 +1,144 @@
+package dbcli
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"db/database"
+)
+
+func TestPruneSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	writeSnapshotsFile := func(snapshots map[string]Snapshot) {
+		t.Helper()
+		if err := writeSnapshots(dir, snapshots); err != nil {
+			t.Fatalf("Failed to write snapshots: %v", err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(dir, ".nutella"), 0755); err != nil {
+		t.Fatalf("Failed to create repository: %v", err)
+	}
+
+	// Two auto snapshots an hour for two days, plus an old manual one.
+	now := time.Date(2026, 3, 11, 12, 30, 0, 0, time.UTC)
+	snapshots := map[string]Snapshot{
+		"manual": {Commit: "m", Message: "by hand", Timestamp: now.Add(-30 * 24 * time.Hour).Format(time.RFC3339)},
+	}
+	for i := 0; i < 96; i++ {
+		ts := now.Add(-time.Duration(i) * 30 * time.Minute)
+		snapshots[ts.Format(time.RFC3339)] = Snapshot{Commit: "c", Message: "auto", Timestamp: ts.Format(time.RFC3339), Auto: true}
+	}
+	writeSnapshotsFile(snapshots)
+
+	if pruned, err := PruneSnapshots(dir, Retention{}); err != nil || len(pruned) != 0 {
+		t.Fatalf("zero Retention pruned %d, %v; want nothing", len(pruned), err)
+	}
+
+	pruned, err := PruneSnapshots(dir, Retention{Hourly: 6, Daily: 3})
+	if err != nil {
+		t.Fatalf("Failed to prune: %v", err)
+	}
+	left, err := LoadSnapshotsFrom(dir)
+	if err != nil {
+		t.Fatalf("Failed to load snapshots: %v", err)
+	}
+	// The newest of each of the last 6 hours, plus the newest of the two
+	// earlier days (the newest of today is already kept by the hourly rule).
+	if len(left) != 1+6+2 {
+		t.Errorf("%d snapshots left; want 9: %v", len(left), SortSnapshots(left))
+	}
+	if len(pruned)+len(left) != len(snapshots) {
+		t.Errorf("pruned %d and kept %d of %d", len(pruned), len(left), len(snapshots))
+	}
+	if _, ok := left["manual"]; !ok {
+		t.Errorf("a manual snapshot was pruned")
+	}
+	if _, ok := left[now.Format(time.RFC3339)]; !ok {
+		t.Errorf("the newest auto snapshot was pruned")
+	}
+
+	if again, err := PruneSnapshots(dir, Retention{Hourly: 6, Daily: 3}); err != nil || len(again) != 0 {
+		t.Errorf("pruning twice removed %d more, %v", len(again), err)
+	}
+}
+
+func TestAutoCommitter(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "db_auto")
+	db, err := database.OpenDatabase(dir, "db_auto")
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	db.Close()
+	editCollection(t, dir, "fruits", func(c *database.Collection) {
+		if err := c.Insert("apple", "red"); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	})
+	commitDir(t, dir, "first")
+
+	// Nothing changed since the last commit, so there is nothing to commit.
+	if c, err := AutoCommit(dir, "auto: nothing", nil); err != nil || c != nil {
+		t.Fatalf("AutoCommit of a clean tree = %v, %v; want nil", c, err)
+	}
+
+	registry := database.NewRegistry(root, 0)
+	defer registry.Close()
+	a := NewAutoCommitter(registry, AutoCommitPolicy{Writes: 2, BeforeDestructive: true}, t.Logf)
+	editCollection(t, dir, "fruits", func(c *database.Collection) {
+		if _, err := c.Update("apple", "green"); err != nil {
+			t.Fatalf("Failed to update: %v", err)
+		}
+	})
+	a.Wrote("db_auto")
+	a.Wrote("db_auto")
+	a.Wrote("db_missing") // no such database: skipped without failing
+	a.Close()
+
+	snapshots, err := LoadSnapshotsFrom(dir)
+	if err != nil {
+		t.Fatalf("Failed to load snapshots: %v", err)
+	}
+	var auto []Snapshot
+	for _, e := range SortSnapshots(snapshots) {
+		if e.Snapshot.Auto {
+			auto = append(auto, e.Snapshot)
+		}
+	}
+	if len(auto) != 1 || !strings.Contains(auto[0].Message, "2 writes") {
+		t.Fatalf("auto snapshots = %v; want one after 2 writes", auto)
+	}
+	if commits, err := Log(dir, auto[0].Commit, 0); err != nil || len(commits) != 2 {
+		t.Errorf("Log from the auto-commit = %d commits, %v; want 2", len(commits), err)
+	}
+
+	editCollection(t, dir, "fruits", func(c *database.Collection) {
+		if err := c.Insert("banana", "yellow"); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	})
+	if err := a.BeforeDestructive("db_auto", "restore to HEAD~1"); err != nil {
+		t.Fatalf("BeforeDestructive: %v", err)
+	}
+	head, err := ResolveRevision(dir, "HEAD")
+	if err != nil {
+		t.Fatalf("Failed to resolve HEAD: %v", err)
+	}
+	m, err := MountCommit(dir, head)
+	if err != nil {
+		t.Fatalf("Failed to mount HEAD: %v", err)
+	}
+	if v, found, err := m.Find("fruits", "banana"); err != nil || !found || v != "yellow" {
+		t.Errorf("HEAD Find(banana) = %v, %v, %v; want the write saved before the restore", v, found, err)
+	}
+
+	var none *AutoCommitter
+	none.Wrote("db_auto")
+	if err := none.BeforeDestructive("db_auto", "restore"); err != nil {
+		t.Errorf("nil AutoCommitter: %v", err)
+	}
+	none.Close()
+}
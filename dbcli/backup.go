@@ -0,0 +1,211 @@
+package dbcli
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"db/database"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	backupServer  string
+	restoreUntil  string
+	restoreWALDir string
+)
+
+// writeBackupFile writes an archive to path through a temporary file in the
+// same directory, so a failed backup never leaves a partial archive behind.
+func writeBackupFile(path string, write func(f *os.File) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Command to archive a database
+var backupCmd = &cobra.Command{
+	Use:   "backup <dbID> <file>",
+	Short: "Write a checksummed archive of a database's data",
+	Long: `Writes the manifest, the pages of every collection and the cache settings to
+one gzipped tar archive in which every file carries its SHA-256. Writes are held
+off while the files are copied, so the archive is consistent. The history in
+.nutella is not included.
+
+With --server the server at that URL takes the backup of its own copy, which is
+the way to back up a database the server is writing to. When the database keeps
+a write-ahead log (see 'wal'), the archive records where in the log it was
+taken so restore-backup can replay the writes that came after it.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		dbID, file := args[0], args[1]
+		var info *database.BackupInfo
+		err := writeBackupFile(file, func(f *os.File) error {
+			if backupServer != "" {
+				c := remoteClient(Remote{URL: backupServer}, remoteAuthToken())
+				archive, err := c.Backup(context.Background(), dbID)
+				if err != nil {
+					return err
+				}
+				if info, err = database.ReadBackupInfo(bytes.NewReader(archive)); err != nil {
+					return err
+				}
+				_, err = f.Write(archive)
+				return err
+			}
+
+			db, err := database.LoadDatabase(repoPath(dbID))
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			info, err = db.Backup(f)
+			return err
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Backed up %s (%d files, %d bytes) to %s\n", info.DBID, info.Files, info.Bytes, file)
+		if info.WALID != "" {
+			fmt.Printf("Write-ahead log position: %d\n", info.WALSeq)
+		}
+	},
+}
+
+// Command to create a database from a backup archive
+var restoreBackupCmd = &cobra.Command{
+	Use:   "restore-backup <file> <new-dbID>",
+	Short: "Create a database from a backup archive, optionally replaying its write-ahead log",
+	Long: `Checks every file of the archive against its checksum and creates
+./files/<new-dbID> from it with a fresh, empty history. Nothing is created if
+the archive is damaged or incomplete.
+
+With --until, the writes the backed-up database logged after the backup are
+replayed up to and including that moment, recovering the data as it was then.
+--wal names the log directory to read; it defaults to the .wal directory of the
+backed-up database under ./files. Giving --wal without --until replays the
+whole log.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		f, err := os.Open(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+
+		var opts database.RestoreOptions
+		if restoreUntil != "" {
+			if opts.Until, err = time.Parse(time.RFC3339, restoreUntil); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: --until must be an RFC 3339 time such as 2024-05-01T12:00:00Z: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		opts.WALDir = restoreWALDir
+		if opts.WALDir == "" && restoreUntil != "" {
+			info, err := database.ReadBackupInfo(f)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			opts.WALDir = database.WALDir(filepath.Join("files", info.DBID))
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		root, _ := filepath.Abs("files")
+		res, err := database.RestoreBackup(f, root, args[1], opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Restored %s from the backup of %s taken %s\n", args[1], res.Backup.DBID, res.Backup.Created.Format(time.RFC3339))
+		if opts.WALDir != "" {
+			if res.Replayed == 0 {
+				fmt.Println("No logged writes to replay.")
+				return
+			}
+			fmt.Printf("Replayed %d write(s), up to record %d made %s\n", res.Replayed, res.LastSeq, res.LastTime.Format(time.RFC3339Nano))
+		}
+	},
+}
+
+// Command group to manage a database's write-ahead log
+var walCmd = &cobra.Command{
+	Use:   "wal",
+	Short: "Manage the write-ahead log used for point-in-time recovery",
+	Long: `A database with a write-ahead log appends every write to .wal in its
+directory before applying it. Together with a backup the log lets
+restore-backup --until recover the data as it was at any moment since the
+backup. Each backup starts a new segment; segments numbered at or below a
+backup's log position are not needed to restore from it.`,
+}
+
+var walEnableCmd = &cobra.Command{
+	Use:   "enable <dbID>",
+	Short: "Start logging every write",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := database.EnableWAL(repoPath(args[0])); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Write-ahead log enabled for %s. Take a backup to start a recovery point.\n", args[0])
+	},
+}
+
+var walDisableCmd = &cobra.Command{
+	Use:   "disable <dbID>",
+	Short: "Stop logging writes and delete the log",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := database.DisableWAL(repoPath(args[0])); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Write-ahead log disabled for %s.\n", args[0])
+	},
+}
+
+var walStatusCmd = &cobra.Command{
+	Use:   "status <dbID>",
+	Short: "Show the extent of the write-ahead log",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		basePath := repoPath(args[0])
+		if _, err := os.Stat(database.WALDir(basePath)); os.IsNotExist(err) {
+			fmt.Printf("Write-ahead log is disabled for %s.\n", args[0])
+			return
+		}
+		info, err := database.StatWAL(basePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Log %s: %d segment(s), %d bytes\n", info.ID, info.Segments, info.Bytes)
+		if info.Records == 0 {
+			fmt.Println("No writes logged.")
+			return
+		}
+		fmt.Printf("Records %d..%d, %s to %s\n", info.FirstSeq, info.LastSeq,
+			info.FirstTime.Format(time.RFC3339), info.LastTime.Format(time.RFC3339))
+	},
+}
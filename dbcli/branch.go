@@ -0,0 +1,299 @@
+package dbcli
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	// ErrBranchExists is returned when creating a branch that already exists.
+	ErrBranchExists = errors.New("branch already exists")
+	// ErrLocalChanges is returned by Checkout when the working tree has keys
+	// that differ from HEAD and force is not set.
+	ErrLocalChanges = errors.New("working tree has uncommitted changes")
+)
+
+// Branch is one ref under .nutella/refs/heads.
+type Branch struct {
+	Name    string `json:"name"`
+	Commit  string `json:"commit"`
+	Current bool   `json:"current"`
+}
+
+func branchRef(name string) string {
+	return "refs/heads/" + name
+}
+
+// ListBranches returns the branches of the repository at basePath, sorted by
+// name, with the one HEAD points at marked current.
+func ListBranches(basePath string) ([]Branch, error) {
+	headRef, _, err := readHead(basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	root := filepath.Join(basePath, ".nutella", "refs", "heads")
+	branches := []Branch{}
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(path, ".lock") {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		sha, err := readRef(basePath, branchRef(name))
+		if err != nil {
+			return err
+		}
+		branches = append(branches, Branch{Name: name, Commit: sha, Current: branchRef(name) == headRef})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(branches, func(i, j int) bool { return branches[i].Name < branches[j].Name })
+	return branches, nil
+}
+
+// CreateBranch creates branch name at commit start, or at HEAD when start is
+// empty.
+func CreateBranch(basePath, name, start string) error {
+	if err := validRefName(name); err != nil {
+		return err
+	}
+	if sha, err := readRef(basePath, branchRef(name)); err != nil {
+		return err
+	} else if sha != "" {
+		return fmt.Errorf("%s: %w", name, ErrBranchExists)
+	}
+
+	if start == "" {
+		_, head, err := readHead(basePath)
+		if err != nil {
+			return err
+		}
+		if head == "" {
+			return errors.New("HEAD has no commits yet; commit before branching")
+		}
+		start = head
+	} else {
+		resolved, err := ResolveRevision(basePath, start)
+		if err != nil {
+			return err
+		}
+		start = resolved
+	}
+	return writeRef(basePath, branchRef(name), start)
+}
+
+// DeleteBranch removes branch name. The branch HEAD points at cannot be deleted.
+func DeleteBranch(basePath, name string) error {
+	if err := validRefName(name); err != nil {
+		return err
+	}
+	headRef, _, err := readHead(basePath)
+	if err != nil {
+		return err
+	}
+	if headRef == branchRef(name) {
+		return fmt.Errorf("cannot delete branch %s: it is checked out", name)
+	}
+	path := filepath.Join(basePath, ".nutella", "refs", "heads", filepath.FromSlash(name))
+	if err := os.Remove(path); os.IsNotExist(err) {
+		return fmt.Errorf("branch %s: %w", name, ErrUnknownRevision)
+	} else if err != nil {
+		return fmt.Errorf("error deleting branch %s: %v", name, err)
+	}
+	return nil
+}
+
+// localChanges lists the collections whose keys in the working tree differ
+// from commit head ("" for an unborn branch).
+func localChanges(basePath, head string) ([]string, error) {
+	working, err := workingKeys(basePath)
+	if err != nil {
+		return nil, err
+	}
+	committed := map[string]map[string]interface{}{}
+	if head != "" {
+		treeSha, err := readCommitTree(basePath, head)
+		if err != nil {
+			return nil, err
+		}
+		if committed, err = treeKeys(basePath, treeSha); err != nil {
+			return nil, err
+		}
+	}
+
+	var changed []string
+	for name, keys := range working {
+		if old, ok := committed[name]; !ok && len(keys) > 0 || ok && !reflect.DeepEqual(old, keys) {
+			changed = append(changed, name)
+		}
+	}
+	for name, keys := range committed {
+		if _, ok := working[name]; !ok && len(keys) > 0 {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// Checkout switches the repository at basePath to target, a branch name or a
+// commit SHA (which detaches HEAD), and rewrites the working tree to match.
+// Uncommitted key changes make it fail with ErrLocalChanges unless force is
+// set, in which case they are discarded. It returns the checked-out commit.
+func Checkout(basePath, target string, force bool) (string, error) {
+	sha, err := ResolveRevision(basePath, target)
+	if err != nil {
+		return "", err
+	}
+	_, head, err := readHead(basePath)
+	if err != nil {
+		return "", err
+	}
+
+	if !force {
+		changed, err := localChanges(basePath, head)
+		if err != nil {
+			return "", err
+		}
+		if len(changed) > 0 {
+			return "", fmt.Errorf("%w in %s; commit them or checkout with --force", ErrLocalChanges, strings.Join(changed, ", "))
+		}
+	}
+
+	if sha != head || force {
+		if err := restoreWorkingTree(basePath, sha); err != nil {
+			return "", err
+		}
+	}
+
+	// Switching away abandons any merge in progress.
+	if err := clearMergeState(basePath); err != nil {
+		return "", err
+	}
+
+	newHead := sha
+	if validRefName(target) == nil {
+		if branchSha, _ := readRef(basePath, branchRef(target)); branchSha != "" {
+			newHead = "ref: " + branchRef(target)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(basePath, ".nutella", "HEAD"), []byte(newHead+"\n"), 0644); err != nil {
+		return "", fmt.Errorf("error writing HEAD: %v", err)
+	}
+	return sha, nil
+}
+
+var (
+	branchDelete bool
+	checkoutNew  bool
+	checkoutHard bool
+)
+
+// Command to list, create and delete branches
+var branchCmd = &cobra.Command{
+	Use:   "branch <dbID> [name] [start-commit]",
+	Short: "List, create or delete branches",
+	Long: `With only a dbID, lists the branches and marks the current one with "*".
+With a name, creates a branch at HEAD or at the given commit or branch.
+With -d, deletes the named branch; the checked-out branch cannot be deleted.`,
+	Args: cobra.RangeArgs(1, 3),
+	Run: func(cmd *cobra.Command, args []string) {
+		basePath := filepath.Join(".", "files", args[0])
+		if _, err := os.Stat(filepath.Join(basePath, ".nutella")); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: repository not found at %s. Please run 'init' first.\n", basePath)
+			os.Exit(1)
+		}
+
+		switch {
+		case branchDelete:
+			if len(args) != 2 {
+				fmt.Fprintf(os.Stderr, "Usage: branch -d <dbID> <name>\n")
+				os.Exit(1)
+			}
+			if err := DeleteBranch(basePath, args[1]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Deleted branch %s\n", args[1])
+
+		case len(args) == 1:
+			branches, err := ListBranches(basePath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error listing branches: %v\n", err)
+				os.Exit(1)
+			}
+			for _, b := range branches {
+				marker := " "
+				if b.Current {
+					marker = "*"
+				}
+				fmt.Printf("%s %s\t%s\n", marker, b.Name, b.Commit)
+			}
+
+		default:
+			start := ""
+			if len(args) == 3 {
+				start = args[2]
+			}
+			if err := CreateBranch(basePath, args[1], start); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Created branch %s\n", args[1])
+		}
+	},
+}
+
+// Command to switch a database to another branch or commit
+var checkoutCmd = &cobra.Command{
+	Use:   "checkout <dbID> <branch|commit>",
+	Short: "Switch a database to a branch or commit",
+	Long: `Points HEAD at the branch (or detaches it at the commit) and rewrites the
+database's collections to match. Refuses to discard uncommitted key changes
+unless --force is given. With -b, creates the branch at HEAD first.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		basePath := filepath.Join(".", "files", args[0])
+		if _, err := os.Stat(filepath.Join(basePath, ".nutella")); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: repository not found at %s. Please run 'init' first.\n", basePath)
+			os.Exit(1)
+		}
+
+		if checkoutNew {
+			if err := CreateBranch(basePath, args[1], ""); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		sha, err := Checkout(basePath, args[1], checkoutHard)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if ref, _, _ := readHead(basePath); ref != "" {
+			fmt.Printf("Switched to branch %s at %s\n", args[1], sha)
+		} else {
+			fmt.Printf("HEAD is now detached at %s\n", sha)
+		}
+	},
+}
@@ -0,0 +1,93 @@
+package dbcli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"db/database"
+)
+
+// ErrNoRepository is returned when committing a database that has no
+// .nutella repository yet.
+var ErrNoRepository = errors.New("repository not initialized; run 'init' first")
+
+// commitMu serializes the commits made in this process, which read and move
+// HEAD and rewrite snapshots.json.
+var commitMu sync.Mutex
+
+// workdirMu serializes the code in this process that chdirs into a
+// repository, since the working directory is shared by every goroutine.
+var workdirMu sync.Mutex
+
+// LockWorkdir takes the lock held by code that chdirs into a repository,
+// such as a server running CLI commands; call the returned func to release
+// it.
+func LockWorkdir() (unlock func()) {
+	workdirMu.Lock()
+	return workdirMu.Unlock
+}
+
+// CommitWorkingTree commits the repository at basePath: it writes a tree for
+// every file not ignored by .nutignore, records the commit on the current
+// branch and stores it in snapshots.json. A zero author means the default
+// identity.
+//
+// db is the open handle of the database at basePath, or nil when no writer
+// in this process has it open. Its writes are held off while the files are
+// hashed, and its manifest, B-tree metadata and cache are flushed first, so
+// the commit cannot capture a page split half written.
+func CommitWorkingTree(basePath, message string, author Signature, db *database.Database) (*Commit, error) {
+	commitMu.Lock()
+	defer commitMu.Unlock()
+
+	treeSha, err := hashWorkingTree(basePath, db)
+	if err != nil {
+		return nil, err
+	}
+	if author.Name == "" {
+		author = defaultIdentity()
+	}
+	return commitTree(basePath, treeSha, message, author, false)
+}
+
+// hashWorkingTree writes the objects for the working tree at repo and returns
+// the SHA of its root tree, quiescing db, if any, while it reads the files.
+func hashWorkingTree(repo string, db *database.Database) (string, error) {
+	if _, err := os.Stat(filepath.Join(repo, ".nutella")); err != nil {
+		return "", fmt.Errorf("%s: %w", repo, ErrNoRepository)
+	}
+	ignores, err := loadIgnores(repo)
+	if err != nil {
+		return "", fmt.Errorf("Error reading .nutignore: %w", err)
+	}
+
+	if db != nil {
+		resume, err := db.Quiesce()
+		if err != nil {
+			return "", fmt.Errorf("Error flushing database: %w", err)
+		}
+		defer resume()
+	}
+	treeSha, err := writeTreeRecursive(repo, ".", ignores)
+	if err != nil {
+		return "", fmt.Errorf("Error writing tree: %w", err)
+	}
+	return treeSha, nil
+}
+
+// commitTree records treeSha as a commit on the current branch of repo and
+// adds it to snapshots.json, marked auto when a policy rather than a person
+// asked for it.
+func commitTree(repo, treeSha, message string, author Signature, auto bool) (*Commit, error) {
+	commit, err := createAndStoreCommit(repo, treeSha, message, author)
+	if err != nil {
+		return nil, fmt.Errorf("Error storing commit: %w", err)
+	}
+	if err := recordSnapshot(repo, Snapshot{Commit: commit.Sha, Message: message, Auto: auto}); err != nil {
+		return nil, fmt.Errorf("Error storing snapshot: %w", err)
+	}
+	return commit, nil
+}
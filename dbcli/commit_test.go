@@ -0,0 +1,85 @@
+package dbcli
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"db/btree"
+	"db/database"
+)
+
+// TestCommitWorkingTreeWhileWriting commits while another goroutine keeps
+// splitting pages, and checks every commit restores to a well-formed tree.
+func TestCommitWorkingTreeWhileWriting(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "db_busy")
+	db, err := database.OpenDatabase(dir, "db_busy")
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+	if err := db.CreateCollection("items", 3); err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	coll, err := db.GetCollection("items")
+	if err != nil {
+		t.Fatalf("Failed to get collection: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 300; i++ {
+			if err := coll.Insert(fmt.Sprintf("k%04d", i), "v"); err != nil {
+				t.Errorf("Failed to insert: %v", err)
+				return
+			}
+		}
+	}()
+	var commits []string
+	for i := 0; i < 5; i++ {
+		c, err := CommitWorkingTree(dir, fmt.Sprintf("commit %d", i), Signature{}, db)
+		if err != nil {
+			t.Fatalf("Failed to commit: %v", err)
+		}
+		commits = append(commits, c.Sha)
+	}
+	wg.Wait()
+
+	last := -1
+	for i, sha := range commits {
+		into := fmt.Sprintf("db_copy%d", i)
+		if _, err := RestoreInto(dir, sha, root, into); err != nil {
+			t.Fatalf("Failed to restore %s: %v", sha, err)
+		}
+		copyDB, err := database.LoadDatabase(filepath.Join(root, into))
+		if err != nil {
+			t.Fatalf("Failed to load restored database: %v", err)
+		}
+		items, err := copyDB.GetCollection("items")
+		if err != nil {
+			t.Fatalf("Failed to get restored collection: %v", err)
+		}
+		if problems, err := items.Check(); err != nil || len(problems) > 0 {
+			t.Errorf("commit %d restores a broken tree: %v, %v", i, problems, err)
+		}
+		n := 0
+		items.Scan(func(kv btree.KeyValue) bool {
+			n++
+			return true
+		})
+		if n < last {
+			t.Errorf("commit %d holds %d keys, fewer than the %d before it", i, n, last)
+		}
+		last = n
+		copyDB.Close()
+	}
+
+	if _, err := CommitWorkingTree(t.TempDir(), "no repo", Signature{}, nil); !errors.Is(err, ErrNoRepository) {
+		t.Errorf("committing outside a repository: err = %v; want ErrNoRepository", err)
+	}
+}
@@ -0,0 +1,372 @@
+package dbcli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"db/btree"
+
+	"github.com/spf13/cobra"
+)
+
+// ErrInvalidTree is returned when the pages of a stored B-tree do not form a
+// tree, such as when a page is reached twice.
+var ErrInvalidTree = errors.New("invalid B-tree")
+
+// KeyChange is one key that differs between two commits. Op is "added",
+// "removed" or "modified"; Old and New are unset when the key is absent.
+type KeyChange struct {
+	Key string      `json:"key"`
+	Op  string      `json:"op"`
+	Old interface{} `json:"old,omitempty"`
+	New interface{} `json:"new,omitempty"`
+}
+
+// CollectionDiff lists the key changes in one collection, sorted by key.
+// Status is "added" or "removed" when the whole collection appears or
+// disappears, and "modified" otherwise.
+type CollectionDiff struct {
+	Name    string      `json:"name"`
+	Status  string      `json:"status"`
+	Changes []KeyChange `json:"changes"`
+}
+
+// DiffCommits compares the collections stored in two revisions (commits,
+// branches or tags) of the repository at basePath and returns the key-level
+// differences, sorted by collection name. Collections whose trees are
+// identical are skipped without decoding their pages.
+func DiffCommits(basePath, from, to string) ([]CollectionDiff, error) {
+	from, err := ResolveRevision(basePath, from)
+	if err != nil {
+		return nil, err
+	}
+	if to, err = ResolveRevision(basePath, to); err != nil {
+		return nil, err
+	}
+	fromTree, err := readCommitTree(basePath, from)
+	if err != nil {
+		return nil, err
+	}
+	toTree, err := readCommitTree(basePath, to)
+	if err != nil {
+		return nil, err
+	}
+	return diffTrees(basePath, fromTree, toTree)
+}
+
+func diffTrees(repo, fromTree, toTree string) ([]CollectionDiff, error) {
+	before, err := collectionTrees(repo, fromTree)
+	if err != nil {
+		return nil, err
+	}
+	after, err := collectionTrees(repo, toTree)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for name := range before {
+		names[name] = true
+	}
+	for name := range after {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	diffs := []CollectionDiff{}
+	for _, name := range sorted {
+		oldSha, inOld := before[name]
+		newSha, inNew := after[name]
+		if oldSha == newSha {
+			continue
+		}
+
+		var oldKeys, newKeys map[string]interface{}
+		if inOld {
+			if oldKeys, err = collectionKeys(repo, oldSha); err != nil {
+				return nil, fmt.Errorf("collection %s: %w", name, err)
+			}
+		}
+		if inNew {
+			if newKeys, err = collectionKeys(repo, newSha); err != nil {
+				return nil, fmt.Errorf("collection %s: %w", name, err)
+			}
+		}
+
+		d := CollectionDiff{Name: name, Status: "modified", Changes: diffKeys(oldKeys, newKeys)}
+		if !inOld {
+			d.Status = "added"
+		} else if !inNew {
+			d.Status = "removed"
+		}
+		if len(d.Changes) > 0 || d.Status != "modified" {
+			diffs = append(diffs, d)
+		}
+	}
+	return diffs, nil
+}
+
+func diffKeys(before, after map[string]interface{}) []KeyChange {
+	changes := []KeyChange{}
+	for key, old := range before {
+		if cur, ok := after[key]; !ok {
+			changes = append(changes, KeyChange{Key: key, Op: "removed", Old: old})
+		} else if !reflect.DeepEqual(old, cur) {
+			changes = append(changes, KeyChange{Key: key, Op: "modified", Old: old, New: cur})
+		}
+	}
+	for key, cur := range after {
+		if _, ok := before[key]; !ok {
+			changes = append(changes, KeyChange{Key: key, Op: "added", New: cur})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes
+}
+
+// collectionTrees maps each collection in a database tree to the SHA of its
+// directory tree. A collection is a top-level directory holding
+// pages/metadata.json.
+func collectionTrees(repo, treeSha string) (map[string]string, error) {
+	entries, err := readTreeEntries(repo, treeSha)
+	if err != nil {
+		return nil, err
+	}
+
+	collections := make(map[string]string)
+	for _, e := range entries {
+		if !e.isDir() {
+			continue
+		}
+		if _, err := pagesOf(repo, e.Sha); err == errNoPages {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		collections[e.Name] = e.Sha
+	}
+	return collections, nil
+}
+
+var errNoPages = errors.New("no B-tree pages")
+
+// pagesOf returns the blob SHA of every file in a collection's pages directory.
+func pagesOf(repo, collTree string) (map[string]string, error) {
+	entries, err := readTreeEntries(repo, collTree)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Name != "pages" || !e.isDir() {
+			continue
+		}
+		files, err := readTreeEntries(repo, e.Sha)
+		if err != nil {
+			return nil, err
+		}
+		pages := make(map[string]string, len(files))
+		for _, f := range files {
+			pages[f.Name] = f.Sha
+		}
+		if _, ok := pages["metadata.json"]; !ok {
+			return nil, errNoPages
+		}
+		return pages, nil
+	}
+	return nil, errNoPages
+}
+
+// committedOrder reads the B-tree order from a committed collection's
+// metadata.json.
+func committedOrder(repo, collTree string) (int, error) {
+	pages, err := pagesOf(repo, collTree)
+	if err != nil {
+		return 0, err
+	}
+	var meta struct {
+		Order int `json:"order"`
+	}
+	if err := decodeBlob(repo, pages["metadata.json"], &meta); err != nil {
+		return 0, err
+	}
+	return meta.Order, nil
+}
+
+// collectionKeys decodes the committed B-tree of one collection.
+func collectionKeys(repo, collTree string) (map[string]interface{}, error) {
+	pages, err := pagesOf(repo, collTree)
+	if err != nil {
+		return nil, err
+	}
+	return decodePages(func(name string, v interface{}) error {
+		sha, ok := pages[name]
+		if !ok {
+			return fmt.Errorf("%s is missing from the commit", name)
+		}
+		return decodeBlob(repo, sha, v)
+	})
+}
+
+// decodePages walks a B-tree from the root recorded in metadata.json, reading
+// each file through load. Only the newest live version of each key counts:
+// tombstones and version history are ignored. Pages come from commits that
+// may have been pushed, so a page reached twice fails with ErrInvalidTree
+// rather than recursing forever.
+func decodePages(load func(name string, v interface{}) error) (map[string]interface{}, error) {
+	var meta struct {
+		RootID int `json:"root_id"`
+	}
+	if err := load("metadata.json", &meta); err != nil {
+		return nil, fmt.Errorf("metadata.json: %w", err)
+	}
+
+	keys := make(map[string]interface{})
+	visited := make(map[int]bool)
+	var walk func(id int) error
+	walk = func(id int) error {
+		name := "page_" + strconv.Itoa(id) + ".json"
+		if visited[id] {
+			return fmt.Errorf("%s is reached twice: %w", name, ErrInvalidTree)
+		}
+		visited[id] = true
+		var node btree.Node
+		if err := load(name, &node); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		for _, kv := range node.Keys {
+			if !kv.Deleted {
+				keys[kv.Key] = kv.Value
+			}
+		}
+		for _, child := range node.Children {
+			if err := walk(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(meta.RootID); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// treeKeys decodes every collection in a database tree.
+func treeKeys(repo, treeSha string) (map[string]map[string]interface{}, error) {
+	colls, err := collectionTrees(repo, treeSha)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]map[string]interface{}, len(colls))
+	for name, sha := range colls {
+		if out[name], err = collectionKeys(repo, sha); err != nil {
+			return nil, fmt.Errorf("collection %s: %w", name, err)
+		}
+	}
+	return out, nil
+}
+
+// workingKeys decodes every collection in the working tree at basePath,
+// skipping ignored ones like a commit would.
+func workingKeys(basePath string) (map[string]map[string]interface{}, error) {
+	ignores, err := loadIgnores(basePath)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]map[string]interface{})
+	for _, e := range entries {
+		pagesDir := filepath.Join(basePath, e.Name(), "pages")
+		if !e.IsDir() || e.Name() == ".nutella" || shouldIgnore(e.Name(), ignores) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(pagesDir, "metadata.json")); err != nil {
+			continue
+		}
+		keys, err := decodePages(func(name string, v interface{}) error {
+			data, err := os.ReadFile(filepath.Join(pagesDir, name))
+			if err != nil {
+				return err
+			}
+			return json.Unmarshal(data, v)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("collection %s: %w", e.Name(), err)
+		}
+		out[e.Name()] = keys
+	}
+	return out, nil
+}
+
+func decodeBlob(repo, sha string, v interface{}) error {
+	content, err := loadTyped(repo, sha, "blob")
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+// diffJSON selects JSON output for the diff command.
+var diffJSON bool
+
+// Command to show the key-level differences between two commits
+var diffCmd = &cobra.Command{
+	Use:   "diff <dbID> <revA> <revB>",
+	Short: "Show the keys added, removed and modified between two commits",
+	Long: `Decodes the B-tree pages of every collection in both revisions (commit
+SHAs or short SHAs, branches or tags) and prints the
+changes per collection: "+" for added keys, "-" for removed keys and "~" for
+modified keys. Use --json for machine-readable output.`,
+	Args: cobra.ExactArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		basePath := filepath.Join(".", "files", args[0])
+		diffs, err := DiffCommits(basePath, args[1], args[2])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error computing diff: %v\n", err)
+			os.Exit(1)
+		}
+
+		if diffJSON {
+			out, _ := json.MarshalIndent(diffs, "", "  ")
+			fmt.Println(string(out))
+			return
+		}
+		if len(diffs) == 0 {
+			fmt.Println("No differences.")
+			return
+		}
+		for _, d := range diffs {
+			fmt.Printf("collection %s (%s)\n", d.Name, d.Status)
+			printKeyChanges(d.Changes)
+		}
+	},
+}
+
+// printKeyChanges prints one indented line per change: "+" for an added key,
+// "-" for a removed one and "~" for a modified one.
+func printKeyChanges(changes []KeyChange) {
+	for _, c := range changes {
+		switch c.Op {
+		case "added":
+			fmt.Printf("  + %s: %v\n", c.Key, c.New)
+		case "removed":
+			fmt.Printf("  - %s: %v\n", c.Key, c.Old)
+		default:
+			fmt.Printf("  ~ %s: %v -> %v\n", c.Key, c.Old, c.New)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package dbcli
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"db/database"
+)
+
+// commitDir commits the working tree of the repository at dir and returns the
+// commit SHA.
+func commitDir(t *testing.T, dir, message string) string {
+	t.Helper()
+	originalDir, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get current directory: %v", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("Failed to change directory: %v", err)
+	}
+	defer os.Chdir(originalDir)
+
+	treeSha, err := writeTreeRecursive(".", ".", nil)
+	if err != nil {
+		t.Fatalf("Failed to write tree: %v", err)
+	}
+	commit, err := createAndStoreCommit(".", treeSha, message, defaultIdentity())
+	if err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	return commit.Sha
+}
+
+func TestDiffCommits(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db_diff")
+	db, err := database.OpenDatabase(dir, "db_diff")
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+	if err := os.MkdirAll(filepath.Join(dir, ".nutella", "objects"), 0755); err != nil {
+		t.Fatalf("Failed to create repository: %v", err)
+	}
+
+	if err := db.CreateCollection("fruits", 3); err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	fruits, err := db.GetCollection("fruits")
+	if err != nil {
+		t.Fatalf("Failed to get collection: %v", err)
+	}
+	// Enough keys to split the root, so the diff has to follow child pages.
+	for _, k := range []string{"apple", "banana", "cherry", "date", "elder", "fig", "grape"} {
+		if err := fruits.Insert(k, "v1"); err != nil {
+			t.Fatalf("Failed to insert %s: %v", k, err)
+		}
+	}
+	first := commitDir(t, dir, "first")
+
+	if _, err := fruits.Update("banana", "v2"); err != nil {
+		t.Fatalf("Failed to update: %v", err)
+	}
+	if _, err := fruits.Delete("cherry"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	if err := fruits.Insert("kiwi", "v1"); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	if err := db.CreateCollection("veg", 3); err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+	second := commitDir(t, dir, "second")
+
+	diffs, err := DiffCommits(dir, first, second)
+	if err != nil {
+		t.Fatalf("Failed to diff: %v", err)
+	}
+	if len(diffs) != 2 || diffs[0].Name != "fruits" || diffs[1].Name != "veg" || diffs[1].Status != "added" {
+		t.Fatalf("diff = %+v; want modified fruits and added veg", diffs)
+	}
+	want := []KeyChange{
+		{Key: "banana", Op: "modified", Old: "v1", New: "v2"},
+		{Key: "cherry", Op: "removed", Old: "v1"},
+		{Key: "kiwi", Op: "added", New: "v1"},
+	}
+	if got := diffs[0].Changes; len(got) != len(want) {
+		t.Fatalf("fruits changes = %+v; want %+v", got, want)
+	}
+	for i, c := range diffs[0].Changes {
+		if c != want[i] {
+			t.Errorf("change %d = %+v; want %+v", i, c, want[i])
+		}
+	}
+
+	if diffs, err := DiffCommits(dir, second, second); err != nil || len(diffs) != 0 {
+		t.Errorf("diff of a commit with itself = %+v, %v; want none", diffs, err)
+	}
+	if _, err := DiffCommits(dir, first, "0000000000000000000000000000000000000000"); err == nil {
+		t.Errorf("diff against a missing commit succeeded")
+	}
+}
+
+// TestCyclicPagesAreRejected commits a collection whose two pages name each
+// other as children, as a pushed commit could, and checks that reading it
+// fails instead of recursing forever.
+func TestCyclicPagesAreRejected(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db_cycle")
+	db, err := database.OpenDatabase(dir, "db_cycle")
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	db.Close()
+	editCollection(t, dir, "fruits", func(c *database.Collection) {
+		if err := c.Insert("apple", "red"); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	})
+	first := commitDir(t, dir, "first")
+
+	coll := filepath.Join(dir, "fruits", "pages")
+	pages := map[string]string{
+		"metadata.json": `{"root_id":1}`,
+		"page_1.json":   `{"id":1,"keys":[{"key":"m","value":1}],"children":[2,2]}`,
+		"page_2.json":   `{"id":2,"keys":[{"key":"c","value":2}],"children":[1,1]}`,
+	}
+	for name, data := range pages {
+		if err := os.WriteFile(filepath.Join(coll, name), []byte(data), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	cyclic := commitDir(t, dir, "cyclic")
+
+	if _, err := DiffCommits(dir, first, cyclic); !errors.Is(err, ErrInvalidTree) {
+		t.Errorf("DiffCommits = %v; want ErrInvalidTree", err)
+	}
+	m, err := MountCommit(dir, cyclic)
+	if err != nil {
+		t.Fatalf("Failed to mount: %v", err)
+	}
+	if _, err := m.FindAll("fruits"); !errors.Is(err, ErrInvalidTree) {
+		t.Errorf("FindAll = %v; want ErrInvalidTree", err)
+	}
+	if _, _, err := m.Find("fruits", "a"); !errors.Is(err, ErrInvalidTree) {
+		t.Errorf("Find = %v; want ErrInvalidTree", err)
+	}
+	if _, err := workingKeys(dir); !errors.Is(err, ErrInvalidTree) {
+		t.Errorf("workingKeys = %v; want ErrInvalidTree", err)
+	}
+}
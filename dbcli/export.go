@@ -0,0 +1,221 @@
+package dbcli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"db/database"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	exportFormat        string
+	exportOutput        string
+	importFormat        string
+	importResume        bool
+	transferKeyColumn   string
+	transferValueColumn string
+)
+
+// importCheckpoint records how far an import of a file got, so that
+// import --resume can skip the records already written.
+type importCheckpoint struct {
+	File       string    `json:"file"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"mod_time"`
+	DBID       string    `json:"db_id"`
+	Collection string    `json:"collection"`
+	Records    int       `json:"records"`
+}
+
+// checkpointPath is where the checkpoint of an import of file is kept.
+func checkpointPath(file string) string {
+	return file + ".progress"
+}
+
+func newCheckpoint(file string, st os.FileInfo, dbID, collection string) importCheckpoint {
+	abs, _ := filepath.Abs(file)
+	return importCheckpoint{File: abs, Size: st.Size(), ModTime: st.ModTime().UTC(), DBID: dbID, Collection: collection}
+}
+
+func saveCheckpoint(cp importCheckpoint) error {
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(checkpointPath(cp.File), data, 0644)
+}
+
+// loadCheckpoint returns how many records of want.File an earlier import
+// into the same collection wrote, or 0 if none was interrupted. A checkpoint
+// for a file that has changed since is refused.
+func loadCheckpoint(want importCheckpoint) (int, error) {
+	data, err := os.ReadFile(checkpointPath(want.File))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var cp importCheckpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return 0, fmt.Errorf("failed to parse %s: %v", checkpointPath(want.File), err)
+	}
+	if cp.Size != want.Size || !cp.ModTime.Equal(want.ModTime) || cp.DBID != want.DBID || cp.Collection != want.Collection {
+		return 0, fmt.Errorf("%s belongs to another file, database or collection, or the file changed; delete it to start over", checkpointPath(want.File))
+	}
+	return cp.Records, nil
+}
+
+// fileFormat is format, or the format the extension of file names, with
+// NDJSON as the default.
+func fileFormat(format, file string) string {
+	if format != "" {
+		return format
+	}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".csv":
+		return database.FormatCSV
+	case ".json":
+		return database.FormatJSON
+	}
+	return database.FormatNDJSON
+}
+
+// Command to dump collections in a portable format
+var exportCmd = &cobra.Command{
+	Use:   "export <dbID> [collection]",
+	Short: "Write the pairs of a collection, or of every collection, as NDJSON, CSV or JSON",
+	Long: `Writes every pair in key order to standard output or to --output. Exporting a
+whole database adds a collection field to every record. Values are written as
+JSON, except in CSV where string values are written as they are and others as
+JSON. The format comes from --format, else from the extension of --output, and
+defaults to ndjson.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		db, err := database.LoadDatabase(filepath.Join(".", "files", args[0]))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		var out io.Writer = os.Stdout
+		opts := database.ExportOptions{
+			Format:      fileFormat(exportFormat, exportOutput),
+			KeyColumn:   transferKeyColumn,
+			ValueColumn: transferValueColumn,
+		}
+		if exportOutput != "" {
+			f, err := os.Create(exportOutput)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			out = f
+			opts.Progress = func(n int) { fmt.Fprintf(os.Stderr, "\rExported %d records", n) }
+		}
+
+		n, err := db.Export(out, args[1:], opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "\nError: %v\n", err)
+			os.Exit(1)
+		}
+		if exportOutput != "" {
+			fmt.Fprintf(os.Stderr, "\rExported %d records to %s\n", n, exportOutput)
+		}
+	},
+}
+
+// Command to load pairs into a collection
+var importCmd = &cobra.Command{
+	Use:   "import <dbID> <collection> <file>",
+	Short: "Load NDJSON, CSV or JSON records into a collection",
+	Long: `Streams records from file into the collection, replacing the values of keys
+that exist. --key-column and --value-column name the fields, or CSV header
+columns, to read; other fields are ignored. CSV values are stored as strings.
+The format comes from --format, else from the file extension, and defaults to
+ndjson.
+
+Progress is saved to <file>.progress every thousand records. If an import
+stops, rerun it with --resume to skip the records already written; the
+checkpoint is removed once the import completes.`,
+	Args: cobra.ExactArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		dbID, collName, file := args[0], args[1], args[2]
+		f, err := os.Open(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		st, err := f.Stat()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		cp := newCheckpoint(file, st, dbID, collName)
+		if importResume {
+			if cp.Records, err = loadCheckpoint(cp); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		db, err := database.LoadDatabase(filepath.Join(".", "files", dbID))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+		coll, err := db.GetCollection(collName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		shown := false
+		res, err := coll.Import(f, database.ImportOptions{
+			Format:      fileFormat(importFormat, file),
+			KeyColumn:   transferKeyColumn,
+			ValueColumn: transferValueColumn,
+			Skip:        cp.Records,
+			Progress: func(n int) {
+				cp.Records = n
+				saveCheckpoint(cp)
+				fmt.Fprintf(os.Stderr, "\rImported %d records", n)
+				shown = true
+			},
+		})
+		if err != nil {
+			// os.Exit skips deferred calls, and Close flushes what was written.
+			db.Close()
+			cp.Records = res.Skipped + res.Imported
+			saveCheckpoint(cp)
+			if shown {
+				fmt.Fprintln(os.Stderr)
+			}
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			fmt.Fprintf(os.Stderr, "%d records are in; rerun with --resume to continue after them.\n", cp.Records)
+			os.Exit(1)
+		}
+		os.Remove(checkpointPath(cp.File))
+		if shown {
+			fmt.Fprintln(os.Stderr)
+		}
+		fmt.Printf("Imported %d records into %s/%s", res.Imported, dbID, collName)
+		if res.Skipped > 0 {
+			fmt.Printf(", skipped %d imported before", res.Skipped)
+		}
+		fmt.Println(".")
+	},
+}
@@ -0,0 +1,334 @@
+package dbcli
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"db/database"
+
+	"github.com/spf13/cobra"
+)
+
+// Kinds of FsckIssue, in the order fsck reports them.
+const (
+	fsckCorrupt  = "corrupt"   // unreadable, or its content does not hash to its SHA
+	fsckBadDelta = "bad-delta" // a delta whose base is missing or does not apply
+	fsckMissing  = "missing"   // referenced but stored nowhere
+	fsckPage     = "page"      // a broken B-tree invariant in the working tree
+	fsckDangling = "dangling"  // stored but referenced by nothing
+)
+
+var fsckKindOrder = map[string]int{fsckCorrupt: 0, fsckBadDelta: 1, fsckMissing: 2, fsckPage: 3, fsckDangling: 4}
+
+// FsckIssue is one problem found by Fsck. Object is a SHA, a pack name, or a
+// collection for page issues.
+type FsckIssue struct {
+	Kind   string `json:"kind"`
+	Object string `json:"object"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// FsckReport lists what Fsck checked and found.
+type FsckReport struct {
+	Loose  int         `json:"loose"`
+	Packed int         `json:"packed"`
+	Issues []FsckIssue `json:"issues"`
+}
+
+// OK reports whether nothing worse than dangling objects, which gc prunes,
+// was found.
+func (r *FsckReport) OK() bool {
+	for _, issue := range r.Issues {
+		if issue.Kind != fsckDangling {
+			return false
+		}
+	}
+	return true
+}
+
+// Fsck checks the object store of the repository at basePath. Every loose and
+// packed object is read and rehashed, loose deltas are resolved against their
+// bases, and the commits, trees and tags are checked to reference only stored
+// objects. Objects that no other object, ref, HEAD or snapshot references are
+// reported as dangling. With checkPages, the B-tree pages of every collection
+// in the working tree are checked too. Problems land in the report; the error
+// is for failures to run the check at all.
+func Fsck(basePath string, checkPages bool) (*FsckReport, error) {
+	report := &FsckReport{Issues: []FsckIssue{}}
+	add := func(kind, object, format string, args ...interface{}) {
+		report.Issues = append(report.Issues, FsckIssue{Kind: kind, Object: object, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	stored := make(map[string]bool) // every SHA found, readable or not
+	raws := make(map[string][]byte) // objects that read back and hashed cleanly
+
+	loose, err := looseObjects(basePath)
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range loose {
+		report.Loose++
+		stored[obj.Sha] = true
+		raw, err := readLooseObject(basePath, obj.Sha)
+		if err != nil {
+			add(fsckCorrupt, obj.Sha, "%v", err)
+			continue
+		}
+		if got := fmt.Sprintf("%x", sha1.Sum(raw)); got != obj.Sha {
+			add(fsckCorrupt, obj.Sha, "content hashes to %s", got)
+			continue
+		}
+		raws[obj.Sha] = raw
+	}
+
+	if err := fsckPacks(basePath, report, stored, raws, add); err != nil {
+		return nil, err
+	}
+
+	// Resolve deltas; a loose delta references its base like a tree its blobs.
+	referenced := make(map[string]bool)
+	resolved := make(map[string][]byte, len(raws))
+	for sha, raw := range raws {
+		base, err := deltaBase(sha, raw)
+		if err != nil {
+			add(fsckCorrupt, sha, "%v", err)
+			continue
+		}
+		if base == "" {
+			resolved[sha] = raw
+			continue
+		}
+		referenced[base] = true
+		if !stored[base] {
+			add(fsckBadDelta, sha, "delta base %s is missing", base)
+			continue
+		}
+		full, err := loadObject(basePath, sha)
+		if err != nil {
+			add(fsckBadDelta, sha, "%v", err)
+			continue
+		}
+		resolved[sha] = full
+	}
+
+	missing := make(map[string]string)
+	refer := func(sha, from string) {
+		referenced[sha] = true
+		if !stored[sha] {
+			if _, ok := missing[sha]; !ok {
+				missing[sha] = from
+			}
+		}
+	}
+	for sha, data := range resolved {
+		objType, content, err := parseObject(data)
+		if err != nil {
+			add(fsckCorrupt, sha, "%v", err)
+			continue
+		}
+		switch objType {
+		case "commit":
+			c, err := parseCommit(sha, content)
+			if err != nil {
+				add(fsckCorrupt, sha, "%v", err)
+				continue
+			}
+			refer(c.Tree, "commit "+sha)
+			for _, p := range c.Parents {
+				refer(p, "commit "+sha)
+			}
+		case "tree":
+			entries, err := readTreeEntries(basePath, sha)
+			if err != nil {
+				add(fsckCorrupt, sha, "%v", err)
+				continue
+			}
+			for _, e := range entries {
+				refer(e.Sha, "tree "+sha)
+			}
+		case "tag":
+			t, err := parseTag(sha, content)
+			if err != nil {
+				add(fsckCorrupt, sha, "%v", err)
+				continue
+			}
+			refer(t.Commit, "tag "+sha)
+		}
+	}
+
+	roots, err := gcRoots(basePath)
+	if err != nil {
+		return nil, err
+	}
+	for _, root := range roots {
+		refer(root, "a ref, HEAD or snapshot")
+	}
+	for sha, from := range missing {
+		add(fsckMissing, sha, "referenced by %s", from)
+	}
+	for sha, data := range resolved {
+		if !referenced[sha] {
+			objType, _, _ := parseObject(data)
+			add(fsckDangling, sha, "%s", objType)
+		}
+	}
+
+	if checkPages {
+		if err := fsckPages(basePath, add); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(report.Issues, func(i, j int) bool {
+		a, b := report.Issues[i], report.Issues[j]
+		if a.Kind != b.Kind {
+			return fsckKindOrder[a.Kind] < fsckKindOrder[b.Kind]
+		}
+		return a.Object < b.Object
+	})
+	return report, nil
+}
+
+// fsckPacks checks every pack's checksum and rebuilds and rehashes each object
+// in it, recording the good ones in raws. Objects already read loose are not
+// decoded again.
+func fsckPacks(basePath string, report *FsckReport, stored map[string]bool, raws map[string][]byte, add func(kind, object, format string, args ...interface{})) error {
+	dir := filepath.Join(basePath, ".nutella", "objects", "pack")
+	files, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), "pack-") || !strings.HasSuffix(file.Name(), ".idx") {
+			continue
+		}
+		name := strings.TrimSuffix(file.Name(), ".idx")
+		idx, err := openPackIndex(filepath.Join(dir, file.Name()))
+		if err != nil {
+			add(fsckCorrupt, name, "%v", err)
+			continue
+		}
+		if _, err := checkPackChecksum(idx, name); err != nil {
+			add(fsckCorrupt, name, "%v", err)
+		}
+
+		f, err := os.Open(idx.packPath)
+		if err != nil {
+			add(fsckCorrupt, name, "%v", err)
+			continue
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		for i := 0; i < idx.count(); i++ {
+			sha := idx.sha(i)
+			report.Packed++
+			stored[sha] = true
+			if _, ok := raws[sha]; ok {
+				continue
+			}
+			e, err := idx.decodeEntry(f, info.Size(), int64(idx.offsets[i]), 0)
+			if err != nil {
+				add(fsckCorrupt, sha, "%v", err)
+				continue
+			}
+			if got := fmt.Sprintf("%x", sha1.Sum(e.raw)); got != sha {
+				add(fsckCorrupt, sha, "%s: content hashes to %s", name, got)
+				continue
+			}
+			raws[sha] = e.raw
+		}
+		f.Close()
+	}
+	return nil
+}
+
+// fsckPages checks the B-tree pages of every collection in the working tree.
+func fsckPages(basePath string, add func(kind, object, format string, args ...interface{})) error {
+	db, err := database.LoadDatabase(basePath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	names, err := db.GetAllCollections()
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		coll, err := db.GetCollection(name)
+		if err != nil {
+			add(fsckPage, name, "%v", err)
+			continue
+		}
+		problems, err := coll.Check()
+		if err != nil {
+			add(fsckPage, name, "%v", err)
+			continue
+		}
+		for _, p := range problems {
+			add(fsckPage, name, "%s", p)
+		}
+	}
+	return nil
+}
+
+var (
+	fsckPagesFlag bool
+	fsckJSON      bool
+)
+
+// Command to check the integrity of the object store
+var fsckCmd = &cobra.Command{
+	Use:   "fsck <dbID>",
+	Short: "Check the integrity of the object store",
+	Long: `Reads and rehashes every loose and packed object, resolves delta bases and
+checks that commits, trees and tags only reference objects that exist. Objects
+nothing refers to are reported as dangling. --pages also checks the B-tree page
+invariants of every collection in the working tree. Exits non-zero when anything
+other than dangling objects is found.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		basePath := filepath.Join(".", "files", args[0])
+		if _, err := os.Stat(filepath.Join(basePath, ".nutella")); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: repository not found at %s. Please run 'init' first.\n", basePath)
+			os.Exit(1)
+		}
+
+		report, err := Fsck(basePath, fsckPagesFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error checking repository: %v\n", err)
+			os.Exit(1)
+		}
+
+		if fsckJSON {
+			out, _ := json.MarshalIndent(report, "", "  ")
+			fmt.Println(string(out))
+		} else {
+			dangling := 0
+			for _, issue := range report.Issues {
+				if issue.Kind == fsckDangling {
+					dangling++
+				}
+				fmt.Printf("%s %s: %s\n", issue.Kind, issue.Object, issue.Detail)
+			}
+			fmt.Printf("Checked %d loose and %d packed objects: %d problems, %d dangling\n",
+				report.Loose, report.Packed, len(report.Issues)-dangling, dangling)
+		}
+		if !report.OK() {
+			os.Exit(1)
+		}
+	},
+}
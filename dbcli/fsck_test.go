@@ -0,0 +1,125 @@
+package dbcli
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"db/database"
+)
+
+func TestFsck(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db_fsck")
+	db, err := database.OpenDatabase(dir, "db_fsck")
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	db.Close()
+
+	editCollection(t, dir, "fruits", func(c *database.Collection) {
+		for _, k := range []string{"apple", "banana", "cherry", "date", "elder", "fig", "grape"} {
+			if err := c.Insert(k, "v1"); err != nil {
+				t.Fatalf("Failed to insert %s: %v", k, err)
+			}
+		}
+	})
+	first := commitDir(t, dir, "first")
+	editCollection(t, dir, "fruits", func(c *database.Collection) {
+		if _, err := c.Update("fig", "v2"); err != nil {
+			t.Fatalf("Failed to update: %v", err)
+		}
+	})
+	commitDir(t, dir, "second")
+
+	report, err := Fsck(dir, true)
+	if err != nil {
+		t.Fatalf("Failed to run fsck: %v", err)
+	}
+	if !report.OK() || len(report.Issues) != 0 || report.Loose == 0 {
+		t.Fatalf("fsck on a healthy repository = %+v; want no issues", report)
+	}
+
+	// Pack everything so the checks run against pack entries too, then
+	// damage the store in three ways.
+	loose, _ := looseObjects(dir)
+	shas := make([]string, len(loose))
+	for i, obj := range loose {
+		shas[i] = obj.Sha
+	}
+	if _, err := writePack(dir, shas, defaultPackOptions); err != nil {
+		t.Fatalf("Failed to write pack: %v", err)
+	}
+	if _, err := pruneLoose(dir, shas); err != nil {
+		t.Fatalf("Failed to prune loose objects: %v", err)
+	}
+
+	orphan, err := writeObject(dir, "blob", []byte("nothing points at this"))
+	if err != nil {
+		t.Fatalf("Failed to write object: %v", err)
+	}
+	corrupt, err := writeObject(dir, "blob", []byte("about to be truncated"))
+	if err != nil {
+		t.Fatalf("Failed to write object: %v", err)
+	}
+	corruptPath := filepath.Join(dir, ".nutella", "objects", corrupt[:2], corrupt[2:])
+	if data, err := os.ReadFile(corruptPath); err != nil || os.WriteFile(corruptPath, data[:len(data)/2], 0644) != nil {
+		t.Fatalf("Failed to truncate object: %v", err)
+	}
+	firstTree, err := readCommitTree(dir, first)
+	if err != nil {
+		t.Fatalf("Failed to read commit: %v", err)
+	}
+	// Drop the pack and keep only the first commit loose, so its tree is gone.
+	packDir := filepath.Join(dir, ".nutella", "objects", "pack")
+	raw, err := readRawObject(dir, first)
+	if err != nil {
+		t.Fatalf("Failed to read commit: %v", err)
+	}
+	if err := os.RemoveAll(packDir); err != nil {
+		t.Fatalf("Failed to remove pack: %v", err)
+	}
+	objType, content, _ := parseObject(raw)
+	if sha, err := writeObject(dir, objType, content); err != nil || sha != first {
+		t.Fatalf("Failed to rewrite commit loose: %s, %v", sha, err)
+	}
+
+	report, err = Fsck(dir, false)
+	if err != nil {
+		t.Fatalf("Failed to run fsck: %v", err)
+	}
+	found := map[string]bool{}
+	for _, issue := range report.Issues {
+		found[issue.Kind+" "+issue.Object] = true
+	}
+	for _, want := range []string{
+		fsckCorrupt + " " + corrupt,
+		fsckMissing + " " + firstTree,
+		fsckDangling + " " + orphan,
+	} {
+		if !found[want] {
+			t.Errorf("fsck issues %v; want %q among them", report.Issues, want)
+		}
+	}
+	if report.OK() {
+		t.Errorf("fsck reported OK for a damaged repository")
+	}
+
+	// Leave a page in the working tree that the B-tree never reaches.
+	orphanPage := filepath.Join(dir, "fruits", "pages", "page_999.json")
+	if err := os.WriteFile(orphanPage, []byte(`{"id":999,"is_leaf":true}`), 0644); err != nil {
+		t.Fatalf("Failed to write page: %v", err)
+	}
+	report, err = Fsck(dir, true)
+	if err != nil {
+		t.Fatalf("Failed to run fsck: %v", err)
+	}
+	pageIssue := false
+	for _, issue := range report.Issues {
+		if issue.Kind == fsckPage && issue.Object == "fruits" {
+			pageIssue = true
+		}
+	}
+	if !pageIssue {
+		t.Errorf("fsck --pages issues %v; want the orphaned page in fruits", report.Issues)
+	}
+}
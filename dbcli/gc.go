@@ -0,0 +1,441 @@
+package dbcli
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// defaultGCGrace is how old an unreachable object must be before gc prunes
+// it, so objects written by a commit that has not updated its ref yet survive.
+const defaultGCGrace = 14 * 24 * time.Hour
+
+// looseObject is one zlib file under .nutella/objects/<xx>/.
+type looseObject struct {
+	Sha     string
+	Size    int64
+	ModTime time.Time
+}
+
+// looseObjects lists the loose objects of the repository at repo.
+func looseObjects(repo string) ([]looseObject, error) {
+	objectsDir := filepath.Join(repo, ".nutella", "objects")
+	dirs, err := os.ReadDir(objectsDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []looseObject
+	for _, d := range dirs {
+		if !d.IsDir() || len(d.Name()) != 2 || !isHex(d.Name()) {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(objectsDir, d.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if f.IsDir() || len(f.Name()) != 38 || !isHex(f.Name()) {
+				continue
+			}
+			info, err := f.Info()
+			if err != nil {
+				return nil, err
+			}
+			objects = append(objects, looseObject{Sha: d.Name() + f.Name(), Size: info.Size(), ModTime: info.ModTime()})
+		}
+	}
+	return objects, nil
+}
+
+// refTips returns every ref under .nutella/refs, such as "refs/heads/main",
+// with the object it points at.
+func refTips(repo string) (map[string]string, error) {
+	tips := make(map[string]string)
+	nutellaDir := filepath.Join(repo, ".nutella")
+	err := filepath.WalkDir(filepath.Join(nutellaDir, "refs"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(path, ".lock") {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(nutellaDir, path)
+		if err != nil {
+			return err
+		}
+		if sha := strings.TrimSpace(string(data)); sha != "" {
+			tips[filepath.ToSlash(rel)] = sha
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading refs: %v", err)
+	}
+	return tips, nil
+}
+
+// gcRoots returns the objects that keep history alive: every branch, tag and
+// remote-tracking ref, HEAD, a merge in progress and every commit recorded in
+// snapshots.json.
+func gcRoots(repo string) ([]string, error) {
+	tips, err := refTips(repo)
+	if err != nil {
+		return nil, err
+	}
+	var roots []string
+	for _, sha := range tips {
+		roots = append(roots, sha)
+	}
+
+	if _, head, err := readHead(repo); err != nil {
+		return nil, err
+	} else if head != "" {
+		roots = append(roots, head)
+	}
+	if mergeHead, _, err := readMergeState(repo); err != nil {
+		return nil, err
+	} else if mergeHead != "" {
+		roots = append(roots, mergeHead)
+	}
+
+	snapshots, err := LoadSnapshotsFrom(repo)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error loading snapshots: %v", err)
+	}
+	for _, snap := range snapshots {
+		roots = append(roots, snap.Commit)
+	}
+	return roots, nil
+}
+
+// reachableObjects walks commits, trees, tags and delta bases from the gc
+// roots and returns every object reached. A missing object aborts the walk,
+// since pruning against an incomplete graph could delete live data.
+func reachableObjects(repo string) (map[string]bool, error) {
+	roots, err := gcRoots(repo)
+	if err != nil {
+		return nil, err
+	}
+	return walkObjects(repo, roots, nil)
+}
+
+// walkObjects returns every object reachable from roots through commits,
+// trees, tags and delta bases, without entering the objects in stop. A
+// missing object is an error.
+func walkObjects(repo string, roots []string, stop map[string]bool) (map[string]bool, error) {
+	pending := append([]string(nil), roots...)
+	reached := make(map[string]bool)
+	for len(pending) > 0 {
+		sha := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if reached[sha] || stop[sha] {
+			continue
+		}
+		reached[sha] = true
+
+		raw, err := readRawObject(repo, sha)
+		if err != nil {
+			return nil, err
+		}
+		data := raw
+		if base, err := deltaBase(sha, raw); err != nil {
+			return nil, err
+		} else if base != "" {
+			pending = append(pending, base)
+			if data, err = loadObject(repo, sha); err != nil {
+				return nil, err
+			}
+		}
+
+		objType, content, err := parseObject(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", sha, err)
+		}
+		switch objType {
+		case "commit":
+			c, err := parseCommit(sha, content)
+			if err != nil {
+				return nil, err
+			}
+			pending = append(pending, c.Tree)
+			pending = append(pending, c.Parents...)
+		case "tree":
+			entries, err := readTreeEntries(repo, sha)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range entries {
+				pending = append(pending, e.Sha)
+			}
+		case "tag":
+			t, err := parseTag(sha, content)
+			if err != nil {
+				return nil, err
+			}
+			pending = append(pending, t.Commit)
+		}
+	}
+	return reached, nil
+}
+
+// GCReport describes what GC found and did. In a dry run nothing in the
+// repository is deleted or written; the new pack is built in a temporary
+// directory so PackBytes still gives its size.
+type GCReport struct {
+	DryRun        bool   `json:"dry_run"`
+	Reachable     int    `json:"reachable"`
+	Unreachable   int    `json:"unreachable"`
+	Recent        int    `json:"recent"`
+	Pruned        int    `json:"pruned"`
+	PrunedBytes   int64  `json:"pruned_bytes"`
+	OldPacks      int    `json:"old_packs"`
+	OldPackBytes  int64  `json:"old_pack_bytes"`
+	Exploded      int    `json:"exploded"`
+	Repacked      int    `json:"repacked"`
+	RepackedBytes int64  `json:"repacked_bytes"`
+	Pack          string `json:"pack,omitempty"`
+	PackBytes     int64  `json:"pack_bytes"`
+}
+
+// Reclaimed is the net number of bytes gc frees.
+func (r *GCReport) Reclaimed() int64 {
+	return r.PrunedBytes + r.RepackedBytes + r.OldPackBytes - r.PackBytes
+}
+
+// GC collects garbage in the repository at basePath. It marks every object
+// reachable from refs, tags, HEAD and snapshots.json, deletes unreachable loose
+// objects older than grace (Recent counts the younger ones it keeps), and
+// replaces the existing packs with one pack of the reachable objects.
+//
+// An unreachable object in a pack written within grace, such as one received
+// by a push whose ref update has not landed yet, is written out as a loose
+// object carrying the pack's modification time (Exploded counts them), so it
+// ages from when it arrived rather than from this run. Reachable loose
+// objects are deleted once the new pack holds them.
+func GC(basePath string, grace time.Duration, dryRun bool) (*GCReport, error) {
+	reachable, err := reachableObjects(basePath)
+	if err != nil {
+		return nil, err
+	}
+	loose, err := looseObjects(basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &GCReport{DryRun: dryRun, Reachable: len(reachable)}
+	now := time.Now()
+	var prune []looseObject
+	var repack []string
+	isLoose := make(map[string]bool, len(loose))
+	for _, obj := range loose {
+		isLoose[obj.Sha] = true
+		if reachable[obj.Sha] {
+			repack = append(repack, obj.Sha)
+			report.Repacked++
+			report.RepackedBytes += obj.Size
+			continue
+		}
+		report.Unreachable++
+		if now.Sub(obj.ModTime) < grace {
+			report.Recent++
+			continue
+		}
+		prune = append(prune, obj)
+		report.Pruned++
+		report.PrunedBytes += obj.Size
+	}
+
+	packDir := filepath.Join(basePath, ".nutella", "objects", "pack")
+	packFiles, err := os.ReadDir(packDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var oldPacks []string
+	for _, f := range packFiles {
+		if f.IsDir() || !strings.HasPrefix(f.Name(), "pack-") {
+			continue
+		}
+		if info, err := f.Info(); err == nil {
+			report.OldPackBytes += info.Size()
+		}
+		if strings.HasSuffix(f.Name(), ".pack") {
+			report.OldPacks++
+		}
+		oldPacks = append(oldPacks, f.Name())
+	}
+
+	// Unreachable packed objects go with their pack unless it is recent.
+	indexes, err := packIndexesIn(basePath)
+	if err != nil {
+		return nil, err
+	}
+	packedAt := make(map[string]time.Time)
+	for _, idx := range indexes {
+		info, err := os.Stat(idx.packPath)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < idx.count(); i++ {
+			sha := idx.sha(i)
+			if !reachable[sha] && !isLoose[sha] && info.ModTime().After(packedAt[sha]) {
+				packedAt[sha] = info.ModTime()
+			}
+		}
+	}
+	explode := make(map[string]time.Time)
+	for sha, modTime := range packedAt {
+		report.Unreachable++
+		if now.Sub(modTime) < grace {
+			explode[sha] = modTime
+			report.Recent++
+			report.Exploded++
+			continue
+		}
+		report.Pruned++
+	}
+
+	shas := make([]string, 0, len(reachable))
+	for sha := range reachable {
+		shas = append(shas, sha)
+	}
+
+	if dryRun {
+		if len(shas) > 0 {
+			tmp, err := os.MkdirTemp("", "nutella-gc-")
+			if err != nil {
+				return nil, err
+			}
+			defer os.RemoveAll(tmp)
+			if report.Pack, err = writePackTo(basePath, tmp, shas, defaultPackOptions); err != nil {
+				return nil, err
+			}
+			report.PackBytes = packSize(tmp, report.Pack)
+		}
+		return report, nil
+	}
+
+	for sha, modTime := range explode {
+		if err := explodeObject(basePath, sha, modTime); err != nil {
+			return nil, err
+		}
+	}
+	pruned := make([]string, len(prune))
+	for i, obj := range prune {
+		pruned[i] = obj.Sha
+	}
+	if _, err := pruneLoose(basePath, pruned); err != nil {
+		return nil, err
+	}
+
+	if len(shas) > 0 {
+		if report.Pack, err = writePack(basePath, shas, defaultPackOptions); err != nil {
+			return nil, err
+		}
+		report.PackBytes = packSize(packDir, report.Pack)
+	}
+	if _, err := pruneLoose(basePath, repack); err != nil {
+		return nil, err
+	}
+	for _, name := range oldPacks {
+		if strings.TrimSuffix(strings.TrimSuffix(name, ".pack"), ".idx") == report.Pack {
+			continue
+		}
+		if err := os.Remove(filepath.Join(packDir, name)); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("error removing old pack %s: %v", name, err)
+		}
+	}
+	return report, nil
+}
+
+// explodeObject writes packed object sha out as a loose object whose
+// modification time is modTime.
+func explodeObject(repo, sha string, modTime time.Time) error {
+	data, err := loadObject(repo, sha)
+	if err != nil {
+		return err
+	}
+	objType, content, err := parseObject(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", sha, err)
+	}
+	if _, err := writeObject(repo, objType, content); err != nil {
+		return err
+	}
+	path := filepath.Join(repo, ".nutella", "objects", sha[:2], sha[2:])
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		return fmt.Errorf("error dating loose object %s: %v", sha, err)
+	}
+	return nil
+}
+
+var (
+	gcDryRun bool
+	gcGrace  time.Duration
+)
+
+// packSize is the combined size of pack name's .pack and .idx files in dir.
+func packSize(dir, name string) int64 {
+	var size int64
+	for _, ext := range []string{".pack", ".idx"} {
+		if info, err := os.Stat(filepath.Join(dir, name+ext)); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// Command to prune unreachable objects and repack the reachable ones
+var gcCmd = &cobra.Command{
+	Use:   "gc <dbID>",
+	Short: "Prune unreachable objects and repack the rest",
+	Long: `Marks every object reachable from branches, tags, HEAD and snapshots.json,
+deletes unreachable objects older than the grace period and replaces the
+existing packs with a single pack of the reachable objects. Unreachable objects
+from a pack younger than the grace period, such as a push whose ref update is
+still in flight, are kept as loose objects. Use --dry-run to see what would be
+pruned and how much space it would reclaim.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		basePath := filepath.Join(".", "files", args[0])
+		if _, err := os.Stat(filepath.Join(basePath, ".nutella")); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: repository not found at %s. Please run 'init' first.\n", basePath)
+			os.Exit(1)
+		}
+
+		report, err := GC(basePath, gcGrace, gcDryRun)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error collecting garbage: %v\n", err)
+			os.Exit(1)
+		}
+
+		verb, packVerb, keepVerb := "Pruned", "Repacked", "Kept"
+		if report.DryRun {
+			verb, packVerb, keepVerb = "Would prune", "Would repack", "Would keep"
+		}
+		fmt.Printf("Reachable objects: %d\n", report.Reachable)
+		fmt.Printf("Unreachable objects: %d (%d younger than %s kept)\n", report.Unreachable, report.Recent, gcGrace)
+		fmt.Printf("%s %d objects (%d bytes)\n", verb, report.Pruned, report.PrunedBytes)
+		if report.Exploded > 0 {
+			fmt.Printf("%s %d objects from recent packs as loose objects\n", keepVerb, report.Exploded)
+		}
+		fmt.Printf("%s %d objects into one pack (%d bytes), replacing %d packs (%d bytes)\n",
+			packVerb, report.Reachable, report.PackBytes, report.OldPacks, report.OldPackBytes)
+		fmt.Printf("Space reclaimed: %d bytes\n", report.Reclaimed())
+	},
+}
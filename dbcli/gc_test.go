@@ -0,0 +1,189 @@
+package dbcli
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"db/database"
+)
+
+func TestGC(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db_gc")
+	db, err := database.OpenDatabase(dir, "db_gc")
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	db.Close()
+
+	editCollection(t, dir, "fruits", func(c *database.Collection) {
+		if err := c.Insert("apple", "red"); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	})
+	first := commitDir(t, dir, "first")
+	if _, err := CreateTag(dir, "v1", "", "first release", defaultIdentity()); err != nil {
+		t.Fatalf("Failed to tag: %v", err)
+	}
+	editCollection(t, dir, "fruits", func(c *database.Collection) {
+		if _, err := c.Update("apple", "green"); err != nil {
+			t.Fatalf("Failed to update: %v", err)
+		}
+	})
+	commitDir(t, dir, "second")
+
+	old, err := writeObject(dir, "blob", []byte("nothing points at this"))
+	if err != nil {
+		t.Fatalf("Failed to write object: %v", err)
+	}
+	oldPath := filepath.Join(dir, ".nutella", "objects", old[:2], old[2:])
+	longAgo := time.Now().Add(-30 * 24 * time.Hour)
+	if err := os.Chtimes(oldPath, longAgo, longAgo); err != nil {
+		t.Fatalf("Failed to age object: %v", err)
+	}
+	recent, err := writeObject(dir, "blob", []byte("written by a commit still in flight"))
+	if err != nil {
+		t.Fatalf("Failed to write object: %v", err)
+	}
+
+	dry, err := GC(dir, defaultGCGrace, true)
+	if err != nil {
+		t.Fatalf("Failed to run gc --dry-run: %v", err)
+	}
+	if dry.Unreachable != 2 || dry.Recent != 1 || dry.Pruned != 1 || dry.PrunedBytes == 0 {
+		t.Errorf("dry run report = %+v; want 2 unreachable, 1 recent, 1 pruned", dry)
+	}
+	if _, err := os.Stat(oldPath); err != nil {
+		t.Errorf("dry run removed an object: %v", err)
+	}
+
+	report, err := GC(dir, defaultGCGrace, false)
+	if err != nil {
+		t.Fatalf("Failed to run gc: %v", err)
+	}
+	if report.Pruned != 1 || report.Reachable != dry.Reachable || report.Pack == "" {
+		t.Errorf("gc report = %+v; want 1 pruned and a new pack", report)
+	}
+	if _, err := os.Stat(oldPath); !os.IsNotExist(err) {
+		t.Errorf("old unreachable object survived gc: %v", err)
+	}
+	if _, err := readLooseObject(dir, recent); err != nil {
+		t.Errorf("object inside the grace period was pruned: %v", err)
+	}
+	if report.PackBytes == 0 || report.PackBytes != dry.PackBytes {
+		t.Errorf("gc wrote a %d byte pack; dry run predicted %d", report.PackBytes, dry.PackBytes)
+	}
+
+	// Everything reachable from the branch and the tag is still readable.
+	head, err := ResolveRevision(dir, "HEAD")
+	if err != nil {
+		t.Fatalf("Failed to resolve HEAD after gc: %v", err)
+	}
+	if commits, err := Log(dir, head, 0); err != nil || len(commits) != 2 {
+		t.Errorf("Log after gc = %d commits, %v; want 2", len(commits), err)
+	}
+	if sha, err := ResolveRevision(dir, "v1"); err != nil || sha != first {
+		t.Errorf("ResolveRevision(v1) = %s, %v; want %s", sha, err, first)
+	}
+	if _, err := MountCommit(dir, first); err != nil {
+		t.Errorf("Failed to mount the tagged commit after gc: %v", err)
+	}
+
+	// A second run rewrites the same pack rather than piling up another.
+	again, err := GC(dir, defaultGCGrace, false)
+	if err != nil {
+		t.Fatalf("Failed to rerun gc: %v", err)
+	}
+	if again.OldPacks != 1 || again.Pruned != 0 {
+		t.Errorf("second gc report = %+v; want 1 old pack and nothing pruned", again)
+	}
+	packs, _ := os.ReadDir(filepath.Join(dir, ".nutella", "objects", "pack"))
+	for _, p := range packs {
+		if !strings.HasPrefix(p.Name(), again.Pack+".") {
+			t.Errorf("old pack file %s left behind", p.Name())
+		}
+	}
+}
+
+// TestGCKeepsRecentPushes checks that gc keeps the objects of a pack received
+// within the grace period, before any ref points at them, and drops them once
+// the pack is older than that.
+func TestGCKeepsRecentPushes(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "db_src")
+	dst := filepath.Join(t.TempDir(), "db_dst")
+	for _, dir := range []string{src, dst} {
+		db, err := database.OpenDatabase(dir, filepath.Base(dir))
+		if err != nil {
+			t.Fatalf("Failed to create database: %v", err)
+		}
+		db.Close()
+	}
+	editCollection(t, src, "fruits", func(c *database.Collection) { c.Insert("apple", "red") })
+	first := commitDir(t, src, "apple")
+	editCollection(t, src, "fruits", func(c *database.Collection) { c.Insert("banana", "yellow") })
+	second := commitDir(t, src, "banana")
+
+	bundle, n, err := PackObjects(src, []string{first}, nil)
+	if err != nil {
+		t.Fatalf("Failed to pack: %v", err)
+	}
+	if _, err := ReceivePack(dst, bundle); err != nil {
+		t.Fatalf("Failed to receive pack: %v", err)
+	}
+	report, err := GC(dst, defaultGCGrace, false)
+	if err != nil {
+		t.Fatalf("Failed to run gc: %v", err)
+	}
+	if report.Exploded != n || report.Pruned != 0 {
+		t.Errorf("gc report = %+v; want %d exploded and nothing pruned", report, n)
+	}
+	if _, err := walkObjects(dst, []string{first}, nil); err != nil {
+		t.Fatalf("gc lost a pushed object before its ref landed: %v", err)
+	}
+
+	// Once the ref lands the objects are packed and their loose copies go.
+	if _, err := UpdateRef(dst, RefUpdate{Ref: "refs/heads/feature", New: first}); err != nil {
+		t.Fatalf("Failed to update ref after gc: %v", err)
+	}
+	report, err = GC(dst, defaultGCGrace, false)
+	if err != nil {
+		t.Fatalf("Failed to rerun gc: %v", err)
+	}
+	if report.Repacked != n || report.Unreachable != 0 {
+		t.Errorf("gc report = %+v; want %d repacked and nothing unreachable", report, n)
+	}
+	if loose, err := looseObjects(dst); err != nil || len(loose) != 0 {
+		t.Errorf("%d loose objects left after repacking, %v", len(loose), err)
+	}
+
+	// A push whose ref never landed is pruned once its pack is old enough.
+	bundle, m, err := PackObjects(src, []string{second}, []string{first})
+	if err != nil {
+		t.Fatalf("Failed to pack: %v", err)
+	}
+	if _, err := ReceivePack(dst, bundle); err != nil {
+		t.Fatalf("Failed to receive pack: %v", err)
+	}
+	longAgo := time.Now().Add(-30 * 24 * time.Hour)
+	packs, _ := filepath.Glob(filepath.Join(dst, ".nutella", "objects", "pack", "pack-*"))
+	for _, p := range packs {
+		if !strings.Contains(p, report.Pack) {
+			if err := os.Chtimes(p, longAgo, longAgo); err != nil {
+				t.Fatalf("Failed to age pack: %v", err)
+			}
+		}
+	}
+	report, err = GC(dst, defaultGCGrace, false)
+	if err != nil {
+		t.Fatalf("Failed to run gc: %v", err)
+	}
+	if report.Pruned != m || report.Exploded != 0 {
+		t.Errorf("gc report = %+v; want %d pruned and nothing exploded", report, m)
+	}
+	if _, err := readRawObject(dst, second); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("reading the stale pushed commit = %v; want ErrObjectNotFound", err)
+	}
+}
@@ -0,0 +1,257 @@
+package dbcli
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Signature identifies who authored or committed a change, and when.
+type Signature struct {
+	Name  string    `json:"name"`
+	Email string    `json:"email"`
+	When  time.Time `json:"when"`
+}
+
+// String formats s as it is stored in a commit: "Name <email> <unix> <+hhmm>".
+func (s Signature) String() string {
+	return fmt.Sprintf("%s <%s> %d %s", s.Name, s.Email, s.When.Unix(), s.When.Format("-0700"))
+}
+
+// parseSignature is the inverse of Signature.String.
+func parseSignature(v string) (Signature, error) {
+	lt, gt := strings.Index(v, "<"), strings.Index(v, ">")
+	if lt == -1 || gt < lt {
+		return Signature{}, fmt.Errorf("invalid signature %q", v)
+	}
+	sig := Signature{Name: strings.TrimSpace(v[:lt]), Email: v[lt+1 : gt]}
+
+	fields := strings.Fields(v[gt+1:])
+	if len(fields) != 2 {
+		return Signature{}, fmt.Errorf("invalid signature %q", v)
+	}
+	secs, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return Signature{}, fmt.Errorf("invalid signature time %q", fields[0])
+	}
+	zone, err := time.Parse("-0700", fields[1])
+	if err != nil {
+		return Signature{}, fmt.Errorf("invalid signature zone %q", fields[1])
+	}
+	sig.When = time.Unix(secs, 0).In(zone.Location())
+	return sig, nil
+}
+
+// ParseIdentity parses "Name <email>" as given to --author.
+func ParseIdentity(v string) (Signature, error) {
+	lt, gt := strings.Index(v, "<"), strings.LastIndex(v, ">")
+	if lt == -1 || gt < lt || strings.TrimSpace(v[:lt]) == "" {
+		return Signature{}, fmt.Errorf("identity %q is not of the form 'Name <email>'", v)
+	}
+	return Signature{Name: strings.TrimSpace(v[:lt]), Email: v[lt+1 : gt], When: time.Now()}, nil
+}
+
+// defaultIdentity is the committer identity: NUTELLA_AUTHOR_NAME and
+// NUTELLA_AUTHOR_EMAIL when set, otherwise the login name and host.
+func defaultIdentity() Signature {
+	sig := Signature{Name: os.Getenv("NUTELLA_AUTHOR_NAME"), Email: os.Getenv("NUTELLA_AUTHOR_EMAIL"), When: time.Now()}
+	if sig.Name == "" {
+		sig.Name = "nutella"
+		if u, err := user.Current(); err == nil && u.Username != "" {
+			sig.Name = u.Username
+		}
+	}
+	if sig.Email == "" {
+		host, err := os.Hostname()
+		if err != nil || host == "" {
+			host = "localhost"
+		}
+		sig.Email = sig.Name + "@" + host
+	}
+	return sig
+}
+
+// Commit is a parsed commit object. Commits written before history was
+// recorded have no parents and zero signatures.
+type Commit struct {
+	Sha       string    `json:"sha"`
+	Tree      string    `json:"tree"`
+	Parents   []string  `json:"parents"`
+	Author    Signature `json:"author"`
+	Committer Signature `json:"committer"`
+	Message   string    `json:"message"`
+}
+
+// encode renders c in the stored commit format: header lines, a blank line and
+// the message.
+func (c *Commit) encode() []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "tree %s\n", c.Tree)
+	for _, p := range c.Parents {
+		fmt.Fprintf(&b, "parent %s\n", p)
+	}
+	fmt.Fprintf(&b, "author %s\n", c.Author)
+	fmt.Fprintf(&b, "committer %s\n", c.Committer)
+	fmt.Fprintf(&b, "\n%s\n", c.Message)
+	return []byte(b.String())
+}
+
+func parseCommit(sha string, body []byte) (*Commit, error) {
+	c := &Commit{Sha: sha}
+	header, message, _ := strings.Cut(string(body), "\n\n")
+	c.Message = strings.TrimSuffix(message, "\n")
+
+	for _, line := range strings.Split(header, "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		var err error
+		switch key {
+		case "tree":
+			c.Tree = value
+		case "parent":
+			c.Parents = append(c.Parents, value)
+		case "author":
+			c.Author, err = parseSignature(value)
+		case "committer":
+			c.Committer, err = parseSignature(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("commit %s: %v", sha, err)
+		}
+	}
+	if c.Tree == "" {
+		return nil, fmt.Errorf("invalid commit object %s: no tree reference found", sha)
+	}
+	return c, nil
+}
+
+// ReadCommit loads commit sha from the repository at basePath.
+func ReadCommit(basePath, sha string) (*Commit, error) {
+	body, err := loadTyped(basePath, sha, "commit")
+	if err != nil {
+		return nil, err
+	}
+	return parseCommit(sha, body)
+}
+
+// Log walks the history reachable from start, newest commit first by
+// committer time, following every parent. max <= 0 means no limit.
+func Log(basePath, start string, max int) ([]*Commit, error) {
+	first, err := ReadCommit(basePath, start)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{start: true}
+	pending := []*Commit{first}
+
+	var out []*Commit
+	for len(pending) > 0 && (max <= 0 || len(out) < max) {
+		// Emit the newest pending commit, then queue its parents.
+		sort.SliceStable(pending, func(i, j int) bool {
+			return pending[i].Committer.When.After(pending[j].Committer.When)
+		})
+		c := pending[0]
+		pending = pending[1:]
+		out = append(out, c)
+
+		for _, p := range c.Parents {
+			if seen[p] {
+				continue
+			}
+			seen[p] = true
+			parent, err := ReadCommit(basePath, p)
+			if err != nil {
+				return nil, err
+			}
+			pending = append(pending, parent)
+		}
+	}
+	return out, nil
+}
+
+var (
+	logMaxCount int
+	logOneline  bool
+	logVerify   bool
+)
+
+// Command to show the commit history of the current branch
+var logCmd = &cobra.Command{
+	Use:   "log <dbID> [revision]",
+	Short: "Show commit history, newest first",
+	Long: `Walks the parent chain from HEAD, or from the given commit, branch or tag,
+and prints each commit with its author, date and message. --verify adds the
+result of checking each commit's signature (see verify-commit).`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		basePath := filepath.Join(".", "files", args[0])
+		ref, start, err := readHead(basePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading HEAD: %v\n", err)
+			os.Exit(1)
+		}
+		if len(args) == 2 {
+			if start, err = ResolveRevision(basePath, args[1]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		if start == "" {
+			fmt.Fprintf(os.Stderr, "Branch %s has no commits yet.\n", strings.TrimPrefix(ref, "refs/heads/"))
+			os.Exit(1)
+		}
+
+		commits, err := Log(basePath, start, logMaxCount)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error walking history: %v\n", err)
+			os.Exit(1)
+		}
+		var policy *SigningPolicy
+		if logVerify {
+			if policy, err = ReadSigningPolicy(basePath); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		for _, c := range commits {
+			var v *Verification
+			if logVerify {
+				if v, err = verifyCommit(basePath, policy, c.Sha); err != nil {
+					fmt.Fprintf(os.Stderr, "Error verifying %s: %v\n", c.Sha, err)
+					os.Exit(1)
+				}
+			}
+			if logOneline {
+				subject, _, _ := strings.Cut(c.Message, "\n")
+				if v != nil {
+					fmt.Printf("%s [%s] %s\n", c.Sha[:7], v.Status, subject)
+					continue
+				}
+				fmt.Printf("%s %s\n", c.Sha[:7], subject)
+				continue
+			}
+			fmt.Printf("commit %s\n", c.Sha)
+			if v != nil {
+				fmt.Println(describeVerification(v))
+			}
+			if len(c.Parents) > 1 {
+				fmt.Printf("Merge: %s\n", strings.Join(c.Parents, " "))
+			}
+			if c.Author.Name != "" {
+				fmt.Printf("Author: %s <%s>\n", c.Author.Name, c.Author.Email)
+				fmt.Printf("Date:   %s\n", c.Author.When.Format("Mon Jan 2 15:04:05 2006 -0700"))
+			}
+			fmt.Println()
+			for _, line := range strings.Split(c.Message, "\n") {
+				fmt.Printf("    %s\n", line)
+			}
+			fmt.Println()
+		}
+	},
+}
@@ -0,0 +1,65 @@
+package dbcli
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCommitHistory(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, ".nutella", "objects"), 0755); err != nil {
+		t.Fatalf("Failed to create repository: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".nutella", "HEAD"), []byte("ref: refs/heads/main\n"), 0644); err != nil {
+		t.Fatalf("Failed to write HEAD: %v", err)
+	}
+
+	var shas []string
+	for i, content := range []string{"one", "two", "three"} {
+		if err := os.WriteFile(filepath.Join(dir, "data.txt"), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write data: %v", err)
+		}
+		shas = append(shas, commitDir(t, dir, "commit "+content))
+
+		if i == 0 {
+			c, err := ReadCommit(dir, shas[0])
+			if err != nil {
+				t.Fatalf("Failed to read commit: %v", err)
+			}
+			if len(c.Parents) != 0 || c.Author.Name == "" || c.Committer.When.IsZero() {
+				t.Errorf("root commit = %+v; want no parents and signatures", c)
+			}
+		}
+	}
+
+	if ref, head, err := readHead(dir); err != nil || ref != "refs/heads/main" || head != shas[2] {
+		t.Errorf("readHead = %q, %q, %v; want refs/heads/main at %s", ref, head, err, shas[2])
+	}
+
+	commits, err := Log(dir, shas[2], 0)
+	if err != nil {
+		t.Fatalf("Failed to walk history: %v", err)
+	}
+	if len(commits) != 3 {
+		t.Fatalf("log has %d commits; want 3", len(commits))
+	}
+	for i, c := range commits {
+		if want := shas[2-i]; c.Sha != want {
+			t.Errorf("log[%d] = %s; want %s", i, c.Sha, want)
+		}
+		if i < 2 && (len(c.Parents) != 1 || c.Parents[0] != shas[1-i]) {
+			t.Errorf("commit %s has parents %v; want [%s]", c.Sha, c.Parents, shas[1-i])
+		}
+	}
+	if limited, _ := Log(dir, shas[2], 2); len(limited) != 2 {
+		t.Errorf("log -n 2 returned %d commits", len(limited))
+	}
+
+	sig := Signature{Name: "Ada Lovelace", Email: "ada@example.com", When: time.Unix(1700000000, 0).In(time.FixedZone("", 5*3600+1800))}
+	parsed, err := parseSignature(sig.String())
+	if err != nil || parsed.Name != sig.Name || parsed.Email != sig.Email || !parsed.When.Equal(sig.When) {
+		t.Errorf("parseSignature(%q) = %+v, %v", sig.String(), parsed, err)
+	}
+}
@@ -23,7 +23,7 @@ import (
 )
 
 type PackObject struct {
-	Type       int    // 1=commit, 2=tree, 3=blob, 4=delta (ref delta), 7=obj_delta (offset delta)
+	Type       int    // one of the obj* pack entry types in pack.go
 	Data       []byte // object data or delta instructions
 	Size       int    // size of the object
 	BaseObjID  string // base object SHA for ref delta
@@ -137,89 +137,61 @@ func computeDelta(base, target []byte) []byte {
 	return result.Bytes()
 }
 
+// deltaBlock is the block size computeDeltaOperations indexes the base by.
+// Matches shorter than this are stored as inserts.
+const deltaBlock = 16
+
+// maxDeltaCopy is the longest copy one instruction can encode.
+const maxDeltaCopy = 0xFFFFFF
+
 func computeDeltaOperations(base, target []byte) []DeltaOperation {
-	// This is a simplified approach. A real implementation would use
-	// rolling hashes or suffix arrays for more efficient matching.
+	// Index each aligned block of the base by its bytes, keeping the first
+	// occurrence. Every target position is looked up in the index and a hit is
+	// extended in both directions, so matching is linear in the input sizes.
+	index := make(map[string]int, len(base)/deltaBlock+1)
+	for off := 0; off+deltaBlock <= len(base); off += deltaBlock {
+		if _, ok := index[string(base[off:off+deltaBlock])]; !ok {
+			index[string(base[off:off+deltaBlock])] = off
+		}
+	}
 
 	var operations []DeltaOperation
-	targetIndex := 0
-
-	for targetIndex < len(target) {
-		// Try to find a matching sequence in base
-		bestMatchLen := 0
-		bestMatchOffset := 0
-
-		// Look for longest matching sequence
-		// For simplicity, we use a brute force approach
-		// A real implementation would use a more efficient algorithm
-		if len(target)-targetIndex >= 4 { // Only look for matches of at least 4 bytes
-			for baseIndex := 0; baseIndex < len(base); baseIndex++ {
-				// Calculate max possible match length from this position
-				maxMatchLen := 0
-				for i := 0; i < min(len(base)-baseIndex, len(target)-targetIndex); i++ {
-					if base[baseIndex+i] == target[targetIndex+i] {
-						maxMatchLen++
-					} else {
-						break
-					}
-				}
+	insertStart := 0
+	for i := 0; i+deltaBlock <= len(target); {
+		off, ok := index[string(target[i:i+deltaBlock])]
+		if !ok {
+			i++
+			continue
+		}
 
-				// If this match is better than our previous best, update
-				if maxMatchLen > bestMatchLen {
-					bestMatchLen = maxMatchLen
-					bestMatchOffset = baseIndex
-				}
-			}
+		// Grow the match backwards into the pending insert, then forwards.
+		start, baseStart := i, off
+		for start > insertStart && baseStart > 0 && target[start-1] == base[baseStart-1] {
+			start--
+			baseStart--
+		}
+		end, baseEnd := i+deltaBlock, off+deltaBlock
+		for end < len(target) && baseEnd < len(base) && target[end] == base[baseEnd] {
+			end++
+			baseEnd++
 		}
 
-		if bestMatchLen >= 4 { // Only use copy if match is at least 4 bytes
-			// Add a copy operation
+		if start > insertStart {
+			operations = append(operations, DeltaOperation{Data: target[insertStart:start]})
+		}
+		for n := start; n < end; {
+			size := min(end-n, maxDeltaCopy)
 			operations = append(operations, DeltaOperation{
 				IsCopy: true,
-				Offset: bestMatchOffset,
-				Size:   bestMatchLen,
-			})
-			targetIndex += bestMatchLen
-		} else {
-			// Find how many bytes don't match
-			insertStart := targetIndex
-			for targetIndex < len(target) {
-				// Check if we can find a match of at least 4 bytes
-				if targetIndex+4 <= len(target) {
-					found := false
-					for baseIndex := 0; baseIndex < len(base); baseIndex++ {
-						if baseIndex+4 <= len(base) {
-							matches := 0
-							for i := 0; i < 4; i++ {
-								if base[baseIndex+i] == target[targetIndex+i] {
-									matches++
-								} else {
-									break
-								}
-							}
-							if matches == 4 {
-								found = true
-								break
-							}
-						}
-					}
-					if found {
-						break
-					}
-				}
-				targetIndex++
-				if targetIndex-insertStart >= 127 {
-					// Maximum insert size in one operation, break here
-					break
-				}
-			}
-
-			// Add an insert operation
-			operations = append(operations, DeltaOperation{
-				IsCopy: false,
-				Data:   target[insertStart:targetIndex],
+				Offset: baseStart + (n - start),
+				Size:   size,
 			})
+			n += size
 		}
+		i, insertStart = end, end
+	}
+	if insertStart < len(target) {
+		operations = append(operations, DeltaOperation{Data: target[insertStart:]})
 	}
 
 	return operations
@@ -238,6 +210,9 @@ func applyDelta(base, delta []byte) ([]byte, error) {
 
 	// Read target size from next 4 bytes
 	targetSize := binary.LittleEndian.Uint32(delta[4:8])
+	if targetSize > maxObjectSize {
+		return nil, fmt.Errorf("delta target size %d exceeds %d bytes", targetSize, maxObjectSize)
+	}
 
 	// Allocate result buffer
 	result := make([]byte, 0, targetSize)
@@ -259,6 +234,9 @@ func applyDelta(base, delta []byte) ([]byte, error) {
 			// Read offset (if corresponding bit is set)
 			for j := 0; j < 4; j++ {
 				if cmd&(1<<j) != 0 {
+					if i >= len(delta) {
+						return nil, fmt.Errorf("truncated copy operation")
+					}
 					offset |= int(delta[i]) << (j * 8)
 					i++
 				}
@@ -267,6 +245,9 @@ func applyDelta(base, delta []byte) ([]byte, error) {
 			// Read size (if corresponding bit is set)
 			for j := 0; j < 3; j++ {
 				if cmd&(1<<(j+4)) != 0 {
+					if i >= len(delta) {
+						return nil, fmt.Errorf("truncated copy operation")
+					}
 					size |= int(delta[i]) << (j * 8)
 					i++
 				}
@@ -282,6 +263,9 @@ func applyDelta(base, delta []byte) ([]byte, error) {
 				return nil, fmt.Errorf("invalid copy operation: offset=%d, size=%d, base_len=%d",
 					offset, size, len(base))
 			}
+			if len(result)+size > int(targetSize) {
+				return nil, fmt.Errorf("delta writes past its target size %d", targetSize)
+			}
 
 			// Copy data from base
 			result = append(result, base[offset:offset+size]...)
@@ -292,6 +276,9 @@ func applyDelta(base, delta []byte) ([]byte, error) {
 				return nil, fmt.Errorf("invalid insert operation: size=%d, remaining=%d",
 					size, len(delta)-i)
 			}
+			if len(result)+size > int(targetSize) {
+				return nil, fmt.Errorf("delta writes past its target size %d", targetSize)
+			}
 
 			// Copy data from delta
 			result = append(result, delta[i:i+size]...)
@@ -315,7 +302,9 @@ func min(a, b int) int {
 	return b
 }
 
-func writeDeltaObject(baseObjID string, delta []byte) (string, error) {
+// writeDeltaObject stores delta against baseObjID as a loose delta object of
+// the repository at repo.
+func writeDeltaObject(repo, baseObjID string, delta []byte) (string, error) {
 	// Format: "delta <base-sha> <size>\0<delta-data>"
 	header := fmt.Sprintf("delta %s %d\u0000", baseObjID, len(delta))
 	store := append([]byte(header), delta...)
@@ -327,10 +316,10 @@ func writeDeltaObject(baseObjID string, delta []byte) (string, error) {
 	// Build path to store the delta object
 	dir := sha[:2]
 	name := sha[2:]
-	objPath := filepath.Join(".nutella", "objects", dir, name)
+	objPath := filepath.Join(repo, ".nutella", "objects", dir, name)
 
 	// Ensure directory exists
-	if err := os.MkdirAll(filepath.Join(".nutella", "objects", dir), 0755); err != nil {
+	if err := os.MkdirAll(filepath.Join(repo, ".nutella", "objects", dir), 0755); err != nil {
 		return "", fmt.Errorf("error creating object directory: %w", err)
 	}
 
@@ -377,11 +366,19 @@ var createDBCmd = &cobra.Command{
 	},
 }
 
+var (
+	packPruneLoose bool
+	packOpts       = defaultPackOptions
+)
+
 var packObjectsCmd = &cobra.Command{
 	Use:   "pack <dbID>",
 	Short: "Pack loose objects into a packfile",
-	Long:  "This command packs loose objects in the repository into a packfile to save space",
-	Args:  cobra.ExactArgs(1),
+	Long: `This command packs loose objects in the repository into a packfile to save space.
+Each object is stored as a delta against the most similar of the --window objects
+of its type before it, with chains capped at --depth. With --prune-loose, the
+pack is read back and every object rehashed before the loose copies are deleted.`,
+	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		dbID := args[0]
 		basePath, _ := filepath.Abs(filepath.Join("files", dbID))
@@ -392,46 +389,16 @@ var packObjectsCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
-		// Create a packfile
-		packID := time.Now().Format("20060102-150405")
-		packName := fmt.Sprintf("pack-%s", packID)
-		packPath := filepath.Join(".nutella", "objects", "pack")
-
-		// Ensure pack directory exists
-		if err := os.MkdirAll(packPath, 0755); err != nil {
-			fmt.Fprintf(os.Stderr, "Error creating pack directory: %v\n", err)
-			os.Exit(1)
-		}
-
 		// Find all loose objects
-		objectsDir := filepath.Join(".nutella", "objects")
-		var objects []string
-
-		// Walk the objects directory to find loose objects
-		err := filepath.Walk(objectsDir, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-
-			// Skip directories and pack files
-			if info.IsDir() || strings.Contains(path, "pack") {
-				return nil
-			}
-
-			// Get the object ID from the path
-			dir := filepath.Base(filepath.Dir(path))
-			file := filepath.Base(path)
-			if len(dir) == 2 && len(file) == 38 {
-				objects = append(objects, dir+file)
-			}
-
-			return nil
-		})
-
+		loose, err := looseObjects(".")
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error scanning objects: %v\n", err)
 			os.Exit(1)
 		}
+		objects := make([]string, 0, len(loose))
+		for _, obj := range loose {
+			objects = append(objects, obj.Sha)
+		}
 
 		if len(objects) == 0 {
 			fmt.Println("No loose objects found to pack")
@@ -440,59 +407,31 @@ var packObjectsCmd = &cobra.Command{
 
 		fmt.Printf("Found %d objects to pack\n", len(objects))
 
-		// Sort objects by type and then by path to improve delta compression
-		// In a real implementation, you'd sort them in a way that maximizes delta compression
-
-		// Create a packfile
-		packFile, err := os.Create(filepath.Join(packPath, packName+".pack"))
+		packName, err := writePack(".", objects, packOpts)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error creating packfile: %v\n", err)
+			fmt.Fprintf(os.Stderr, "Error packing objects: %v\n", err)
 			os.Exit(1)
 		}
-		defer packFile.Close()
 
-		// Write pack header: "PACK" signature, version (2), and number of objects
-		packFile.Write([]byte("PACK"))
-		binary.Write(packFile, binary.BigEndian, uint32(2)) // Version
-		binary.Write(packFile, binary.BigEndian, uint32(len(objects)))
-
-		// Create index file
-		indexFile, err := os.Create(filepath.Join(packPath, packName+".idx"))
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error creating index file: %v\n", err)
-			os.Exit(1)
-		}
-		defer indexFile.Close()
-
-		// Write index header: the format depends on your implementation
-		// For simplicity, we'll use a simple format: list of (sha, offset) pairs
-
-		// Process objects
-		for i, objID := range objects {
-			// Read the object
-			objData := readObject(objID)
-
-			// Record the offset in the packfile
-			offset, _ := packFile.Seek(0, io.SeekCurrent)
-
-			// Write the object to the packfile
-			// In a real implementation, you'd use delta compression between objects
-			// For simplicity, we'll just write them as-is
-			packFile.Write(objData)
-
-			// Write the index entry
-			binary.Write(indexFile, binary.BigEndian, objID)
-			binary.Write(indexFile, binary.BigEndian, uint64(offset))
+		fmt.Printf("Successfully packed %d objects into %s\n", len(objects), packName)
 
-			if i%100 == 0 {
-				fmt.Printf("Packed %d/%d objects\n", i, len(objects))
+		if packPruneLoose {
+			entries, err := verifyPack(".", packName)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error verifying pack, keeping loose objects: %v\n", err)
+				os.Exit(1)
 			}
+			packed := make([]string, len(entries))
+			for i, e := range entries {
+				packed[i] = e.Sha
+			}
+			pruned, err := pruneLoose(".", packed)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Verified %s and removed %d loose objects\n", packName, pruned)
 		}
-
-		fmt.Printf("Successfully packed %d objects into %s\n", len(objects), packName)
-
-		// In a real implementation, you'd add an option to remove the loose objects
-		// after successful packing
 	},
 }
 
@@ -558,6 +497,9 @@ var insertCmd = &cobra.Command{
 	},
 }
 
+// findAt makes find and find-all read a branch or commit instead of the live data.
+var findAt string
+
 // Command to find a key in a collection
 var findKeyCmd = &cobra.Command{
 	Use:   "find [dbID] [collection] [key]",
@@ -570,6 +512,23 @@ var findKeyCmd = &cobra.Command{
 
 		basePath := filepath.Join(".", "files", dbID)
 
+		if findAt != "" {
+			m, err := MountCommit(basePath, findAt)
+			if err != nil {
+				log.Fatalf("Error mounting %s: %v", findAt, err)
+			}
+			val, found, err := m.Find(collName, key)
+			if err != nil {
+				log.Fatalf("Error reading collection '%s' at %s: %v", collName, findAt, err)
+			}
+			if found {
+				fmt.Printf("Found key: %s => %v (in collection: %s at %s)\n", key, val, collName, m.Commit())
+			} else {
+				fmt.Printf("Key not found: %s (in collection: %s at %s)\n", key, collName, m.Commit())
+			}
+			return
+		}
+
 		db, err := database.LoadDatabase(basePath)
 		if err != nil {
 			log.Fatalf("Error loading database '%s': %v", dbID, err)
@@ -585,7 +544,7 @@ var findKeyCmd = &cobra.Command{
 	},
 }
 
-// Command to find a key in a collection
+// Command to list every key in a collection
 var findAllCmd = &cobra.Command{
 	Use:   "find-all [dbID] [collection]",
 	Short: "Find all keys in a collection",
@@ -596,6 +555,21 @@ var findAllCmd = &cobra.Command{
 
 		basePath := filepath.Join(".", "files", dbID)
 
+		if findAt != "" {
+			m, err := MountCommit(basePath, findAt)
+			if err != nil {
+				log.Fatalf("Error mounting %s: %v", findAt, err)
+			}
+			result, err := m.FindAll(collName)
+			if err != nil {
+				log.Fatalf("Error reading collection '%s' at %s: %v", collName, findAt, err)
+			}
+			for _, kv := range result {
+				fmt.Printf("%s : %v\n", kv.Key, kv.Value)
+			}
+			return
+		}
+
 		db, err := database.LoadDatabase(basePath)
 		if err != nil {
 			log.Fatalf("Error loading database '%s': %v", dbID, err)
@@ -691,6 +665,9 @@ var handleInitCmd = &cobra.Command{
 // commitMessage will hold the commit message from the "-m" flag.
 var commitMessage string
 
+// commitAuthor overrides the commit author ("Name <email>").
+var commitAuthor string
+
 // Command to commit all changes and store the snapshot.
 var handleCommitAllCmd = &cobra.Command{
 	Use:   "commit-all <dbID>",
@@ -700,7 +677,8 @@ var handleCommitAllCmd = &cobra.Command{
   2. Loads ignore patterns from .nutignore.
   3. Recursively hashes all files in the repository (ignoring .nutella and matching ignore patterns).
   4. Writes a tree object for the entire directory structure.
-  5. Creates and stores a commit object with the provided commit message.
+  5. Creates and stores a commit object with the provided commit message, whose
+     parent is the current HEAD, and moves the current branch to it.
   6. Stores the resulting commit hash, commit message, and a timestamp in snapshots.json with a unique UUID key.`,
 	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
@@ -713,74 +691,73 @@ var handleCommitAllCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
-		// Change current working directory to the repository base.
-		if err := os.Chdir(basePath); err != nil {
-			fmt.Fprintf(os.Stderr, "Error changing directory to %s: %s\n", basePath, err)
-			os.Exit(1)
-		}
-
 		if commitMessage == "" {
 			fmt.Fprintf(os.Stderr, "Error: commit message cannot be empty. Usage: commit-all <dbID> -m \"<message>\"\n")
 			os.Exit(1)
 		}
 
-		// Load ignore patterns from .nutignore.
-		ignores, err := loadGitignore()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error reading .nutignore: %s\n", err)
-			os.Exit(1)
-		}
-
-		// Create tree recursively from the repository directory.
-		treeSha, err := writeTreeRecursive(".", ".", ignores)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error writing tree: %s\n", err)
-			os.Exit(1)
+		author := defaultIdentity()
+		if commitAuthor != "" {
+			var err error
+			if author, err = ParseIdentity(commitAuthor); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+				os.Exit(1)
+			}
 		}
-
-		sha, err := createAndStoreCommit(treeSha, commitMessage)
+		commit, err := CommitWorkingTree(basePath, commitMessage, author, nil)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error storing commit: %s\n", err)
+			fmt.Fprintf(os.Stderr, "%s\n", err)
 			os.Exit(1)
 		}
 
-		// Store the commit snapshot using the relative path.
-		if err := storeSnapshot(sha, commitMessage); err != nil {
-			fmt.Fprintf(os.Stderr, "Error storing snapshot: %s\n", err)
-			os.Exit(1)
-		}
-
-		fmt.Println(sha)
+		fmt.Println(commit.Sha)
 	},
 }
 
-// createAndStoreCommit creates a commit object with the given tree SHA and commit message.
-// It returns the computed commit hash.
-func createAndStoreCommit(treeSha, message string) (string, error) {
-	commitContent := fmt.Sprintf("tree %s\n\n%s\n", treeSha, message)
-	header := fmt.Sprintf("commit %d\u0000", len(commitContent))
-	store := append([]byte(header), []byte(commitContent)...)
-	hash := sha1.Sum(store)
-	sha := fmt.Sprintf("%x", hash)
-
-	// Build path to store the commit object under .nutella/objects.
-	dir := sha[:2]
-	name := sha[2:]
-	path := filepath.Join(".nutella", "objects", dir, name)
-
-	if err := os.MkdirAll(filepath.Join(".nutella", "objects", dir), 0755); err != nil {
-		return "", fmt.Errorf("Error creating commit directory: %w", err)
+// createAndStoreCommit records treeSha as a new commit on the current branch
+// of the repository at repo. The commit's parent is the commit HEAD resolves
+// to, if any, and HEAD's branch is moved to the new commit. While a merge is
+// in progress the merged commit becomes the second parent, and the commit is
+// refused until every conflict is resolved. The commit is signed when
+// NUTELLA_SIGNING_KEY names a key.
+func createAndStoreCommit(repo, treeSha, message string, author Signature) (*Commit, error) {
+	_, parent, err := readHead(repo)
+	if err != nil {
+		return nil, err
+	}
+	mergeHead, conflicts, err := readMergeState(repo)
+	if err != nil {
+		return nil, err
+	}
+	if len(conflicts) > 0 {
+		return nil, fmt.Errorf("%w (%d left); resolve them with 'resolve' first", ErrUnresolvedConflicts, len(conflicts))
 	}
 
-	var buf bytes.Buffer
-	w := zlib.NewWriter(&buf)
-	_, _ = w.Write(store)
-	w.Close()
-
-	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
-		return "", fmt.Errorf("Error writing commit: %w", err)
+	c := &Commit{Tree: treeSha, Author: author, Committer: defaultIdentity(), Message: message}
+	if parent != "" {
+		c.Parents = []string{parent}
 	}
-	return sha, nil
+	if mergeHead != "" {
+		c.Parents = append(c.Parents, mergeHead)
+	}
+	key, err := signingKey()
+	if err != nil {
+		return nil, err
+	}
+	body := c.encode()
+	if key != nil {
+		body = signObject(body, key)
+	}
+	if c.Sha, err = writeObject(repo, "commit", body); err != nil {
+		return nil, fmt.Errorf("Error writing commit: %w", err)
+	}
+	if err := advanceHead(repo, c.Sha); err != nil {
+		return nil, err
+	}
+	if err := clearMergeState(repo); err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
 // Snapshot represents a single commit snapshot.
@@ -788,47 +765,56 @@ type Snapshot struct {
 	Commit    string `json:"commit"`
 	Message   string `json:"message"`
 	Timestamp string `json:"timestamp"`
+	Auto      bool   `json:"auto,omitempty"` // made by the server's auto-commit, subject to retention
+}
+
+// SnapshotEntry pairs a snapshots.json key with its snapshot.
+type SnapshotEntry struct {
+	Key      string
+	Snapshot Snapshot
 }
 
-// storeSnapshot updates the snapshots.json file (in the .nutella folder) by adding
-// a new entry keyed by a UUID containing the commit hash, commit message, and the current timestamp.
-func storeSnapshot(commitHash, commitMsg string) error {
-	// Since we've already changed to the repository base, use a relative path.
-	snapshotsPath := filepath.Join(".nutella", "snapshots.json")
+// SortSnapshots orders snapshots by timestamp, oldest first.
+// If timestamps cannot be parsed, it falls back to a simple string comparison.
+func SortSnapshots(snapshots map[string]Snapshot) []SnapshotEntry {
+	var snapshotList []SnapshotEntry
+	for key, snap := range snapshots {
+		snapshotList = append(snapshotList, SnapshotEntry{Key: key, Snapshot: snap})
+	}
+
+	sort.Slice(snapshotList, func(i, j int) bool {
+		ti, err1 := time.Parse(time.RFC3339, snapshotList[i].Snapshot.Timestamp)
+		tj, err2 := time.Parse(time.RFC3339, snapshotList[j].Snapshot.Timestamp)
+		if err1 != nil || err2 != nil {
+			return snapshotList[i].Snapshot.Timestamp < snapshotList[j].Snapshot.Timestamp
+		}
+		return ti.Before(tj)
+	})
+	return snapshotList
+}
 
+// recordSnapshot adds snap to <repo>/.nutella/snapshots.json under a new UUID,
+// stamping it with the current time in RFC3339 format.
+func recordSnapshot(repo string, snap Snapshot) error {
 	// Read existing snapshots file.
-	var snapshots map[string]Snapshot
-	data, err := os.ReadFile(snapshotsPath)
+	snapshots, err := LoadSnapshotsFrom(repo)
 	if err != nil {
-		// If file doesn't exist or cannot be read, start with an empty map.
+		// If the file doesn't exist or cannot be parsed, start with an empty map.
 		snapshots = make(map[string]Snapshot)
-	} else {
-		if err := json.Unmarshal(data, &snapshots); err != nil {
-			// If unmarshalling fails, start fresh.
-			snapshots = make(map[string]Snapshot)
-		}
 	}
 
-	// Generate a new UUID as the key.
-	id := uuid.New().String()
-	// Use RFC3339 format for the timestamp.
-	timestamp := time.Now().Format(time.RFC3339)
-
-	// Append new snapshot with commit hash, message, and timestamp.
-	snapshots[id] = Snapshot{
-		Commit:    commitHash,
-		Message:   commitMsg,
-		Timestamp: timestamp,
-	}
+	snap.Timestamp = time.Now().Format(time.RFC3339)
+	snapshots[uuid.New().String()] = snap
+	return writeSnapshots(repo, snapshots)
+}
 
-	// Marshal back to JSON.
+// writeSnapshots replaces <repo>/.nutella/snapshots.json with snapshots.
+func writeSnapshots(repo string, snapshots map[string]Snapshot) error {
 	updatedData, err := json.MarshalIndent(snapshots, "", "  ")
 	if err != nil {
 		return fmt.Errorf("Error marshalling snapshots: %w", err)
 	}
-
-	// Write updated JSON back to snapshots.json.
-	if err := os.WriteFile(snapshotsPath, updatedData, 0644); err != nil {
+	if err := os.WriteFile(filepath.Join(repo, ".nutella", "snapshots.json"), updatedData, 0644); err != nil {
 		return fmt.Errorf("Error writing snapshots file: %w", err)
 	}
 	return nil
@@ -836,7 +822,12 @@ func storeSnapshot(commitHash, commitMsg string) error {
 
 // loadGitignore reads the .nutignore file and returns the list of ignore patterns.
 func loadGitignore() ([]string, error) {
-	data, err := os.ReadFile(".nutignore")
+	return loadIgnores(".")
+}
+
+// loadIgnores reads <repo>/.nutignore.
+func loadIgnores(repo string) ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(repo, ".nutignore"))
 	if os.IsNotExist(err) {
 		return []string{}, nil
 	}
@@ -857,7 +848,8 @@ func loadGitignore() ([]string, error) {
 }
 
 // writeTreeRecursive creates a tree object for the directory (relative to repo root).
-// 'root' is the repository root (".") and 'dir' is the current directory relative to root.
+// 'root' is the repository root and 'dir' is the current directory relative to root;
+// objects are written to root's .nutella.
 func writeTreeRecursive(root, dir string, ignores []string) (string, error) {
 	var entries []byte
 
@@ -868,8 +860,8 @@ func writeTreeRecursive(root, dir string, ignores []string) (string, error) {
 	}
 
 	for _, f := range files {
-		// Ignore the .nutella folder.
-		if f.Name() == ".nutella" {
+		// Ignore the .nutella folder and the write-ahead log.
+		if f.Name() == ".nutella" || f.Name() == ".wal" {
 			continue
 		}
 		// Compute relative path from repo root.
@@ -893,7 +885,7 @@ func writeTreeRecursive(root, dir string, ignores []string) (string, error) {
 			}
 		} else {
 			mode = "100644"
-			sha, err = hashAndWriteBlob(fullPath)
+			sha, err = hashAndWriteBlob(root, fullPath)
 			if err != nil {
 				return "", err
 			}
@@ -914,7 +906,7 @@ func writeTreeRecursive(root, dir string, ignores []string) (string, error) {
 	shaStr := fmt.Sprintf("%x", hash)
 	dirName := shaStr[:2]
 	fileName := shaStr[2:]
-	objPath := filepath.Join(".nutella", "objects", dirName, fileName)
+	objPath := filepath.Join(root, ".nutella", "objects", dirName, fileName)
 
 	if err := os.MkdirAll(filepath.Dir(objPath), 0755); err != nil {
 		return "", err
@@ -942,8 +934,9 @@ func shouldIgnore(relPath string, patterns []string) bool {
 	return false
 }
 
-// hashAndWriteBlob creates a blob object from the given file and returns its SHA.
-func hashAndWriteBlob(filename string) (string, error) {
+// hashAndWriteBlob creates a blob object from the given file in the repository
+// at repo and returns its SHA.
+func hashAndWriteBlob(repo, filename string) (string, error) {
 	content, err := os.ReadFile(filename)
 	if err != nil {
 		return "", err
@@ -958,14 +951,14 @@ func hashAndWriteBlob(filename string) (string, error) {
 	// Check if this object already exists
 	dir := sha[:2]
 	name := sha[2:]
-	objPath := filepath.Join(".nutella", "objects", dir, name)
+	objPath := filepath.Join(repo, ".nutella", "objects", dir, name)
 	if _, err := os.Stat(objPath); err == nil {
 		// Object already exists, just return its SHA
 		return sha, nil
 	}
 
 	// Find a similar object to use as a base for delta compression
-	baseObjID, baseContent := findSimilarObject(content)
+	baseObjID, baseContent := findSimilarObject(repo, content)
 
 	if baseObjID != "" {
 		// Compute delta
@@ -974,7 +967,7 @@ func hashAndWriteBlob(filename string) (string, error) {
 		// If delta is smaller than the original content (with some margin)
 		if len(delta) < len(content)*9/10 {
 			// Store as a delta object
-			deltaSha, err := writeDeltaObject(baseObjID, delta)
+			deltaSha, err := writeDeltaObject(repo, baseObjID, delta)
 			if err != nil {
 				// Fall back to direct storage on error
 				fmt.Fprintf(os.Stderr, "Warning: failed to write delta: %v\n", err)
@@ -986,7 +979,7 @@ func hashAndWriteBlob(filename string) (string, error) {
 
 	// If we reach here, either no suitable base was found or delta wasn't efficient
 	// Fall back to storing the full object
-	if err := os.MkdirAll(filepath.Join(".nutella", "objects", dir), 0755); err != nil {
+	if err := os.MkdirAll(filepath.Join(repo, ".nutella", "objects", dir), 0755); err != nil {
 		return "", err
 	}
 
@@ -1002,10 +995,10 @@ func hashAndWriteBlob(filename string) (string, error) {
 	return sha, nil
 }
 
-func findSimilarObject(content []byte) (string, []byte) {
+func findSimilarObject(repo string, content []byte) (string, []byte) {
 	// This is a simplified approach. A real implementation would index objects
 	// by size or use other heuristics to find similar files quickly.
-	objectsDir := filepath.Join(".nutella", "objects")
+	objectsDir := filepath.Join(repo, ".nutella", "objects")
 
 	// Look for blob objects only
 	var bestMatch string
@@ -1145,26 +1138,7 @@ var restoreCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
-		// Convert map to slice for sorting.
-		type snapEntry struct {
-			Key      string
-			Snapshot Snapshot
-		}
-		var snapshotList []snapEntry
-		for key, snap := range snapshots {
-			snapshotList = append(snapshotList, snapEntry{Key: key, Snapshot: snap})
-		}
-
-		// Sort snapshots by timestamp.
-		// If timestamps cannot be parsed, fallback to a simple string comparison.
-		sort.Slice(snapshotList, func(i, j int) bool {
-			ti, err1 := time.Parse(time.RFC3339, snapshotList[i].Snapshot.Timestamp)
-			tj, err2 := time.Parse(time.RFC3339, snapshotList[j].Snapshot.Timestamp)
-			if err1 != nil || err2 != nil {
-				return snapshotList[i].Snapshot.Timestamp < snapshotList[j].Snapshot.Timestamp
-			}
-			return ti.Before(tj)
-		})
+		snapshotList := SortSnapshots(snapshots)
 
 		// Display snapshots.
 		fmt.Println("Available snapshots:")
@@ -1196,65 +1170,105 @@ var restoreCmd = &cobra.Command{
 	},
 }
 
+var (
+	// restoreInto names the new database restore-to materializes the commit as.
+	restoreInto string
+	// restoreCollection and restoreKeys limit restore-to to one collection,
+	// optionally to some of its keys.
+	restoreCollection string
+	restoreKeys       []string
+)
+
 // New Restore Command
 var restoreToCmd = &cobra.Command{
-	Use:   "restore-to <dbname> <commit-hash>",
+	Use:   "restore-to <dbname> <revision>",
 	Short: "Restore a database to a previous commit snapshot",
-	Long: `This command will:
-  1. Change directory to the given database (./files/<dbname>).
-  2. Load snapshots stored in .nutella/snapshots.json.
-  3. Display the commit hash, commit message, and timestamp (sorted by time).
-  4. Prompt for a commit hash to restore.
-  5. Restore the working directory to that commit state.`,
+	Long: `Without --into, replaces the working tree of ./files/<dbname> with the given
+revision, overwriting the live data. The revision may be a full or short
+commit SHA, a branch or a tag.
+
+With --into <newDbID>, leaves <dbname> untouched and materializes the commit
+(or branch) as a separate database ./files/<newDbID> with a fresh repository.
+
+With --collection <name>, only that collection is brought back to the revision:
+the keys that differ are updated, inserted or deleted through the collection,
+and every other collection, HEAD and the rest of the working tree are left
+alone. --keys limits this further to exact keys or prefixes ending in "*",
+e.g. --keys "user:*,config".`,
 	Args: cobra.ExactArgs(2),
 	Run: func(cmd *cobra.Command, args []string) {
 		dbName := args[0]
 		basePath := filepath.Join(".", "files", dbName)
 
+		if len(restoreKeys) > 0 && restoreCollection == "" {
+			fmt.Fprintln(os.Stderr, "Error: --keys requires --collection")
+			os.Exit(1)
+		}
+		if restoreCollection != "" {
+			if restoreInto != "" {
+				fmt.Fprintln(os.Stderr, "Error: --collection cannot be combined with --into")
+				os.Exit(1)
+			}
+			if _, err := os.Stat(filepath.Join(basePath, ".nutella")); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: repository not found at %s. Please run 'init' first.\n", basePath)
+				os.Exit(1)
+			}
+			changes, err := RestoreCollection(basePath, args[1], restoreCollection, restoreKeys)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error restoring collection %s: %v\n", restoreCollection, err)
+				os.Exit(1)
+			}
+			printKeyChanges(changes)
+			fmt.Printf("Restored %d keys of collection %s from %s\n", len(changes), restoreCollection, args[1])
+			return
+		}
+
+		if restoreInto != "" {
+			sha, err := RestoreInto(basePath, args[1], filepath.Join(".", "files"), restoreInto)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error restoring %s into %s: %v\n", args[1], restoreInto, err)
+				os.Exit(1)
+			}
+			fmt.Printf("Restored commit %s into database %s\n", sha, restoreInto)
+			return
+		}
+
+		sha, err := ResolveRevision(basePath, args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
 		// Change working directory to the repository base.
 		if err := os.Chdir(basePath); err != nil {
 			fmt.Fprintf(os.Stderr, "Error changing directory to %s: %v\n", basePath, err)
 			os.Exit(1)
 		}
 
-		restoreCommit(args[1])
+		restoreCommit(sha)
 	},
 }
 
 // restoreCommit reads the commit object, extracts the tree SHA, cleans the directory,
 // and restores the tree from that commit.
 func restoreCommit(commitSha string) {
-	data := readObject(commitSha)
-
-	// Find the first null byte to separate header from content
-	nullIndex := bytes.IndexByte(data, 0)
-	if nullIndex == -1 {
-		fmt.Fprintf(os.Stderr, "Invalid commit object: missing null byte\n")
-		os.Exit(1)
-	}
-	body := data[nullIndex+1:]
-	lines := bytes.Split(body, []byte("\n"))
-	if len(lines) < 1 || !bytes.HasPrefix(lines[0], []byte("tree ")) {
-		fmt.Fprintf(os.Stderr, "Invalid commit object: no tree reference found\n")
+	if err := Restore(".", commitSha); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
-	treeSha := string(bytes.TrimPrefix(lines[0], []byte("tree ")))
-
-	// Load ignore patterns
-	ignores, _ := loadGitignore()
-
-	// Clean the current directory, preserving .nutella and .nutignore
-	cleanCurrentDirectory(ignores)
-
-	// Restore the tree - this will now handle delta objects through the readObject function
-	restoreTree(treeSha, ".", "", ignores)
 
 	fmt.Printf("Restored to commit %s\n", commitSha)
 }
 
 // LoadSnapshots reads snapshots from .nutella/snapshots.json.
 func LoadSnapshots() (map[string]Snapshot, error) {
-	data, err := os.ReadFile(filepath.Join(".nutella", "snapshots.json"))
+	return LoadSnapshotsFrom(".")
+}
+
+// LoadSnapshotsFrom reads snapshots from <basePath>/.nutella/snapshots.json
+// without changing the working directory.
+func LoadSnapshotsFrom(basePath string) (map[string]Snapshot, error) {
+	data, err := os.ReadFile(filepath.Join(basePath, ".nutella", "snapshots.json"))
 	if err != nil {
 		return nil, err
 	}
@@ -1267,170 +1281,111 @@ func LoadSnapshots() (map[string]Snapshot, error) {
 
 // readObject reads a stored object from .nutella/objects given its SHA.
 func readObject(sha string) []byte {
-	if len(sha) < 2 {
-		fmt.Fprintf(os.Stderr, "Invalid SHA: %q\n", sha)
-		os.Exit(1)
-	}
-	dir, name := sha[:2], sha[2:]
-	path := filepath.Join(".nutella", "objects", dir, name)
-	data, err := os.ReadFile(path)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading object file: %v\n", err)
-		os.Exit(1)
-	}
-
-	r, err := zlib.NewReader(bytes.NewReader(data))
+	data, err := loadObject(".", sha)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating zlib reader: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error reading object: %v\n", err)
 		os.Exit(1)
 	}
-	defer r.Close()
-
-	decompressedData, err := io.ReadAll(r)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error decompressing data: %v\n", err)
-		os.Exit(1)
-	}
-
-	// Check if this is a delta object
-	if bytes.HasPrefix(decompressedData, []byte("delta ")) {
-		// Parse the header to get base object ID and delta size
-		nullIdx := bytes.IndexByte(decompressedData, 0)
-		if nullIdx == -1 {
-			fmt.Fprintf(os.Stderr, "Invalid delta object: missing null byte\n")
-			os.Exit(1)
-		}
-
-		header := string(decompressedData[:nullIdx])
-		parts := strings.Fields(header)
-		if len(parts) != 3 {
-			fmt.Fprintf(os.Stderr, "Invalid delta header: %s\n", header)
-			os.Exit(1)
-		}
-
-		baseObjID := parts[1]
-
-		// Get the delta data
-		deltaData := decompressedData[nullIdx+1:]
-
-		// Get the base object
-		baseObj := readObject(baseObjID)
-
-		// Extract the content from the base object
-		baseNullIdx := bytes.IndexByte(baseObj, 0)
-		if baseNullIdx == -1 {
-			fmt.Fprintf(os.Stderr, "Invalid base object: missing null byte\n")
-			os.Exit(1)
-		}
-		baseContent := baseObj[baseNullIdx+1:]
-
-		// Apply the delta
-		resultContent, err := applyDelta(baseContent, deltaData)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error applying delta: %v\n", err)
-			os.Exit(1)
-		}
-
-		// Reconstruct the object with proper header
-		// We need to determine the original object type from the base object
-		baseHeader := string(baseObj[:baseNullIdx])
-		baseParts := strings.Fields(baseHeader)
-		if len(baseParts) < 1 {
-			fmt.Fprintf(os.Stderr, "Invalid base object header: %s\n", baseHeader)
-			os.Exit(1)
-		}
-
-		objType := baseParts[0]
-		objHeader := fmt.Sprintf("%s %d", objType, len(resultContent))
-
-		return append([]byte(objHeader+"\u0000"), resultContent...)
-	}
-
-	// Not a delta object, return as-is
-	return decompressedData
-}
-
-// cleanCurrentDirectory removes all files and directories in the current directory,
-// except for .nutella and .nutignore.
-func cleanCurrentDirectory(ignores []string) {
-	entries, err := os.ReadDir(".")
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading current directory: %v\n", err)
-		os.Exit(1)
-	}
-
-	for _, entry := range entries {
-		name := entry.Name()
-		if name == ".nutella" || name == ".nutignore" {
-			continue
-		}
-		if shouldIgnore(name, ignores) {
-			continue
-		}
-		if err := os.RemoveAll(name); err != nil {
-			fmt.Fprintf(os.Stderr, "Error removing %s: %v\n", name, err)
-		}
-	}
-}
-
-// restoreTree recreates the files and directories from a tree object.
-func restoreTree(treeSha, restorePath, repoRel string, ignores []string) {
-	data := readObject(treeSha)
-
-	nullIndex := bytes.IndexByte(data, 0)
-	body := data[nullIndex+1:]
-	i := 0
-	for i < len(body) {
-		modeEnd := bytes.IndexByte(body[i:], ' ')
-		mode := string(body[i : i+modeEnd])
-		i += modeEnd + 1
-		nameEnd := bytes.IndexByte(body[i:], 0)
-		name := string(body[i : i+nameEnd])
-		i += nameEnd + 1
-		entrySha := fmt.Sprintf("%x", body[i:i+20])
-		i += 20
-
-		relEntry := name
-		if repoRel != "" {
-			relEntry = filepath.Join(repoRel, name)
-		}
-		if shouldIgnore(relEntry, ignores) {
-			continue
-		}
-
-		fullPath := filepath.Join(restorePath, name)
-		if mode == "100644" {
-			blobData := readObject(entrySha)
-			nullIdx := bytes.IndexByte(blobData, 0)
-			fileContent := blobData[nullIdx+1:]
-			_ = os.MkdirAll(restorePath, 0755)
-			if err := os.WriteFile(fullPath, fileContent, 0644); err != nil {
-				fmt.Fprintf(os.Stderr, "Failed to write file %s: %v\n", fullPath, err)
-			}
-		} else if mode == "40000" || mode == "040000" {
-			if err := os.MkdirAll(fullPath, 0755); err != nil {
-				fmt.Fprintf(os.Stderr, "Failed to create directory %s: %v\n", fullPath, err)
-				continue
-			}
-			newRepoRel := relEntry
-			restoreTree(entrySha, fullPath, newRepoRel, ignores)
-		}
-	}
+	return data
 }
 
 func Init() {
 	RootCmd.AddCommand(createDBCmd)
 	RootCmd.AddCommand(createCollectionCmd)
 	RootCmd.AddCommand(insertCmd)
+	findKeyCmd.Flags().StringVar(&findAt, "at", "", "Read from this branch or commit instead of the live data")
 	RootCmd.AddCommand(findKeyCmd)
+	findAllCmd.Flags().StringVar(&findAt, "at", "", "Read from this branch or commit instead of the live data")
 	RootCmd.AddCommand(findAllCmd)
 	RootCmd.AddCommand(updateCmd)
 	RootCmd.AddCommand(deleteCmd)
 	RootCmd.AddCommand(handleInitCmd)
 	RootCmd.AddCommand(handleCommitAllCmd)
 	handleCommitAllCmd.Flags().StringVarP(&commitMessage, "message", "m", "", "Commit message")
+	handleCommitAllCmd.Flags().StringVar(&commitAuthor, "author", "", "Override the commit author (\"Name <email>\")")
 	RootCmd.AddCommand(restoreCmd)
+	restoreToCmd.Flags().StringVar(&restoreInto, "into", "", "Restore into this new database instead of overwriting")
+	restoreToCmd.Flags().StringVar(&restoreCollection, "collection", "", "Restore only this collection, leaving the others untouched")
+	restoreToCmd.Flags().StringSliceVar(&restoreKeys, "keys", nil, "With --collection, restore only these keys or key prefixes ending in *")
 	RootCmd.AddCommand(restoreToCmd)
+	packObjectsCmd.Flags().BoolVar(&packPruneLoose, "prune-loose", false, "Delete loose objects once the pack is verified")
+	packObjectsCmd.Flags().IntVar(&packOpts.Window, "window", defaultPackOptions.Window, "Number of preceding objects to try as delta bases")
+	packObjectsCmd.Flags().IntVar(&packOpts.Depth, "depth", defaultPackOptions.Depth, "Longest delta chain to build (0 stores every object whole)")
+	packObjectsCmd.Flags().BoolVar(&packOpts.RefDelta, "ref-delta", false, "Name delta bases by SHA instead of by pack offset")
 	RootCmd.AddCommand(packObjectsCmd)
-
+	verifyPackCmd.Flags().BoolVarP(&verifyPackVerbose, "verbose", "v", false, "List every object in the pack")
+	RootCmd.AddCommand(verifyPackCmd)
+	gcCmd.Flags().BoolVar(&gcDryRun, "dry-run", false, "Report what would be pruned without deleting anything")
+	gcCmd.Flags().DurationVar(&gcGrace, "grace", defaultGCGrace, "Keep unreachable objects younger than this")
+	RootCmd.AddCommand(gcCmd)
+	fsckCmd.Flags().BoolVar(&fsckPagesFlag, "pages", false, "Also check the B-tree pages of the working tree")
+	fsckCmd.Flags().BoolVar(&fsckJSON, "json", false, "Print the report as JSON")
+	RootCmd.AddCommand(fsckCmd)
+	diffCmd.Flags().BoolVar(&diffJSON, "json", false, "Print the diff as JSON")
+	RootCmd.AddCommand(diffCmd)
+	logCmd.Flags().IntVarP(&logMaxCount, "max-count", "n", 0, "Show at most this many commits")
+	logCmd.Flags().BoolVar(&logOneline, "oneline", false, "Show each commit on one line")
+	logCmd.Flags().BoolVar(&logVerify, "verify", false, "Check the signature of each commit")
+	RootCmd.AddCommand(logCmd)
+	branchCmd.Flags().BoolVarP(&branchDelete, "delete", "d", false, "Delete the named branch")
+	RootCmd.AddCommand(branchCmd)
+	checkoutCmd.Flags().BoolVarP(&checkoutNew, "branch", "b", false, "Create the branch at HEAD before switching to it")
+	checkoutCmd.Flags().BoolVarP(&checkoutHard, "force", "f", false, "Discard uncommitted changes")
+	RootCmd.AddCommand(checkoutCmd)
+	tagCmd.Flags().BoolVarP(&tagList, "list", "l", false, "List tags")
+	tagCmd.Flags().BoolVarP(&tagDelete, "delete", "d", false, "Delete the named tag")
+	tagCmd.Flags().StringVarP(&tagMessage, "message", "m", "", "Create an annotated tag with this message")
+	RootCmd.AddCommand(tagCmd)
+	RootCmd.AddCommand(signingKeyCmd)
+	signersCmd.AddCommand(signersListCmd, signersAddCmd, signersRemoveCmd, signersRequireCmd)
+	RootCmd.AddCommand(signersCmd)
+	RootCmd.AddCommand(verifyCommitCmd)
+	RootCmd.AddCommand(verifyTagCmd)
+	mergeCmd.Flags().BoolVar(&mergeOurs, "ours", false, "Resolve conflicting keys with our value")
+	mergeCmd.Flags().BoolVar(&mergeTheirs, "theirs", false, "Resolve conflicting keys with their value")
+	mergeCmd.Flags().BoolVar(&mergeNoCommit, "no-commit", false, "Stop before committing a clean merge")
+	mergeCmd.Flags().BoolVar(&mergeAbort, "abort", false, "Abandon the merge in progress")
+	mergeCmd.Flags().StringVarP(&mergeMessage, "message", "m", "", "Merge commit message")
+	RootCmd.AddCommand(mergeCmd)
+	conflictsCmd.Flags().BoolVar(&conflictsJSON, "json", false, "Print the conflicts as JSON")
+	RootCmd.AddCommand(conflictsCmd)
+	resolveCmd.Flags().BoolVar(&resolveOurs, "ours", false, "Keep our value")
+	resolveCmd.Flags().BoolVar(&resolveTheirs, "theirs", false, "Take their value")
+	RootCmd.AddCommand(resolveCmd)
+	remoteCmd.AddCommand(remoteAddCmd, remoteRemoveCmd, remoteListCmd)
+	RootCmd.AddCommand(remoteCmd)
+	for _, cmd := range []*cobra.Command{fetchCmd, pullCmd, pushCmd, cloneCmd} {
+		cmd.Flags().StringVar(&remoteToken, "token", "", "Bearer token for the remote server (default $NUTELLA_TOKEN)")
+	}
+	pullCmd.Flags().BoolVar(&pullOurs, "ours", false, "Resolve conflicting keys with our value")
+	pullCmd.Flags().BoolVar(&pullTheirs, "theirs", false, "Resolve conflicting keys with the remote's value")
+	pullCmd.Flags().StringVarP(&pullMessage, "message", "m", "", "Merge commit message")
+	pushCmd.Flags().BoolVarP(&pushForce, "force", "f", false, "Let the remote drop commits or move tags")
+	RootCmd.AddCommand(fetchCmd, pullCmd, pushCmd, cloneCmd)
+
+	backupCmd.Flags().StringVar(&backupServer, "server", "", "Have the server at this URL take the backup")
+	backupCmd.Flags().StringVar(&remoteToken, "token", "", "Bearer token for --server (default $NUTELLA_TOKEN)")
+	RootCmd.AddCommand(backupCmd)
+	restoreBackupCmd.Flags().StringVar(&restoreUntil, "until", "", "Replay logged writes up to this RFC 3339 time")
+	restoreBackupCmd.Flags().StringVar(&restoreWALDir, "wal", "", "Write-ahead log directory to replay (default: the backed-up database's)")
+	RootCmd.AddCommand(restoreBackupCmd)
+	walCmd.AddCommand(walEnableCmd, walDisableCmd, walStatusCmd)
+	RootCmd.AddCommand(walCmd)
+
+	exportCmd.Flags().StringVar(&exportFormat, "format", "", "ndjson, csv or json (default: from --output, else ndjson)")
+	exportCmd.Flags().StringVarP(&exportOutput, "output", "o", "", "Write to this file instead of standard output")
+	importCmd.Flags().StringVar(&importFormat, "format", "", "ndjson, csv or json (default: from the file extension, else ndjson)")
+	importCmd.Flags().BoolVar(&importResume, "resume", false, "Skip the records an interrupted import of the file already wrote")
+	for _, cmd := range []*cobra.Command{exportCmd, importCmd} {
+		cmd.Flags().StringVar(&transferKeyColumn, "key-column", "key", "Field or CSV column holding the key")
+		cmd.Flags().StringVar(&transferValueColumn, "value-column", "value", "Field or CSV column holding the value")
+	}
+	RootCmd.AddCommand(exportCmd, importCmd)
+
+	userCmd.AddCommand(userAddCmd, userRemoveCmd, userListCmd, userGrantCmd, userRevokeCmd)
+	RootCmd.AddCommand(userCmd)
+	keyCmd.AddCommand(keyCreateCmd, keyListCmd, keyRevokeCmd)
+	RootCmd.AddCommand(keyCmd)
+	tokenCmd.Flags().DurationVar(&tokenTTL, "ttl", 24*time.Hour, "How long the token stays valid")
+	RootCmd.AddCommand(tokenCmd)
 }
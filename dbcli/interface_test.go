@@ -202,7 +202,7 @@ func BenchmarkFindSimilarObject(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		objID, content := findSimilarObject(targetBlob)
+		objID, content := findSimilarObject(".", targetBlob)
 		if i == 0 {
 			if objID == "" {
 				b.Logf("No similar object found")
@@ -251,7 +251,7 @@ func BenchmarkEndToEndObjectStorage(b *testing.B) {
 		baseFiles[i] = filePath
 
 		// Store the file as an object
-		_, err := hashAndWriteBlob(filePath)
+		_, err := hashAndWriteBlob(".", filePath)
 		if err != nil {
 			b.Fatalf("Failed to store base file: %v", err)
 		}
@@ -292,7 +292,7 @@ func BenchmarkEndToEndObjectStorage(b *testing.B) {
 			b.ResetTimer()
 			for i := 0; i < b.N; i++ {
 				// Store the file and measure performance
-				objID, err := hashAndWriteBlob(testFilePath)
+				objID, err := hashAndWriteBlob(".", testFilePath)
 				if err != nil {
 					b.Fatalf("Failed to hash and write blob: %v", err)
 				}
@@ -0,0 +1,596 @@
+package dbcli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"db/database"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	// ErrMergeInProgress is returned when starting a merge while another one
+	// is waiting to be committed or aborted.
+	ErrMergeInProgress = errors.New("a merge is already in progress")
+	// ErrNoMerge is returned by Resolve and AbortMerge when no merge is in progress.
+	ErrNoMerge = errors.New("no merge in progress")
+	// ErrUnresolvedConflicts is returned when committing a merge that still
+	// has conflicts.
+	ErrUnresolvedConflicts = errors.New("merge has unresolved conflicts")
+)
+
+// MergeConflict is a key both sides changed differently since the merge base.
+// Base, Ours and Theirs are unset when the key is absent on that side.
+type MergeConflict struct {
+	Collection string      `json:"collection"`
+	Key        string      `json:"key"`
+	Base       interface{} `json:"base,omitempty"`
+	Ours       interface{} `json:"ours,omitempty"`
+	Theirs     interface{} `json:"theirs,omitempty"`
+}
+
+// MergeResult describes what Merge did. Changed counts the keys written to
+// the working tree; conflicting keys keep our value until resolved.
+type MergeResult struct {
+	Base        string          `json:"base"`
+	Head        string          `json:"head"`
+	Theirs      string          `json:"theirs"`
+	UpToDate    bool            `json:"up_to_date"`
+	FastForward bool            `json:"fast_forward"`
+	Changed     int             `json:"changed"`
+	Conflicts   []MergeConflict `json:"conflicts"`
+}
+
+func mergeHeadPath(repo string) string {
+	return filepath.Join(repo, ".nutella", "MERGE_HEAD")
+}
+
+func mergeConflictsPath(repo string) string {
+	return filepath.Join(repo, ".nutella", "MERGE_CONFLICTS.json")
+}
+
+// readMergeState returns the commit being merged and the conflicts still
+// recorded for it. mergeHead is empty when no merge is in progress.
+func readMergeState(repo string) (mergeHead string, conflicts []MergeConflict, err error) {
+	data, err := os.ReadFile(mergeHeadPath(repo))
+	if os.IsNotExist(err) {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("error reading MERGE_HEAD: %w", err)
+	}
+	mergeHead = strings.TrimSpace(string(data))
+
+	data, err = os.ReadFile(mergeConflictsPath(repo))
+	if os.IsNotExist(err) {
+		return mergeHead, nil, nil
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("error reading merge conflicts: %w", err)
+	}
+	if err := json.Unmarshal(data, &conflicts); err != nil {
+		return "", nil, fmt.Errorf("error parsing merge conflicts: %w", err)
+	}
+	return mergeHead, conflicts, nil
+}
+
+func writeMergeState(repo, mergeHead string, conflicts []MergeConflict) error {
+	if conflicts == nil {
+		conflicts = []MergeConflict{}
+	}
+	data, err := json.MarshalIndent(conflicts, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling merge conflicts: %w", err)
+	}
+	if err := os.WriteFile(mergeConflictsPath(repo), data, 0644); err != nil {
+		return fmt.Errorf("error writing merge conflicts: %w", err)
+	}
+	if err := os.WriteFile(mergeHeadPath(repo), []byte(mergeHead+"\n"), 0644); err != nil {
+		return fmt.Errorf("error writing MERGE_HEAD: %w", err)
+	}
+	return nil
+}
+
+func clearMergeState(repo string) error {
+	for _, path := range []string{mergeHeadPath(repo), mergeConflictsPath(repo)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error clearing merge state: %w", err)
+		}
+	}
+	return nil
+}
+
+// mergeBase returns the newest commit reachable from both a and b, or "" when
+// the histories are unrelated.
+func mergeBase(repo, a, b string) (string, error) {
+	ours, err := Log(repo, a, 0)
+	if err != nil {
+		return "", err
+	}
+	reachable := make(map[string]bool, len(ours))
+	for _, c := range ours {
+		reachable[c.Sha] = true
+	}
+
+	theirs, err := Log(repo, b, 0)
+	if err != nil {
+		return "", err
+	}
+	for _, c := range theirs {
+		if reachable[c.Sha] {
+			return c.Sha, nil
+		}
+	}
+	return "", nil
+}
+
+// commitKeys decodes every collection of commit sha; "" yields no collections.
+func commitKeys(repo, sha string) (map[string]map[string]interface{}, error) {
+	if sha == "" {
+		return map[string]map[string]interface{}{}, nil
+	}
+	treeSha, err := readCommitTree(repo, sha)
+	if err != nil {
+		return nil, err
+	}
+	return treeKeys(repo, treeSha)
+}
+
+// mergeKeys three-way merges one collection. It returns the keys whose merged
+// value differs from ours, as changes against ours, and the keys both sides
+// changed differently. favor ("ours" or "theirs") settles those instead of
+// reporting them.
+func mergeKeys(collection string, base, ours, theirs map[string]interface{}, favor string) ([]KeyChange, []MergeConflict) {
+	keys := make(map[string]bool)
+	for _, side := range []map[string]interface{}{base, ours, theirs} {
+		for key := range side {
+			keys[key] = true
+		}
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	same := func(a, b map[string]interface{}, key string) bool {
+		va, inA := a[key]
+		vb, inB := b[key]
+		return inA == inB && (!inA || reflect.DeepEqual(va, vb))
+	}
+
+	var changes []KeyChange
+	var conflicts []MergeConflict
+	for _, key := range sorted {
+		takeTheirs := false
+		switch {
+		case same(ours, theirs, key), same(base, theirs, key):
+			// Nothing to bring over.
+		case same(base, ours, key):
+			takeTheirs = true
+		case favor == "theirs":
+			takeTheirs = true
+		case favor == "ours":
+		default:
+			conflicts = append(conflicts, MergeConflict{
+				Collection: collection, Key: key,
+				Base: base[key], Ours: ours[key], Theirs: theirs[key],
+			})
+		}
+		if !takeTheirs {
+			continue
+		}
+
+		old, inOurs := ours[key]
+		cur, inTheirs := theirs[key]
+		switch {
+		case !inTheirs:
+			changes = append(changes, KeyChange{Key: key, Op: "removed", Old: old})
+		case !inOurs:
+			changes = append(changes, KeyChange{Key: key, Op: "added", New: cur})
+		default:
+			changes = append(changes, KeyChange{Key: key, Op: "modified", Old: old, New: cur})
+		}
+	}
+	return changes, conflicts
+}
+
+// applyChange writes one merged key through the collection so the B-tree and
+// the cache stay in step.
+func applyChange(coll *database.Collection, c KeyChange) error {
+	if c.Op == "removed" {
+		_, err := coll.Delete(c.Key)
+		return err
+	}
+	_, err := coll.Update(c.Key, c.New)
+	return err
+}
+
+// Merge merges target, a branch name or commit SHA, into the current branch
+// of the repository at basePath. Histories that have not diverged are handled
+// as a no-op or a fast-forward. Otherwise every collection is merged key by
+// key against the common ancestor and the result is written through the
+// collection APIs; a collection removed on one side is emptied rather than
+// dropped. favor ("ours" or "theirs") resolves conflicting keys up front;
+// with no favor they keep our value and are recorded for Resolve. The merge
+// stays in progress until commit-all records it with both parents, or
+// AbortMerge undoes it.
+func Merge(basePath, target, favor string) (*MergeResult, error) {
+	if favor != "" && favor != "ours" && favor != "theirs" {
+		return nil, fmt.Errorf("invalid merge side %q: want ours or theirs", favor)
+	}
+	if mergeHead, _, err := readMergeState(basePath); err != nil {
+		return nil, err
+	} else if mergeHead != "" {
+		return nil, fmt.Errorf("%w; commit it or run 'merge --abort'", ErrMergeInProgress)
+	}
+
+	theirs, err := ResolveRevision(basePath, target)
+	if err != nil {
+		return nil, err
+	}
+	_, head, err := readHead(basePath)
+	if err != nil {
+		return nil, err
+	}
+	if head == "" {
+		return nil, errors.New("HEAD has no commits yet; commit before merging")
+	}
+	if changed, err := localChanges(basePath, head); err != nil {
+		return nil, err
+	} else if len(changed) > 0 {
+		return nil, fmt.Errorf("%w in %s; commit them before merging", ErrLocalChanges, strings.Join(changed, ", "))
+	}
+
+	base, err := mergeBase(basePath, head, theirs)
+	if err != nil {
+		return nil, err
+	}
+	res := &MergeResult{Base: base, Head: head, Theirs: theirs, Conflicts: []MergeConflict{}}
+	switch base {
+	case theirs:
+		res.UpToDate = true
+		return res, nil
+	case head:
+		if err := restoreWorkingTree(basePath, theirs); err != nil {
+			return nil, err
+		}
+		if err := advanceHead(basePath, theirs); err != nil {
+			return nil, err
+		}
+		res.FastForward = true
+		return res, nil
+	}
+
+	baseKeys, err := commitKeys(basePath, base)
+	if err != nil {
+		return nil, err
+	}
+	oursKeys, err := commitKeys(basePath, head)
+	if err != nil {
+		return nil, err
+	}
+	theirsKeys, err := commitKeys(basePath, theirs)
+	if err != nil {
+		return nil, err
+	}
+	theirsTree, err := readCommitTree(basePath, theirs)
+	if err != nil {
+		return nil, err
+	}
+	theirsColls, err := collectionTrees(basePath, theirsTree)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for _, side := range []map[string]map[string]interface{}{baseKeys, oursKeys, theirsKeys} {
+		for name := range side {
+			names[name] = true
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	db, err := database.LoadDatabase(basePath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	for _, name := range sorted {
+		changes, conflicts := mergeKeys(name, baseKeys[name], oursKeys[name], theirsKeys[name], favor)
+		res.Conflicts = append(res.Conflicts, conflicts...)
+		if len(changes) == 0 {
+			continue
+		}
+
+		if _, ok := oursKeys[name]; !ok {
+			// The collection only exists on their side: create it with their order.
+			order, err := committedOrder(basePath, theirsColls[name])
+			if err != nil {
+				return nil, fmt.Errorf("collection %s: %w", name, err)
+			}
+			if err := db.CreateCollection(name, order); err != nil {
+				return nil, err
+			}
+		}
+		coll, err := db.GetCollection(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range changes {
+			if err := applyChange(coll, c); err != nil {
+				return nil, err
+			}
+		}
+		res.Changed += len(changes)
+	}
+
+	if err := writeMergeState(basePath, theirs, res.Conflicts); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Resolve settles the recorded conflicts of the merge in progress by writing
+// our or their value (side is "ours" or "theirs"). An empty collection selects
+// every conflict and an empty key every conflict in collection. It returns how
+// many conflicts were resolved.
+func Resolve(basePath, side, collection, key string) (int, error) {
+	if side != "ours" && side != "theirs" {
+		return 0, fmt.Errorf("invalid merge side %q: want ours or theirs", side)
+	}
+	mergeHead, conflicts, err := readMergeState(basePath)
+	if err != nil {
+		return 0, err
+	}
+	if mergeHead == "" {
+		return 0, ErrNoMerge
+	}
+
+	db, err := database.LoadDatabase(basePath)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var remaining []MergeConflict
+	resolved := 0
+	for _, c := range conflicts {
+		if collection != "" && c.Collection != collection || key != "" && c.Key != key {
+			remaining = append(remaining, c)
+			continue
+		}
+		coll, err := db.GetCollection(c.Collection)
+		if err != nil {
+			return 0, err
+		}
+		value := c.Ours
+		if side == "theirs" {
+			value = c.Theirs
+		}
+		change := KeyChange{Key: c.Key, Op: "modified", New: value}
+		if value == nil {
+			change.Op = "removed"
+		}
+		if err := applyChange(coll, change); err != nil {
+			return 0, err
+		}
+		resolved++
+	}
+	if err := writeMergeState(basePath, mergeHead, remaining); err != nil {
+		return 0, err
+	}
+	return resolved, nil
+}
+
+// AbortMerge abandons the merge in progress and restores the working tree to HEAD.
+func AbortMerge(basePath string) error {
+	mergeHead, _, err := readMergeState(basePath)
+	if err != nil {
+		return err
+	}
+	if mergeHead == "" {
+		return ErrNoMerge
+	}
+	_, head, err := readHead(basePath)
+	if err != nil {
+		return err
+	}
+	if err := restoreWorkingTree(basePath, head); err != nil {
+		return err
+	}
+	return clearMergeState(basePath)
+}
+
+var (
+	mergeOurs     bool
+	mergeTheirs   bool
+	mergeNoCommit bool
+	mergeAbort    bool
+	mergeMessage  string
+	conflictsJSON bool
+	resolveOurs   bool
+	resolveTheirs bool
+)
+
+// mergeSide turns an --ours/--theirs flag pair into "ours", "theirs" or "".
+func mergeSide(ours, theirs bool) (string, error) {
+	switch {
+	case ours && theirs:
+		return "", errors.New("--ours and --theirs are mutually exclusive")
+	case ours:
+		return "ours", nil
+	case theirs:
+		return "theirs", nil
+	}
+	return "", nil
+}
+
+// Command to merge a branch or commit into the current branch
+var mergeCmd = &cobra.Command{
+	Use:   "merge <dbID> <branch|commit>",
+	Short: "Merge a branch or commit into the current branch, key by key",
+	Long: `Finds the common ancestor of HEAD and the given branch or commit and merges
+every collection at the key level. Keys changed on only one side are taken from
+that side; keys both sides changed differently are conflicts. With --ours or
+--theirs, conflicts are settled in favour of that side; otherwise they keep
+HEAD's value and are recorded for 'conflicts' and 'resolve'.
+
+A clean merge is committed straight away with both parents unless --no-commit
+is given; otherwise finish it with commit-all, or undo it with --abort.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		basePath, _ := filepath.Abs(filepath.Join("files", args[0]))
+		if _, err := os.Stat(filepath.Join(basePath, ".nutella")); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: repository not found at %s. Please run 'init' first.\n", basePath)
+			os.Exit(1)
+		}
+
+		if mergeAbort {
+			if err := AbortMerge(basePath); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Println("Merge aborted.")
+			return
+		}
+		if len(args) != 2 {
+			fmt.Fprintf(os.Stderr, "Usage: merge <dbID> <branch|commit>\n")
+			os.Exit(1)
+		}
+		favor, err := mergeSide(mergeOurs, mergeTheirs)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		res, err := Merge(basePath, args[1], favor)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		switch {
+		case res.UpToDate:
+			fmt.Println("Already up to date.")
+			return
+		case res.FastForward:
+			fmt.Printf("Fast-forward to %s\n", res.Theirs)
+			return
+		}
+
+		fmt.Printf("Merged %d key(s) from %s (base %s).\n", res.Changed, args[1], res.Base)
+		if len(res.Conflicts) > 0 {
+			fmt.Printf("%d conflict(s):\n", len(res.Conflicts))
+			for _, c := range res.Conflicts {
+				fmt.Printf("  %s/%s\n", c.Collection, c.Key)
+			}
+			fmt.Println("Review them with 'conflicts', settle them with 'resolve --ours|--theirs', then run commit-all.")
+			return
+		}
+		if mergeNoCommit {
+			fmt.Println("Merge prepared; run commit-all to record it.")
+			return
+		}
+
+		message := mergeMessage
+		if message == "" {
+			ref, _, _ := readHead(basePath)
+			message = fmt.Sprintf("Merge %s into %s", args[1], strings.TrimPrefix(ref, "refs/heads/"))
+		}
+		commit, err := CommitWorkingTree(basePath, message, defaultIdentity(), nil)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(commit.Sha)
+	},
+}
+
+// Command to list the conflicts of the merge in progress
+var conflictsCmd = &cobra.Command{
+	Use:   "conflicts <dbID>",
+	Short: "List the unresolved conflicts of the merge in progress",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		basePath := filepath.Join(".", "files", args[0])
+		mergeHead, conflicts, err := readMergeState(basePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if mergeHead == "" {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", ErrNoMerge)
+			os.Exit(1)
+		}
+
+		if conflictsJSON {
+			if conflicts == nil {
+				conflicts = []MergeConflict{}
+			}
+			out, _ := json.MarshalIndent(conflicts, "", "  ")
+			fmt.Println(string(out))
+			return
+		}
+		if len(conflicts) == 0 {
+			fmt.Println("No conflicts left; run commit-all to record the merge.")
+			return
+		}
+		show := func(v interface{}) string {
+			if v == nil {
+				return "(absent)"
+			}
+			return fmt.Sprint(v)
+		}
+		for _, c := range conflicts {
+			fmt.Printf("%s/%s\n", c.Collection, c.Key)
+			fmt.Printf("  base:   %s\n  ours:   %s\n  theirs: %s\n", show(c.Base), show(c.Ours), show(c.Theirs))
+		}
+	},
+}
+
+// Command to settle merge conflicts in favour of one side
+var resolveCmd = &cobra.Command{
+	Use:   "resolve <dbID> (--ours|--theirs) [collection [key]]",
+	Short: "Resolve merge conflicts with our or their value",
+	Long: `Writes our or their value for the recorded conflicts of the merge in
+progress: all of them, those in one collection, or a single key.`,
+	Args: cobra.RangeArgs(1, 3),
+	Run: func(cmd *cobra.Command, args []string) {
+		side, err := mergeSide(resolveOurs, resolveTheirs)
+		if err == nil && side == "" {
+			err = errors.New("one of --ours or --theirs is required")
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		basePath := filepath.Join(".", "files", args[0])
+		collection, key := "", ""
+		if len(args) > 1 {
+			collection = args[1]
+		}
+		if len(args) > 2 {
+			key = args[2]
+		}
+
+		n, err := Resolve(basePath, side, collection, key)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		_, left, _ := readMergeState(basePath)
+		fmt.Printf("Resolved %d conflict(s) with %s; %d left.\n", n, side, len(left))
+	},
+}
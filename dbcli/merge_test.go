@@ -0,0 +1,128 @@
+package dbcli
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"db/database"
+)
+
+// editCollection opens the database at dir, runs fn on collection name
+// (creating it first when missing) and closes the database again.
+func editCollection(t *testing.T, dir, name string, fn func(c *database.Collection)) {
+	t.Helper()
+	db, err := database.LoadDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to load database: %v", err)
+	}
+	defer db.Close()
+	coll, err := db.GetCollection(name)
+	if err != nil {
+		if err := db.CreateCollection(name, 3); err != nil {
+			t.Fatalf("Failed to create collection: %v", err)
+		}
+		if coll, err = db.GetCollection(name); err != nil {
+			t.Fatalf("Failed to get collection: %v", err)
+		}
+	}
+	fn(coll)
+}
+
+func TestMergeBranches(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db_merge")
+	db, err := database.OpenDatabase(dir, "db_merge")
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	db.Close()
+
+	set := func(c *database.Collection, kv ...string) {
+		for i := 0; i < len(kv); i += 2 {
+			if _, err := c.Update(kv[i], kv[i+1]); err != nil {
+				t.Fatalf("Failed to update %s: %v", kv[i], err)
+			}
+		}
+	}
+	editCollection(t, dir, "fruits", func(c *database.Collection) {
+		set(c, "apple", "1", "banana", "1", "cherry", "1", "date", "1")
+	})
+	commitDir(t, dir, "base")
+	if err := CreateBranch(dir, "feature", ""); err != nil {
+		t.Fatalf("Failed to create branch: %v", err)
+	}
+
+	editCollection(t, dir, "fruits", func(c *database.Collection) {
+		set(c, "banana", "main", "date", "main")
+		if _, err := c.Delete("cherry"); err != nil {
+			t.Fatalf("Failed to delete: %v", err)
+		}
+	})
+	ours := commitDir(t, dir, "main work")
+
+	if _, err := Checkout(dir, "feature", false); err != nil {
+		t.Fatalf("Failed to checkout feature: %v", err)
+	}
+	editCollection(t, dir, "fruits", func(c *database.Collection) { set(c, "apple", "feat", "date", "feat") })
+	editCollection(t, dir, "veg", func(c *database.Collection) { set(c, "carrot", "1") })
+	theirs := commitDir(t, dir, "feature work")
+
+	if _, err := Checkout(dir, "main", false); err != nil {
+		t.Fatalf("Failed to checkout main: %v", err)
+	}
+	res, err := Merge(dir, "feature", "")
+	if err != nil {
+		t.Fatalf("Failed to merge: %v", err)
+	}
+	if res.UpToDate || res.FastForward || res.Changed != 2 {
+		t.Errorf("merge result = %+v; want 2 keys merged", res)
+	}
+	if len(res.Conflicts) != 1 || res.Conflicts[0].Key != "date" || res.Conflicts[0].Ours != "main" || res.Conflicts[0].Theirs != "feat" {
+		t.Fatalf("conflicts = %+v; want fruits/date main vs feat", res.Conflicts)
+	}
+
+	if _, err := createAndStoreCommit(dir, "unused", "too early", defaultIdentity()); !errors.Is(err, ErrUnresolvedConflicts) {
+		t.Errorf("commit with conflicts: err = %v; want ErrUnresolvedConflicts", err)
+	}
+	if _, err := Merge(dir, "feature", ""); !errors.Is(err, ErrMergeInProgress) {
+		t.Errorf("second merge: err = %v; want ErrMergeInProgress", err)
+	}
+	if n, err := Resolve(dir, "theirs", "fruits", ""); err != nil || n != 1 {
+		t.Fatalf("Resolve = %d, %v; want 1 conflict resolved", n, err)
+	}
+
+	merged := commitDir(t, dir, "merge feature")
+	c, err := ReadCommit(dir, merged)
+	if err != nil {
+		t.Fatalf("Failed to read merge commit: %v", err)
+	}
+	if !reflect.DeepEqual(c.Parents, []string{ours, theirs}) {
+		t.Errorf("merge parents = %v; want [%s %s]", c.Parents, ours, theirs)
+	}
+	if _, err := os.Stat(mergeHeadPath(dir)); !os.IsNotExist(err) {
+		t.Errorf("MERGE_HEAD still present after commit")
+	}
+
+	keys, err := commitKeys(dir, merged)
+	if err != nil {
+		t.Fatalf("Failed to decode merge commit: %v", err)
+	}
+	want := map[string]map[string]interface{}{
+		"fruits": {"apple": "feat", "banana": "main", "date": "feat"},
+		"veg":    {"carrot": "1"},
+	}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("merged keys = %v; want %v", keys, want)
+	}
+	editCollection(t, dir, "fruits", func(c *database.Collection) {
+		if v, found, _ := c.Find("date"); !found || v != "feat" {
+			t.Errorf("Find(date) = %v, %v; want feat from the cache and B-tree", v, found)
+		}
+	})
+
+	if res, err := Merge(dir, "feature", ""); err != nil || !res.UpToDate {
+		t.Errorf("re-merge = %+v, %v; want already up to date", res, err)
+	}
+}
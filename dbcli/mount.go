@@ -0,0 +1,128 @@
+package dbcli
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"db/btree"
+)
+
+// ErrNoCollection is returned when a mounted commit has no such collection.
+var ErrNoCollection = errors.New("collection not found in commit")
+
+// Mount is a read-only view of the collections stored in one commit. Pages are
+// read straight from the object store, so the live database is never opened
+// or modified.
+type Mount struct {
+	repo        string
+	commit      string
+	collections map[string]string            // collection name -> tree SHA
+	pages       map[string]map[string]string // collection name -> page file -> blob SHA, loaded lazily
+}
+
+// MountCommit mounts rev, a branch name or commit SHA, of the repository at
+// basePath.
+func MountCommit(basePath, rev string) (*Mount, error) {
+	sha, err := ResolveRevision(basePath, rev)
+	if err != nil {
+		return nil, err
+	}
+	treeSha, err := readCommitTree(basePath, sha)
+	if err != nil {
+		return nil, err
+	}
+	colls, err := collectionTrees(basePath, treeSha)
+	if err != nil {
+		return nil, err
+	}
+	return &Mount{repo: basePath, commit: sha, collections: colls, pages: make(map[string]map[string]string)}, nil
+}
+
+// Commit returns the SHA of the mounted commit.
+func (m *Mount) Commit() string {
+	return m.commit
+}
+
+// Collections returns the names of the mounted collections, sorted.
+func (m *Mount) Collections() []string {
+	names := make([]string, 0, len(m.collections))
+	for name := range m.collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// load decodes page file name of collection from the object store.
+func (m *Mount) load(collection, name string, v interface{}) error {
+	pages, ok := m.pages[collection]
+	if !ok {
+		tree, found := m.collections[collection]
+		if !found {
+			return fmt.Errorf("%s at %s: %w", collection, m.commit, ErrNoCollection)
+		}
+		var err error
+		if pages, err = pagesOf(m.repo, tree); err != nil {
+			return fmt.Errorf("collection %s: %w", collection, err)
+		}
+		m.pages[collection] = pages
+	}
+	sha, ok := pages[name]
+	if !ok {
+		return fmt.Errorf("collection %s: %s is missing from the commit", collection, name)
+	}
+	return decodeBlob(m.repo, sha, v)
+}
+
+// Find looks key up in collection, descending the committed B-tree from its
+// root like BTree.Find does.
+func (m *Mount) Find(collection, key string) (interface{}, bool, error) {
+	var meta struct {
+		RootID int `json:"root_id"`
+	}
+	if err := m.load(collection, "metadata.json", &meta); err != nil {
+		return nil, false, err
+	}
+
+	id := meta.RootID
+	visited := make(map[int]bool)
+	for {
+		if visited[id] {
+			return nil, false, fmt.Errorf("collection %s: page_%d.json is reached twice: %w", collection, id, ErrInvalidTree)
+		}
+		visited[id] = true
+		var node btree.Node
+		if err := m.load(collection, "page_"+strconv.Itoa(id)+".json", &node); err != nil {
+			return nil, false, err
+		}
+		i := sort.Search(len(node.Keys), func(i int) bool { return node.Keys[i].Key >= key })
+		if i < len(node.Keys) && node.Keys[i].Key == key {
+			if node.Keys[i].Deleted {
+				return nil, false, nil
+			}
+			return node.Keys[i].Value, true, nil
+		}
+		if node.IsLeaf || i >= len(node.Children) {
+			return nil, false, nil
+		}
+		id = node.Children[i]
+	}
+}
+
+// FindAll returns every live key of collection in ascending order.
+func (m *Mount) FindAll(collection string) ([]btree.KeyValue, error) {
+	keys, err := decodePages(func(name string, v interface{}) error {
+		return m.load(collection, name, v)
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := make([]btree.KeyValue, 0, len(keys))
+	for k, v := range keys {
+		out = append(out, btree.KeyValue{Key: k, Value: v})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out, nil
+}
@@ -0,0 +1,172 @@
+package dbcli
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"db/database"
+)
+
+func TestMountAndRestoreInto(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "db_live")
+	db, err := database.OpenDatabase(dir, "db_live")
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	db.Close()
+
+	// Enough keys to split the root, so Find has to descend.
+	editCollection(t, dir, "fruits", func(c *database.Collection) {
+		for _, k := range []string{"apple", "banana", "cherry", "date", "elder", "fig", "grape"} {
+			if err := c.Insert(k, "v1"); err != nil {
+				t.Fatalf("Failed to insert %s: %v", k, err)
+			}
+		}
+	})
+	first := commitDir(t, dir, "first")
+	editCollection(t, dir, "fruits", func(c *database.Collection) {
+		if _, err := c.Update("fig", "v2"); err != nil {
+			t.Fatalf("Failed to update: %v", err)
+		}
+		if _, err := c.Delete("apple"); err != nil {
+			t.Fatalf("Failed to delete: %v", err)
+		}
+	})
+
+	m, err := MountCommit(dir, first)
+	if err != nil {
+		t.Fatalf("Failed to mount: %v", err)
+	}
+	for key, want := range map[string]interface{}{"apple": "v1", "fig": "v1", "grape": "v1"} {
+		if v, found, err := m.Find("fruits", key); err != nil || !found || v != want {
+			t.Errorf("mounted Find(%s) = %v, %v, %v; want %v", key, v, found, err, want)
+		}
+	}
+	if _, found, _ := m.Find("fruits", "kiwi"); found {
+		t.Errorf("mounted Find(kiwi) found a key that was never committed")
+	}
+	if all, err := m.FindAll("fruits"); err != nil || len(all) != 7 || all[0].Key != "apple" {
+		t.Errorf("mounted FindAll = %v, %v; want 7 keys from apple", all, err)
+	}
+	if _, _, err := m.Find("veg", "carrot"); !errors.Is(err, ErrNoCollection) {
+		t.Errorf("Find in missing collection: err = %v; want ErrNoCollection", err)
+	}
+
+	if _, err := RestoreInto(dir, first, root, "db_copy"); err != nil {
+		t.Fatalf("Failed to restore into a new database: %v", err)
+	}
+	if _, err := RestoreInto(dir, first, root, "db_copy"); !errors.Is(err, ErrDatabaseExists) {
+		t.Errorf("second restore: err = %v; want ErrDatabaseExists", err)
+	}
+
+	copyDB, err := database.LoadDatabase(filepath.Join(root, "db_copy"))
+	if err != nil {
+		t.Fatalf("Failed to load restored database: %v", err)
+	}
+	defer copyDB.Close()
+	if copyDB.ID() != "db_copy" {
+		t.Errorf("restored manifest names %q; want db_copy", copyDB.ID())
+	}
+	fruits, err := copyDB.GetCollection("fruits")
+	if err != nil {
+		t.Fatalf("Failed to get restored collection: %v", err)
+	}
+	if v, found, err := fruits.Find("apple"); err != nil || !found || v != "v1" {
+		t.Errorf("restored Find(apple) = %v, %v, %v; want v1", v, found, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "db_copy", ".nutella", "HEAD")); err != nil {
+		t.Errorf("restored database has no repository: %v", err)
+	}
+
+	// The live database keeps its uncommitted changes.
+	editCollection(t, dir, "fruits", func(c *database.Collection) {
+		if v, _, _ := c.Find("fig"); v != "v2" {
+			t.Errorf("live Find(fig) = %v; want v2", v)
+		}
+	})
+	if dbs, _ := database.ListDatabases(root); len(dbs) != 2 {
+		t.Errorf("ListDatabases = %v; want db_copy and db_live only", dbs)
+	}
+}
+
+func TestRestoreCollection(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db_restore")
+	db, err := database.OpenDatabase(dir, "db_restore")
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	db.Close()
+
+	editCollection(t, dir, "users", func(c *database.Collection) {
+		for _, k := range []string{"user:1", "user:2", "user:3", "config"} {
+			if err := c.Insert(k, "v1"); err != nil {
+				t.Fatalf("Failed to insert %s: %v", k, err)
+			}
+		}
+	})
+	editCollection(t, dir, "orders", func(c *database.Collection) {
+		if err := c.Insert("o1", "v1"); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	})
+	first := commitDir(t, dir, "first")
+
+	editCollection(t, dir, "users", func(c *database.Collection) {
+		if _, err := c.Update("user:1", "v2"); err != nil {
+			t.Fatalf("Failed to update: %v", err)
+		}
+		if _, err := c.Delete("user:2"); err != nil {
+			t.Fatalf("Failed to delete: %v", err)
+		}
+		if err := c.Insert("user:9", "v2"); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+		if _, err := c.Update("config", "v2"); err != nil {
+			t.Fatalf("Failed to update: %v", err)
+		}
+	})
+	editCollection(t, dir, "orders", func(c *database.Collection) {
+		if _, err := c.Update("o1", "v2"); err != nil {
+			t.Fatalf("Failed to update: %v", err)
+		}
+	})
+
+	changes, err := RestoreCollection(dir, first, "users", []string{"user:*"})
+	if err != nil {
+		t.Fatalf("Failed to restore collection: %v", err)
+	}
+	if len(changes) != 3 {
+		t.Errorf("restored %d keys; want 3: %v", len(changes), changes)
+	}
+	editCollection(t, dir, "users", func(c *database.Collection) {
+		for key, want := range map[string]interface{}{"user:1": "v1", "user:2": "v1", "config": "v2"} {
+			if v, found, err := c.Find(key); err != nil || !found || v != want {
+				t.Errorf("Find(%s) = %v, %v, %v; want %v", key, v, found, err, want)
+			}
+		}
+		if _, found, _ := c.Find("user:9"); found {
+			t.Errorf("user:9 survived a restore to before it existed")
+		}
+	})
+
+	if _, err := RestoreCollection(dir, first, "users", nil); err != nil {
+		t.Fatalf("Failed to restore whole collection: %v", err)
+	}
+	editCollection(t, dir, "users", func(c *database.Collection) {
+		if v, _, _ := c.Find("config"); v != "v1" {
+			t.Errorf("Find(config) = %v; want v1", v)
+		}
+	})
+	editCollection(t, dir, "orders", func(c *database.Collection) {
+		if v, _, _ := c.Find("o1"); v != "v2" {
+			t.Errorf("other collection changed: Find(o1) = %v; want v2", v)
+		}
+	})
+
+	if _, err := RestoreCollection(dir, first, "missing", nil); !errors.Is(err, ErrNoCollection) {
+		t.Errorf("restoring a missing collection: err = %v; want ErrNoCollection", err)
+	}
+}
@@ -0,0 +1,208 @@
+package dbcli
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrObjectNotFound is returned when a SHA names no object in the repository.
+var ErrObjectNotFound = errors.New("object not found")
+
+// treeEntry is one "<mode> <name>\0<sha>" record of a tree object.
+type treeEntry struct {
+	Mode string
+	Name string
+	Sha  string
+}
+
+func (e treeEntry) isDir() bool {
+	return e.Mode == "40000" || e.Mode == "040000"
+}
+
+// readLooseObject reads and decompresses the loose object file for sha
+// without resolving deltas.
+func readLooseObject(repo, sha string) ([]byte, error) {
+	if len(sha) < 3 {
+		return nil, fmt.Errorf("invalid SHA: %q", sha)
+	}
+	path := filepath.Join(repo, ".nutella", "objects", sha[:2], sha[2:])
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: %w", sha, ErrObjectNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading object file: %v", err)
+	}
+
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error creating zlib reader: %v", err)
+	}
+	defer r.Close()
+
+	decompressedData, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing data: %v", err)
+	}
+	return decompressedData, nil
+}
+
+// readRawObject reads object sha without resolving deltas, from its loose
+// file or, failing that, from a pack.
+func readRawObject(repo, sha string) ([]byte, error) {
+	data, err := readLooseObject(repo, sha)
+	if errors.Is(err, ErrObjectNotFound) {
+		return readPackedObject(repo, sha)
+	}
+	return data, err
+}
+
+// deltaBase returns the base SHA named in the header of a raw delta object,
+// or "" when data is not a delta.
+func deltaBase(sha string, data []byte) (string, error) {
+	if !bytes.HasPrefix(data, []byte("delta ")) {
+		return "", nil
+	}
+	// Delta objects are "delta <baseSha> <size>\0<instructions>".
+	nullIdx := bytes.IndexByte(data, 0)
+	if nullIdx == -1 {
+		return "", fmt.Errorf("invalid delta object %s: missing null byte", sha)
+	}
+	parts := strings.Fields(string(data[:nullIdx]))
+	if len(parts) != 3 {
+		return "", fmt.Errorf("invalid delta header in %s", sha)
+	}
+	return parts[1], nil
+}
+
+// loadObject reads object sha from <repo>/.nutella/objects or its packs,
+// resolving delta objects against their base. It returns the full
+// "<type> <size>\0<content>" form, like readObject, but reports failures
+// instead of exiting.
+func loadObject(repo, sha string) ([]byte, error) {
+	decompressedData, err := readRawObject(repo, sha)
+	if err != nil {
+		return nil, err
+	}
+	base, err := deltaBase(sha, decompressedData)
+	if err != nil || base == "" {
+		return decompressedData, err
+	}
+
+	baseObj, err := loadObject(repo, base)
+	if err != nil {
+		return nil, fmt.Errorf("error reading delta base of %s: %w", sha, err)
+	}
+	objType, baseContent, err := parseObject(baseObj)
+	if err != nil {
+		return nil, err
+	}
+	resultContent, err := applyDelta(baseContent, decompressedData[bytes.IndexByte(decompressedData, 0)+1:])
+	if err != nil {
+		return nil, fmt.Errorf("error applying delta %s: %v", sha, err)
+	}
+	header := fmt.Sprintf("%s %d\u0000", objType, len(resultContent))
+	return append([]byte(header), resultContent...), nil
+}
+
+// parseObject splits a stored object into its type and content.
+func parseObject(data []byte) (string, []byte, error) {
+	nullIdx := bytes.IndexByte(data, 0)
+	if nullIdx == -1 {
+		return "", nil, errors.New("invalid object: missing null byte")
+	}
+	fields := strings.Fields(string(data[:nullIdx]))
+	if len(fields) < 1 {
+		return "", nil, errors.New("invalid object: empty header")
+	}
+	return fields[0], data[nullIdx+1:], nil
+}
+
+// loadTyped loads sha and checks that it is an object of type want.
+func loadTyped(repo, sha, want string) ([]byte, error) {
+	data, err := loadObject(repo, sha)
+	if err != nil {
+		return nil, err
+	}
+	objType, content, err := parseObject(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", sha, err)
+	}
+	if objType != want {
+		return nil, fmt.Errorf("%s is a %s, not a %s", sha, objType, want)
+	}
+	return content, nil
+}
+
+// readTreeEntries loads and parses tree object sha.
+func readTreeEntries(repo, sha string) ([]treeEntry, error) {
+	body, err := loadTyped(repo, sha, "tree")
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []treeEntry
+	for i := 0; i < len(body); {
+		modeEnd := bytes.IndexByte(body[i:], ' ')
+		if modeEnd == -1 {
+			return nil, fmt.Errorf("corrupt tree %s", sha)
+		}
+		mode := string(body[i : i+modeEnd])
+		i += modeEnd + 1
+		nameEnd := bytes.IndexByte(body[i:], 0)
+		if nameEnd == -1 || i+nameEnd+21 > len(body) {
+			return nil, fmt.Errorf("corrupt tree %s", sha)
+		}
+		name := string(body[i : i+nameEnd])
+		i += nameEnd + 1
+		entries = append(entries, treeEntry{Mode: mode, Name: name, Sha: fmt.Sprintf("%x", body[i:i+20])})
+		i += 20
+	}
+	return entries, nil
+}
+
+// readCommitTree returns the tree SHA recorded in commit object sha.
+func readCommitTree(repo, sha string) (string, error) {
+	body, err := loadTyped(repo, sha, "commit")
+	if err != nil {
+		return "", err
+	}
+	line, _, _ := strings.Cut(string(body), "\n")
+	if !strings.HasPrefix(line, "tree ") {
+		return "", fmt.Errorf("invalid commit object %s: no tree reference found", sha)
+	}
+	return strings.TrimPrefix(line, "tree "), nil
+}
+
+// writeObject stores content as a loose object of type objType under
+// <repo>/.nutella/objects and returns its SHA. Existing objects are left as
+// they are.
+func writeObject(repo, objType string, content []byte) (string, error) {
+	store := append([]byte(fmt.Sprintf("%s %d\u0000", objType, len(content))), content...)
+	sha := fmt.Sprintf("%x", sha1.Sum(store))
+
+	dir := filepath.Join(repo, ".nutella", "objects", sha[:2])
+	path := filepath.Join(dir, sha[2:])
+	if _, err := os.Stat(path); err == nil {
+		return sha, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("error creating object directory: %w", err)
+	}
+
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	_, _ = w.Write(store)
+	w.Close()
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		return "", fmt.Errorf("error writing %s object: %w", objType, err)
+	}
+	return sha, nil
+}
@@ -0,0 +1,795 @@
+package dbcli
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Pack entry types, stored in bits 4-6 of each entry's first header byte.
+const (
+	objCommit   = 1
+	objTree     = 2
+	objBlob     = 3
+	objTag      = 4
+	objDelta    = 5 // a loose "delta" object, stored verbatim
+	objOfsDelta = 6
+	objRefDelta = 7
+)
+
+var packTypeCodes = map[string]int{"commit": objCommit, "tree": objTree, "blob": objBlob, "tag": objTag}
+
+var packTypeNames = map[int]string{objCommit: "commit", objTree: "tree", objBlob: "blob", objTag: "tag"}
+
+const (
+	packVersion  = 2
+	indexMagic   = "NIDX"
+	indexVersion = 1
+
+	// maxPackChain bounds delta resolution when reading, so a corrupt pack
+	// whose offsets loop cannot recurse forever.
+	maxPackChain = 4096
+
+	// maxObjectSize bounds the size an entry header or a delta may claim, so
+	// a corrupt pack cannot make a reader allocate more than the largest
+	// bundle a push may upload.
+	maxObjectSize = 512 << 20
+)
+
+// A pack is "PACK", a version and an object count, then one entry per object
+// and the SHA-1 of everything before it. Each entry is a type-and-size header
+// followed by the zlib-compressed content. Between the two, an ofs-delta entry
+// carries the distance back to its base entry and a ref-delta entry the base's
+// 20-byte SHA; their content is computeDelta instructions against the base,
+// whose type the result takes. A loose delta object keeps its own SHA, so it
+// is stored verbatim as an objDelta entry with its base SHA.
+//
+// The index is "NIDX" and a version, a 256-entry fan-out table where slot b
+// counts the objects whose first SHA byte is at most b, the sorted 20-byte
+// SHAs, their uint64 pack offsets, the pack's checksum and the index's own.
+
+// packIndex is a parsed .idx file.
+type packIndex struct {
+	packPath string
+	modTime  time.Time
+	size     int64
+	fanout   [256]uint32
+	shas     []byte // 20 bytes per object, sorted
+	offsets  []uint64
+	checksum []byte // trailing SHA-1 of the pack
+}
+
+// packIndexes caches parsed indexes by path; an entry is reused while the
+// file's size and modification time are unchanged.
+var packIndexes = struct {
+	sync.Mutex
+	byPath map[string]*packIndex
+}{byPath: make(map[string]*packIndex)}
+
+func (idx *packIndex) count() int {
+	return len(idx.offsets)
+}
+
+func (idx *packIndex) sha(i int) string {
+	return hex.EncodeToString(idx.shas[i*20 : (i+1)*20])
+}
+
+// find binary-searches the fan-out bucket of sha for its pack offset.
+func (idx *packIndex) find(sha string) (int64, bool) {
+	raw, err := hex.DecodeString(sha)
+	if err != nil || len(raw) != 20 {
+		return 0, false
+	}
+	lo, hi := 0, int(idx.fanout[raw[0]])
+	if raw[0] > 0 {
+		lo = int(idx.fanout[raw[0]-1])
+	}
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(idx.shas[(lo+i)*20:(lo+i+1)*20], raw) >= 0
+	})
+	if i < hi && bytes.Equal(idx.shas[i*20:(i+1)*20], raw) {
+		return int64(idx.offsets[i]), true
+	}
+	return 0, false
+}
+
+// withPrefix returns the SHAs in the index that start with the hex prefix,
+// which must be at least two characters long.
+func (idx *packIndex) withPrefix(prefix string) []string {
+	first, err := hex.DecodeString(prefix[:2])
+	if err != nil {
+		return nil
+	}
+	lo, hi := 0, int(idx.fanout[first[0]])
+	if first[0] > 0 {
+		lo = int(idx.fanout[first[0]-1])
+	}
+	var matches []string
+	for i := lo; i < hi; i++ {
+		if sha := idx.sha(i); strings.HasPrefix(sha, prefix) {
+			matches = append(matches, sha)
+		}
+	}
+	return matches
+}
+
+// openPackIndex reads and checks the index at path.
+func openPackIndex(path string) (*packIndex, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	packIndexes.Lock()
+	defer packIndexes.Unlock()
+	if idx, ok := packIndexes.byPath[path]; ok && idx.size == info.Size() && idx.modTime.Equal(info.ModTime()) {
+		return idx, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := parsePackIndex(data)
+	if err != nil {
+		return nil, fmt.Errorf("pack index %s: %v", filepath.Base(path), err)
+	}
+	idx.packPath = strings.TrimSuffix(path, ".idx") + ".pack"
+	idx.modTime, idx.size = info.ModTime(), info.Size()
+	packIndexes.byPath[path] = idx
+	return idx, nil
+}
+
+func parsePackIndex(data []byte) (*packIndex, error) {
+	const headerLen = 8 + 256*4
+	if len(data) < headerLen+40 || string(data[:4]) != indexMagic {
+		return nil, errors.New("not a pack index")
+	}
+	if v := binary.BigEndian.Uint32(data[4:8]); v != indexVersion {
+		return nil, fmt.Errorf("unsupported index version %d", v)
+	}
+	if sum := sha1.Sum(data[:len(data)-20]); !bytes.Equal(sum[:], data[len(data)-20:]) {
+		return nil, errors.New("index checksum mismatch")
+	}
+
+	idx := &packIndex{}
+	for i := range idx.fanout {
+		idx.fanout[i] = binary.BigEndian.Uint32(data[8+i*4:])
+		if i > 0 && idx.fanout[i] < idx.fanout[i-1] {
+			return nil, fmt.Errorf("index fan-out decreases at %02x", i)
+		}
+	}
+	n := int(idx.fanout[255])
+	if len(data) != headerLen+n*28+40 {
+		return nil, fmt.Errorf("index is %d bytes, want %d for %d objects", len(data), headerLen+n*28+40, n)
+	}
+	idx.shas = data[headerLen : headerLen+n*20]
+	// find trusts the fan-out to bound its binary search, so every bucket
+	// must hold exactly the sorted SHAs that start with its byte.
+	for i := 0; i < n; i++ {
+		sha := idx.shas[i*20 : (i+1)*20]
+		if i > 0 && bytes.Compare(idx.shas[(i-1)*20:i*20], sha) >= 0 {
+			return nil, fmt.Errorf("index SHAs are not sorted at entry %d", i)
+		}
+	}
+	for b := 0; b < 256; b++ {
+		lo := 0
+		if b > 0 {
+			lo = int(idx.fanout[b-1])
+		}
+		hi := int(idx.fanout[b])
+		if (lo < n && int(idx.shas[lo*20]) < b) || (hi > lo && int(idx.shas[(hi-1)*20]) != b) {
+			return nil, fmt.Errorf("index fan-out disagrees with its SHAs at %02x", b)
+		}
+	}
+	offsets := data[headerLen+n*20:]
+	idx.offsets = make([]uint64, n)
+	for i := range idx.offsets {
+		idx.offsets[i] = binary.BigEndian.Uint64(offsets[i*8:])
+	}
+	idx.checksum = data[len(data)-40 : len(data)-20]
+	return idx, nil
+}
+
+// packIndexesIn returns the indexes of every pack in the repository at repo.
+func packIndexesIn(repo string) ([]*packIndex, error) {
+	dir := filepath.Join(repo, ".nutella", "objects", "pack")
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var indexes []*packIndex
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), "pack-") || !strings.HasSuffix(e.Name(), ".idx") {
+			continue
+		}
+		idx, err := openPackIndex(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, idx)
+	}
+	return indexes, nil
+}
+
+// readPackedObject returns object sha from the first pack that holds it, in
+// the same raw form as readLooseObject.
+func readPackedObject(repo, sha string) ([]byte, error) {
+	indexes, err := packIndexesIn(repo)
+	if err != nil {
+		return nil, err
+	}
+	for _, idx := range indexes {
+		if offset, ok := idx.find(sha); ok {
+			return idx.readEntry(offset)
+		}
+	}
+	return nil, fmt.Errorf("%s: %w", sha, ErrObjectNotFound)
+}
+
+// readEntry decodes the pack entry at offset into "<type> <size>\0<content>",
+// resolving pack deltas, or "delta <base> <size>\0<instructions>" for a loose
+// delta object.
+func (idx *packIndex) readEntry(offset int64) ([]byte, error) {
+	f, err := os.Open(idx.packPath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening pack: %v", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	e, err := idx.decodeEntry(f, info.Size(), offset, 0)
+	if err != nil {
+		return nil, err
+	}
+	return e.raw, nil
+}
+
+// packedEntry is a decoded pack entry.
+type packedEntry struct {
+	raw        []byte // resolved object, or a loose delta verbatim
+	depth      int    // number of pack deltas applied to reach raw
+	baseOffset int64  // offset of the pack delta base, or -1
+}
+
+// decodeEntry reads the entry at offset from the pack open as f. chain counts
+// the deltas already being resolved on top of this entry.
+func (idx *packIndex) decodeEntry(f *os.File, packSize, offset int64, chain int) (*packedEntry, error) {
+	name := filepath.Base(idx.packPath)
+	if offset < 12 || offset >= packSize-20 {
+		return nil, fmt.Errorf("%s: offset %d out of range", name, offset)
+	}
+	if chain > maxPackChain {
+		return nil, fmt.Errorf("%s at %d: delta chain longer than %d", name, offset, maxPackChain)
+	}
+	r := bufio.NewReader(io.NewSectionReader(f, offset, packSize-offset))
+
+	typ, size, err := readEntryHeader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s at %d: %v", name, offset, err)
+	}
+	e := &packedEntry{baseOffset: -1}
+	var header string
+	switch {
+	case typ == objDelta:
+		base := make([]byte, 20)
+		if _, err := io.ReadFull(r, base); err != nil {
+			return nil, fmt.Errorf("%s at %d: truncated delta base", name, offset)
+		}
+		header = fmt.Sprintf("delta %x %d\u0000", base, size)
+	case typ == objRefDelta:
+		base := make([]byte, 20)
+		if _, err := io.ReadFull(r, base); err != nil {
+			return nil, fmt.Errorf("%s at %d: truncated delta base", name, offset)
+		}
+		baseOffset, ok := idx.find(hex.EncodeToString(base))
+		if !ok {
+			return nil, fmt.Errorf("%s at %d: delta base %x is not in the pack", name, offset, base)
+		}
+		e.baseOffset = baseOffset
+	case typ == objOfsDelta:
+		distance, err := readOfsDistance(r)
+		if err != nil || distance <= 0 || distance > offset {
+			return nil, fmt.Errorf("%s at %d: invalid delta base offset", name, offset)
+		}
+		e.baseOffset = offset - distance
+	case packTypeNames[typ] != "":
+		header = fmt.Sprintf("%s %d\u0000", packTypeNames[typ], size)
+	default:
+		return nil, fmt.Errorf("%s at %d: unknown entry type %d", name, offset, typ)
+	}
+
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s at %d: %v", name, offset, err)
+	}
+	defer zr.Close()
+	content, err := io.ReadAll(io.LimitReader(zr, int64(size)+1))
+	if err != nil {
+		return nil, fmt.Errorf("%s at %d: %v", name, offset, err)
+	}
+	if len(content) != size {
+		return nil, fmt.Errorf("%s at %d: entry is %d bytes, header says %d", name, offset, len(content), size)
+	}
+	if e.baseOffset < 0 {
+		e.raw = append([]byte(header), content...)
+		return e, nil
+	}
+
+	base, err := idx.decodeEntry(f, packSize, e.baseOffset, chain+1)
+	if err != nil {
+		return nil, err
+	}
+	objType, baseContent, err := parseObject(base.raw)
+	if err != nil || objType == "delta" {
+		return nil, fmt.Errorf("%s at %d: delta base at %d is not a whole object", name, offset, e.baseOffset)
+	}
+	result, err := applyDelta(baseContent, content)
+	if err != nil {
+		return nil, fmt.Errorf("%s at %d: %v", name, offset, err)
+	}
+	e.raw = append([]byte(fmt.Sprintf("%s %d\u0000", objType, len(result))), result...)
+	e.depth = base.depth + 1
+	return e, nil
+}
+
+// readOfsDistance reads an ofs-delta's distance back to its base. Each byte
+// adds seven bits, most significant first, and every continuation also adds
+// one so that no distance has two encodings.
+func readOfsDistance(r io.ByteReader) (int64, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	distance := int64(c & 0x7f)
+	for c&0x80 != 0 {
+		if c, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+		distance = (distance+1)<<7 | int64(c&0x7f)
+	}
+	return distance, nil
+}
+
+func appendOfsDistance(buf []byte, distance int64) []byte {
+	enc := []byte{byte(distance & 0x7f)}
+	for distance >>= 7; distance > 0; distance >>= 7 {
+		distance--
+		enc = append([]byte{0x80 | byte(distance&0x7f)}, enc...)
+	}
+	return append(buf, enc...)
+}
+
+// readEntryHeader reads a pack entry's type and uncompressed size: the type
+// and the low four size bits share the first byte, and further bytes add seven
+// size bits each while their high bit is set.
+func readEntryHeader(r io.ByteReader) (int, int, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	typ, size, shift := int(c>>4)&7, int(c&0x0f), 4
+	for c&0x80 != 0 {
+		if c, err = r.ReadByte(); err != nil {
+			return 0, 0, err
+		}
+		size |= int(c&0x7f) << shift
+		shift += 7
+		if size < 0 || size > maxObjectSize {
+			return 0, 0, fmt.Errorf("entry size exceeds %d bytes", maxObjectSize)
+		}
+	}
+	return typ, size, nil
+}
+
+func appendEntryHeader(buf []byte, typ, size int) []byte {
+	c := byte(typ<<4) | byte(size&0x0f)
+	size >>= 4
+	for size > 0 {
+		buf = append(buf, c|0x80)
+		c = byte(size & 0x7f)
+		size >>= 7
+	}
+	return append(buf, c)
+}
+
+// countingWriter tracks how many bytes have passed through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// packOptions controls how a pack is delta-compressed.
+type packOptions struct {
+	Window   int  // preceding objects of the same type tried as delta bases
+	Depth    int  // longest delta chain allowed; 0 disables deltas
+	RefDelta bool // name delta bases by SHA instead of by offset
+}
+
+var defaultPackOptions = packOptions{Window: 10, Depth: 50}
+
+// packItem is one object on its way into a pack.
+type packItem struct {
+	sha     string
+	typ     int
+	content []byte // object content, or the instructions of a loose delta
+	base    []byte // SHA of a loose delta's base
+	delta   *packItem
+	data    []byte // instructions against delta when delta is set
+	depth   int
+	offset  int64
+}
+
+// writePack packs objects from the repository at repo into
+// <repo>/.nutella/objects/pack and returns the pack's name.
+func writePack(repo string, objects []string, opts packOptions) (string, error) {
+	return writePackTo(repo, filepath.Join(repo, ".nutella", "objects", "pack"), objects, opts)
+}
+
+// selectDeltas orders items by type and then by size, largest first, and
+// tries each against the opts.Window objects before it, keeping the smallest
+// delta that saves at least a tenth of the object and stays within opts.Depth.
+// Bases always precede the objects built on them.
+func selectDeltas(items []*packItem, opts packOptions) {
+	sort.Slice(items, func(i, j int) bool {
+		a, b := items[i], items[j]
+		if a.typ != b.typ {
+			return a.typ < b.typ
+		}
+		if len(a.content) != len(b.content) {
+			return len(a.content) > len(b.content)
+		}
+		return a.sha < b.sha
+	})
+	if opts.Depth <= 0 {
+		return
+	}
+	for i, item := range items {
+		if item.typ == objDelta {
+			continue
+		}
+		for j := i - 1; j >= 0 && j >= i-opts.Window; j-- {
+			cand := items[j]
+			if cand.typ != item.typ || cand.depth >= opts.Depth {
+				continue
+			}
+			delta := computeDelta(cand.content, item.content)
+			if len(delta) >= len(item.content)*9/10 || (item.delta != nil && len(delta) >= len(item.data)) {
+				continue
+			}
+			item.delta, item.data, item.depth = cand, delta, cand.depth+1
+		}
+	}
+}
+
+// writePackTo writes objects, loose or already packed, as a pack and index in
+// dir. The name is derived from the object set, so packing the same objects
+// twice yields the same pack. Both files are written under temporary names and
+// renamed into place, the index last, so readers never see a partial pack.
+func writePackTo(repo, dir string, objects []string, opts packOptions) (string, error) {
+	shas := append([]string(nil), objects...)
+	sort.Strings(shas)
+	uniq := shas[:0]
+	for i, sha := range shas {
+		if i == 0 || sha != shas[i-1] {
+			uniq = append(uniq, sha)
+		}
+	}
+	shas = uniq
+	name := packName(shas)
+
+	items := make([]*packItem, len(shas))
+	for i, sha := range shas {
+		raw, err := readRawObject(repo, sha)
+		if err != nil {
+			return "", err
+		}
+		nullIdx := bytes.IndexByte(raw, 0)
+		if nullIdx == -1 {
+			return "", fmt.Errorf("invalid object %s: missing null byte", sha)
+		}
+		item := &packItem{sha: sha, content: raw[nullIdx+1:]}
+		if base, err := deltaBase(sha, raw); err != nil {
+			return "", err
+		} else if base != "" {
+			item.typ = objDelta
+			if item.base, err = hex.DecodeString(base); err != nil || len(item.base) != 20 {
+				return "", fmt.Errorf("invalid delta base %q in %s", base, sha)
+			}
+		} else {
+			objType, _, _ := parseObject(raw)
+			typ, ok := packTypeCodes[objType]
+			if !ok {
+				return "", fmt.Errorf("cannot pack %s: unknown object type %q", sha, objType)
+			}
+			item.typ = typ
+		}
+		items[i] = item
+	}
+	selectDeltas(items, opts)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("error creating pack directory: %v", err)
+	}
+	packFile, err := os.CreateTemp(dir, ".tmp-pack-*")
+	if err != nil {
+		return "", fmt.Errorf("error creating packfile: %v", err)
+	}
+	defer os.Remove(packFile.Name())
+	defer packFile.Close()
+
+	packSum := sha1.New()
+	out := &countingWriter{w: io.MultiWriter(packFile, packSum)}
+	header := []byte("PACK")
+	header = binary.BigEndian.AppendUint32(header, packVersion)
+	header = binary.BigEndian.AppendUint32(header, uint32(len(items)))
+	if _, err := out.Write(header); err != nil {
+		return "", fmt.Errorf("error writing packfile: %v", err)
+	}
+
+	offsets := make(map[string]uint64, len(items))
+	for _, item := range items {
+		item.offset = out.n
+		offsets[item.sha] = uint64(item.offset)
+
+		var entry []byte
+		data := item.content
+		switch {
+		case item.delta != nil && opts.RefDelta:
+			baseRaw, _ := hex.DecodeString(item.delta.sha)
+			data = item.data
+			entry = append(appendEntryHeader(nil, objRefDelta, len(data)), baseRaw...)
+		case item.delta != nil:
+			data = item.data
+			entry = appendOfsDistance(appendEntryHeader(nil, objOfsDelta, len(data)), item.offset-item.delta.offset)
+		case item.typ == objDelta:
+			entry = append(appendEntryHeader(nil, objDelta, len(data)), item.base...)
+		default:
+			entry = appendEntryHeader(nil, item.typ, len(data))
+		}
+
+		var buf bytes.Buffer
+		w := zlib.NewWriter(&buf)
+		_, _ = w.Write(data)
+		w.Close()
+		if _, err := out.Write(append(entry, buf.Bytes()...)); err != nil {
+			return "", fmt.Errorf("error writing packfile: %v", err)
+		}
+	}
+	checksum := packSum.Sum(nil)
+	if _, err := packFile.Write(checksum); err != nil {
+		return "", fmt.Errorf("error writing packfile: %v", err)
+	}
+	if err := packFile.Close(); err != nil {
+		return "", fmt.Errorf("error writing packfile: %v", err)
+	}
+
+	var fanout [256]uint32
+	for _, sha := range shas {
+		first, _ := hex.DecodeString(sha[:2])
+		fanout[first[0]]++
+	}
+	index := binary.BigEndian.AppendUint32([]byte(indexMagic), indexVersion)
+	var total uint32
+	for _, n := range fanout {
+		total += n
+		index = binary.BigEndian.AppendUint32(index, total)
+	}
+	for _, sha := range shas {
+		raw, err := hex.DecodeString(sha)
+		if err != nil || len(raw) != 20 {
+			return "", fmt.Errorf("invalid SHA %q", sha)
+		}
+		index = append(index, raw...)
+	}
+	for _, sha := range shas {
+		index = binary.BigEndian.AppendUint64(index, offsets[sha])
+	}
+	index = append(index, checksum...)
+	indexSum := sha1.Sum(index)
+	index = append(index, indexSum[:]...)
+
+	indexTmp := filepath.Join(dir, ".tmp-"+name+".idx")
+	if err := os.WriteFile(indexTmp, index, 0644); err != nil {
+		return "", fmt.Errorf("error writing index file: %v", err)
+	}
+	defer os.Remove(indexTmp)
+	if err := os.Rename(packFile.Name(), filepath.Join(dir, name+".pack")); err != nil {
+		return "", fmt.Errorf("error installing packfile: %v", err)
+	}
+	if err := os.Rename(indexTmp, filepath.Join(dir, name+".idx")); err != nil {
+		return "", fmt.Errorf("error installing index file: %v", err)
+	}
+	return name, nil
+}
+
+// packName names the pack of the sorted, distinct objects shas.
+func packName(shas []string) string {
+	return fmt.Sprintf("pack-%x", sha1.Sum([]byte(strings.Join(shas, "\n"))))
+}
+
+// packEntry describes one verified object of a pack.
+type packEntry struct {
+	Sha    string
+	Type   string // the object's type; "delta" for a loose delta object
+	Size   int    // size of the object's content
+	Offset int64
+	Packed int64  // bytes the entry occupies in the pack
+	Depth  int    // pack deltas applied to rebuild the object
+	Base   string // SHA of the pack delta base, if any
+}
+
+// checkPackChecksum compares the pack's trailing SHA-1 with its contents and
+// with the checksum recorded in its index, and returns the pack's size.
+func checkPackChecksum(idx *packIndex, name string) (int64, error) {
+	data, err := os.ReadFile(idx.packPath)
+	if err != nil {
+		return 0, fmt.Errorf("error reading pack: %v", err)
+	}
+	if len(data) < 32 || string(data[:4]) != "PACK" {
+		return 0, fmt.Errorf("%s: not a pack", name)
+	}
+	sum := sha1.Sum(data[:len(data)-20])
+	if !bytes.Equal(sum[:], data[len(data)-20:]) || !bytes.Equal(sum[:], idx.checksum) {
+		return 0, fmt.Errorf("%s: pack checksum mismatch", name)
+	}
+	if n := int(binary.BigEndian.Uint32(data[8:12])); n != idx.count() {
+		return 0, fmt.Errorf("%s: pack holds %d objects but index lists %d", name, n, idx.count())
+	}
+	return int64(len(data)), nil
+}
+
+// verifyPack checks pack name's checksum against its index, rebuilds every
+// object in it and rehashes it, and returns the entries in pack order.
+func verifyPack(repo, name string) ([]packEntry, error) {
+	dir := filepath.Join(repo, ".nutella", "objects", "pack")
+	idx, err := openPackIndex(filepath.Join(dir, name+".idx"))
+	if err != nil {
+		return nil, err
+	}
+	size, err := checkPackChecksum(idx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(idx.packPath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening pack: %v", err)
+	}
+	defer f.Close()
+
+	entries := make([]packEntry, idx.count())
+	shaAt := make(map[int64]string, len(entries))
+	for i := range entries {
+		entries[i] = packEntry{Sha: idx.sha(i), Offset: int64(idx.offsets[i])}
+		shaAt[entries[i].Offset] = entries[i].Sha
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Offset < entries[j].Offset })
+
+	end := size - 20
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := &entries[i]
+		e.Packed, end = end-e.Offset, e.Offset
+
+		decoded, err := idx.decodeEntry(f, size, e.Offset, 0)
+		if err != nil {
+			return nil, err
+		}
+		if got := fmt.Sprintf("%x", sha1.Sum(decoded.raw)); got != e.Sha {
+			return nil, fmt.Errorf("%s: object %s hashes to %s", name, e.Sha, got)
+		}
+		objType, content, _ := parseObject(decoded.raw)
+		e.Type, e.Size, e.Depth = objType, len(content), decoded.depth
+		if decoded.baseOffset >= 0 {
+			e.Base = shaAt[decoded.baseOffset]
+		}
+	}
+	return entries, nil
+}
+
+// pruneLoose deletes the loose copies of objects, leaving any other loose
+// objects and the fan-out directories that still hold them.
+func pruneLoose(repo string, objects []string) (int, error) {
+	pruned := 0
+	for _, sha := range objects {
+		path := filepath.Join(repo, ".nutella", "objects", sha[:2], sha[2:])
+		if err := os.Remove(path); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return pruned, fmt.Errorf("error removing loose object %s: %v", sha, err)
+		}
+		pruned++
+		// Drop the fan-out directory once it is empty; this fails harmlessly otherwise.
+		os.Remove(filepath.Dir(path))
+	}
+	return pruned, nil
+}
+
+var verifyPackVerbose bool
+
+// Command to check packfiles object by object
+var verifyPackCmd = &cobra.Command{
+	Use:   "verify-pack <dbID> [pack...]",
+	Short: "Verify packfiles",
+	Long: `Checks each pack's checksum against its index, then rebuilds every object,
+applying delta chains, and rehashes it. Without pack names, every pack in the
+repository is checked. -v lists each object with its type, size, size in the
+pack and offset, plus the chain depth and base of deltified objects.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		basePath := filepath.Join(".", "files", args[0])
+		if _, err := os.Stat(filepath.Join(basePath, ".nutella")); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: repository not found at %s. Please run 'init' first.\n", basePath)
+			os.Exit(1)
+		}
+
+		names := args[1:]
+		if len(names) == 0 {
+			indexes, err := packIndexesIn(basePath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error reading packs: %v\n", err)
+				os.Exit(1)
+			}
+			for _, idx := range indexes {
+				names = append(names, strings.TrimSuffix(filepath.Base(idx.packPath), ".pack"))
+			}
+		}
+		if len(names) == 0 {
+			fmt.Println("No packs to verify")
+			return
+		}
+
+		failed := false
+		for _, name := range names {
+			name = strings.TrimSuffix(strings.TrimSuffix(filepath.Base(name), ".pack"), ".idx")
+			entries, err := verifyPack(basePath, name)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				failed = true
+				continue
+			}
+			deltas, longest := 0, 0
+			for _, e := range entries {
+				if verifyPackVerbose {
+					fmt.Printf("%s %-6s %d %d %d", e.Sha, e.Type, e.Size, e.Packed, e.Offset)
+					if e.Base != "" {
+						fmt.Printf(" %d %s", e.Depth, e.Base)
+					}
+					fmt.Println()
+				}
+				if e.Base != "" {
+					deltas++
+					longest = max(longest, e.Depth)
+				}
+			}
+			fmt.Printf("%s: ok (%d objects, %d deltas, longest chain %d)\n", name, len(entries), deltas, longest)
+		}
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
@@ -0,0 +1,205 @@
+package dbcli
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"db/database"
+)
+
+func TestPackReadAndPruneLoose(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db_pack")
+	db, err := database.OpenDatabase(dir, "db_pack")
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	db.Close()
+
+	editCollection(t, dir, "fruits", func(c *database.Collection) {
+		for _, k := range []string{"apple", "banana", "cherry"} {
+			if err := c.Insert(k, "v1"); err != nil {
+				t.Fatalf("Failed to insert %s: %v", k, err)
+			}
+		}
+	})
+	first := commitDir(t, dir, "first")
+	editCollection(t, dir, "fruits", func(c *database.Collection) {
+		if _, err := c.Update("banana", "v2"); err != nil {
+			t.Fatalf("Failed to update: %v", err)
+		}
+	})
+	second := commitDir(t, dir, "second")
+	if _, err := CreateTag(dir, "v1", first, "first release", defaultIdentity()); err != nil {
+		t.Fatalf("Failed to tag: %v", err)
+	}
+
+	loose, err := looseObjects(dir)
+	if err != nil {
+		t.Fatalf("Failed to list loose objects: %v", err)
+	}
+	shas := make([]string, len(loose))
+	for i, obj := range loose {
+		shas[i] = obj.Sha
+	}
+	name, err := writePack(dir, shas, defaultPackOptions)
+	if err != nil {
+		t.Fatalf("Failed to write pack: %v", err)
+	}
+	if again, err := writePack(dir, shas, defaultPackOptions); err != nil || again != name {
+		t.Errorf("repacking the same objects = %s, %v; want %s", again, err, name)
+	}
+
+	entries, err := verifyPack(dir, name)
+	if err != nil {
+		t.Fatalf("Failed to verify pack: %v", err)
+	}
+	if len(entries) != len(shas) {
+		t.Errorf("pack holds %d objects; want %d", len(entries), len(shas))
+	}
+	packed := make([]string, len(entries))
+	for i, e := range entries {
+		packed[i] = e.Sha
+	}
+	if n, err := pruneLoose(dir, packed); err != nil || n != len(shas) {
+		t.Fatalf("pruneLoose = %d, %v; want %d", n, err, len(shas))
+	}
+	if left, _ := looseObjects(dir); len(left) != 0 {
+		t.Errorf("%d loose objects left after pruning", len(left))
+	}
+
+	// Every lookup now has to go through the pack index.
+	for _, sha := range shas {
+		if _, err := loadObject(dir, sha); err != nil {
+			t.Errorf("loadObject(%s) from pack: %v", sha, err)
+		}
+	}
+	if _, err := loadObject(dir, "0000000000000000000000000000000000000000"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("loadObject(missing) err = %v; want ErrObjectNotFound", err)
+	}
+	if commits, err := Log(dir, second, 0); err != nil || len(commits) != 2 {
+		t.Errorf("Log from pack = %d commits, %v; want 2", len(commits), err)
+	}
+	if sha, err := ResolveRevision(dir, second[:7]); err != nil || sha != second {
+		t.Errorf("ResolveRevision(%s) = %s, %v; want %s", second[:7], sha, err, second)
+	}
+	if sha, err := ResolveRevision(dir, "v1"); err != nil || sha != first {
+		t.Errorf("ResolveRevision(v1) = %s, %v; want %s", sha, err, first)
+	}
+	m, err := MountCommit(dir, first)
+	if err != nil {
+		t.Fatalf("Failed to mount packed commit: %v", err)
+	}
+	if v, found, err := m.Find("fruits", "banana"); err != nil || !found || v != "v1" {
+		t.Errorf("packed Find(banana) = %v, %v, %v; want v1", v, found, err)
+	}
+
+	// A flipped byte in the pack is caught before anything trusts it.
+	packPath := filepath.Join(dir, ".nutella", "objects", "pack", name+".pack")
+	data, err := os.ReadFile(packPath)
+	if err != nil {
+		t.Fatalf("Failed to read pack: %v", err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := os.WriteFile(packPath, data, 0644); err != nil {
+		t.Fatalf("Failed to corrupt pack: %v", err)
+	}
+	if _, err := verifyPack(dir, name); err == nil {
+		t.Errorf("verifyPack accepted a corrupted pack")
+	}
+}
+
+func TestPackDeltas(t *testing.T) {
+	repo := t.TempDir()
+
+	// Pages of the same collection differ in a few keys, so each version
+	// should pack as a small delta against another.
+	var page bytes.Buffer
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&page, "{\"key\":\"k%03d\",\"value\":\"v%03d\"},", i, i)
+	}
+	contents := map[string][]byte{}
+	for v := 0; v < 6; v++ {
+		content := bytes.Replace(page.Bytes(), []byte(fmt.Sprintf("v%03d", v*30)), []byte("changed"), 1)
+		sha, err := writeObject(repo, "blob", content)
+		if err != nil {
+			t.Fatalf("Failed to write object: %v", err)
+		}
+		contents[sha] = content
+	}
+	tree, err := writeObject(repo, "tree", []byte("not similar to anything"))
+	if err != nil {
+		t.Fatalf("Failed to write object: %v", err)
+	}
+	contents[tree] = []byte("not similar to anything")
+
+	var shas []string
+	for sha := range contents {
+		shas = append(shas, sha)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		opts      packOptions
+		wantDelta bool
+		maxDepth  int
+	}{
+		{"offset deltas", defaultPackOptions, true, 50},
+		{"ref deltas", packOptions{Window: 10, Depth: 50, RefDelta: true}, true, 50},
+		{"depth one", packOptions{Window: 10, Depth: 1}, true, 1},
+		{"no deltas", packOptions{Window: 10, Depth: 0}, false, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			name, err := writePackTo(repo, dir, shas, tc.opts)
+			if err != nil {
+				t.Fatalf("Failed to write pack: %v", err)
+			}
+			idx, err := openPackIndex(filepath.Join(dir, name+".idx"))
+			if err != nil {
+				t.Fatalf("Failed to open index: %v", err)
+			}
+
+			deltas := 0
+			for sha, want := range contents {
+				offset, ok := idx.find(sha)
+				if !ok {
+					t.Fatalf("%s missing from the index", sha)
+				}
+				raw, err := idx.readEntry(offset)
+				if err != nil {
+					t.Fatalf("Failed to read %s: %v", sha, err)
+				}
+				if _, content, _ := parseObject(raw); !bytes.Equal(content, want) {
+					t.Errorf("%s read back differently from the pack", sha)
+				}
+
+				f, _ := os.Open(idx.packPath)
+				info, _ := f.Stat()
+				e, err := idx.decodeEntry(f, info.Size(), offset, 0)
+				f.Close()
+				if err != nil {
+					t.Fatalf("Failed to decode %s: %v", sha, err)
+				}
+				if e.depth > tc.maxDepth {
+					t.Errorf("%s has chain depth %d; want at most %d", sha, e.depth, tc.maxDepth)
+				}
+				if e.baseOffset >= 0 {
+					deltas++
+					if sha == tree {
+						t.Errorf("the tree was deltified against a blob")
+					}
+				}
+			}
+			if tc.wantDelta && deltas == 0 {
+				t.Errorf("no objects were stored as deltas")
+			}
+			if !tc.wantDelta && deltas != 0 {
+				t.Errorf("%d objects were stored as deltas with deltas disabled", deltas)
+			}
+		})
+	}
+}
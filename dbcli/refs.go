@@ -0,0 +1,209 @@
+package dbcli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultBranch is the branch HEAD points at in a fresh repository.
+const defaultBranch = "main"
+
+// minShortSHA is the shortest SHA prefix ResolveRevision accepts.
+const minShortSHA = 4
+
+var (
+	// ErrUnknownRevision is returned when a name is not a branch, tag or commit.
+	ErrUnknownRevision = errors.New("unknown branch, tag or commit")
+	// ErrAmbiguousRevision is returned when a short SHA matches several commits.
+	ErrAmbiguousRevision = errors.New("ambiguous short SHA")
+)
+
+// validRefName rejects branch and tag names that would escape their refs
+// directory or be confused with a commit SHA or a flag.
+func validRefName(name string) error {
+	switch {
+	case name == "", name == "HEAD", strings.HasPrefix(name, "-"), strings.HasPrefix(name, "/"), strings.HasSuffix(name, "/"),
+		strings.Contains(name, ".."), strings.Contains(name, "//"), strings.HasSuffix(name, ".lock"),
+		strings.ContainsAny(name, " \t\\:~^?*["):
+		return fmt.Errorf("invalid ref name %q", name)
+	}
+	return nil
+}
+
+// readHead returns the ref HEAD points at (for example "refs/heads/main") and
+// the commit it resolves to. ref is empty when HEAD is detached; sha is empty
+// when the branch has no commits yet.
+func readHead(repo string) (ref, sha string, err error) {
+	data, err := os.ReadFile(filepath.Join(repo, ".nutella", "HEAD"))
+	if os.IsNotExist(err) {
+		return "refs/heads/" + defaultBranch, "", nil
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("error reading HEAD: %w", err)
+	}
+
+	head := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(head, "ref: ") {
+		return "", head, nil
+	}
+	ref = strings.TrimPrefix(head, "ref: ")
+	sha, err = readRef(repo, ref)
+	return ref, sha, err
+}
+
+// readRef returns the commit a ref file holds, or "" if it does not exist.
+func readRef(repo, ref string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(repo, ".nutella", filepath.FromSlash(ref)))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error reading %s: %w", ref, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// writeRef points ref at sha, replacing the ref file atomically.
+func writeRef(repo, ref, sha string) error {
+	path := filepath.Join(repo, ".nutella", filepath.FromSlash(ref))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error creating %s: %w", filepath.Dir(ref), err)
+	}
+	tmp := path + ".lock"
+	if err := os.WriteFile(tmp, []byte(sha+"\n"), 0644); err != nil {
+		return fmt.Errorf("error writing %s: %w", ref, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error updating %s: %w", ref, err)
+	}
+	return nil
+}
+
+// advanceHead moves the current branch, or a detached HEAD, to sha.
+func advanceHead(repo, sha string) error {
+	ref, _, err := readHead(repo)
+	if err != nil {
+		return err
+	}
+	if ref == "" {
+		return os.WriteFile(filepath.Join(repo, ".nutella", "HEAD"), []byte(sha+"\n"), 0644)
+	}
+	return writeRef(repo, ref, sha)
+}
+
+// ResolveRevision turns rev into a commit SHA. It accepts, in order, HEAD, a
+// full commit SHA, a branch, a tag (peeling annotated tags), a remote-tracking
+// branch such as "origin/main" and a unique SHA prefix of at least four
+// characters.
+func ResolveRevision(basePath, rev string) (string, error) {
+	if rev == "HEAD" {
+		_, sha, err := readHead(basePath)
+		if err != nil {
+			return "", err
+		}
+		if sha == "" {
+			return "", fmt.Errorf("HEAD: %w", ErrUnknownRevision)
+		}
+		return sha, nil
+	}
+	if isHex(rev) && len(rev) == 40 {
+		if _, err := loadTyped(basePath, rev, "commit"); err == nil {
+			return rev, nil
+		} else if !errors.Is(err, ErrObjectNotFound) {
+			return "", err
+		}
+	}
+	if validRefName(rev) == nil {
+		for _, ref := range []string{branchRef(rev), tagRef(rev), remoteRef(rev)} {
+			sha, err := readRef(basePath, ref)
+			if err != nil {
+				return "", err
+			}
+			if sha != "" {
+				return peelToCommit(basePath, sha)
+			}
+		}
+	}
+	if isHex(rev) && len(rev) >= minShortSHA && len(rev) < 40 {
+		return expandShortSHA(basePath, rev)
+	}
+	return "", fmt.Errorf("%s: %w", rev, ErrUnknownRevision)
+}
+
+func isHex(s string) bool {
+	for _, r := range s {
+		if !strings.ContainsRune("0123456789abcdef", r) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// peelToCommit follows annotated tag objects until it reaches a commit.
+func peelToCommit(repo, sha string) (string, error) {
+	for i := 0; i < 10; i++ {
+		data, err := loadObject(repo, sha)
+		if err != nil {
+			return "", err
+		}
+		objType, content, err := parseObject(data)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", sha, err)
+		}
+		switch objType {
+		case "commit":
+			return sha, nil
+		case "tag":
+			t, err := parseTag(sha, content)
+			if err != nil {
+				return "", err
+			}
+			sha = t.Commit
+		default:
+			return "", fmt.Errorf("%s is a %s, not a commit", sha, objType)
+		}
+	}
+	return "", fmt.Errorf("%s: tag chain too deep", sha)
+}
+
+// expandShortSHA finds the one commit whose SHA starts with prefix.
+func expandShortSHA(repo, prefix string) (string, error) {
+	entries, err := os.ReadDir(filepath.Join(repo, ".nutella", "objects", prefix[:2]))
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("error reading objects: %v", err)
+	}
+
+	candidates := make(map[string]bool)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), prefix[2:]) {
+			candidates[prefix[:2]+e.Name()] = true
+		}
+	}
+	indexes, err := packIndexesIn(repo)
+	if err != nil {
+		return "", err
+	}
+	for _, idx := range indexes {
+		for _, sha := range idx.withPrefix(prefix) {
+			candidates[sha] = true
+		}
+	}
+
+	var matches []string
+	for sha := range candidates {
+		if commit, err := peelToCommit(repo, sha); err == nil {
+			matches = append(matches, commit)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("%s: %w", prefix, ErrUnknownRevision)
+	case 1:
+		return matches[0], nil
+	}
+	return "", fmt.Errorf("%s matches %d objects: %w", prefix, len(matches), ErrAmbiguousRevision)
+}
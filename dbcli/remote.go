@@ -0,0 +1,737 @@
+package dbcli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"db/client"
+	"db/database"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	// ErrUnknownRemote is returned when a remote name is not configured.
+	ErrUnknownRemote = errors.New("no such remote")
+	// ErrRemoteExists is returned when adding a remote whose name is taken.
+	ErrRemoteExists = errors.New("remote already exists")
+)
+
+// remoteTimeout bounds each request to a remote; packs of a large history
+// take a while to build and send.
+const remoteTimeout = 10 * time.Minute
+
+// Remote is a database on another server that fetch, pull and push exchange
+// history with.
+type Remote struct {
+	Name string `json:"name"`
+	URL  string `json:"url"` // base URL of the server, such as "http://backup:3000"
+	DB   string `json:"db"`  // ID of the database on that server
+}
+
+// RefChange is a ref that fetch, pull or push moved. Old is empty for a ref
+// that did not exist before.
+type RefChange struct {
+	Ref string `json:"ref"`
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// remoteRef is the ref under which fetch records a remote's branch, named
+// "<remote>/<branch>".
+func remoteRef(name string) string {
+	return "refs/remotes/" + name
+}
+
+func remotesPath(repo string) string {
+	return filepath.Join(repo, ".nutella", "remotes.json")
+}
+
+// readRemotes loads <repo>/.nutella/remotes.json, keyed by remote name.
+func readRemotes(repo string) (map[string]Remote, error) {
+	remotes := make(map[string]Remote)
+	data, err := os.ReadFile(remotesPath(repo))
+	if os.IsNotExist(err) {
+		return remotes, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading remotes: %v", err)
+	}
+	if err := json.Unmarshal(data, &remotes); err != nil {
+		return nil, fmt.Errorf("error parsing remotes: %v", err)
+	}
+	for name, r := range remotes {
+		r.Name = name
+		remotes[name] = r
+	}
+	return remotes, nil
+}
+
+func writeRemotes(repo string, remotes map[string]Remote) error {
+	data, err := json.MarshalIndent(remotes, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling remotes: %v", err)
+	}
+	if err := os.WriteFile(remotesPath(repo), data, 0644); err != nil {
+		return fmt.Errorf("error writing remotes: %v", err)
+	}
+	return nil
+}
+
+// AddRemote records database remoteDB of the server at url as remote name of
+// the repository at basePath.
+func AddRemote(basePath, name, url, remoteDB string) error {
+	if _, err := os.Stat(filepath.Join(basePath, ".nutella")); err != nil {
+		return fmt.Errorf("%s: %w", basePath, ErrNoRepository)
+	}
+	if err := validRefName(name); err != nil || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid remote name %q", name)
+	}
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return fmt.Errorf("invalid remote URL %q: want http:// or https://", url)
+	}
+	if err := database.ValidDBID(remoteDB); err != nil {
+		return err
+	}
+	remotes, err := readRemotes(basePath)
+	if err != nil {
+		return err
+	}
+	if _, ok := remotes[name]; ok {
+		return fmt.Errorf("%s: %w", name, ErrRemoteExists)
+	}
+	remotes[name] = Remote{Name: name, URL: strings.TrimRight(url, "/"), DB: remoteDB}
+	return writeRemotes(basePath, remotes)
+}
+
+// RemoveRemote forgets remote name along with its remote-tracking refs.
+func RemoveRemote(basePath, name string) error {
+	remotes, err := readRemotes(basePath)
+	if err != nil {
+		return err
+	}
+	if _, ok := remotes[name]; !ok {
+		return fmt.Errorf("%s: %w", name, ErrUnknownRemote)
+	}
+	delete(remotes, name)
+	if err := writeRemotes(basePath, remotes); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(filepath.Join(basePath, ".nutella", "refs", "remotes", name)); err != nil {
+		return fmt.Errorf("error removing refs of %s: %v", name, err)
+	}
+	return nil
+}
+
+// ListRemotes returns the remotes of the repository at basePath, sorted by
+// name.
+func ListRemotes(basePath string) ([]Remote, error) {
+	remotes, err := readRemotes(basePath)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Remote, 0, len(remotes))
+	for _, r := range remotes {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// GetRemote returns remote name of the repository at basePath.
+func GetRemote(basePath, name string) (Remote, error) {
+	remotes, err := readRemotes(basePath)
+	if err != nil {
+		return Remote{}, err
+	}
+	r, ok := remotes[name]
+	if !ok {
+		return Remote{}, fmt.Errorf("%s: %w", name, ErrUnknownRemote)
+	}
+	return r, nil
+}
+
+// remoteClient talks to r's server, authenticating with token when it is set.
+func remoteClient(r Remote, token string) *client.Client {
+	opts := []client.Option{client.WithTimeout(remoteTimeout)}
+	if token != "" {
+		opts = append(opts, client.WithToken(token))
+	}
+	return client.New(r.URL, opts...)
+}
+
+// localTips lists the commits and tags the repository at repo has refs for,
+// which a fetch offers as history it already holds.
+func localTips(repo string) ([]string, error) {
+	tips, err := refTips(repo)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var have []string
+	for _, sha := range tips {
+		if !seen[sha] {
+			seen[sha] = true
+			have = append(have, sha)
+		}
+	}
+	sort.Strings(have)
+	return have, nil
+}
+
+// fetchRefs downloads the objects of refs that the repository at basePath
+// lacks, then records the remote's branches as refs/remotes/<remote>/<branch>
+// and creates its tags unless a tag of the same name exists.
+func fetchRefs(ctx context.Context, basePath string, c *client.Client, remote Remote, refs map[string]string) ([]RefChange, error) {
+	var want []string
+	seen := make(map[string]bool)
+	for _, sha := range refs {
+		if seen[sha] {
+			continue
+		}
+		seen[sha] = true
+		ok, err := hasObject(basePath, sha)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			want = append(want, sha)
+		}
+	}
+	sort.Strings(want)
+
+	if len(want) > 0 {
+		have, err := localTips(basePath)
+		if err != nil {
+			return nil, err
+		}
+		bundle, err := c.FetchPack(ctx, remote.DB, client.FetchPackRequest{Want: want, Have: have})
+		if err != nil {
+			return nil, fmt.Errorf("remote %s: %w", remote.Name, err)
+		}
+		if _, err := ReceivePack(basePath, bundle); err != nil {
+			return nil, err
+		}
+		if _, err := walkObjects(basePath, want, nil); err != nil {
+			return nil, fmt.Errorf("remote %s sent incomplete history: %w", remote.Name, err)
+		}
+	}
+
+	names := make([]string, 0, len(refs))
+	for ref := range refs {
+		names = append(names, ref)
+	}
+	sort.Strings(names)
+
+	var changes []RefChange
+	for _, ref := range names {
+		sha := refs[ref]
+		var local string
+		switch {
+		case strings.HasPrefix(ref, "refs/heads/"):
+			local = remoteRef(remote.Name + "/" + strings.TrimPrefix(ref, "refs/heads/"))
+		case strings.HasPrefix(ref, "refs/tags/"):
+			local = ref
+		default:
+			continue
+		}
+		if validRefName(strings.TrimPrefix(local, "refs/")) != nil {
+			continue
+		}
+		old, err := readRef(basePath, local)
+		if err != nil {
+			return nil, err
+		}
+		if old == sha || old != "" && strings.HasPrefix(local, "refs/tags/") {
+			continue
+		}
+		if err := writeRef(basePath, local, sha); err != nil {
+			return nil, err
+		}
+		changes = append(changes, RefChange{Ref: local, Old: old, New: sha})
+	}
+	return changes, nil
+}
+
+// Fetch downloads the history of remote name that the repository at basePath
+// lacks. The remote's branches are recorded as refs/remotes/<name>/<branch>;
+// its tags are created locally unless a tag of the same name exists. The
+// working tree and local branches are left alone. It returns the refs it
+// moved.
+func Fetch(basePath, name, token string) ([]RefChange, error) {
+	remote, err := GetRemote(basePath, name)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	c := remoteClient(remote, token)
+	refs, err := c.Refs(ctx, remote.DB)
+	if err != nil {
+		return nil, fmt.Errorf("remote %s: %w", name, err)
+	}
+	return fetchRefs(ctx, basePath, c, remote, refs.Refs)
+}
+
+// Pull fetches remote name and merges its copy of the current branch into
+// the current branch, as Merge does with favor. A branch with no commits yet
+// simply takes the remote's history.
+func Pull(basePath, name, favor, token string) (*MergeResult, []RefChange, error) {
+	headRef, head, err := readHead(basePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !strings.HasPrefix(headRef, "refs/heads/") {
+		return nil, nil, errors.New("HEAD is detached; check out a branch to pull into")
+	}
+	branch := strings.TrimPrefix(headRef, "refs/heads/")
+
+	changes, err := Fetch(basePath, name, token)
+	if err != nil {
+		return nil, nil, err
+	}
+	theirs, err := readRef(basePath, remoteRef(name+"/"+branch))
+	if err != nil {
+		return nil, changes, err
+	}
+	if theirs == "" {
+		return nil, changes, fmt.Errorf("remote %s has no branch %s: %w", name, branch, ErrUnknownRevision)
+	}
+
+	if head == "" {
+		if changed, err := localChanges(basePath, ""); err != nil {
+			return nil, changes, err
+		} else if len(changed) > 0 {
+			return nil, changes, fmt.Errorf("%w in %s; commit them before pulling", ErrLocalChanges, strings.Join(changed, ", "))
+		}
+		if err := restoreWorkingTree(basePath, theirs); err != nil {
+			return nil, changes, err
+		}
+		if err := writeRef(basePath, headRef, theirs); err != nil {
+			return nil, changes, err
+		}
+		if err := recordHistory(basePath, theirs); err != nil {
+			return nil, changes, err
+		}
+		return &MergeResult{Theirs: theirs, FastForward: true, Conflicts: []MergeConflict{}}, changes, nil
+	}
+
+	res, err := Merge(basePath, theirs, favor)
+	if err != nil {
+		return nil, changes, err
+	}
+	if res.FastForward {
+		if err := recordHistory(basePath, theirs); err != nil {
+			return nil, changes, err
+		}
+	}
+	return res, changes, nil
+}
+
+// Push sends branches of the repository at basePath, or the current branch
+// when none are named, to remote name; a name that is not a branch is pushed
+// as a tag. The remote only takes objects it lacks, and only accepts
+// fast-forwards unless force is set. A pushed branch the remote has checked
+// out also rewrites the remote's data, which fails if it has uncommitted
+// changes. It returns the remote refs it moved.
+func Push(basePath, name string, names []string, force bool, token string) ([]RefChange, error) {
+	remote, err := GetRemote(basePath, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		headRef, _, err := readHead(basePath)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(headRef, "refs/heads/") {
+			return nil, errors.New("HEAD is detached; name the branch to push")
+		}
+		names = []string{strings.TrimPrefix(headRef, "refs/heads/")}
+	}
+
+	var refs, want []string
+	for _, n := range names {
+		if err := validRefName(n); err != nil {
+			return nil, err
+		}
+		ref := branchRef(n)
+		sha, err := readRef(basePath, ref)
+		if err == nil && sha == "" {
+			ref = tagRef(n)
+			sha, err = readRef(basePath, ref)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if sha == "" {
+			return nil, fmt.Errorf("%s: %w", n, ErrUnknownRevision)
+		}
+		refs = append(refs, ref)
+		want = append(want, sha)
+	}
+
+	ctx := context.Background()
+	c := remoteClient(remote, token)
+	theirs, err := c.Refs(ctx, remote.DB)
+	if err != nil {
+		return nil, fmt.Errorf("remote %s: %w", name, err)
+	}
+	var have []string
+	for _, sha := range theirs.Refs {
+		have = append(have, sha)
+	}
+	objects, err := missingObjects(basePath, want, have)
+	if err != nil {
+		return nil, err
+	}
+	if len(objects) > 0 {
+		bundle, err := writeBundle(basePath, objects)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := c.ReceivePack(ctx, remote.DB, bundle); err != nil {
+			return nil, fmt.Errorf("remote %s: %w", name, err)
+		}
+	}
+
+	var changes []RefChange
+	for i, ref := range refs {
+		old := theirs.Refs[ref]
+		if old != want[i] {
+			res, err := c.UpdateRef(ctx, remote.DB, client.RefUpdate{Ref: ref, Old: old, New: want[i], Force: force})
+			if err != nil {
+				return changes, fmt.Errorf("remote %s rejected %s: %w", name, ref, err)
+			}
+			changes = append(changes, RefChange{Ref: ref, Old: res.Old, New: res.New})
+		}
+		if strings.HasPrefix(ref, "refs/heads/") {
+			if err := writeRef(basePath, remoteRef(name+"/"+strings.TrimPrefix(ref, "refs/heads/")), want[i]); err != nil {
+				return changes, err
+			}
+		}
+	}
+	return changes, nil
+}
+
+// Clone copies database remoteDB of the server at url into a new database
+// newDBID under root, with the remote recorded as "origin" and the branch
+// the remote has checked out checked out. It returns that branch's commit,
+// or "" when the remote has no commits yet. Like RestoreInto, the clone is
+// assembled in a temporary directory and renamed into place.
+func Clone(url, remoteDB, root, newDBID, token string) (string, error) {
+	if err := database.ValidDBID(newDBID); err != nil {
+		return "", err
+	}
+	dest := filepath.Join(root, newDBID)
+	if _, err := os.Stat(dest); err == nil {
+		return "", fmt.Errorf("%s: %w", newDBID, ErrDatabaseExists)
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return "", fmt.Errorf("error creating %s: %v", root, err)
+	}
+	tmp, err := os.MkdirTemp(root, "."+newDBID+"-")
+	if err != nil {
+		return "", fmt.Errorf("error creating staging directory: %v", err)
+	}
+	done := false
+	defer func() {
+		if !done {
+			os.RemoveAll(tmp)
+		}
+	}()
+
+	db, err := database.OpenDatabase(tmp, newDBID)
+	if err != nil {
+		return "", err
+	}
+	if err := db.Close(); err != nil {
+		return "", err
+	}
+	if err := AddRemote(tmp, "origin", url, remoteDB); err != nil {
+		return "", err
+	}
+	remote, err := GetRemote(tmp, "origin")
+	if err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	c := remoteClient(remote, token)
+	refs, err := c.Refs(ctx, remote.DB)
+	if err != nil {
+		return "", fmt.Errorf("remote origin: %w", err)
+	}
+	if _, err := fetchRefs(ctx, tmp, c, remote, refs.Refs); err != nil {
+		return "", err
+	}
+
+	branch := defaultBranch
+	if strings.HasPrefix(refs.Head, "refs/heads/") {
+		branch = strings.TrimPrefix(refs.Head, "refs/heads/")
+	}
+	if err := os.WriteFile(filepath.Join(tmp, ".nutella", "HEAD"), []byte("ref: "+branchRef(branch)+"\n"), 0644); err != nil {
+		return "", fmt.Errorf("error writing HEAD: %v", err)
+	}
+	sha := refs.Refs[branchRef(branch)]
+	if sha != "" {
+		if err := writeRef(tmp, branchRef(branch), sha); err != nil {
+			return "", err
+		}
+		if err := restoreWorkingTree(tmp, sha); err != nil {
+			return "", err
+		}
+		// The committed manifest still names the remote database.
+		if err := setManifestDBID(tmp, newDBID); err != nil {
+			return "", err
+		}
+		if err := recordHistory(tmp, sha); err != nil {
+			return "", err
+		}
+	}
+
+	if err := os.Rename(tmp, dest); err != nil {
+		return "", fmt.Errorf("error moving %s into place: %v", newDBID, err)
+	}
+	done = true
+	return sha, nil
+}
+
+var (
+	remoteToken string
+	pushForce   bool
+	pullOurs    bool
+	pullTheirs  bool
+	pullMessage string
+)
+
+// remoteAuthToken is the bearer token for remote servers: --token, or the
+// NUTELLA_TOKEN environment variable.
+func remoteAuthToken() string {
+	if remoteToken != "" {
+		return remoteToken
+	}
+	return os.Getenv("NUTELLA_TOKEN")
+}
+
+// repoPath resolves dbID under ./files and exits unless it has a repository.
+func repoPath(dbID string) string {
+	basePath, _ := filepath.Abs(filepath.Join("files", dbID))
+	if _, err := os.Stat(filepath.Join(basePath, ".nutella")); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: repository not found at %s. Please run 'init' first.\n", basePath)
+		os.Exit(1)
+	}
+	return basePath
+}
+
+func printRefChanges(changes []RefChange) {
+	for _, c := range changes {
+		switch {
+		case c.Old == "":
+			fmt.Printf(" * [new] %s -> %s\n", c.Ref, c.New)
+		default:
+			fmt.Printf("   %s..%s %s\n", c.Old[:7], c.New[:7], c.Ref)
+		}
+	}
+}
+
+// Command group to manage the remotes of a database
+var remoteCmd = &cobra.Command{
+	Use:   "remote",
+	Short: "Manage the remote databases that push, fetch and pull talk to",
+}
+
+var remoteAddCmd = &cobra.Command{
+	Use:   "add <dbID> <name> <url> <remote-dbID>",
+	Short: "Add a remote: database remote-dbID of the server at url",
+	Args:  cobra.ExactArgs(4),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := AddRemote(repoPath(args[0]), args[1], args[2], args[3]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Remote '%s' added.\n", args[1])
+	},
+}
+
+var remoteRemoveCmd = &cobra.Command{
+	Use:   "remove <dbID> <name>",
+	Short: "Remove a remote and its remote-tracking branches",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := RemoveRemote(repoPath(args[0]), args[1]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Remote '%s' removed.\n", args[1])
+	},
+}
+
+var remoteListCmd = &cobra.Command{
+	Use:   "list <dbID>",
+	Short: "List remotes",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		remotes, err := ListRemotes(repoPath(args[0]))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		for _, r := range remotes {
+			fmt.Printf("%s\t%s\t%s\n", r.Name, r.URL, r.DB)
+		}
+	},
+}
+
+// Command to download history from a remote
+var fetchCmd = &cobra.Command{
+	Use:   "fetch <dbID> [remote]",
+	Short: "Download branches and tags from a remote",
+	Long: `Asks the remote for the commits this repository lacks and stores them as one
+pack. The remote's branches become <remote>/<branch>, which log, diff and merge
+accept; its tags are created unless a local tag has the same name. The data and
+local branches are not changed. The remote defaults to origin.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		basePath := repoPath(args[0])
+		name := "origin"
+		if len(args) == 2 {
+			name = args[1]
+		}
+		changes, err := Fetch(basePath, name, remoteAuthToken())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if len(changes) == 0 {
+			fmt.Println("Already up to date.")
+			return
+		}
+		printRefChanges(changes)
+	},
+}
+
+// Command to fetch from a remote and merge its copy of the current branch
+var pullCmd = &cobra.Command{
+	Use:   "pull <dbID> [remote]",
+	Short: "Fetch from a remote and merge its copy of the current branch",
+	Long: `Runs fetch, then merges <remote>/<branch> into the current branch key by key,
+like merge. A clean merge is committed straight away; conflicts are recorded
+for 'conflicts' and 'resolve' unless --ours or --theirs settles them. The
+remote defaults to origin.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		basePath := repoPath(args[0])
+		name := "origin"
+		if len(args) == 2 {
+			name = args[1]
+		}
+		favor, err := mergeSide(pullOurs, pullTheirs)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		res, changes, err := Pull(basePath, name, favor, remoteAuthToken())
+		printRefChanges(changes)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		switch {
+		case res.UpToDate:
+			fmt.Println("Already up to date.")
+			return
+		case res.FastForward:
+			fmt.Printf("Fast-forward to %s\n", res.Theirs)
+			return
+		}
+
+		ref, _, _ := readHead(basePath)
+		branch := strings.TrimPrefix(ref, "refs/heads/")
+		fmt.Printf("Merged %d key(s) from %s/%s (base %s).\n", res.Changed, name, branch, res.Base)
+		if len(res.Conflicts) > 0 {
+			fmt.Printf("%d conflict(s):\n", len(res.Conflicts))
+			for _, c := range res.Conflicts {
+				fmt.Printf("  %s/%s\n", c.Collection, c.Key)
+			}
+			fmt.Println("Review them with 'conflicts', settle them with 'resolve --ours|--theirs', then run commit-all.")
+			return
+		}
+		message := pullMessage
+		if message == "" {
+			message = fmt.Sprintf("Merge %s/%s into %s", name, branch, branch)
+		}
+		commit, err := CommitWorkingTree(basePath, message, defaultIdentity(), nil)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(commit.Sha)
+	},
+}
+
+// Command to upload branches or tags to a remote
+var pushCmd = &cobra.Command{
+	Use:   "push <dbID> [remote] [branch|tag...]",
+	Short: "Upload branches or tags to a remote",
+	Long: `Sends the commits the remote lacks as one pack, then moves the remote's refs.
+Without names, the current branch is pushed. The remote refuses an update that
+would drop commits unless --force is given, and refuses one that raced with
+another push either way. Pushing the branch the remote has checked out also
+rewrites the remote's data, provided it has no uncommitted changes. The remote
+defaults to origin.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		basePath := repoPath(args[0])
+		name := "origin"
+		if len(args) >= 2 {
+			name = args[1]
+		}
+		var names []string
+		if len(args) > 2 {
+			names = args[2:]
+		}
+		changes, err := Push(basePath, name, names, pushForce, remoteAuthToken())
+		printRefChanges(changes)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if len(changes) == 0 {
+			fmt.Println("Everything up to date.")
+		}
+	},
+}
+
+// Command to copy a database and its history from a server
+var cloneCmd = &cobra.Command{
+	Use:   "clone <url> <remote-dbID> <new-dbID>",
+	Short: "Copy a database and its history from a server into a new database",
+	Long: `Creates ./files/<new-dbID> with the full history of database remote-dbID on
+the server at url, checks out the branch the server has checked out and records
+the server as the remote origin.`,
+	Args: cobra.ExactArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		root, _ := filepath.Abs("files")
+		sha, err := Clone(args[0], args[1], root, args[2], remoteAuthToken())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if sha == "" {
+			fmt.Printf("Cloned %s into %s; the remote has no commits yet.\n", args[1], args[2])
+			return
+		}
+		fmt.Printf("Cloned %s into %s at %s\n", args[1], args[2], sha)
+	},
+}
@@ -0,0 +1,478 @@
+package dbcli
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	// ErrUnsignedCommit is returned when a restore is refused because the
+	// repository requires signed commits and the commit is not signed by a
+	// trusted key.
+	ErrUnsignedCommit = errors.New("commit is not signed by a trusted key")
+	// ErrUnknownSigner is returned when removing a signer that is not trusted.
+	ErrUnknownSigner = errors.New("no such signer")
+)
+
+// signingKeyEnv names the file holding the key commits and tags are signed
+// with. Nothing is signed when it is unset.
+const signingKeyEnv = "NUTELLA_SIGNING_KEY"
+
+// publicKeyPrefix starts the text form of a public key, "ed25519:<base64>".
+const publicKeyPrefix = "ed25519:"
+
+// Verification results.
+const (
+	VerifyGood      = "good"      // signed by the key trusted for the signer
+	VerifyUntrusted = "untrusted" // a valid signature by a key not trusted for the signer
+	VerifyBad       = "bad"       // the signature does not match the object
+	VerifyUnsigned  = "unsigned"  // no signature
+)
+
+// Verification is the outcome of checking the signature of a commit or tag.
+// Signer is the email of the committer or tagger, whom the key must be
+// trusted for.
+type Verification struct {
+	Sha    string `json:"sha"`
+	Status string `json:"status"`
+	Signer string `json:"signer"`
+	Key    string `json:"key,omitempty"`
+}
+
+// Good reports whether the object is signed by a key trusted for its signer.
+func (v *Verification) Good() bool {
+	return v.Status == VerifyGood
+}
+
+// SigningPolicy is the repository's list of trusted keys, kept in
+// .nutella/signers.json. Signers maps an email to the public key its commits
+// and tags must be signed with.
+type SigningPolicy struct {
+	RequireSigned bool              `json:"require_signed"`
+	Signers       map[string]string `json:"signers"`
+}
+
+// FormatPublicKey renders pub as "ed25519:<base64>".
+func FormatPublicKey(pub ed25519.PublicKey) string {
+	return publicKeyPrefix + base64.StdEncoding.EncodeToString(pub)
+}
+
+// ParsePublicKey is the inverse of FormatPublicKey.
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, publicKeyPrefix))
+	if err != nil || !strings.HasPrefix(s, publicKeyPrefix) || len(data) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key %q: want ed25519:<base64 of %d bytes>", s, ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(data), nil
+}
+
+// GenerateSigningKey writes a new private key to path, readable by its owner
+// only, and returns the public key. An existing file is never overwritten.
+func GenerateSigningKey(path string) (string, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := fmt.Fprintln(f, base64.StdEncoding.EncodeToString(priv.Seed())); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return FormatPublicKey(pub), nil
+}
+
+// readSigningKey loads a key written by GenerateSigningKey.
+func readSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading signing key: %v", err)
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s is not a signing key", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// signingKey is the key named by NUTELLA_SIGNING_KEY, or nil when unset.
+func signingKey() (ed25519.PrivateKey, error) {
+	path := os.Getenv(signingKeyEnv)
+	if path == "" {
+		return nil, nil
+	}
+	return readSigningKey(path)
+}
+
+// signObject adds a "signature ed25519:<key> <sig>" header line to the end of
+// the headers of body, a commit or tag object. The signature covers body as
+// it was, so removing the line gives back what was signed.
+func signObject(body []byte, key ed25519.PrivateKey) []byte {
+	sig := ed25519.Sign(key, body)
+	line := fmt.Sprintf("signature %s %s\n", FormatPublicKey(key.Public().(ed25519.PublicKey)),
+		base64.StdEncoding.EncodeToString(sig))
+	end := bytes.Index(body, []byte("\n\n")) + 1
+	out := make([]byte, 0, len(body)+len(line))
+	out = append(out, body[:end]...)
+	out = append(out, line...)
+	return append(out, body[end:]...)
+}
+
+// splitSignature undoes signObject, returning the signed body and the key
+// and signature of the header. ok is false for an unsigned object.
+func splitSignature(body []byte) (signed []byte, key, sig string, ok bool) {
+	end := bytes.Index(body, []byte("\n\n")) + 1
+	if end <= 0 {
+		return body, "", "", false
+	}
+	lines := strings.SplitAfter(string(body[:end]), "\n")
+	for i, line := range lines {
+		value, found := strings.CutPrefix(line, "signature ")
+		if !found {
+			continue
+		}
+		key, sig, _ = strings.Cut(strings.TrimSuffix(value, "\n"), " ")
+		rest := strings.Join(append(lines[:i:i], lines[i+1:]...), "")
+		return append([]byte(rest), body[end:]...), key, sig, true
+	}
+	return body, "", "", false
+}
+
+func signersPath(repo string) string {
+	return filepath.Join(repo, ".nutella", "signers.json")
+}
+
+// ReadSigningPolicy loads <repo>/.nutella/signers.json; a repository without
+// one trusts no keys and requires nothing.
+func ReadSigningPolicy(repo string) (*SigningPolicy, error) {
+	p := &SigningPolicy{Signers: map[string]string{}}
+	data, err := os.ReadFile(signersPath(repo))
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading signers: %v", err)
+	}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("error parsing signers: %v", err)
+	}
+	if p.Signers == nil {
+		p.Signers = map[string]string{}
+	}
+	return p, nil
+}
+
+func writeSigningPolicy(repo string, p *SigningPolicy) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling signers: %v", err)
+	}
+	if err := os.WriteFile(signersPath(repo), data, 0644); err != nil {
+		return fmt.Errorf("error writing signers: %v", err)
+	}
+	return nil
+}
+
+// updateSigningPolicy applies fn to the policy of the repository at basePath
+// and saves it.
+func updateSigningPolicy(basePath string, fn func(p *SigningPolicy) error) error {
+	if _, err := os.Stat(filepath.Join(basePath, ".nutella")); err != nil {
+		return ErrNoRepository
+	}
+	p, err := ReadSigningPolicy(basePath)
+	if err != nil {
+		return err
+	}
+	if err := fn(p); err != nil {
+		return err
+	}
+	return writeSigningPolicy(basePath, p)
+}
+
+// TrustSigner trusts key for the commits and tags of email, replacing any key
+// trusted for it before.
+func TrustSigner(basePath, email, key string) error {
+	if _, err := ParsePublicKey(key); err != nil {
+		return err
+	}
+	return updateSigningPolicy(basePath, func(p *SigningPolicy) error {
+		p.Signers[email] = key
+		return nil
+	})
+}
+
+// UntrustSigner stops trusting the key of email.
+func UntrustSigner(basePath, email string) error {
+	return updateSigningPolicy(basePath, func(p *SigningPolicy) error {
+		if _, ok := p.Signers[email]; !ok {
+			return fmt.Errorf("%s: %w", email, ErrUnknownSigner)
+		}
+		delete(p.Signers, email)
+		return nil
+	})
+}
+
+// RequireSigned turns on or off the refusal to restore commits that are not
+// signed by a trusted key.
+func RequireSigned(basePath string, on bool) error {
+	return updateSigningPolicy(basePath, func(p *SigningPolicy) error {
+		p.RequireSigned = on
+		return nil
+	})
+}
+
+// verifyObject checks the signature of body against the key policy trusts
+// for signer.
+func verifyObject(policy *SigningPolicy, sha string, body []byte, signer string) *Verification {
+	v := &Verification{Sha: sha, Status: VerifyUnsigned, Signer: signer}
+	signed, key, sig, ok := splitSignature(body)
+	if !ok {
+		return v
+	}
+	v.Key, v.Status = key, VerifyBad
+	pub, err := ParsePublicKey(key)
+	if err != nil {
+		return v
+	}
+	raw, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil || !ed25519.Verify(pub, signed, raw) {
+		return v
+	}
+	v.Status = VerifyUntrusted
+	if policy.Signers[signer] == key {
+		v.Status = VerifyGood
+	}
+	return v
+}
+
+// VerifyCommit checks the signature of commit sha against the key the
+// repository trusts for its committer.
+func VerifyCommit(basePath, sha string) (*Verification, error) {
+	policy, err := ReadSigningPolicy(basePath)
+	if err != nil {
+		return nil, err
+	}
+	return verifyCommit(basePath, policy, sha)
+}
+
+func verifyCommit(basePath string, policy *SigningPolicy, sha string) (*Verification, error) {
+	body, err := loadTyped(basePath, sha, "commit")
+	if err != nil {
+		return nil, err
+	}
+	c, err := parseCommit(sha, body)
+	if err != nil {
+		return nil, err
+	}
+	return verifyObject(policy, sha, body, c.Committer.Email), nil
+}
+
+// VerifyTag checks the signature of annotated tag name against the key the
+// repository trusts for its tagger. Lightweight tags are unsigned.
+func VerifyTag(basePath, name string) (*Verification, error) {
+	policy, err := ReadSigningPolicy(basePath)
+	if err != nil {
+		return nil, err
+	}
+	t, err := readTag(basePath, name)
+	if err != nil {
+		return nil, err
+	}
+	if !t.Annotated {
+		return &Verification{Sha: t.Commit, Status: VerifyUnsigned}, nil
+	}
+	body, err := loadTyped(basePath, t.Object, "tag")
+	if err != nil {
+		return nil, err
+	}
+	return verifyObject(policy, t.Object, body, t.Tagger.Email), nil
+}
+
+// checkRestorable refuses commit sha with ErrUnsignedCommit when the
+// repository at basePath requires signed commits and sha is not signed by a
+// trusted key.
+func checkRestorable(basePath, sha string) error {
+	policy, err := ReadSigningPolicy(basePath)
+	if err != nil || !policy.RequireSigned {
+		return err
+	}
+	v, err := verifyCommit(basePath, policy, sha)
+	if err != nil {
+		return err
+	}
+	if !v.Good() {
+		return fmt.Errorf("%s (%s): %w", sha, v.Status, ErrUnsignedCommit)
+	}
+	return nil
+}
+
+// describeVerification is the line log --verify and verify-commit print.
+func describeVerification(v *Verification) string {
+	switch v.Status {
+	case VerifyGood:
+		return fmt.Sprintf("Good signature from %s (%s)", v.Signer, v.Key)
+	case VerifyUntrusted:
+		return fmt.Sprintf("Valid signature by untrusted key %s for %s", v.Key, v.Signer)
+	case VerifyBad:
+		return fmt.Sprintf("BAD signature claiming key %s", v.Key)
+	}
+	return "No signature"
+}
+
+// Command to create a signing key
+var signingKeyCmd = &cobra.Command{
+	Use:   "signing-key <file>",
+	Short: "Generate an Ed25519 key to sign commits and tags with",
+	Long: `Writes a new private key to file, readable only by you, and prints its public
+key. Point NUTELLA_SIGNING_KEY at the file to sign every commit and annotated
+tag you make, and trust the public key for your email in each repository with
+'signers add'.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		pub, err := GenerateSigningKey(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(pub)
+	},
+}
+
+// Command group to manage trusted keys
+var signersCmd = &cobra.Command{
+	Use:   "signers",
+	Short: "Manage the keys trusted to sign commits and tags",
+	Long: `Each repository keeps, in .nutella/signers.json, the public key trusted for
+each committer email. A commit verifies as good only when it is signed by the
+key trusted for its committer, and a tag by the key trusted for its tagger.
+The list is local: fetch, pull and push do not exchange it.`,
+}
+
+var signersListCmd = &cobra.Command{
+	Use:   "list <dbID>",
+	Short: "List trusted keys and whether restores require signed commits",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		p, err := ReadSigningPolicy(repoPath(args[0]))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		emails := make([]string, 0, len(p.Signers))
+		for email := range p.Signers {
+			emails = append(emails, email)
+		}
+		sort.Strings(emails)
+		for _, email := range emails {
+			fmt.Printf("%s\t%s\n", email, p.Signers[email])
+		}
+		if p.RequireSigned {
+			fmt.Println("Restores require commits signed by a trusted key.")
+		}
+	},
+}
+
+var signersAddCmd = &cobra.Command{
+	Use:   "add <dbID> <email> <public-key>",
+	Short: "Trust a key for the commits and tags of an email",
+	Args:  cobra.ExactArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := TrustSigner(repoPath(args[0]), args[1], args[2]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Trusted %s for %s\n", args[2], args[1])
+	},
+}
+
+var signersRemoveCmd = &cobra.Command{
+	Use:   "remove <dbID> <email>",
+	Short: "Stop trusting the key of an email",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := UntrustSigner(repoPath(args[0]), args[1]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Removed the key of %s\n", args[1])
+	},
+}
+
+var signersRequireCmd = &cobra.Command{
+	Use:   "require <dbID> <on|off>",
+	Short: "Refuse, or stop refusing, to restore commits not signed by a trusted key",
+	Long: `With on, restore, restore-to (with or without --into and --collection) and
+the restore routes of the server refuse commits that do not verify as good.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if args[1] != "on" && args[1] != "off" {
+			fmt.Fprintln(os.Stderr, "Error: want on or off")
+			os.Exit(1)
+		}
+		if err := RequireSigned(repoPath(args[0]), args[1] == "on"); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Signed commits required for restores of %s: %s\n", args[0], args[1])
+	},
+}
+
+// Command to check the signature of a commit
+var verifyCommitCmd = &cobra.Command{
+	Use:   "verify-commit <dbID> <revision>",
+	Short: "Check that a commit is signed by the key trusted for its committer",
+	Long:  `Prints the result and exits non-zero unless the signature is good.`,
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		basePath := repoPath(args[0])
+		sha, err := ResolveRevision(basePath, args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		v, err := VerifyCommit(basePath, sha)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("commit %s: %s\n", sha, describeVerification(v))
+		if !v.Good() {
+			os.Exit(1)
+		}
+	},
+}
+
+// Command to check the signature of an annotated tag
+var verifyTagCmd = &cobra.Command{
+	Use:   "verify-tag <dbID> <name>",
+	Short: "Check that an annotated tag is signed by the key trusted for its tagger",
+	Long:  `Prints the result and exits non-zero unless the signature is good.`,
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		v, err := VerifyTag(repoPath(args[0]), args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("tag %s: %s\n", args[1], describeVerification(v))
+		if !v.Good() {
+			os.Exit(1)
+		}
+	},
+}
@@ -0,0 +1,152 @@
+package dbcli
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"db/database"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "db_signed")
+	db, err := database.OpenDatabase(dir, "db_signed")
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	db.Close()
+
+	editCollection(t, dir, "fruits", func(c *database.Collection) {
+		if err := c.Insert("apple", "red"); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	})
+	unsigned := commitDir(t, dir, "unsigned")
+
+	pub, err := GenerateSigningKey(filepath.Join(root, "key"))
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	if _, err := GenerateSigningKey(filepath.Join(root, "key")); err == nil {
+		t.Errorf("GenerateSigningKey overwrote an existing key")
+	}
+	t.Setenv(signingKeyEnv, filepath.Join(root, "key"))
+	editCollection(t, dir, "fruits", func(c *database.Collection) {
+		if _, err := c.Update("apple", "green"); err != nil {
+			t.Fatalf("Failed to update: %v", err)
+		}
+	})
+	signed := commitDir(t, dir, "signed")
+	if _, err := CreateTag(dir, "v1", "", "first release", defaultIdentity()); err != nil {
+		t.Fatalf("Failed to create tag: %v", err)
+	}
+
+	// Signing must not change how the commit reads.
+	c, err := ReadCommit(dir, signed)
+	if err != nil || c.Message != "signed" || len(c.Parents) != 1 || c.Parents[0] != unsigned {
+		t.Fatalf("signed commit = %+v, %v", c, err)
+	}
+
+	status := func(sha string) string {
+		t.Helper()
+		v, err := VerifyCommit(dir, sha)
+		if err != nil {
+			t.Fatalf("VerifyCommit(%s) = %v", sha, err)
+		}
+		return v.Status
+	}
+	if got := status(unsigned); got != VerifyUnsigned {
+		t.Errorf("unsigned commit verifies as %s", got)
+	}
+	if got := status(signed); got != VerifyUntrusted {
+		t.Errorf("commit signed by an untrusted key verifies as %s", got)
+	}
+	email := defaultIdentity().Email
+	if err := TrustSigner(dir, email, pub); err != nil {
+		t.Fatalf("Failed to trust key: %v", err)
+	}
+	if got := status(signed); got != VerifyGood {
+		t.Errorf("commit signed by a trusted key verifies as %s", got)
+	}
+	if v, err := VerifyTag(dir, "v1"); err != nil || !v.Good() || v.Signer != email {
+		t.Errorf("VerifyTag = %+v, %v; want a good signature from %s", v, err, email)
+	}
+
+	// A forged commit that copies the signature of another one must fail.
+	body, err := loadTyped(dir, signed, "commit")
+	if err != nil {
+		t.Fatalf("Failed to read commit: %v", err)
+	}
+	forged, err := writeObject(dir, "commit", []byte(strings.Replace(string(body), "\nsigned\n", "\nforged\n", 1)))
+	if err != nil {
+		t.Fatalf("Failed to write forged commit: %v", err)
+	}
+	if got := status(forged); got != VerifyBad {
+		t.Errorf("forged commit verifies as %s", got)
+	}
+
+	if err := RequireSigned(dir, true); err != nil {
+		t.Fatalf("Failed to require signatures: %v", err)
+	}
+	for _, sha := range []string{unsigned, forged} {
+		if _, err := RestoreInto(dir, sha, root, "db_copy"); !errors.Is(err, ErrUnsignedCommit) {
+			t.Errorf("RestoreInto(%s) = %v; want ErrUnsignedCommit", sha, err)
+		}
+		if _, err := RestoreCollection(dir, sha, "fruits", nil); !errors.Is(err, ErrUnsignedCommit) {
+			t.Errorf("RestoreCollection(%s) = %v; want ErrUnsignedCommit", sha, err)
+		}
+	}
+	if _, err := RestoreInto(dir, signed, root, "db_copy"); err != nil {
+		t.Errorf("RestoreInto of a signed commit = %v", err)
+	}
+
+	if err := UntrustSigner(dir, email); err != nil {
+		t.Fatalf("Failed to remove signer: %v", err)
+	}
+	if err := UntrustSigner(dir, email); !errors.Is(err, ErrUnknownSigner) {
+		t.Errorf("removing a removed signer = %v; want ErrUnknownSigner", err)
+	}
+	if _, err := RestoreInto(dir, signed, root, "db_other"); !errors.Is(err, ErrUnsignedCommit) {
+		t.Errorf("RestoreInto after the key is distrusted = %v; want ErrUnsignedCommit", err)
+	}
+}
+
+// TestUpdateRefRefusesUnsignedPush pushes an unsigned commit to the
+// checked-out branch of a repository that requires signatures, which would
+// otherwise write it to the working tree.
+func TestUpdateRefRefusesUnsignedPush(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "db_src")
+	dst := filepath.Join(t.TempDir(), "db_dst")
+	for _, dir := range []string{src, dst} {
+		db, err := database.OpenDatabase(dir, filepath.Base(dir))
+		if err != nil {
+			t.Fatalf("Failed to create database: %v", err)
+		}
+		db.Close()
+	}
+	editCollection(t, src, "fruits", func(c *database.Collection) { c.Insert("apple", "red") })
+	unsigned := commitDir(t, src, "unsigned")
+	bundle, _, err := PackObjects(src, []string{unsigned}, nil)
+	if err != nil {
+		t.Fatalf("Failed to pack: %v", err)
+	}
+	if _, err := ReceivePack(dst, bundle); err != nil {
+		t.Fatalf("Failed to receive: %v", err)
+	}
+	if err := RequireSigned(dst, true); err != nil {
+		t.Fatalf("Failed to require signatures: %v", err)
+	}
+
+	if _, err := UpdateRef(dst, RefUpdate{Ref: "refs/heads/main", New: unsigned}); !errors.Is(err, ErrUnsignedCommit) {
+		t.Fatalf("UpdateRef of the checked-out branch = %v; want ErrUnsignedCommit", err)
+	}
+	if sha, err := readRef(dst, "refs/heads/main"); err != nil || sha != "" {
+		t.Errorf("main = %q, %v after a refused push; want it unborn", sha, err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "fruits")); !os.IsNotExist(err) {
+		t.Errorf("refused push wrote the working tree: %v", err)
+	}
+}
@@ -0,0 +1,251 @@
+package dbcli
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// ErrTagExists is returned when creating a tag that already exists.
+var ErrTagExists = errors.New("tag already exists")
+
+// Tag is one ref under .nutella/refs/tags. A lightweight tag points straight at
+// a commit; an annotated tag points at a tag object carrying a tagger and a
+// message, and Object is that object's SHA.
+type Tag struct {
+	Name      string     `json:"name"`
+	Commit    string     `json:"commit"`
+	Object    string     `json:"object,omitempty"`
+	Annotated bool       `json:"annotated"`
+	Tagger    *Signature `json:"tagger,omitempty"`
+	Message   string     `json:"message,omitempty"`
+}
+
+func tagRef(name string) string {
+	return "refs/tags/" + name
+}
+
+// encodeTag renders an annotated tag object.
+func encodeTag(object, name string, tagger Signature, message string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "object %s\n", object)
+	fmt.Fprintf(&b, "type commit\n")
+	fmt.Fprintf(&b, "tag %s\n", name)
+	fmt.Fprintf(&b, "tagger %s\n", tagger)
+	fmt.Fprintf(&b, "\n%s\n", message)
+	return []byte(b.String())
+}
+
+// parseTag reads an annotated tag object into a Tag whose Commit is the
+// object it points at, which may itself be a tag.
+func parseTag(sha string, body []byte) (*Tag, error) {
+	t := &Tag{Object: sha, Annotated: true}
+	header, message, _ := strings.Cut(string(body), "\n\n")
+	t.Message = strings.TrimSuffix(message, "\n")
+
+	var target string
+	for _, line := range strings.Split(header, "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "object":
+			target = value
+		case "tag":
+			t.Name = value
+		case "tagger":
+			sig, err := parseSignature(value)
+			if err != nil {
+				return nil, fmt.Errorf("tag %s: %v", sha, err)
+			}
+			t.Tagger = &sig
+		}
+	}
+	if target == "" {
+		return nil, fmt.Errorf("invalid tag object %s: no object reference found", sha)
+	}
+	t.Commit = target
+	return t, nil
+}
+
+// readTag resolves tag name. Object is set to the tag object for annotated
+// tags and Commit to the commit the tag finally names.
+func readTag(basePath, name string) (*Tag, error) {
+	sha, err := readRef(basePath, tagRef(name))
+	if err != nil {
+		return nil, err
+	}
+	if sha == "" {
+		return nil, fmt.Errorf("tag %s: %w", name, ErrUnknownRevision)
+	}
+
+	t := &Tag{Name: name, Commit: sha}
+	data, err := loadObject(basePath, sha)
+	if err != nil {
+		return nil, err
+	}
+	objType, content, err := parseObject(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", sha, err)
+	}
+	if objType == "tag" {
+		annotated, err := parseTag(sha, content)
+		if err != nil {
+			return nil, err
+		}
+		t.Object, t.Annotated, t.Tagger, t.Message = sha, true, annotated.Tagger, annotated.Message
+		if t.Commit, err = peelToCommit(basePath, sha); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// ListTags returns the tags of the repository at basePath, sorted by name.
+func ListTags(basePath string) ([]Tag, error) {
+	root := filepath.Join(basePath, ".nutella", "refs", "tags")
+	tags := []Tag{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(path, ".lock") {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		t, err := readTag(basePath, filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		tags = append(tags, *t)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+	return tags, nil
+}
+
+// CreateTag tags rev (HEAD when empty). With a message it writes an annotated
+// tag object signed by tagger, and by the key NUTELLA_SIGNING_KEY names if
+// set; without one the tag points at the commit.
+func CreateTag(basePath, name, rev, message string, tagger Signature) (*Tag, error) {
+	if err := validRefName(name); err != nil {
+		return nil, err
+	}
+	if sha, err := readRef(basePath, tagRef(name)); err != nil {
+		return nil, err
+	} else if sha != "" {
+		return nil, fmt.Errorf("%s: %w", name, ErrTagExists)
+	}
+	if rev == "" {
+		rev = "HEAD"
+	}
+	commit, err := ResolveRevision(basePath, rev)
+	if err != nil {
+		return nil, err
+	}
+
+	target := commit
+	if message != "" {
+		key, err := signingKey()
+		if err != nil {
+			return nil, err
+		}
+		body := encodeTag(commit, name, tagger, message)
+		if key != nil {
+			body = signObject(body, key)
+		}
+		if target, err = writeObject(basePath, "tag", body); err != nil {
+			return nil, err
+		}
+	}
+	if err := writeRef(basePath, tagRef(name), target); err != nil {
+		return nil, err
+	}
+	return readTag(basePath, name)
+}
+
+// DeleteTag removes tag name. An annotated tag's object stays in the store.
+func DeleteTag(basePath, name string) error {
+	if err := validRefName(name); err != nil {
+		return err
+	}
+	path := filepath.Join(basePath, ".nutella", "refs", "tags", filepath.FromSlash(name))
+	if err := os.Remove(path); os.IsNotExist(err) {
+		return fmt.Errorf("tag %s: %w", name, ErrUnknownRevision)
+	} else if err != nil {
+		return fmt.Errorf("error deleting tag %s: %v", name, err)
+	}
+	return nil
+}
+
+var (
+	tagList    bool
+	tagDelete  bool
+	tagMessage string
+)
+
+// Command to list, create and delete tags
+var tagCmd = &cobra.Command{
+	Use:   "tag <dbID> [name] [commit]",
+	Short: "List, create or delete tags",
+	Long: `With only a dbID or with -l, lists the tags. With a name, tags HEAD or the
+given branch, tag or commit; -m makes it an annotated tag recording the tagger
+and message. With -d, deletes the named tag.`,
+	Args: cobra.RangeArgs(1, 3),
+	Run: func(cmd *cobra.Command, args []string) {
+		basePath := filepath.Join(".", "files", args[0])
+		if _, err := os.Stat(filepath.Join(basePath, ".nutella")); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: repository not found at %s. Please run 'init' first.\n", basePath)
+			os.Exit(1)
+		}
+
+		switch {
+		case tagDelete:
+			if len(args) != 2 {
+				fmt.Fprintf(os.Stderr, "Usage: tag -d <dbID> <name>\n")
+				os.Exit(1)
+			}
+			if err := DeleteTag(basePath, args[1]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Deleted tag %s\n", args[1])
+
+		case tagList || len(args) == 1:
+			tags, err := ListTags(basePath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error listing tags: %v\n", err)
+				os.Exit(1)
+			}
+			for _, t := range tags {
+				subject, _, _ := strings.Cut(t.Message, "\n")
+				fmt.Printf("%s\t%s\t%s\n", t.Name, t.Commit, subject)
+			}
+
+		default:
+			rev := ""
+			if len(args) == 3 {
+				rev = args[2]
+			}
+			t, err := CreateTag(basePath, args[1], rev, tagMessage, defaultIdentity())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Tagged %s as %s\n", t.Commit, t.Name)
+		}
+	},
+}
@@ -0,0 +1,76 @@
+package dbcli
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTagsAndRevisions(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, ".nutella", "objects"), 0755); err != nil {
+		t.Fatalf("Failed to create repository: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".nutella", "HEAD"), []byte("ref: refs/heads/main\n"), 0644); err != nil {
+		t.Fatalf("Failed to write HEAD: %v", err)
+	}
+
+	var shas []string
+	for _, content := range []string{"one", "two"} {
+		if err := os.WriteFile(filepath.Join(dir, "data.txt"), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write data: %v", err)
+		}
+		shas = append(shas, commitDir(t, dir, "commit "+content))
+	}
+
+	if _, err := CreateTag(dir, "v1", shas[0][:7], "", defaultIdentity()); err != nil {
+		t.Fatalf("Failed to create lightweight tag: %v", err)
+	}
+	annotated, err := CreateTag(dir, "release/v2", "", "second release\n\nnotes", defaultIdentity())
+	if err != nil {
+		t.Fatalf("Failed to create annotated tag: %v", err)
+	}
+	if !annotated.Annotated || annotated.Commit != shas[1] || annotated.Object == shas[1] || annotated.Tagger == nil {
+		t.Errorf("annotated tag = %+v; want a tag object for %s", annotated, shas[1])
+	}
+	if _, err := CreateTag(dir, "v1", "", "", defaultIdentity()); !errors.Is(err, ErrTagExists) {
+		t.Errorf("duplicate tag: err = %v; want ErrTagExists", err)
+	}
+
+	for rev, want := range map[string]string{
+		"HEAD":       shas[1],
+		"main":       shas[1],
+		"v1":         shas[0],
+		"release/v2": shas[1],
+		shas[0]:      shas[0],
+		shas[0][:6]:  shas[0],
+	} {
+		if got, err := ResolveRevision(dir, rev); err != nil || got != want {
+			t.Errorf("ResolveRevision(%q) = %q, %v; want %s", rev, got, err, want)
+		}
+	}
+	for _, rev := range []string{"nope", shas[0][:3], "0000000"} {
+		if _, err := ResolveRevision(dir, rev); !errors.Is(err, ErrUnknownRevision) {
+			t.Errorf("ResolveRevision(%q): err = %v; want ErrUnknownRevision", rev, err)
+		}
+	}
+
+	tags, err := ListTags(dir)
+	if err != nil || len(tags) != 2 || tags[0].Name != "release/v2" || tags[1].Name != "v1" || tags[1].Annotated {
+		t.Fatalf("ListTags = %+v, %v; want release/v2 and lightweight v1", tags, err)
+	}
+	if tags[0].Message != "second release\n\nnotes" {
+		t.Errorf("annotated message = %q", tags[0].Message)
+	}
+	if _, err := DiffCommits(dir, "v1", "release/v2"); err != nil {
+		t.Errorf("DiffCommits by tag name: %v", err)
+	}
+
+	if err := DeleteTag(dir, "v1"); err != nil {
+		t.Fatalf("Failed to delete tag: %v", err)
+	}
+	if _, err := ResolveRevision(dir, "v1"); !errors.Is(err, ErrUnknownRevision) {
+		t.Errorf("deleted tag still resolves: %v", err)
+	}
+}
@@ -0,0 +1,381 @@
+package dbcli
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrInvalidBundle is returned when received objects are truncated,
+	// corrupt or do not hash to their names.
+	ErrInvalidBundle = errors.New("invalid bundle")
+	// ErrStaleRef is returned when a pushed ref no longer holds the commit
+	// the pusher last saw.
+	ErrStaleRef = errors.New("ref has changed since it was read; fetch and try again")
+	// ErrNonFastForward is returned when a push would drop commits from a
+	// branch or move an existing tag and force is not set.
+	ErrNonFastForward = errors.New("not a fast-forward")
+)
+
+// bundleMagic starts a bundle, the unit fetch and push move between servers:
+// the pack's length as a big-endian uint64, the pack and then its index. A
+// bundle without objects is the magic and a zero length.
+const bundleMagic = "NBDL"
+
+// RefList is what a repository advertises to fetch and push. Head is the ref
+// HEAD points at, or a commit SHA when it is detached; Refs maps every branch
+// and tag, such as "refs/heads/main", to the object it points at.
+type RefList struct {
+	Head string            `json:"head"`
+	Refs map[string]string `json:"refs"`
+}
+
+// RefUpdate asks a repository to move Ref from Old, or to create it when Old
+// is empty, to New.
+type RefUpdate struct {
+	Ref   string `json:"ref"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+	Force bool   `json:"force,omitempty"`
+}
+
+// RefUpdateResult reports an applied RefUpdate. WorkingTree is set when Ref
+// was the checked-out branch and the working tree was rewritten to New.
+type RefUpdateResult struct {
+	Ref         string `json:"ref"`
+	Old         string `json:"old"`
+	New         string `json:"new"`
+	WorkingTree bool   `json:"working_tree"`
+}
+
+// ListRefs returns the branches and tags of the repository at basePath.
+// Remote-tracking refs stay private to the repository.
+func ListRefs(basePath string) (*RefList, error) {
+	if _, err := os.Stat(filepath.Join(basePath, ".nutella")); err != nil {
+		return nil, fmt.Errorf("%s: %w", basePath, ErrNoRepository)
+	}
+	tips, err := refTips(basePath)
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[string]string)
+	for ref, sha := range tips {
+		if strings.HasPrefix(ref, "refs/heads/") || strings.HasPrefix(ref, "refs/tags/") {
+			refs[ref] = sha
+		}
+	}
+	headRef, head, err := readHead(basePath)
+	if err != nil {
+		return nil, err
+	}
+	if headRef == "" {
+		headRef = head
+	}
+	return &RefList{Head: headRef, Refs: refs}, nil
+}
+
+// hasObject reports whether the repository at repo holds object sha.
+func hasObject(repo, sha string) (bool, error) {
+	if len(sha) != 40 || !isHex(sha) {
+		return false, nil
+	}
+	if _, err := readRawObject(repo, sha); errors.Is(err, ErrObjectNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// missingObjects lists the objects reachable from want but not from have,
+// sorted. Entries of have the repository does not hold are ignored, since
+// the other side may have history this one lacks.
+func missingObjects(repo string, want, have []string) ([]string, error) {
+	var known []string
+	for _, sha := range have {
+		ok, err := hasObject(repo, sha)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			known = append(known, sha)
+		}
+	}
+	stop, err := walkObjects(repo, known, nil)
+	if err != nil {
+		return nil, err
+	}
+	send, err := walkObjects(repo, want, stop)
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]string, 0, len(send))
+	for sha := range send {
+		objects = append(objects, sha)
+	}
+	sort.Strings(objects)
+	return objects, nil
+}
+
+// writeBundle packs objects of repo into a bundle. The pack is built in a
+// temporary directory, so the repository's own packs are left alone.
+func writeBundle(repo string, objects []string) ([]byte, error) {
+	bundle := binary.BigEndian.AppendUint64([]byte(bundleMagic), 0)
+	if len(objects) == 0 {
+		return bundle, nil
+	}
+	dir, err := os.MkdirTemp("", "nutella-bundle-")
+	if err != nil {
+		return nil, fmt.Errorf("error creating bundle directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	name, err := writePackTo(repo, dir, objects, defaultPackOptions)
+	if err != nil {
+		return nil, err
+	}
+	pack, err := os.ReadFile(filepath.Join(dir, name+".pack"))
+	if err != nil {
+		return nil, fmt.Errorf("error reading pack: %v", err)
+	}
+	index, err := os.ReadFile(filepath.Join(dir, name+".idx"))
+	if err != nil {
+		return nil, fmt.Errorf("error reading index: %v", err)
+	}
+	binary.BigEndian.PutUint64(bundle[len(bundleMagic):], uint64(len(pack)))
+	return append(append(bundle, pack...), index...), nil
+}
+
+// PackObjects bundles the objects reachable from want but not from have, for
+// a fetch, and returns the bundle with the number of objects in it.
+func PackObjects(basePath string, want, have []string) ([]byte, int, error) {
+	if _, err := os.Stat(filepath.Join(basePath, ".nutella")); err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", basePath, ErrNoRepository)
+	}
+	for _, sha := range want {
+		if len(sha) != 40 || !isHex(sha) {
+			return nil, 0, fmt.Errorf("invalid object name %q", sha)
+		}
+	}
+	objects, err := missingObjects(basePath, want, have)
+	if err != nil {
+		return nil, 0, err
+	}
+	bundle, err := writeBundle(basePath, objects)
+	if err != nil {
+		return nil, 0, err
+	}
+	return bundle, len(objects), nil
+}
+
+// ReceivePack stores the objects of bundle in the repository at basePath and
+// returns how many it held. The pack is verified object by object under a
+// temporary name before it is installed, so a truncated or corrupt bundle
+// leaves the repository as it was. Refs are not touched; see UpdateRef.
+func ReceivePack(basePath string, bundle []byte) (int, error) {
+	if _, err := os.Stat(filepath.Join(basePath, ".nutella")); err != nil {
+		return 0, fmt.Errorf("%s: %w", basePath, ErrNoRepository)
+	}
+	header := len(bundleMagic) + 8
+	if len(bundle) < header || string(bundle[:len(bundleMagic)]) != bundleMagic {
+		return 0, fmt.Errorf("%w: bad header", ErrInvalidBundle)
+	}
+	packLen := binary.BigEndian.Uint64(bundle[len(bundleMagic):header])
+	if packLen == 0 {
+		if len(bundle) != header {
+			return 0, fmt.Errorf("%w: trailing data after an empty bundle", ErrInvalidBundle)
+		}
+		return 0, nil
+	}
+	if packLen > uint64(len(bundle)-header) {
+		return 0, fmt.Errorf("%w: pack is truncated", ErrInvalidBundle)
+	}
+	pack, index := bundle[header:header+int(packLen)], bundle[header+int(packLen):]
+
+	dir := filepath.Join(basePath, ".nutella", "objects", "pack")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, fmt.Errorf("error creating pack directory: %v", err)
+	}
+	tmp := fmt.Sprintf(".tmp-receive-%d", time.Now().UnixNano())
+	tmpPack, tmpIndex := filepath.Join(dir, tmp+".pack"), filepath.Join(dir, tmp+".idx")
+	defer os.Remove(tmpPack)
+	defer os.Remove(tmpIndex)
+	defer func() {
+		packIndexes.Lock()
+		delete(packIndexes.byPath, tmpIndex)
+		packIndexes.Unlock()
+	}()
+	if err := os.WriteFile(tmpPack, pack, 0644); err != nil {
+		return 0, fmt.Errorf("error writing packfile: %v", err)
+	}
+	if err := os.WriteFile(tmpIndex, index, 0644); err != nil {
+		return 0, fmt.Errorf("error writing index file: %v", err)
+	}
+	entries, err := verifyPack(basePath, tmp)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidBundle, err)
+	}
+
+	// Name the pack after its objects as writePackTo does, so receiving the
+	// same objects twice installs one pack.
+	shas := make([]string, len(entries))
+	for i, e := range entries {
+		shas[i] = e.Sha
+	}
+	sort.Strings(shas)
+	name := packName(shas)
+	if _, err := os.Stat(filepath.Join(dir, name+".idx")); err == nil {
+		return len(entries), nil
+	}
+	if err := os.Rename(tmpPack, filepath.Join(dir, name+".pack")); err != nil {
+		return 0, fmt.Errorf("error installing packfile: %v", err)
+	}
+	if err := os.Rename(tmpIndex, filepath.Join(dir, name+".idx")); err != nil {
+		return 0, fmt.Errorf("error installing index file: %v", err)
+	}
+	return len(entries), nil
+}
+
+// IsCheckedOut reports whether ref is the branch HEAD of the repository at
+// basePath points at, with or without commits, which UpdateRef of ref may
+// rewrite the working tree for.
+func IsCheckedOut(basePath, ref string) (bool, error) {
+	headRef, _, err := readHead(basePath)
+	if err != nil {
+		return false, err
+	}
+	return headRef == ref, nil
+}
+
+// UpdateRef applies a push to the repository at basePath. Only branches and
+// tags can be updated, New must be present with all of its history, and the
+// ref must still hold Old. Unless Force is set a branch may only move forward
+// and an existing tag may not move at all.
+//
+// When Ref is the checked-out branch the working tree is rewritten to New,
+// provided it has no uncommitted changes and New passes the signing policy
+// (ErrUnsignedCommit otherwise), and the commits it gained are added to
+// snapshots.json.
+func UpdateRef(basePath string, u RefUpdate) (*RefUpdateResult, error) {
+	commitMu.Lock()
+	defer commitMu.Unlock()
+
+	if _, err := os.Stat(filepath.Join(basePath, ".nutella")); err != nil {
+		return nil, fmt.Errorf("%s: %w", basePath, ErrNoRepository)
+	}
+	var name string
+	branch := strings.HasPrefix(u.Ref, "refs/heads/")
+	switch {
+	case branch:
+		name = strings.TrimPrefix(u.Ref, "refs/heads/")
+	case strings.HasPrefix(u.Ref, "refs/tags/"):
+		name = strings.TrimPrefix(u.Ref, "refs/tags/")
+	default:
+		return nil, fmt.Errorf("cannot update %q: only branches and tags can be pushed", u.Ref)
+	}
+	if err := validRefName(name); err != nil {
+		return nil, err
+	}
+	if len(u.New) != 40 || !isHex(u.New) {
+		return nil, fmt.Errorf("invalid object name %q", u.New)
+	}
+
+	current, err := readRef(basePath, u.Ref)
+	if err != nil {
+		return nil, err
+	}
+	if current != u.Old {
+		return nil, fmt.Errorf("%s: %w", u.Ref, ErrStaleRef)
+	}
+	if _, err := walkObjects(basePath, []string{u.New}, nil); err != nil {
+		return nil, fmt.Errorf("history of %s is incomplete: %w", u.New, err)
+	}
+	if branch {
+		if _, err := loadTyped(basePath, u.New, "commit"); err != nil {
+			return nil, fmt.Errorf("%s: %w", u.Ref, err)
+		}
+	}
+	if current != "" && current != u.New && !u.Force {
+		if !branch {
+			return nil, fmt.Errorf("%s: %w", u.Ref, ErrTagExists)
+		}
+		base, err := mergeBase(basePath, current, u.New)
+		if err != nil {
+			return nil, err
+		}
+		if base != current {
+			return nil, fmt.Errorf("%s: %w; fetch and merge first, or force", u.Ref, ErrNonFastForward)
+		}
+	}
+
+	res := &RefUpdateResult{Ref: u.Ref, Old: current, New: u.New}
+	headRef, head, err := readHead(basePath)
+	if err != nil {
+		return nil, err
+	}
+	if branch && headRef == u.Ref && head != u.New {
+		if mergeHead, _, err := readMergeState(basePath); err != nil {
+			return nil, err
+		} else if mergeHead != "" {
+			return nil, fmt.Errorf("%s is checked out: %w", u.Ref, ErrMergeInProgress)
+		}
+		changed, err := localChanges(basePath, head)
+		if err != nil {
+			return nil, err
+		}
+		if len(changed) > 0 {
+			return nil, fmt.Errorf("%s is checked out: %w in %s; commit them first", u.Ref, ErrLocalChanges, strings.Join(changed, ", "))
+		}
+		if err := Restore(basePath, u.New); err != nil {
+			return nil, err
+		}
+		res.WorkingTree = true
+	}
+	if err := writeRef(basePath, u.Ref, u.New); err != nil {
+		return nil, err
+	}
+	if res.WorkingTree {
+		if err := recordHistory(basePath, u.New); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// recordHistory adds the commits reachable from tip that snapshots.json does
+// not list yet, stamped with their commit time, so history that arrived from
+// a remote can be listed and restored like local commits.
+func recordHistory(repo, tip string) error {
+	snapshots, err := LoadSnapshotsFrom(repo)
+	if err != nil {
+		snapshots = make(map[string]Snapshot)
+	}
+	known := make(map[string]bool, len(snapshots))
+	for _, snap := range snapshots {
+		known[snap.Commit] = true
+	}
+	commits, err := Log(repo, tip, 0)
+	if err != nil {
+		return err
+	}
+	added := 0
+	for _, c := range commits {
+		if known[c.Sha] {
+			continue
+		}
+		snapshots[uuid.New().String()] = Snapshot{Commit: c.Sha, Message: c.Message, Timestamp: c.Committer.When.Format(time.RFC3339)}
+		added++
+	}
+	if added == 0 {
+		return nil
+	}
+	return writeSnapshots(repo, snapshots)
+}
@@ -0,0 +1,253 @@
+package dbcli
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"db/database"
+)
+
+// TestBundleTransfer moves history between two repositories the way fetch
+// does and checks that a damaged bundle is refused without leaving a pack.
+func TestBundleTransfer(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "db_src")
+	dst := filepath.Join(t.TempDir(), "db_dst")
+	for _, dir := range []string{src, dst} {
+		db, err := database.OpenDatabase(dir, filepath.Base(dir))
+		if err != nil {
+			t.Fatalf("Failed to create database: %v", err)
+		}
+		db.Close()
+	}
+
+	editCollection(t, src, "fruits", func(c *database.Collection) { c.Insert("apple", "red") })
+	first := commitDir(t, src, "apple")
+	editCollection(t, src, "fruits", func(c *database.Collection) { c.Insert("banana", "yellow") })
+	second := commitDir(t, src, "banana")
+
+	// dst already holds the first commit, so only the second one's new
+	// objects travel.
+	bundle, n, err := PackObjects(src, []string{first}, nil)
+	if err != nil {
+		t.Fatalf("Failed to pack: %v", err)
+	}
+	if got, err := ReceivePack(dst, bundle); err != nil || got != n {
+		t.Fatalf("ReceivePack = %d, %v; want %d objects", got, err, n)
+	}
+	bundle, m, err := PackObjects(src, []string{second}, []string{first, "0123456789012345678901234567890123456789"})
+	if err != nil {
+		t.Fatalf("Failed to pack: %v", err)
+	}
+	if _, all, err := PackObjects(src, []string{second}, nil); err != nil || m == 0 || m >= all {
+		t.Errorf("incremental bundle holds %d of %d objects (%v); want only what the second commit added", m, all, err)
+	}
+
+	damaged := append([]byte(nil), bundle...)
+	damaged[len(bundleMagic)+8+20] ^= 0xff
+	if _, err := ReceivePack(dst, damaged); !errors.Is(err, ErrInvalidBundle) {
+		t.Fatalf("ReceivePack of a damaged bundle = %v; want ErrInvalidBundle", err)
+	}
+	if _, err := ReceivePack(dst, bundle[:len(bundle)/2]); !errors.Is(err, ErrInvalidBundle) {
+		t.Fatalf("ReceivePack of a truncated bundle = %v; want ErrInvalidBundle", err)
+	}
+	entries, err := os.ReadDir(filepath.Join(dst, ".nutella", "objects", "pack"))
+	if err != nil {
+		t.Fatalf("Failed to read pack directory: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("pack directory holds %d files after refused bundles; want the first pack and index", len(entries))
+	}
+
+	if _, err := ReceivePack(dst, bundle); err != nil {
+		t.Fatalf("Failed to receive: %v", err)
+	}
+	if _, err := walkObjects(dst, []string{second}, nil); err != nil {
+		t.Errorf("history of the second commit is incomplete after transfer: %v", err)
+	}
+
+	if _, err := UpdateRef(dst, RefUpdate{Ref: "refs/heads/main", New: second}); err != nil {
+		t.Fatalf("UpdateRef = %v", err)
+	}
+	if _, err := UpdateRef(dst, RefUpdate{Ref: "refs/heads/main", Old: first, New: second}); !errors.Is(err, ErrStaleRef) {
+		t.Errorf("UpdateRef from a stale old value = %v; want ErrStaleRef", err)
+	}
+	if _, err := UpdateRef(dst, RefUpdate{Ref: "refs/heads/main", Old: second, New: first}); !errors.Is(err, ErrNonFastForward) {
+		t.Errorf("UpdateRef backwards = %v; want ErrNonFastForward", err)
+	}
+	if _, err := UpdateRef(dst, RefUpdate{Ref: "refs/heads/main", Old: second, New: first, Force: true}); err != nil {
+		t.Errorf("forced UpdateRef backwards = %v", err)
+	}
+}
+
+// rawEntry is one hand-built pack entry: its header bytes, the data that is
+// compressed after them and the SHA the index lists it under.
+type rawEntry struct {
+	sha    []byte
+	header []byte
+	data   []byte
+}
+
+// rawBundle builds a bundle from entries without checking any of them, so
+// tests can hand ReceivePack packs that writePackTo would never produce.
+func rawBundle(entries []rawEntry) []byte {
+	pack := binary.BigEndian.AppendUint32([]byte("PACK"), packVersion)
+	pack = binary.BigEndian.AppendUint32(pack, uint32(len(entries)))
+	offsets := make(map[string]uint64, len(entries))
+	for _, e := range entries {
+		offsets[string(e.sha)] = uint64(len(pack))
+		pack = append(append(pack, e.header...), deflate(e.data)...)
+	}
+	packSum := sha1.Sum(pack)
+	pack = append(pack, packSum[:]...)
+
+	sorted := append([]rawEntry(nil), entries...)
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i].sha, sorted[j].sha) < 0 })
+	var fanout [256]uint32
+	for _, e := range sorted {
+		fanout[e.sha[0]]++
+	}
+	index := binary.BigEndian.AppendUint32([]byte(indexMagic), indexVersion)
+	var total uint32
+	for _, n := range fanout {
+		total += n
+		index = binary.BigEndian.AppendUint32(index, total)
+	}
+	for _, e := range sorted {
+		index = append(index, e.sha...)
+	}
+	for _, e := range sorted {
+		index = binary.BigEndian.AppendUint64(index, offsets[string(e.sha)])
+	}
+	index = append(index, packSum[:]...)
+	indexSum := sha1.Sum(index)
+	index = append(index, indexSum[:]...)
+
+	bundle := binary.BigEndian.AppendUint64([]byte(bundleMagic), uint64(len(pack)))
+	return append(append(bundle, pack...), index...)
+}
+
+func deflate(data []byte) []byte {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+// rewriteIndex returns a copy of bundle with edit applied to its index and
+// the index checksum recomputed, so only the edit itself is wrong.
+func rewriteIndex(bundle []byte, edit func(index []byte)) []byte {
+	header := len(bundleMagic) + 8
+	packLen := int(binary.BigEndian.Uint64(bundle[len(bundleMagic):header]))
+	out := append([]byte(nil), bundle...)
+	index := out[header+packLen:]
+	edit(index)
+	sum := sha1.Sum(index[:len(index)-20])
+	copy(index[len(index)-20:], sum[:])
+	return out
+}
+
+// testBlob is a well-formed pack entry for the blob "hello world".
+func testBlob() rawEntry {
+	sha := sha1.Sum([]byte("blob 11\x00hello world"))
+	return rawEntry{sha: sha[:], header: appendEntryHeader(nil, objBlob, 11), data: []byte("hello world")}
+}
+
+// badBundles returns bundles whose deltas or indexes are corrupt in ways the
+// pack and index checksums do not catch.
+func badBundles() map[string][]byte {
+	blob := testBlob()
+	withDelta := func(delta []byte) []byte {
+		sha := sha1.Sum(delta)
+		// The delta entry follows the blob, so its base is one entry back.
+		header := appendEntryHeader(nil, objOfsDelta, len(delta))
+		header = appendOfsDistance(header, int64(len(blob.header)+len(deflate(blob.data))))
+		return rawBundle([]rawEntry{blob, {sha: sha[:], header: header, data: delta}})
+	}
+	delta := func(target uint32, ops ...byte) []byte {
+		d := binary.LittleEndian.AppendUint32(nil, 11)
+		return append(binary.LittleEndian.AppendUint32(d, target), ops...)
+	}
+
+	good := rawBundle([]rawEntry{blob, {
+		sha:    []byte("\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff"),
+		header: appendEntryHeader(nil, objBlob, 3),
+		data:   []byte("abc"),
+	}})
+	return map[string][]byte{
+		"truncated copy offset":  withDelta(delta(5, 0x91)),
+		"truncated copy size":    withDelta(delta(5, 0x91, 0x00)),
+		"copy past the target":   withDelta(delta(2, 0x90, 0x05)),
+		"insert past the target": withDelta(delta(2, 0x05, 'a', 'b', 'c', 'd', 'e')),
+		"huge target size":       withDelta(delta(0xffffffff, 0x05, 'a', 'b', 'c', 'd', 'e')),
+		"huge entry size": rawBundle([]rawEntry{{
+			sha:    blob.sha,
+			header: appendEntryHeader(nil, objBlob, maxObjectSize+1),
+			data:   blob.data,
+		}}),
+		"fan-out decreases": rewriteIndex(good, func(index []byte) {
+			binary.BigEndian.PutUint32(index[8+254*4:], 3)
+		}),
+		"fan-out disagrees with the SHAs": rewriteIndex(good, func(index []byte) {
+			for b := 0; b < 255; b++ {
+				binary.BigEndian.PutUint32(index[8+b*4:], 0)
+			}
+		}),
+		"SHAs out of order": rewriteIndex(good, func(index []byte) {
+			shas := index[8+256*4:]
+			a, b := append([]byte(nil), shas[:20]...), append([]byte(nil), shas[20:40]...)
+			copy(shas, b)
+			copy(shas[20:], a)
+		}),
+	}
+}
+
+// TestReceivePackRejectsCorruptDeltasAndIndexes checks that ReceivePack
+// refuses bundles whose checksums are intact but whose deltas or index lie,
+// rather than reading out of bounds or trusting a broken fan-out.
+func TestReceivePackRejectsCorruptDeltasAndIndexes(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db_recv")
+	db, err := database.OpenDatabase(dir, "db_recv")
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	db.Close()
+
+	for name, bundle := range badBundles() {
+		if _, err := ReceivePack(dir, bundle); !errors.Is(err, ErrInvalidBundle) {
+			t.Errorf("ReceivePack with a %s = %v; want ErrInvalidBundle", name, err)
+		}
+	}
+	if packs, _ := filepath.Glob(filepath.Join(dir, ".nutella", "objects", "pack", "*")); len(packs) != 0 {
+		t.Errorf("refused bundles left %v behind", packs)
+	}
+	if _, err := ReceivePack(dir, rawBundle([]rawEntry{testBlob()})); err != nil {
+		t.Errorf("ReceivePack of a well-formed hand-built bundle = %v", err)
+	}
+}
+
+func FuzzReceivePack(f *testing.F) {
+	dir := filepath.Join(f.TempDir(), "db_fuzz")
+	db, err := database.OpenDatabase(dir, "db_fuzz")
+	if err != nil {
+		f.Fatalf("Failed to create database: %v", err)
+	}
+	db.Close()
+	f.Add(rawBundle([]rawEntry{testBlob()}))
+	for _, bundle := range badBundles() {
+		f.Add(bundle)
+	}
+
+	f.Fuzz(func(t *testing.T, bundle []byte) {
+		if _, err := ReceivePack(dir, bundle); err != nil && !errors.Is(err, ErrInvalidBundle) {
+			t.Errorf("ReceivePack = %v; want nil or ErrInvalidBundle", err)
+		}
+	})
+}
@@ -0,0 +1,282 @@
+package dbcli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"db/btree"
+	"db/database"
+)
+
+// ErrDatabaseExists is returned by RestoreInto when the target database exists.
+var ErrDatabaseExists = database.ErrDatabaseExists
+
+// restoreWorkingTree replaces the working tree of the repository at repo with
+// the tree of commit commitSha. .nutella, .nutignore and ignored paths are
+// left alone.
+func restoreWorkingTree(repo, commitSha string) error {
+	treeSha, err := readCommitTree(repo, commitSha)
+	if err != nil {
+		return err
+	}
+	ignores, err := loadIgnores(repo)
+	if err != nil {
+		return fmt.Errorf("error reading .nutignore: %v", err)
+	}
+
+	if err := cleanWorkingTree(repo, ignores); err != nil {
+		return err
+	}
+	return writeWorkingTree(repo, treeSha, repo, "", ignores)
+}
+
+// Restore rewrites the working tree of the repository at basePath to commit
+// sha, which must already be resolved. A repository that requires signed
+// commits refuses others with ErrUnsignedCommit and is left as it was.
+func Restore(basePath, sha string) error {
+	if err := checkRestorable(basePath, sha); err != nil {
+		return err
+	}
+	if err := restoreWorkingTree(basePath, sha); err != nil {
+		return fmt.Errorf("error restoring commit %s: %w", sha, err)
+	}
+	return nil
+}
+
+// cleanWorkingTree removes everything in repo except .nutella, .nutignore,
+// the write-ahead log and ignored entries.
+func cleanWorkingTree(repo string, ignores []string) error {
+	entries, err := os.ReadDir(repo)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", repo, err)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == ".nutella" || name == ".nutignore" || name == ".wal" || shouldIgnore(name, ignores) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(repo, name)); err != nil {
+			return fmt.Errorf("error removing %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// writeWorkingTree recreates the files and directories of tree treeSha under
+// dest. repoRel is dest relative to the repository root, for ignore matching.
+func writeWorkingTree(repo, treeSha, dest, repoRel string, ignores []string) error {
+	entries, err := readTreeEntries(repo, treeSha)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %v", dest, err)
+	}
+
+	for _, e := range entries {
+		relEntry := e.Name
+		if repoRel != "" {
+			relEntry = filepath.Join(repoRel, e.Name)
+		}
+		if shouldIgnore(relEntry, ignores) {
+			continue
+		}
+
+		fullPath := filepath.Join(dest, e.Name)
+		if e.isDir() {
+			if err := writeWorkingTree(repo, e.Sha, fullPath, relEntry, ignores); err != nil {
+				return err
+			}
+			continue
+		}
+		content, err := loadTyped(repo, e.Sha, "blob")
+		if err != nil {
+			return fmt.Errorf("%s: %w", relEntry, err)
+		}
+		if err := os.WriteFile(fullPath, content, 0644); err != nil {
+			return fmt.Errorf("failed to write file %s: %v", fullPath, err)
+		}
+	}
+	return nil
+}
+
+// RestoreInto materializes rev, a branch name or commit SHA of the repository
+// at basePath, as a new database newDBID under root and returns the commit it
+// used. The source database is only read. The new database gets a fresh,
+// empty .nutella repository; it is assembled in a temporary directory and
+// renamed into place, so a failed restore leaves nothing behind. A repository
+// that requires signed commits refuses others with ErrUnsignedCommit.
+func RestoreInto(basePath, rev, root, newDBID string) (string, error) {
+	if err := database.ValidDBID(newDBID); err != nil {
+		return "", err
+	}
+	dest := filepath.Join(root, newDBID)
+	if _, err := os.Stat(dest); err == nil {
+		return "", fmt.Errorf("%s: %w", newDBID, ErrDatabaseExists)
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	sha, err := ResolveRevision(basePath, rev)
+	if err != nil {
+		return "", err
+	}
+	if err := checkRestorable(basePath, sha); err != nil {
+		return "", err
+	}
+	treeSha, err := readCommitTree(basePath, sha)
+	if err != nil {
+		return "", err
+	}
+
+	tmp, err := os.MkdirTemp(root, "."+newDBID+"-")
+	if err != nil {
+		return "", fmt.Errorf("error creating staging directory: %v", err)
+	}
+	done := false
+	defer func() {
+		if !done {
+			os.RemoveAll(tmp)
+		}
+	}()
+
+	db, err := database.OpenDatabase(tmp, newDBID)
+	if err != nil {
+		return "", err
+	}
+	if err := db.Close(); err != nil {
+		return "", err
+	}
+	if err := writeWorkingTree(basePath, treeSha, tmp, "", nil); err != nil {
+		return "", err
+	}
+
+	// The committed manifest still names the source database.
+	if err := setManifestDBID(tmp, newDBID); err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(tmp, dest); err != nil {
+		return "", fmt.Errorf("error moving %s into place: %v", newDBID, err)
+	}
+	done = true
+	return sha, nil
+}
+
+// setManifestDBID renames the database whose manifest is in dir to dbID.
+func setManifestDBID(dir, dbID string) error {
+	manifestPath := filepath.Join(dir, "manifest.json")
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return fmt.Errorf("failed to read manifest file: %v", err)
+	}
+	var m database.DBManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("failed to parse manifest: %v", err)
+	}
+	m.DBID = dbID
+	if data, err = json.MarshalIndent(m, "", "  "); err != nil {
+		return fmt.Errorf("failed to marshal manifest: %v", err)
+	}
+	if err := os.WriteFile(manifestPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+	return nil
+}
+
+// matchKey reports whether key matches one of patterns. A pattern ending in
+// "*" matches keys with that prefix; any other pattern matches one key. No
+// patterns match every key.
+func matchKey(key string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok && strings.HasPrefix(key, prefix) || p == key {
+			return true
+		}
+	}
+	return false
+}
+
+// RestoreCollection brings collection in the working tree at basePath back to
+// its state at rev, a branch, tag or commit. The keys that differ are written
+// through the collection's Update and Delete, so other collections, HEAD and
+// the rest of the working tree are untouched. With patterns (see matchKey)
+// only matching keys are restored. A collection the working tree has lost is
+// recreated with its committed order. It returns the changes applied, sorted
+// by key.
+func RestoreCollection(basePath, rev, collection string, patterns []string) ([]KeyChange, error) {
+	sha, err := ResolveRevision(basePath, rev)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRestorable(basePath, sha); err != nil {
+		return nil, err
+	}
+	treeSha, err := readCommitTree(basePath, sha)
+	if err != nil {
+		return nil, err
+	}
+	colls, err := collectionTrees(basePath, treeSha)
+	if err != nil {
+		return nil, err
+	}
+	collTree, ok := colls[collection]
+	if !ok {
+		return nil, fmt.Errorf("%s at %s: %w", collection, sha, ErrNoCollection)
+	}
+	committed, err := collectionKeys(basePath, collTree)
+	if err != nil {
+		return nil, fmt.Errorf("collection %s: %w", collection, err)
+	}
+
+	db, err := database.LoadDatabase(basePath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	names, err := db.GetAllCollections()
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(names, collection) {
+		order, err := committedOrder(basePath, collTree)
+		if err != nil {
+			return nil, fmt.Errorf("collection %s: %w", collection, err)
+		}
+		if err := db.CreateCollection(collection, order); err != nil {
+			return nil, err
+		}
+	}
+	coll, err := db.GetCollection(collection)
+	if err != nil {
+		return nil, err
+	}
+
+	live := make(map[string]interface{})
+	if err := coll.Scan(func(kv btree.KeyValue) bool {
+		live[kv.Key] = kv.Value
+		return true
+	}); err != nil {
+		return nil, err
+	}
+
+	changes := []KeyChange{}
+	for _, c := range diffKeys(live, committed) {
+		if !matchKey(c.Key, patterns) {
+			continue
+		}
+		if err := applyChange(coll, c); err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
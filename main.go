@@ -11,6 +11,8 @@ var RootCmd = &cobra.Command{
 	Use:   "cli",
 	Short: "CLI for NutellaDB",
 	Long:  "A Command Line Interface (CLI) for managing collections, version control and server on NutellaDB",
+	// Subcommand flags are parsed again by dbcli.Execute.
+	FParseErrWhitelist: cobra.FParseErrWhitelist{UnknownFlags: true},
 	Run: func(cmd *cobra.Command, args []string) {
 		if len(args) > 0 && args[0] == "startserver" {
 			server.Server(cmd)
@@ -24,5 +26,6 @@ func main() {
 	var commitMessage string
 	dbcli.Init()
 	RootCmd.Flags().StringVarP(&commitMessage, "message", "m", "", "Commit message")
+	server.RegisterFlags(RootCmd)
 	RootCmd.Execute()
 }
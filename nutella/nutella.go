@@ -0,0 +1,255 @@
+// Package nutella embeds a NutellaDB database in another Go program. It wraps
+// the database and collection types with a small, context-aware API that
+// reports failures as errors instead of printing to stdout or exiting.
+package nutella
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"db/btree"
+	"db/database"
+)
+
+// DefaultOrder is the B-tree order used by CreateCollection when none is given.
+const DefaultOrder = 8
+
+var (
+	// ErrNotFound is returned by Get when the key does not exist.
+	ErrNotFound = errors.New("nutella: key not found")
+	// ErrClosed is returned by every method once Close has been called.
+	ErrClosed = errors.New("nutella: database is closed")
+)
+
+// Options controls how Open prepares the database directory.
+type Options struct {
+	// CreateIfMissing creates an empty database when dir has no manifest.
+	CreateIfMissing bool
+	// DBID names a newly created database. It defaults to the base name of dir.
+	DBID string
+}
+
+// DB is an open database. It is safe for concurrent use; operations run in
+// parallel and only Close waits for them to finish.
+type DB struct {
+	mu     sync.RWMutex
+	db     *database.Database
+	closed bool
+}
+
+// Open opens the database stored in dir, which is the directory that holds
+// manifest.json (for example ./files/db_1234).
+func Open(dir string, opts *Options) (*DB, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	var (
+		db  *database.Database
+		err error
+	)
+	if opts.CreateIfMissing {
+		dbID := opts.DBID
+		if dbID == "" {
+			dbID = filepath.Base(dir)
+		}
+		db, err = database.OpenDatabase(dir, dbID)
+	} else {
+		db, err = database.LoadDatabase(dir)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("nutella: open %s: %w", dir, err)
+	}
+
+	return &DB{db: db}, nil
+}
+
+// Close flushes B-tree metadata and the manifest to disk. The DB cannot be used
+// afterwards.
+func (d *DB) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return ErrClosed
+	}
+	d.closed = true
+	return d.db.Close()
+}
+
+// ID returns the database ID from the manifest.
+func (d *DB) ID() string {
+	return d.db.ID()
+}
+
+// CreateCollection adds a collection backed by a B-tree of the given order.
+// An order of 0 selects DefaultOrder.
+func (d *DB) CreateCollection(ctx context.Context, name string, order int) error {
+	if order == 0 {
+		order = DefaultOrder
+	}
+	return d.do(ctx, func() error {
+		return d.db.CreateCollection(name, order)
+	})
+}
+
+// Collections lists the collection names in the manifest.
+func (d *DB) Collections(ctx context.Context) ([]string, error) {
+	var names []string
+	err := d.do(ctx, func() error {
+		var err error
+		names, err = d.db.GetAllCollections()
+		return err
+	})
+	return names, err
+}
+
+// Get returns the value stored under key, or ErrNotFound.
+func (d *DB) Get(ctx context.Context, collection, key string) (string, error) {
+	var value string
+	err := d.do(ctx, func() error {
+		coll, err := d.db.GetCollection(collection)
+		if err != nil {
+			return err
+		}
+		v, found, err := coll.Find(key)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return ErrNotFound
+		}
+		value = fmt.Sprint(v)
+		return nil
+	})
+	return value, err
+}
+
+// Put inserts or overwrites key.
+func (d *DB) Put(ctx context.Context, collection, key, value string) error {
+	return d.do(ctx, func() error {
+		coll, err := d.db.GetCollection(collection)
+		if err != nil {
+			return err
+		}
+		_, err = coll.Update(key, value)
+		return err
+	})
+}
+
+// Delete removes key. Deleting a missing key is not an error.
+func (d *DB) Delete(ctx context.Context, collection, key string) error {
+	return d.do(ctx, func() error {
+		coll, err := d.db.GetCollection(collection)
+		if err != nil {
+			return err
+		}
+		_, err = coll.Delete(key)
+		return err
+	})
+}
+
+// Scan calls fn for every key starting with prefix, in ascending key order.
+// It reads a snapshot taken when the scan starts, so writes made while it runs
+// are not seen and do not have to wait for it. Scanning stops at the first
+// error returned by fn or when ctx is done.
+func (d *DB) Scan(ctx context.Context, collection, prefix string, fn func(key, value string) error) error {
+	return d.do(ctx, func() error {
+		coll, err := d.db.GetCollection(collection)
+		if err != nil {
+			return err
+		}
+		snap := coll.Snapshot()
+		defer snap.Release()
+
+		var scanErr error
+		err = snap.Scan(func(kv btree.KeyValue) bool {
+			if !strings.HasPrefix(kv.Key, prefix) {
+				// Keys come back sorted, so nothing after the prefix range can match.
+				return kv.Key < prefix
+			}
+			if scanErr = ctx.Err(); scanErr != nil {
+				return false
+			}
+			scanErr = fn(kv.Key, fmt.Sprint(kv.Value))
+			return scanErr == nil
+		})
+		if err != nil {
+			return err
+		}
+		return scanErr
+	})
+}
+
+// Batch applies every operation in b in order. It stops at the first failing
+// operation; operations applied before it are not rolled back.
+func (d *DB) Batch(ctx context.Context, b *Batch) error {
+	return d.do(ctx, func() error {
+		for i, op := range b.ops {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			coll, err := d.db.GetCollection(op.collection)
+			if err != nil {
+				return fmt.Errorf("batch op %d: %w", i, err)
+			}
+			if op.delete {
+				_, err = coll.Delete(op.key)
+			} else {
+				_, err = coll.Update(op.key, op.value)
+			}
+			if err != nil {
+				return fmt.Errorf("batch op %d: %w", i, err)
+			}
+		}
+		return nil
+	})
+}
+
+// do runs fn after checking ctx and the closed flag, holding the DB lock
+// shared so Close waits for it.
+func (d *DB) do(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.closed {
+		return ErrClosed
+	}
+	return fn()
+}
+
+// Batch collects writes to be applied together by DB.Batch. The zero value is
+// an empty batch.
+type Batch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	collection string
+	key        string
+	value      string
+	delete     bool
+}
+
+// Put queues an insert or overwrite of key.
+func (b *Batch) Put(collection, key, value string) {
+	b.ops = append(b.ops, batchOp{collection: collection, key: key, value: value})
+}
+
+// Delete queues the removal of key.
+func (b *Batch) Delete(collection, key string) {
+	b.ops = append(b.ops, batchOp{collection: collection, key: key, delete: true})
+}
+
+// Len reports the number of queued operations.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
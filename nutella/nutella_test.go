@@ -0,0 +1,72 @@
+package nutella_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"db/nutella"
+)
+
+// TestOpenPutGetScan exercises the embedded API end to end, including reopening
+// the database after Close.
+func TestOpenPutGetScan(t *testing.T) {
+	ctx := context.Background()
+	dir := filepath.Join(t.TempDir(), "db_embedded")
+
+	db, err := nutella.Open(dir, &nutella.Options{CreateIfMissing: true})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if err := db.CreateCollection(ctx, "fruits", 3); err != nil {
+		t.Fatalf("Failed to create collection: %v", err)
+	}
+
+	var b nutella.Batch
+	for i := 0; i < 50; i++ {
+		b.Put("fruits", fmt.Sprintf("key_%02d", i), fmt.Sprintf("value_%d", i))
+	}
+	b.Delete("fruits", "key_07")
+	if err := db.Batch(ctx, &b); err != nil {
+		t.Fatalf("Failed to apply batch: %v", err)
+	}
+	if err := db.Put(ctx, "fruits", "key_01", "changed"); err != nil {
+		t.Fatalf("Failed to put key: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+
+	db, err = nutella.Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+
+	if v, err := db.Get(ctx, "fruits", "key_01"); err != nil || v != "changed" {
+		t.Errorf("Get(key_01) = %q, %v; want %q", v, err, "changed")
+	}
+	if _, err := db.Get(ctx, "fruits", "key_07"); !errors.Is(err, nutella.ErrNotFound) {
+		t.Errorf("Get(key_07) error = %v; want ErrNotFound", err)
+	}
+
+	var keys []string
+	err = db.Scan(ctx, "fruits", "key_1", func(key, value string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to scan: %v", err)
+	}
+	if len(keys) != 10 || keys[0] != "key_10" || keys[9] != "key_19" {
+		t.Errorf("Scan returned %v; want key_10..key_19 in order", keys)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := db.Put(cancelled, "fruits", "key_99", "x"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Put with cancelled context error = %v; want context.Canceled", err)
+	}
+}
@@ -0,0 +1,121 @@
+package routes
+
+import (
+	"db/auth"
+	"db/database"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// authStore is consulted by authorize. While it is nil, or holds no users,
+// every request is let through.
+var authStore *auth.Store
+
+const (
+	principalKey = "principal"
+	// targetKey holds the database ID authorize checked, which handlers must
+	// act on; see targetDBID.
+	targetKey = "targetDBID"
+)
+
+// UseAuth turns on authentication and authorization backed by store. Call it
+// before SetupRoutes.
+func UseAuth(store *auth.Store) {
+	authStore = store
+}
+
+// authorize returns middleware that admits the request only when its bearer
+// token or API key belongs to a user holding role on the database the request
+// targets. An empty role only requires a valid credential; the handler is then
+// expected to filter its output with canRead. The database is resolved and
+// validated before authentication, whether or not it is on, so handlers act on
+// the same one and never on a path outside the data root.
+func authorize(role auth.Role) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		dbID, ok := requestDBID(c)
+		if !ok {
+			return deny(c, fiber.StatusBadRequest, "dbID in the query and the body differ")
+		}
+		if dbID != "" {
+			if err := database.ValidDBID(dbID); err != nil {
+				return deny(c, fiber.StatusBadRequest, err.Error())
+			}
+		}
+		c.Locals(targetKey, dbID)
+
+		if authStore == nil || !authStore.Enabled() {
+			return c.Next()
+		}
+
+		user, err := authStore.Authenticate(credential(c))
+		if err != nil {
+			c.Set(fiber.HeaderWWWAuthenticate, `Bearer realm="nutelladb"`)
+			return deny(c, fiber.StatusUnauthorized, err.Error())
+		}
+		c.Locals(principalKey, user)
+
+		if role != "" && !authStore.Allowed(user, dbID, role) {
+			return deny(c, fiber.StatusForbidden, "requires "+string(role)+" role")
+		}
+		return c.Next()
+	}
+}
+
+// canRead reports whether the caller may see dbID. It is always true when
+// authorization is off.
+func canRead(c *fiber.Ctx, dbID string) bool {
+	user, ok := c.Locals(principalKey).(*auth.User)
+	if !ok {
+		return true
+	}
+	return authStore.Allowed(user, dbID, auth.RoleRead)
+}
+
+// credential extracts the token from "Authorization: Bearer" or X-API-Key.
+func credential(c *fiber.Ctx) string {
+	if h := c.Get(fiber.HeaderAuthorization); len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return c.Get("X-API-Key")
+}
+
+// requestDBID finds the database a request targets: the /v1 :db parameter, or
+// the dbID query parameter or body field of the legacy routes. The body is
+// read with BodyParser, as the handlers read it, so a body naming the field
+// twice or in another case resolves to the same ID for both. ok is false when
+// the query and the body name different databases.
+func requestDBID(c *fiber.Ctx) (dbID string, ok bool) {
+	if db := param(c, "db"); db != "" {
+		return db, true
+	}
+	query := c.Query("dbID")
+	var body struct {
+		DBID string `json:"dbID" form:"dbID"`
+	}
+	if len(c.Body()) > 0 {
+		c.BodyParser(&body)
+	}
+	if query != "" && body.DBID != "" && query != body.DBID {
+		return "", false
+	}
+	if query != "" {
+		return query, true
+	}
+	return body.DBID, true
+}
+
+// targetDBID is the database authorize resolved and checked for the request.
+// Legacy handlers use it rather than reading dbID themselves.
+func targetDBID(c *fiber.Ctx) string {
+	dbID, _ := c.Locals(targetKey).(string)
+	return dbID
+}
+
+// deny writes an error in the shape the route family uses.
+func deny(c *fiber.Ctx, status int, message string) error {
+	if strings.HasPrefix(c.Path(), "/v1/") {
+		return fail(c, status, message)
+	}
+	return c.Status(status).JSON(fiber.Map{"error": message})
+}
@@ -0,0 +1,120 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"db/auth"
+)
+
+func TestAuthorizeRoles(t *testing.T) {
+	app := newTestApp(t)
+
+	_, out := call(t, app, http.MethodPost, "/v1/dbs", "")
+	db := out["dbID"].(string)
+	_, out = call(t, app, http.MethodPost, "/v1/dbs", "")
+	victim := out["dbID"].(string)
+	call(t, app, http.MethodPost, "/v1/dbs/"+victim+"/collections", `{"name":"c","order":3}`)
+
+	store, err := auth.Open(auth.DefaultPath("files"))
+	if err != nil {
+		t.Fatalf("Failed to open auth store: %v", err)
+	}
+	UseAuth(store)
+	t.Cleanup(func() { UseAuth(nil) })
+
+	if err := store.AddUser("reader"); err != nil {
+		t.Fatalf("Failed to add user: %v", err)
+	}
+	if err := store.Grant("reader", db, auth.RoleRead); err != nil {
+		t.Fatalf("Failed to grant role: %v", err)
+	}
+	key, _, err := store.CreateKey("reader")
+	if err != nil {
+		t.Fatalf("Failed to create key: %v", err)
+	}
+	if err := store.AddUser("writer"); err != nil {
+		t.Fatalf("Failed to add user: %v", err)
+	}
+	if err := store.Grant("writer", db, auth.RoleWrite); err != nil {
+		t.Fatalf("Failed to grant role: %v", err)
+	}
+	writerKey, _, err := store.CreateKey("writer")
+	if err != nil {
+		t.Fatalf("Failed to create key: %v", err)
+	}
+
+	send := func(method, target, body, token string) int {
+		t.Helper()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, target, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	cases := []struct {
+		method, target, body, token string
+		want                        int
+	}{
+		{http.MethodGet, "/v1/dbs/" + db, "", "", http.StatusUnauthorized},
+		{http.MethodGet, "/v1/dbs/" + db, "", key, http.StatusOK},
+		{http.MethodGet, "/collections?dbID=" + db, "", key, http.StatusOK},
+		{http.MethodPost, "/v1/dbs/" + db + "/collections", `{"name":"c","order":3}`, key, http.StatusForbidden},
+		{http.MethodPost, "/pack", `{"dbID":"` + db + `"}`, key, http.StatusForbidden},
+		{http.MethodPost, "/v1/dbs", "", key, http.StatusForbidden},
+		{http.MethodGet, "/v1/openapi.json", "", "", http.StatusOK},
+		// The database checked must be the one the handler writes to.
+		{http.MethodPost, "/insert?dbID=" + db, `{"dbID":"` + victim + `","collection":"c","key":"k","value":"v"}`, writerKey, http.StatusBadRequest},
+		{http.MethodPost, "/insert", `{"dbID":"` + db + `","DBID":"` + victim + `","collection":"c","key":"k","value":"v"}`, writerKey, http.StatusForbidden},
+		{http.MethodPost, "/insert", `{"dbID":"` + victim + `","collection":"c","key":"k","value":"v"}`, writerKey, http.StatusForbidden},
+	}
+	for _, c := range cases {
+		if got := send(c.method, c.target, c.body, c.token); got != c.want {
+			t.Errorf("%s %s = %d; want %d", c.method, c.target, got, c.want)
+		}
+	}
+
+	UseAuth(nil)
+	if status, _ := call(t, app, http.MethodGet, "/v1/dbs/"+victim+"/collections/c/keys/k", ""); status != http.StatusNotFound {
+		t.Errorf("key written to %s by a user without access to it: status %d", victim, status)
+	}
+}
+
+// TestAuthorizeRejectsEscapingDBIDs checks that a dbID naming a path outside
+// the data root is refused before any handler builds a path from it.
+func TestAuthorizeRejectsEscapingDBIDs(t *testing.T) {
+	app := newTestApp(t)
+	outside := filepath.Join("outside", ".nutella")
+	if err := os.MkdirAll(outside, 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "snapshots.json"), []byte(`{}`), 0644); err != nil {
+		t.Fatalf("Failed to write snapshots: %v", err)
+	}
+
+	cases := []struct{ method, target, body string }{
+		{http.MethodGet, "/snapshots?dbID=../outside", ""},
+		{http.MethodPost, "/pack", `{"dbID":"../outside"}`},
+		{http.MethodPost, "/init", `{"dbID":"../escaped"}`},
+		{http.MethodGet, "/v1/dbs/..%2Foutside", ""},
+	}
+	for _, c := range cases {
+		if status, out := call(t, app, c.method, c.target, c.body); status != http.StatusBadRequest {
+			t.Errorf("%s %s = %d %v; want 400", c.method, c.target, status, out)
+		}
+	}
+	if _, err := os.Stat("escaped"); !os.IsNotExist(err) {
+		t.Errorf("init created a repository outside the data root: %v", err)
+	}
+}
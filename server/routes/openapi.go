@@ -0,0 +1,155 @@
+package routes
+
+import (
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var pathParamPattern = regexp.MustCompile(`:([A-Za-z0-9_]+)`)
+
+// openAPISpec builds an OpenAPI 3.0 document from the endpoint table. Request
+// and response schemas are derived from the zero values stored on each
+// endpoint by reflecting over their json tags.
+func openAPISpec(prefix string, endpoints []endpoint) fiber.Map {
+	paths := fiber.Map{}
+	for _, ep := range endpoints {
+		path := prefix + pathParamPattern.ReplaceAllString(ep.Path, "{$1}")
+
+		var params []fiber.Map
+		for _, m := range pathParamPattern.FindAllStringSubmatch(ep.Path, -1) {
+			params = append(params, fiber.Map{
+				"name": m[1], "in": "path", "required": true,
+				"schema": fiber.Map{"type": "string"},
+			})
+		}
+		for _, q := range ep.Query {
+			params = append(params, fiber.Map{
+				"name": q, "in": "query", "required": false,
+				"schema": fiber.Map{"type": "string"},
+			})
+		}
+
+		success := fiber.Map{"description": "Success"}
+		if ep.Response != nil {
+			success["content"] = contentOf(ep.Response)
+		}
+		op := fiber.Map{
+			"summary":     ep.Summary,
+			"operationId": operationID(ep),
+			"responses": fiber.Map{
+				strconv.Itoa(ep.Status): success,
+				"default": fiber.Map{
+					"description": "Error",
+					"content": fiber.Map{
+						"application/json": fiber.Map{"schema": schemaOf(reflect.TypeOf(errorEnvelope{}))},
+					},
+				},
+			},
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+		if ep.Role != "" {
+			op["x-required-role"] = string(ep.Role)
+		}
+		if ep.Body != nil {
+			op["requestBody"] = fiber.Map{
+				"required": true,
+				"content":  contentOf(ep.Body),
+			}
+		}
+
+		item, ok := paths[path].(fiber.Map)
+		if !ok {
+			item = fiber.Map{}
+			paths[path] = item
+		}
+		item[strings.ToLower(ep.Method)] = op
+	}
+
+	return fiber.Map{
+		"openapi": "3.0.3",
+		"info": fiber.Map{
+			"title":   "NutellaDB API",
+			"version": "1",
+		},
+		"paths": paths,
+		// Credentials are only checked once a user has been added with the CLI.
+		"security": []fiber.Map{{"bearerAuth": []string{}}, {"apiKeyAuth": []string{}}},
+		"components": fiber.Map{
+			"securitySchemes": fiber.Map{
+				"bearerAuth": fiber.Map{"type": "http", "scheme": "bearer", "description": "JWT (HS256) or API key"},
+				"apiKeyAuth": fiber.Map{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+			},
+		},
+	}
+}
+
+// contentOf describes a request or response body: JSON with v's schema, or
+// raw bytes when v is a []byte.
+func contentOf(v interface{}) fiber.Map {
+	if _, ok := v.([]byte); ok {
+		return fiber.Map{
+			"application/octet-stream": fiber.Map{"schema": fiber.Map{"type": "string", "format": "binary"}},
+		}
+	}
+	return fiber.Map{
+		"application/json": fiber.Map{"schema": schemaOf(reflect.TypeOf(v))},
+	}
+}
+
+// operationID turns "GET /dbs/:db/commits" into "getDbsDbCommits".
+func operationID(ep endpoint) string {
+	id := strings.ToLower(ep.Method)
+	for _, part := range strings.FieldsFunc(ep.Path, func(r rune) bool { return r == '/' || r == ':' }) {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+// schemaOf maps a Go type to a JSON schema object.
+func schemaOf(t reflect.Type) fiber.Map {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return fiber.Map{"type": "string"}
+	case reflect.Bool:
+		return fiber.Map{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return fiber.Map{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return fiber.Map{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return fiber.Map{"type": "array", "items": schemaOf(t.Elem())}
+	case reflect.Map:
+		return fiber.Map{"type": "object", "additionalProperties": schemaOf(t.Elem())}
+	case reflect.Struct:
+		props := fiber.Map{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name := f.Name
+			if tag := f.Tag.Get("json"); tag != "" {
+				if tag == "-" {
+					continue
+				}
+				if n := strings.Split(tag, ",")[0]; n != "" {
+					name = n
+				}
+			}
+			props[name] = schemaOf(f.Type)
+		}
+		return fiber.Map{"type": "object", "properties": props}
+	}
+	// interface{} values can hold anything.
+	return fiber.Map{}
+}
@@ -2,53 +2,92 @@ package routes
 
 import (
 	"bytes"
+	"db/auth"
 	"db/database"
 	"db/dbcli"
 	cli "db/dbcli"
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
-	"sort"
-	"strings"
-	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/google/uuid"
 )
 
-var openDBs = map[string]*database.Database{}
+// registry holds the databases opened by the routes. The server swaps in its
+// own with UseRegistry; the default serves ./files relative to the working
+// directory.
+var registry = database.NewRegistry(filepath.Join(".", "files"), 0)
+
+// UseRegistry makes the routes share handles through r. Call it before
+// SetupRoutes.
+func UseRegistry(r *database.Registry) {
+	registry = r
+}
 
 func basePath(dbID string) string {
-	return filepath.Join(".", "files", dbID)
+	return registry.Path(dbID)
+}
+
+// autoCommit commits databases as the server's policy asks; nil disables it.
+var autoCommit *dbcli.AutoCommitter
+
+// UseAutoCommit makes the write routes report to a and the restore and
+// checkout routes commit through it first. Call it before SetupRoutes.
+func UseAutoCommit(a *dbcli.AutoCommitter) {
+	autoCommit = a
+}
+
+// CloseDatabases stops auto-commit, waiting for commits under way, then
+// closes every database opened by the routes. The server calls it once
+// requests have drained during shutdown.
+func CloseDatabases() error {
+	autoCommit.Close()
+	return registry.Close()
 }
 
-func getDB(dbID string, createIfMissing bool) (*database.Database, string, error) {
-	if db, ok := openDBs[dbID]; ok {
-		return db, dbID, nil
+// restoreDatabase restores dbID to commit sha once nobody holds the
+// database and its pending writes are flushed, so no open handle can write
+// over the restored files. The next request loads the restored state.
+func restoreDatabase(dbID, sha string) (string, error) {
+	err := registry.Replace(dbID, func() error {
+		return dbcli.Restore(basePath(dbID), sha)
+	})
+	if err != nil {
+		return "", err
 	}
+	return fmt.Sprintf("Restored to commit %s\n", sha), nil
+}
 
-	db, err := database.LoadDatabase(basePath(dbID))
+// commitDatabase commits dbID in-process through its shared handle, so the
+// commit waits for writes in flight instead of hashing pages mid-split.
+func commitDatabase(dbID, message string) (*dbcli.Commit, error) {
+	db, release, err := registry.Acquire(dbID)
 	if err != nil {
-		if !createIfMissing {
-			return nil, "", err
-		}
-		dbUUID, err := uuid.NewRandom()
-		if err != nil {
-			log.Fatalf("failed to generate uuid: %v", err)
-		}
-		dbSuffix := strings.Split(dbUUID.String(), "-")[0]
-		dbID = fmt.Sprintf("db_%s", dbSuffix)
-		db, err = database.NewDatabase(basePath(dbID), dbID)
-		if err != nil {
-			return nil, dbID, err
-		}
+		return nil, err
 	}
-	openDBs[dbID] = db
-	return db, dbID, nil
+	defer release()
+	return dbcli.CommitWorkingTree(basePath(dbID), message, dbcli.Signature{}, db)
+}
+
+// restoreStatus is the status a failed restore answers with: a commit the
+// signing policy refuses is a conflict, anything else a server error.
+func restoreStatus(err error) int {
+	if errors.Is(err, dbcli.ErrUnsignedCommit) {
+		return fiber.StatusConflict
+	}
+	return fiber.StatusInternalServerError
 }
 
 func runCLI(args []string) (string, error) {
+	// The version-control commands chdir into the database directory, so put
+	// the server back where it was for the next request, and keep auto-commit
+	// out of the way meanwhile.
+	defer cli.LockWorkdir()()
+	if cwd, err := os.Getwd(); err == nil {
+		defer os.Chdir(cwd)
+	}
+
 	var out, errBuf bytes.Buffer
 	cli.RootCmd.SetOut(&out)
 	cli.RootCmd.SetErr(&errBuf)
@@ -57,91 +96,112 @@ func runCLI(args []string) (string, error) {
 	return out.String() + errBuf.String(), err
 }
 
+// SetupRoutes registers the versioned /v1 API and, as a compatibility layer,
+// the original flat routes. Every route is guarded by authorize.
 func SetupRoutes(router fiber.Router) {
-	router.Get("/databases", func(c *fiber.Ctx) error {
-		dbs, err := database.ListDatabases("./files")
+	setupV1(router)
+
+	router.Get("/databases", authorize(""), func(c *fiber.Ctx) error {
+		dbs, err := database.ListDatabases(registry.Root())
 		if err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 				"error": err.Error(),
 			})
 		}
-		return c.JSON(fiber.Map{"databases": dbs})
+		var visible []string
+		for _, db := range dbs {
+			if canRead(c, db) {
+				visible = append(visible, db)
+			}
+		}
+		return c.JSON(fiber.Map{"databases": visible})
 	})
 
-	router.Get("/create-db", func(c *fiber.Ctx) error {
-		_, dbID, err := getDB("", true)
+	router.Get("/create-db", authorize(auth.RoleAdmin), func(c *fiber.Ctx) error {
+		dbID, _, release, err := registry.Create()
 		if err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 		}
+		release()
 		return c.JSON(fiber.Map{"status": "created", "dbID": dbID})
 	})
 
-	router.Get("/collections", func(c *fiber.Ctx) error {
-		dbID := c.Query("dbID")
+	router.Get("/collections", authorize(auth.RoleRead), func(c *fiber.Ctx) error {
+		dbID := targetDBID(c)
 		if dbID == "" {
 			return c.Status(400).JSON(fiber.Map{"error": "dbID required"})
 		}
-		db, _, err := getDB(dbID, false)
+		db, release, err := registry.Acquire(dbID)
 		if err != nil {
 			return c.Status(404).JSON(fiber.Map{"error": err.Error()})
 		}
+		defer release()
 		names, _ := db.GetAllCollections()
 		return c.JSON(fiber.Map{"collections": names})
 	})
 
-	router.Post("/create-collection", func(c *fiber.Ctx) error {
+	router.Post("/create-collection", authorize(auth.RoleAdmin), func(c *fiber.Ctx) error {
 		var body struct {
 			DBID  string `json:"dbID"`
 			Name  string `json:"name"`
 			Order int    `json:"order"`
 		}
-		if err := c.BodyParser(&body); err != nil || body.DBID == "" || body.Name == "" || body.Order < 3 {
+		err := c.BodyParser(&body)
+		body.DBID = targetDBID(c)
+		if err != nil || body.DBID == "" || body.Name == "" || body.Order < 3 {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "dbID, name and order>=3 required"})
 		}
 
-		db, _, err := getDB(body.DBID, false)
+		db, release, err := registry.Acquire(body.DBID)
 		if err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 		}
+		defer release()
 		if err := db.CreateCollection(body.Name, body.Order); err != nil {
 			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
 		}
+		autoCommit.Wrote(body.DBID)
 		return c.JSON(fiber.Map{"status": "collection created"})
 	})
 
-	router.Post("/insert", func(c *fiber.Ctx) error {
+	router.Post("/insert", authorize(auth.RoleWrite), func(c *fiber.Ctx) error {
 		var body struct {
 			DBID       string `json:"dbID"`
 			Collection string `json:"collection"`
 			Key        string `json:"key"`
 			Value      string `json:"value"`
 		}
-		if err := c.BodyParser(&body); err != nil {
+		err := c.BodyParser(&body)
+		body.DBID = targetDBID(c)
+		if err != nil {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid json"})
 		}
 
-		db, _, err := getDB(body.DBID, false)
+		db, release, err := registry.Acquire(body.DBID)
 		if err != nil {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
 		}
+		defer release()
 		coll, err := db.GetCollection(body.Collection)
 		if err != nil {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
 		}
 		coll.InsertKV(body.Key, body.Value)
+		autoCommit.Wrote(body.DBID)
 		return c.JSON(fiber.Map{"status": "inserted"})
 	})
 
-	router.Get("/find", func(c *fiber.Ctx) error {
-		dbID, colName, key := c.Query("dbID"), c.Query("collection"), c.Query("key")
+	router.Get("/find", authorize(auth.RoleRead), func(c *fiber.Ctx) error {
+		dbID, colName, key := targetDBID(c), c.Query("collection"), c.Query("key")
 		if dbID == "" || colName == "" || key == "" {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "missing query params"})
 		}
 
-		db, _, err := getDB(dbID, false)
+		db, release, err := registry.Acquire(dbID)
 		if err != nil {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
 		}
+		defer release()
 		coll, err := db.GetCollection(colName)
 		if err != nil {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
@@ -153,13 +213,17 @@ func SetupRoutes(router fiber.Router) {
 		return c.JSON(fiber.Map{"value": val})
 	})
 
-	router.Get("/find-all", func(c *fiber.Ctx) error {
-		dbID, colName := c.Query("dbID"), c.Query("collection")
+	router.Get("/find-all", authorize(auth.RoleRead), func(c *fiber.Ctx) error {
+		dbID, colName := targetDBID(c), c.Query("collection")
+		if dbID == "" || colName == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "missing query params"})
+		}
 
-		db, _, err := getDB(dbID, false)
+		db, release, err := registry.Acquire(dbID)
 		if err != nil {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
 		}
+		defer release()
 		coll, err := db.GetCollection(colName)
 		if err != nil {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
@@ -169,100 +233,77 @@ func SetupRoutes(router fiber.Router) {
 		return c.JSON(fiber.Map{"value": val})
 	})
 
-	router.Get("/snapshots", func(c *fiber.Ctx) error {
-		dbName := c.Query("dbID")
-		basePath := filepath.Join(".", "files", dbName)
-
-		cwd, _ := os.Getwd()
-		if !strings.HasSuffix(cwd, basePath) {
-			if err := os.Chdir(basePath); err != nil {
-				fmt.Fprintf(os.Stderr, "Error changing directory to %s: %v\n", basePath, err)
-			}
-		}
-		snapshots, err := dbcli.LoadSnapshots()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error loading snapshots: %v\n", err)
-			os.Exit(1)
-		}
-
-		if len(snapshots) == 0 {
-			fmt.Fprintf(os.Stderr, "No snapshots found.\n")
-			// os.Exit(1)
+	router.Get("/snapshots", authorize(auth.RoleRead), func(c *fiber.Ctx) error {
+		dbName := targetDBID(c)
+		if dbName == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "dbID required"})
 		}
 
-		// Convert map to slice for sorting.
-		type snapEntry struct {
-			Key      string
-			Snapshot dbcli.Snapshot
-		}
-		var snapshotList []snapEntry
-		for key, snap := range snapshots {
-			snapshotList = append(snapshotList, snapEntry{Key: key, Snapshot: snap})
+		snapshots, err := dbcli.LoadSnapshotsFrom(basePath(dbName))
+		if err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
 		}
 
-		// Sort snapshots by timestamp.
-		// If timestamps cannot be parsed, fallback to a simple string comparison.
-		sort.Slice(snapshotList, func(i, j int) bool {
-			ti, err1 := time.Parse(time.RFC3339, snapshotList[i].Snapshot.Timestamp)
-			tj, err2 := time.Parse(time.RFC3339, snapshotList[j].Snapshot.Timestamp)
-			if err1 != nil || err2 != nil {
-				return snapshotList[i].Snapshot.Timestamp < snapshotList[j].Snapshot.Timestamp
-			}
-			return ti.Before(tj)
-		})
-
-		os.Chdir("../..")
+		snapshotList := dbcli.SortSnapshots(snapshots)
 
 		return c.Status(200).JSON(fiber.Map{"snapshots": snapshotList})
 
 	})
 
-	router.Post("/update", func(c *fiber.Ctx) error {
+	router.Post("/update", authorize(auth.RoleWrite), func(c *fiber.Ctx) error {
 		var body struct {
 			DBID       string `json:"dbID"`
 			Collection string `json:"collection"`
 			Key        string `json:"key"`
 			Value      string `json:"value"`
 		}
-		if err := c.BodyParser(&body); err != nil {
+		err := c.BodyParser(&body)
+		body.DBID = targetDBID(c)
+		if err != nil {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid json"})
 		}
-		db, _, err := getDB(body.DBID, false)
+		db, release, err := registry.Acquire(body.DBID)
 		if err != nil {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
 		}
+		defer release()
 		coll, err := db.GetCollection(body.Collection)
 		if err != nil {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
 		}
 		coll.UpdateKV(body.Key, body.Value)
+		autoCommit.Wrote(body.DBID)
 		return c.JSON(fiber.Map{"status": "updated"})
 	})
 
-	router.Delete("/delete", func(c *fiber.Ctx) error {
-		dbID, colName, key := c.Query("dbID"), c.Query("collection"), c.Query("key")
+	router.Delete("/delete", authorize(auth.RoleWrite), func(c *fiber.Ctx) error {
+		dbID, colName, key := targetDBID(c), c.Query("collection"), c.Query("key")
 		if dbID == "" || colName == "" || key == "" {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "missing query params"})
 		}
 
-		db, _, err := getDB(dbID, false)
+		db, release, err := registry.Acquire(dbID)
 		if err != nil {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
 		}
+		defer release()
 		coll, err := db.GetCollection(colName)
 		if err != nil {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
 		}
 		coll.DeleteKey(key)
+		autoCommit.Wrote(dbID)
 		return c.JSON(fiber.Map{"status": "deleted (if key existed)"})
 	})
 
 	// nutella-style routes
-	router.Post("/init", func(c *fiber.Ctx) error {
+	router.Post("/init", authorize(auth.RoleVersionControl), func(c *fiber.Ctx) error {
 		var b struct {
 			DBID string `json:"dbID"`
 		}
-		if err := c.BodyParser(&b); err != nil || b.DBID == "" {
+		err := c.BodyParser(&b)
+		b.DBID = targetDBID(c)
+		if err != nil || b.DBID == "" {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "dbID required"})
 		}
 		out, err := runCLI([]string{"init", b.DBID})
@@ -272,50 +313,83 @@ func SetupRoutes(router fiber.Router) {
 		return c.JSON(fiber.Map{"output": out})
 	})
 
-	router.Post("/commit-all", func(c *fiber.Ctx) error {
+	router.Post("/commit-all", authorize(auth.RoleVersionControl), func(c *fiber.Ctx) error {
 		var b struct{ DBID, Message string }
-		if err := c.BodyParser(&b); err != nil || b.DBID == "" || b.Message == "" {
+		err := c.BodyParser(&b)
+		b.DBID = targetDBID(c)
+		if err != nil || b.DBID == "" || b.Message == "" {
 			return c.Status(400).JSON(fiber.Map{"error": "dbID and message required"})
 		}
-		out, err := runCLI([]string{"commit-all", b.DBID, "-m", b.Message})
+		commit, err := commitDatabase(b.DBID, b.Message)
 		if err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": err.Error(), "output": out})
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 		}
-		return c.JSON(fiber.Map{"output": out})
+		return c.JSON(fiber.Map{"output": commit.Sha + "\n"})
 	})
 
-	router.Post("/restore", func(c *fiber.Ctx) error {
-		var b struct{ DBID string }
-		if err := c.BodyParser(&b); err != nil || b.DBID == "" {
+	// The interactive restore command would block on the server's stdin, so
+	// this route takes the commit up front and runs restore-to instead.
+	router.Post("/restore", authorize(auth.RoleVersionControl), func(c *fiber.Ctx) error {
+		var b struct {
+			DBID       string `json:"dbID"`
+			Commit     string `json:"commit"`
+			CommitHash string `json:"commitHash"`
+		}
+		err := c.BodyParser(&b)
+		b.DBID = targetDBID(c)
+		if err != nil || b.DBID == "" {
 			return c.Status(400).JSON(fiber.Map{"error": "dbID required"})
 		}
-		out, err := runCLI([]string{"restore", b.DBID})
+		if b.Commit == "" {
+			b.Commit = b.CommitHash
+		}
+		if b.Commit == "" {
+			return c.Status(400).JSON(fiber.Map{"error": "commit required; list commits with GET /v1/dbs/{db}/commits"})
+		}
+		sha, err := dbcli.ResolveRevision(basePath(b.DBID), b.Commit)
 		if err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": err.Error(), "output": out})
+			return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := autoCommit.BeforeDestructive(b.DBID, "restore to "+sha); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		out, err := restoreDatabase(b.DBID, sha)
+		if err != nil {
+			return c.Status(restoreStatus(err)).JSON(fiber.Map{"error": err.Error()})
 		}
-		delete(openDBs, b.DBID)
 		return c.JSON(fiber.Map{"output": out})
 	})
 
-	router.Post("/restore-to", func(c *fiber.Ctx) error {
+	router.Post("/restore-to", authorize(auth.RoleVersionControl), func(c *fiber.Ctx) error {
 		var b struct {
 			DBID        string `json:"dbID"`
 			Commit_hash string `json:"commit_hash"`
 		}
-		if err := c.BodyParser(&b); err != nil || b.DBID == "" || b.Commit_hash == "" {
+		err := c.BodyParser(&b)
+		b.DBID = targetDBID(c)
+		if err != nil || b.DBID == "" || b.Commit_hash == "" {
 			return c.Status(400).JSON(fiber.Map{"error": "DBID required"})
 		}
-		out, err := runCLI([]string{"restore-to", b.DBID, b.Commit_hash})
+		// Tags, branches and short SHAs are accepted as well as full hashes.
+		sha, err := dbcli.ResolveRevision(basePath(b.DBID), b.Commit_hash)
 		if err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": err.Error(), "output": out})
+			return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := autoCommit.BeforeDestructive(b.DBID, "restore to "+sha); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		out, err := restoreDatabase(b.DBID, sha)
+		if err != nil {
+			return c.Status(restoreStatus(err)).JSON(fiber.Map{"error": err.Error()})
 		}
-		delete(openDBs, b.DBID)
 		return c.JSON(fiber.Map{"output": out})
 	})
 
-	router.Post("/pack", func(c *fiber.Ctx) error {
+	router.Post("/pack", authorize(auth.RoleVersionControl), func(c *fiber.Ctx) error {
 		var b struct{ DBID string }
-		if err := c.BodyParser(&b); err != nil || b.DBID == "" {
+		err := c.BodyParser(&b)
+		b.DBID = targetDBID(c)
+		if err != nil || b.DBID == "" {
 			return c.Status(400).JSON(fiber.Map{"error": "dbID required"})
 		}
 		out, err := runCLI([]string{"pack", b.DBID})
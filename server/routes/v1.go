@@ -0,0 +1,887 @@
+package routes
+
+import (
+	"bytes"
+	"db/auth"
+	"db/btree"
+	"db/database"
+	"db/dbcli"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// endpoint describes one /v1 route. The same table registers the Fiber
+// handlers and generates the OpenAPI document, so the two cannot drift apart.
+type endpoint struct {
+	Method   string
+	Path     string // Fiber syntax, relative to /v1
+	Summary  string
+	Query    []string    // optional query parameters
+	Body     interface{} // zero value of the JSON request body, if any; []byte for raw bytes
+	Status   int         // status of a successful response
+	Response interface{} // zero value of the JSON response body, if any; []byte for raw bytes
+	Role     auth.Role   // role required on :db; empty means any authenticated caller
+	Handler  fiber.Handler
+}
+
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// errorEnvelope is the body of every non-2xx /v1 response.
+type errorEnvelope struct {
+	Error apiError `json:"error"`
+}
+
+type createCollectionBody struct {
+	Name  string `json:"name"`
+	Order int    `json:"order"`
+}
+
+type putKeyBody struct {
+	Value string `json:"value"`
+}
+
+type commitBody struct {
+	Message string `json:"message"`
+}
+
+type restoreBody struct {
+	Commit string `json:"commit"`
+}
+
+type restoreIntoBody struct {
+	Commit string `json:"commit"`
+	Into   string `json:"into"`
+}
+
+type databasesBody struct {
+	Databases []string `json:"databases"`
+}
+
+type databaseBody struct {
+	DBID        string   `json:"dbID"`
+	Collections []string `json:"collections"`
+}
+
+type collectionsBody struct {
+	Collections []string `json:"collections"`
+}
+
+type keyBody struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+}
+
+type keysBody struct {
+	Keys []btree.KeyValue `json:"keys"`
+}
+
+type commitsBody struct {
+	Commits []dbcli.SnapshotEntry `json:"commits"`
+}
+
+type branchesBody struct {
+	Branches []dbcli.Branch `json:"branches"`
+}
+
+type createBranchBody struct {
+	Name  string `json:"name"`
+	Start string `json:"start"`
+}
+
+type checkoutBody struct {
+	Target string `json:"target"`
+	Force  bool   `json:"force"`
+}
+
+type checkoutResultBody struct {
+	Target string `json:"target"`
+	Commit string `json:"commit"`
+}
+
+type diffBody struct {
+	From        string                 `json:"from"`
+	To          string                 `json:"to"`
+	Collections []dbcli.CollectionDiff `json:"collections"`
+}
+
+type commitCreatedBody struct {
+	Commit dbcli.SnapshotEntry `json:"commit"`
+	Output string              `json:"output"`
+}
+
+type fetchPackBody struct {
+	Want []string `json:"want"`
+	Have []string `json:"have"`
+}
+
+type receivePackResultBody struct {
+	Objects int `json:"objects"`
+}
+
+type outputBody struct {
+	Output string `json:"output"`
+}
+
+func v1Endpoints() []endpoint {
+	return []endpoint{
+		{Method: fiber.MethodGet, Path: "/dbs", Summary: "List databases",
+			Status: fiber.StatusOK, Response: databasesBody{}, Handler: v1ListDatabases},
+		{Method: fiber.MethodPost, Path: "/dbs", Summary: "Create a database with a generated ID",
+			Status: fiber.StatusCreated, Response: databaseBody{}, Role: auth.RoleAdmin, Handler: v1CreateDatabase},
+		{Method: fiber.MethodGet, Path: "/dbs/:db", Summary: "Describe a database",
+			Status: fiber.StatusOK, Response: databaseBody{}, Role: auth.RoleRead, Handler: v1GetDatabase},
+		{Method: fiber.MethodGet, Path: "/dbs/:db/collections", Summary: "List collections",
+			Status: fiber.StatusOK, Response: collectionsBody{}, Role: auth.RoleRead, Handler: v1ListCollections},
+		{Method: fiber.MethodPost, Path: "/dbs/:db/collections", Summary: "Create a collection (order >= 3)",
+			Body: createCollectionBody{}, Status: fiber.StatusCreated, Response: collectionsBody{}, Role: auth.RoleAdmin, Handler: v1CreateCollection},
+		{Method: fiber.MethodGet, Path: "/dbs/:db/collections/:collection/keys", Summary: "List key-value pairs in key order",
+			Query: []string{"prefix", "at"}, Status: fiber.StatusOK, Response: keysBody{}, Role: auth.RoleRead, Handler: v1ListKeys},
+		{Method: fiber.MethodGet, Path: "/dbs/:db/collections/:collection/keys/:key", Summary: "Read a key",
+			Query: []string{"at"}, Status: fiber.StatusOK, Response: keyBody{}, Role: auth.RoleRead, Handler: v1GetKey},
+		{Method: fiber.MethodPut, Path: "/dbs/:db/collections/:collection/keys/:key", Summary: "Create or replace a key",
+			Body: putKeyBody{}, Status: fiber.StatusOK, Response: keyBody{}, Role: auth.RoleWrite, Handler: v1PutKey},
+		{Method: fiber.MethodDelete, Path: "/dbs/:db/collections/:collection/keys/:key", Summary: "Delete a key",
+			Status: fiber.StatusNoContent, Role: auth.RoleWrite, Handler: v1DeleteKey},
+		{Method: fiber.MethodPost, Path: "/dbs/:db/repository", Summary: "Initialize the .nutella repository",
+			Status: fiber.StatusCreated, Response: outputBody{}, Role: auth.RoleVersionControl, Handler: v1InitRepository},
+		{Method: fiber.MethodGet, Path: "/dbs/:db/commits", Summary: "List commits, oldest first",
+			Status: fiber.StatusOK, Response: commitsBody{}, Role: auth.RoleRead, Handler: v1ListCommits},
+		{Method: fiber.MethodPost, Path: "/dbs/:db/commits", Summary: "Commit the current state",
+			Body: commitBody{}, Status: fiber.StatusCreated, Response: commitCreatedBody{}, Role: auth.RoleVersionControl, Handler: v1CreateCommit},
+		{Method: fiber.MethodGet, Path: "/dbs/:db/diff", Summary: "Key-level changes between two commits",
+			Query: []string{"from", "to"}, Status: fiber.StatusOK, Response: diffBody{}, Role: auth.RoleRead, Handler: v1Diff},
+		{Method: fiber.MethodGet, Path: "/dbs/:db/branches", Summary: "List branches",
+			Status: fiber.StatusOK, Response: branchesBody{}, Role: auth.RoleRead, Handler: v1ListBranches},
+		{Method: fiber.MethodPost, Path: "/dbs/:db/branches", Summary: "Create a branch at HEAD or at start",
+			Body: createBranchBody{}, Status: fiber.StatusCreated, Response: branchesBody{}, Role: auth.RoleVersionControl, Handler: v1CreateBranch},
+		{Method: fiber.MethodDelete, Path: "/dbs/:db/branches/:branch", Summary: "Delete a branch other than the current one",
+			Status: fiber.StatusNoContent, Role: auth.RoleVersionControl, Handler: v1DeleteBranch},
+		{Method: fiber.MethodPost, Path: "/dbs/:db/checkout", Summary: "Switch to a branch or commit",
+			Body: checkoutBody{}, Status: fiber.StatusOK, Response: checkoutResultBody{}, Role: auth.RoleVersionControl, Handler: v1Checkout},
+		{Method: fiber.MethodPost, Path: "/dbs/:db/restore", Summary: "Reset the working tree to a commit",
+			Body: restoreBody{}, Status: fiber.StatusOK, Response: outputBody{}, Role: auth.RoleVersionControl, Handler: v1Restore},
+		{Method: fiber.MethodPost, Path: "/dbs/:db/restore-into", Summary: "Copy a commit into a new database, leaving this one untouched",
+			Body: restoreIntoBody{}, Status: fiber.StatusCreated, Response: databaseBody{}, Role: auth.RoleAdmin, Handler: v1RestoreInto},
+		{Method: fiber.MethodPost, Path: "/dbs/:db/pack", Summary: "Pack loose objects",
+			Status: fiber.StatusOK, Response: outputBody{}, Role: auth.RoleVersionControl, Handler: v1Pack},
+		{Method: fiber.MethodGet, Path: "/dbs/:db/refs", Summary: "List branches and tags for fetch and push",
+			Status: fiber.StatusOK, Response: dbcli.RefList{}, Role: auth.RoleRead, Handler: v1ListRefs},
+		{Method: fiber.MethodPost, Path: "/dbs/:db/refs", Summary: "Move a branch or tag to pushed history",
+			Body: dbcli.RefUpdate{}, Status: fiber.StatusOK, Response: dbcli.RefUpdateResult{}, Role: auth.RoleVersionControl, Handler: v1UpdateRef},
+		{Method: fiber.MethodPost, Path: "/dbs/:db/fetch-pack", Summary: "Bundle the objects reachable from want but not from have",
+			Body: fetchPackBody{}, Status: fiber.StatusOK, Response: []byte{}, Role: auth.RoleRead, Handler: v1FetchPack},
+		{Method: fiber.MethodPost, Path: "/dbs/:db/receive-pack", Summary: "Store a bundle of objects sent by push",
+			Body: []byte{}, Status: fiber.StatusOK, Response: receivePackResultBody{}, Role: auth.RoleVersionControl, Handler: v1ReceivePack},
+		{Method: fiber.MethodGet, Path: "/dbs/:db/export", Summary: "Stream every collection as NDJSON, CSV or a JSON array",
+			Query: []string{"format", "key", "value"}, Status: fiber.StatusOK, Response: []byte{}, Role: auth.RoleRead, Handler: v1Export},
+		{Method: fiber.MethodGet, Path: "/dbs/:db/collections/:collection/export", Summary: "Stream a collection as NDJSON, CSV or a JSON array",
+			Query: []string{"format", "key", "value"}, Status: fiber.StatusOK, Response: []byte{}, Role: auth.RoleRead, Handler: v1Export},
+		{Method: fiber.MethodPost, Path: "/dbs/:db/collections/:collection/import", Summary: "Upsert the NDJSON, CSV or JSON array records of the request body",
+			Query: []string{"format", "key", "value", "skip"}, Body: []byte{}, Status: fiber.StatusOK, Response: database.ImportResult{}, Role: auth.RoleWrite, Handler: v1Import},
+		{Method: fiber.MethodGet, Path: "/dbs/:db/backup", Summary: "Download a consistent backup archive of a running database",
+			Status: fiber.StatusOK, Response: []byte{}, Role: auth.RoleAdmin, Handler: v1Backup},
+	}
+}
+
+// setupV1 registers the /v1 API and its OpenAPI document on router.
+func setupV1(router fiber.Router) {
+	endpoints := v1Endpoints()
+	v1 := router.Group("/v1")
+	for _, ep := range endpoints {
+		v1.Add(ep.Method, ep.Path, authorize(ep.Role), ep.Handler)
+	}
+
+	spec := openAPISpec("/v1", endpoints)
+	v1.Get("/openapi.json", func(c *fiber.Ctx) error {
+		return c.JSON(spec)
+	})
+}
+
+func fail(c *fiber.Ctx, status int, message string) error {
+	code := "bad_request"
+	switch status {
+	case fiber.StatusUnauthorized:
+		code = "unauthorized"
+	case fiber.StatusForbidden:
+		code = "forbidden"
+	case fiber.StatusNotFound:
+		code = "not_found"
+	case fiber.StatusConflict:
+		code = "conflict"
+	case fiber.StatusInternalServerError:
+		code = "internal"
+	}
+	return c.Status(status).JSON(errorEnvelope{Error: apiError{Code: code, Message: message}})
+}
+
+// param returns a decoded path parameter.
+func param(c *fiber.Ctx, name string) string {
+	v := c.Params(name)
+	if decoded, err := url.PathUnescape(v); err == nil {
+		return decoded
+	}
+	return v
+}
+
+// v1Database acquires the database named by the :db parameter; the handler
+// must call release when done. When it reports false the 404 has already been
+// written and the handler should return nil.
+func v1Database(c *fiber.Ctx) (*database.Database, func(), bool) {
+	db, release, err := registry.Acquire(param(c, "db"))
+	if err != nil {
+		fail(c, fiber.StatusNotFound, err.Error())
+		return nil, nil, false
+	}
+	return db, release, true
+}
+
+// v1Collection resolves the :db and :collection parameters like v1Database.
+func v1Collection(c *fiber.Ctx) (*database.Collection, func(), bool) {
+	db, release, ok := v1Database(c)
+	if !ok {
+		return nil, nil, false
+	}
+	coll, err := db.GetCollection(param(c, "collection"))
+	if err != nil {
+		release()
+		fail(c, fiber.StatusNotFound, err.Error())
+		return nil, nil, false
+	}
+	return coll, release, true
+}
+
+func v1ListDatabases(c *fiber.Ctx) error {
+	dbs, err := database.ListDatabases(registry.Root())
+	if err != nil {
+		return fail(c, fiber.StatusInternalServerError, err.Error())
+	}
+	visible := []string{}
+	for _, db := range dbs {
+		if canRead(c, db) {
+			visible = append(visible, db)
+		}
+	}
+	return c.JSON(databasesBody{Databases: visible})
+}
+
+func v1CreateDatabase(c *fiber.Ctx) error {
+	dbID, _, release, err := registry.Create()
+	if err != nil {
+		return fail(c, fiber.StatusInternalServerError, err.Error())
+	}
+	release()
+	return c.Status(fiber.StatusCreated).JSON(databaseBody{DBID: dbID, Collections: []string{}})
+}
+
+func v1GetDatabase(c *fiber.Ctx) error {
+	db, release, ok := v1Database(c)
+	if !ok {
+		return nil
+	}
+	defer release()
+	names, err := db.GetAllCollections()
+	if err != nil {
+		return fail(c, fiber.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(databaseBody{DBID: param(c, "db"), Collections: names})
+}
+
+func v1ListCollections(c *fiber.Ctx) error {
+	db, release, ok := v1Database(c)
+	if !ok {
+		return nil
+	}
+	defer release()
+	names, err := db.GetAllCollections()
+	if err != nil {
+		return fail(c, fiber.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(collectionsBody{Collections: names})
+}
+
+func v1CreateCollection(c *fiber.Ctx) error {
+	var body createCollectionBody
+	if err := c.BodyParser(&body); err != nil || body.Name == "" || body.Order < 3 {
+		return fail(c, fiber.StatusBadRequest, "name and order>=3 required")
+	}
+	db, release, ok := v1Database(c)
+	if !ok {
+		return nil
+	}
+	defer release()
+	if err := db.CreateCollection(body.Name, body.Order); err != nil {
+		return fail(c, fiber.StatusConflict, err.Error())
+	}
+	autoCommit.Wrote(param(c, "db"))
+	names, _ := db.GetAllCollections()
+	return c.Status(fiber.StatusCreated).JSON(collectionsBody{Collections: names})
+}
+
+// v1Mount mounts the commit named by the "at" query parameter of a key read.
+// When it reports false the error has already been written.
+func v1Mount(c *fiber.Ctx, at string) (*dbcli.Mount, bool) {
+	_, release, ok := v1Database(c)
+	if !ok {
+		return nil, false
+	}
+	release()
+	m, err := dbcli.MountCommit(basePath(param(c, "db")), at)
+	if err != nil {
+		failVCS(c, err)
+		return nil, false
+	}
+	return m, true
+}
+
+func v1ListKeys(c *fiber.Ctx) error {
+	if at := c.Query("at"); at != "" {
+		m, ok := v1Mount(c, at)
+		if !ok {
+			return nil
+		}
+		all, err := m.FindAll(param(c, "collection"))
+		if err != nil {
+			return failVCS(c, err)
+		}
+		keys := []btree.KeyValue{}
+		for _, kv := range all {
+			if strings.HasPrefix(kv.Key, c.Query("prefix")) {
+				keys = append(keys, kv)
+			}
+		}
+		return c.JSON(keysBody{Keys: keys})
+	}
+
+	coll, release, ok := v1Collection(c)
+	if !ok {
+		return nil
+	}
+	defer release()
+	prefix := c.Query("prefix")
+	keys := []btree.KeyValue{}
+	err := coll.Scan(func(kv btree.KeyValue) bool {
+		if strings.HasPrefix(kv.Key, prefix) {
+			keys = append(keys, kv)
+		}
+		return prefix == "" || kv.Key < prefix || strings.HasPrefix(kv.Key, prefix)
+	})
+	if err != nil {
+		return fail(c, fiber.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(keysBody{Keys: keys})
+}
+
+func v1GetKey(c *fiber.Ctx) error {
+	key := param(c, "key")
+	var val interface{}
+	var found bool
+	var err error
+	if at := c.Query("at"); at != "" {
+		m, ok := v1Mount(c, at)
+		if !ok {
+			return nil
+		}
+		if val, found, err = m.Find(param(c, "collection"), key); err != nil {
+			return failVCS(c, err)
+		}
+	} else {
+		coll, release, ok := v1Collection(c)
+		if !ok {
+			return nil
+		}
+		defer release()
+		val, found, err = coll.Find(key)
+	}
+	if err != nil {
+		return fail(c, fiber.StatusInternalServerError, err.Error())
+	}
+	if !found {
+		return fail(c, fiber.StatusNotFound, "key not found")
+	}
+	return c.JSON(keyBody{Key: key, Value: val})
+}
+
+func v1PutKey(c *fiber.Ctx) error {
+	var body putKeyBody
+	if err := c.BodyParser(&body); err != nil {
+		return fail(c, fiber.StatusBadRequest, "invalid json")
+	}
+	coll, release, ok := v1Collection(c)
+	if !ok {
+		return nil
+	}
+	defer release()
+	key := param(c, "key")
+	if _, err := coll.Update(key, body.Value); err != nil {
+		return fail(c, fiber.StatusInternalServerError, err.Error())
+	}
+	autoCommit.Wrote(param(c, "db"))
+	return c.JSON(keyBody{Key: key, Value: body.Value})
+}
+
+func v1DeleteKey(c *fiber.Ctx) error {
+	coll, release, ok := v1Collection(c)
+	if !ok {
+		return nil
+	}
+	defer release()
+	deleted, err := coll.Delete(param(c, "key"))
+	if err != nil {
+		return fail(c, fiber.StatusInternalServerError, err.Error())
+	}
+	if !deleted {
+		return fail(c, fiber.StatusNotFound, "key not found")
+	}
+	autoCommit.Wrote(param(c, "db"))
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func v1InitRepository(c *fiber.Ctx) error {
+	_, release, ok := v1Database(c)
+	if !ok {
+		return nil
+	}
+	release()
+	out, err := runCLI([]string{"init", param(c, "db")})
+	if err != nil {
+		return fail(c, fiber.StatusInternalServerError, err.Error())
+	}
+	return c.Status(fiber.StatusCreated).JSON(outputBody{Output: out})
+}
+
+func v1ListCommits(c *fiber.Ctx) error {
+	_, release, ok := v1Database(c)
+	if !ok {
+		return nil
+	}
+	release()
+	snapshots, err := dbcli.LoadSnapshotsFrom(basePath(param(c, "db")))
+	if err != nil {
+		return fail(c, fiber.StatusNotFound, err.Error())
+	}
+	commits := dbcli.SortSnapshots(snapshots)
+	if commits == nil {
+		commits = []dbcli.SnapshotEntry{}
+	}
+	return c.JSON(commitsBody{Commits: commits})
+}
+
+func v1CreateCommit(c *fiber.Ctx) error {
+	var body commitBody
+	if err := c.BodyParser(&body); err != nil || body.Message == "" {
+		return fail(c, fiber.StatusBadRequest, "message required")
+	}
+	_, release, ok := v1Database(c)
+	if !ok {
+		return nil
+	}
+	release()
+	dbID := param(c, "db")
+	commit, err := commitDatabase(dbID, body.Message)
+	if errors.Is(err, dbcli.ErrNoRepository) {
+		return fail(c, fiber.StatusConflict, err.Error())
+	}
+	if err != nil {
+		return fail(c, fiber.StatusInternalServerError, err.Error())
+	}
+
+	snapshots, err := dbcli.LoadSnapshotsFrom(basePath(dbID))
+	if err != nil {
+		return fail(c, fiber.StatusInternalServerError, err.Error())
+	}
+	commits := dbcli.SortSnapshots(snapshots)
+	for i := len(commits) - 1; i >= 0; i-- {
+		if commits[i].Snapshot.Commit == commit.Sha {
+			return c.Status(fiber.StatusCreated).JSON(commitCreatedBody{Commit: commits[i], Output: commit.Sha + "\n"})
+		}
+	}
+	return fail(c, fiber.StatusInternalServerError, "commit was not recorded")
+}
+
+func v1Diff(c *fiber.Ctx) error {
+	from, to := c.Query("from"), c.Query("to")
+	if from == "" || to == "" {
+		return fail(c, fiber.StatusBadRequest, "from and to required")
+	}
+	_, release, ok := v1Database(c)
+	if !ok {
+		return nil
+	}
+	release()
+	diffs, err := dbcli.DiffCommits(basePath(param(c, "db")), from, to)
+	if errors.Is(err, dbcli.ErrObjectNotFound) {
+		return fail(c, fiber.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		return fail(c, fiber.StatusBadRequest, err.Error())
+	}
+	return c.JSON(diffBody{From: from, To: to, Collections: diffs})
+}
+
+// failVCS maps a version-control error to a /v1 status.
+func failVCS(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, dbcli.ErrObjectNotFound), errors.Is(err, dbcli.ErrUnknownRevision), errors.Is(err, dbcli.ErrNoCollection):
+		return fail(c, fiber.StatusNotFound, err.Error())
+	case errors.Is(err, dbcli.ErrNoRepository):
+		return fail(c, fiber.StatusConflict, err.Error())
+	case errors.Is(err, dbcli.ErrBranchExists), errors.Is(err, dbcli.ErrLocalChanges), errors.Is(err, dbcli.ErrDatabaseExists),
+		errors.Is(err, dbcli.ErrStaleRef), errors.Is(err, dbcli.ErrNonFastForward), errors.Is(err, dbcli.ErrTagExists),
+		errors.Is(err, dbcli.ErrMergeInProgress), errors.Is(err, dbcli.ErrUnsignedCommit):
+		return fail(c, fiber.StatusConflict, err.Error())
+	}
+	return fail(c, fiber.StatusBadRequest, err.Error())
+}
+
+func v1ListBranches(c *fiber.Ctx) error {
+	_, release, ok := v1Database(c)
+	if !ok {
+		return nil
+	}
+	release()
+	branches, err := dbcli.ListBranches(basePath(param(c, "db")))
+	if err != nil {
+		return fail(c, fiber.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(branchesBody{Branches: branches})
+}
+
+func v1CreateBranch(c *fiber.Ctx) error {
+	var body createBranchBody
+	if err := c.BodyParser(&body); err != nil || body.Name == "" {
+		return fail(c, fiber.StatusBadRequest, "name required")
+	}
+	_, release, ok := v1Database(c)
+	if !ok {
+		return nil
+	}
+	release()
+	path := basePath(param(c, "db"))
+	if err := dbcli.CreateBranch(path, body.Name, body.Start); err != nil {
+		return failVCS(c, err)
+	}
+	branches, err := dbcli.ListBranches(path)
+	if err != nil {
+		return fail(c, fiber.StatusInternalServerError, err.Error())
+	}
+	return c.Status(fiber.StatusCreated).JSON(branchesBody{Branches: branches})
+}
+
+func v1DeleteBranch(c *fiber.Ctx) error {
+	_, release, ok := v1Database(c)
+	if !ok {
+		return nil
+	}
+	release()
+	if err := dbcli.DeleteBranch(basePath(param(c, "db")), param(c, "branch")); err != nil {
+		return failVCS(c, err)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// v1Checkout rewrites the database's files, so it runs through
+// registry.Replace: the shared handle is flushed and closed first, and the
+// next request loads the checked-out state.
+func v1Checkout(c *fiber.Ctx) error {
+	var body checkoutBody
+	if err := c.BodyParser(&body); err != nil || body.Target == "" {
+		return fail(c, fiber.StatusBadRequest, "target required")
+	}
+	_, release, ok := v1Database(c)
+	if !ok {
+		return nil
+	}
+	release()
+	dbID := param(c, "db")
+	if err := autoCommit.BeforeDestructive(dbID, "checkout of "+body.Target); err != nil {
+		return fail(c, fiber.StatusInternalServerError, err.Error())
+	}
+	var sha string
+	err := registry.Replace(dbID, func() error {
+		var err error
+		sha, err = dbcli.Checkout(basePath(dbID), body.Target, body.Force)
+		return err
+	})
+	if err != nil {
+		return failVCS(c, err)
+	}
+	return c.JSON(checkoutResultBody{Target: body.Target, Commit: sha})
+}
+
+func v1Restore(c *fiber.Ctx) error {
+	var body restoreBody
+	if err := c.BodyParser(&body); err != nil || body.Commit == "" {
+		return fail(c, fiber.StatusBadRequest, "commit required")
+	}
+	_, release, ok := v1Database(c)
+	if !ok {
+		return nil
+	}
+	release()
+	dbID := param(c, "db")
+	sha, err := dbcli.ResolveRevision(basePath(dbID), body.Commit)
+	if err != nil {
+		return failVCS(c, err)
+	}
+	snapshots, err := dbcli.LoadSnapshotsFrom(basePath(dbID))
+	if err != nil {
+		return fail(c, fiber.StatusNotFound, err.Error())
+	}
+	known := false
+	for _, snap := range snapshots {
+		known = known || snap.Commit == sha
+	}
+	if !known {
+		return fail(c, fiber.StatusNotFound, "commit not found in snapshots")
+	}
+	if err := autoCommit.BeforeDestructive(dbID, "restore to "+sha); err != nil {
+		return fail(c, fiber.StatusInternalServerError, err.Error())
+	}
+
+	out, err := restoreDatabase(dbID, sha)
+	if errors.Is(err, dbcli.ErrUnsignedCommit) {
+		return failVCS(c, err)
+	} else if err != nil {
+		return fail(c, fiber.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(outputBody{Output: out})
+}
+
+func v1RestoreInto(c *fiber.Ctx) error {
+	var body restoreIntoBody
+	if err := c.BodyParser(&body); err != nil || body.Commit == "" || body.Into == "" {
+		return fail(c, fiber.StatusBadRequest, "commit and into required")
+	}
+	_, release, ok := v1Database(c)
+	if !ok {
+		return nil
+	}
+	release()
+
+	if _, err := dbcli.RestoreInto(basePath(param(c, "db")), body.Commit, registry.Root(), body.Into); err != nil {
+		return failVCS(c, err)
+	}
+	db, release, err := registry.Acquire(body.Into)
+	if err != nil {
+		return fail(c, fiber.StatusInternalServerError, err.Error())
+	}
+	defer release()
+	names, err := db.GetAllCollections()
+	if err != nil {
+		return fail(c, fiber.StatusInternalServerError, err.Error())
+	}
+	return c.Status(fiber.StatusCreated).JSON(databaseBody{DBID: body.Into, Collections: names})
+}
+
+func v1Pack(c *fiber.Ctx) error {
+	_, release, ok := v1Database(c)
+	if !ok {
+		return nil
+	}
+	release()
+	out, err := runCLI([]string{"pack", param(c, "db")})
+	if err != nil {
+		return fail(c, fiber.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(outputBody{Output: out})
+}
+
+func v1ListRefs(c *fiber.Ctx) error {
+	_, release, ok := v1Database(c)
+	if !ok {
+		return nil
+	}
+	release()
+	refs, err := dbcli.ListRefs(basePath(param(c, "db")))
+	if err != nil {
+		return failVCS(c, err)
+	}
+	return c.JSON(refs)
+}
+
+func v1FetchPack(c *fiber.Ctx) error {
+	var body fetchPackBody
+	if err := c.BodyParser(&body); err != nil || len(body.Want) == 0 {
+		return fail(c, fiber.StatusBadRequest, "want required")
+	}
+	_, release, ok := v1Database(c)
+	if !ok {
+		return nil
+	}
+	release()
+	bundle, _, err := dbcli.PackObjects(basePath(param(c, "db")), body.Want, body.Have)
+	if err != nil {
+		return failVCS(c, err)
+	}
+	c.Set(fiber.HeaderContentType, fiber.MIMEOctetStream)
+	return c.Send(bundle)
+}
+
+func v1ReceivePack(c *fiber.Ctx) error {
+	_, release, ok := v1Database(c)
+	if !ok {
+		return nil
+	}
+	release()
+	n, err := dbcli.ReceivePack(basePath(param(c, "db")), c.Body())
+	if err != nil {
+		return failVCS(c, err)
+	}
+	return c.JSON(receivePackResultBody{Objects: n})
+}
+
+// v1UpdateRef may rewrite the database's files when the pushed branch is
+// checked out, in which case the shared handle is dropped like on checkout.
+func v1UpdateRef(c *fiber.Ctx) error {
+	var body dbcli.RefUpdate
+	if err := c.BodyParser(&body); err != nil || body.Ref == "" || body.New == "" {
+		return fail(c, fiber.StatusBadRequest, "ref and new required")
+	}
+	_, release, ok := v1Database(c)
+	if !ok {
+		return nil
+	}
+	release()
+	dbID := param(c, "db")
+	update := func() (*dbcli.RefUpdateResult, error) {
+		return dbcli.UpdateRef(basePath(dbID), body)
+	}
+	var res *dbcli.RefUpdateResult
+	var err error
+	if current, _ := dbcli.IsCheckedOut(basePath(dbID), body.Ref); current {
+		// Moving the checked-out branch rewrites the working tree, and its
+		// check for uncommitted changes must see the flushed data.
+		err = registry.Replace(dbID, func() error {
+			res, err = update()
+			return err
+		})
+	} else {
+		res, err = update()
+	}
+	if err != nil {
+		return failVCS(c, err)
+	}
+	return c.JSON(res)
+}
+
+// v1Backup writes the archive to a temporary file while writes are held off
+// and streams it from there, so a slow download does not stall writers.
+func v1Backup(c *fiber.Ctx) error {
+	db, release, ok := v1Database(c)
+	if !ok {
+		return nil
+	}
+	defer release()
+
+	f, err := os.CreateTemp("", "nutella-backup-*.tar.gz")
+	if err != nil {
+		return fail(c, fiber.StatusInternalServerError, err.Error())
+	}
+	os.Remove(f.Name())
+	info, err := db.Backup(f)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return fail(c, fiber.StatusInternalServerError, err.Error())
+	}
+	c.Set(fiber.HeaderContentType, fiber.MIMEOctetStream)
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", info.DBID+".tar.gz"))
+	return c.SendStream(f)
+}
+
+// exportContentTypes maps export formats to the media type of the response.
+var exportContentTypes = map[string]string{
+	database.FormatNDJSON: "application/x-ndjson",
+	database.FormatCSV:    "text/csv; charset=utf-8",
+	database.FormatJSON:   fiber.MIMEApplicationJSON,
+}
+
+// v1Export streams the export once the handler has returned, so it copies
+// the request values it needs and releases the database when done.
+func v1Export(c *fiber.Ctx) error {
+	format := strings.Clone(c.Query("format", database.FormatNDJSON))
+	if err := database.ValidFormat(format); err != nil {
+		return fail(c, fiber.StatusBadRequest, err.Error())
+	}
+	db, release, ok := v1Database(c)
+	if !ok {
+		return nil
+	}
+	var collections []string
+	if name := strings.Clone(param(c, "collection")); name != "" {
+		if _, err := db.GetCollection(name); err != nil {
+			release()
+			return fail(c, fiber.StatusNotFound, err.Error())
+		}
+		collections = []string{name}
+	}
+	opts := database.ExportOptions{
+		Format:      format,
+		KeyColumn:   strings.Clone(c.Query("key")),
+		ValueColumn: strings.Clone(c.Query("value")),
+	}
+
+	c.Set(fiber.HeaderContentType, exportContentTypes[format])
+	// The export runs as the response body is read. A pipe rather than a
+	// stream writer lets a failure reach fasthttp, which then drops the
+	// connection before the final chunk, so the client sees a broken
+	// transfer instead of a shorter export. NDJSON also gets an error record.
+	pr, pw := io.Pipe()
+	go func() {
+		defer release()
+		_, err := db.Export(pw, collections, opts)
+		if err != nil && format == database.FormatNDJSON {
+			record, _ := json.Marshal(map[string]string{"error": err.Error()})
+			pw.Write(append(record, '\n'))
+		}
+		pw.CloseWithError(err)
+	}()
+	c.Context().SetBodyStream(pr, -1)
+	return nil
+}
+
+// v1Import reads the body as it arrives when the server streams large
+// request bodies.
+func v1Import(c *fiber.Ctx) error {
+	format := c.Query("format", database.FormatNDJSON)
+	if err := database.ValidFormat(format); err != nil {
+		return fail(c, fiber.StatusBadRequest, err.Error())
+	}
+	skip := c.QueryInt("skip", 0)
+	if skip < 0 {
+		return fail(c, fiber.StatusBadRequest, "skip must not be negative")
+	}
+	coll, release, ok := v1Collection(c)
+	if !ok {
+		return nil
+	}
+	defer release()
+
+	body := c.Context().RequestBodyStream()
+	if body == nil {
+		body = bytes.NewReader(c.Body())
+	}
+	res, err := coll.Import(body, database.ImportOptions{
+		Format:      format,
+		KeyColumn:   c.Query("key"),
+		ValueColumn: c.Query("value"),
+		Skip:        skip,
+	})
+	if err != nil {
+		done := res.Skipped + res.Imported
+		return fail(c, fiber.StatusBadRequest, fmt.Sprintf("%v; %d records are in, retry with skip=%d", err, done, done))
+	}
+	return c.JSON(res)
+}
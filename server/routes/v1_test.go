@@ -0,0 +1,572 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"db/client"
+	"db/database"
+	"db/dbcli"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// initCLI registers the dbcli commands that runCLI dispatches to, once per
+// test binary as main does once per process.
+var initCLI sync.Once
+
+// newTestApp serves the routes from a temporary working directory, since
+// databases live under ./files.
+func newTestApp(t *testing.T) *fiber.App {
+	t.Helper()
+	initCLI.Do(dbcli.Init)
+
+	originalDir, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get current directory: %v", err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatalf("Failed to change directory: %v", err)
+	}
+	t.Cleanup(func() {
+		CloseDatabases()
+		os.Chdir(originalDir)
+	})
+	UseRegistry(database.NewRegistry("files", 0))
+
+	app := fiber.New()
+	SetupRoutes(app)
+	return app
+}
+
+func call(t *testing.T, app *fiber.App, method, target, body string) (int, map[string]interface{}) {
+	t.Helper()
+
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, target, reader)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, target, err)
+	}
+	defer resp.Body.Close()
+
+	var out map[string]interface{}
+	data, _ := io.ReadAll(resp.Body)
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &out); err != nil {
+			t.Fatalf("%s %s returned invalid json %q: %v", method, target, data, err)
+		}
+	}
+	return resp.StatusCode, out
+}
+
+// TestV1KeyLifecycle walks a key through create, read, replace and delete and
+// checks the error envelope on the way.
+func TestV1KeyLifecycle(t *testing.T) {
+	app := newTestApp(t)
+
+	status, out := call(t, app, http.MethodPost, "/v1/dbs", "")
+	if status != http.StatusCreated {
+		t.Fatalf("POST /v1/dbs = %d %v; want 201", status, out)
+	}
+	db := out["dbID"].(string)
+	keys := "/v1/dbs/" + db + "/collections/fruits/keys"
+
+	if status, out = call(t, app, http.MethodPost, "/v1/dbs/"+db+"/collections", `{"name":"fruits","order":3}`); status != http.StatusCreated {
+		t.Fatalf("create collection = %d %v; want 201", status, out)
+	}
+	if status, out = call(t, app, http.MethodPut, keys+"/apple", `{"value":"red"}`); status != http.StatusOK {
+		t.Fatalf("PUT key = %d %v; want 200", status, out)
+	}
+	if status, out = call(t, app, http.MethodGet, keys+"/apple", ""); status != http.StatusOK || out["value"] != "red" {
+		t.Errorf("GET key = %d %v; want red", status, out)
+	}
+	if status, _ = call(t, app, http.MethodDelete, keys+"/apple", ""); status != http.StatusNoContent {
+		t.Errorf("DELETE key = %d; want 204", status)
+	}
+
+	status, out = call(t, app, http.MethodGet, keys+"/apple", "")
+	envelope, _ := out["error"].(map[string]interface{})
+	if status != http.StatusNotFound || envelope["code"] != "not_found" {
+		t.Errorf("GET deleted key = %d %v; want not_found envelope", status, out)
+	}
+
+	if status, out = call(t, app, http.MethodGet, "/find-all?collection=fruits", ""); status != http.StatusBadRequest {
+		t.Errorf("legacy /find-all without dbID = %d %v; want 400", status, out)
+	}
+}
+
+// TestV1OpenAPI checks that every registered endpoint shows up in the spec.
+func TestV1OpenAPI(t *testing.T) {
+	app := newTestApp(t)
+
+	status, out := call(t, app, http.MethodGet, "/v1/openapi.json", "")
+	if status != http.StatusOK {
+		t.Fatalf("GET /v1/openapi.json = %d", status)
+	}
+	paths := out["paths"].(map[string]interface{})
+	for _, ep := range v1Endpoints() {
+		path := "/v1" + pathParamPattern.ReplaceAllString(ep.Path, "{$1}")
+		item, ok := paths[path].(map[string]interface{})
+		if !ok || item[strings.ToLower(ep.Method)] == nil {
+			t.Errorf("spec is missing %s %s", ep.Method, path)
+		}
+	}
+}
+
+// TestV1BranchCheckout switches a database between branches and checks that
+// the server serves the checked-out state rather than a stale open handle.
+func TestV1BranchCheckout(t *testing.T) {
+	app := newTestApp(t)
+
+	_, out := call(t, app, http.MethodPost, "/v1/dbs", "")
+	db := out["dbID"].(string)
+	base := "/v1/dbs/" + db
+	keys := base + "/collections/fruits/keys"
+	call(t, app, http.MethodPost, base+"/collections", `{"name":"fruits","order":3}`)
+	call(t, app, http.MethodPut, keys+"/apple", `{"value":"red"}`)
+
+	if status, out := call(t, app, http.MethodPost, base+"/repository", ""); status != http.StatusCreated {
+		t.Fatalf("init = %d %v; want 201", status, out)
+	}
+	if status, out := call(t, app, http.MethodPost, base+"/commits", `{"message":"apple"}`); status != http.StatusCreated {
+		t.Fatalf("commit = %d %v; want 201", status, out)
+	}
+	if status, out := call(t, app, http.MethodPost, base+"/branches", `{"name":"exp"}`); status != http.StatusCreated {
+		t.Fatalf("create branch = %d %v; want 201", status, out)
+	}
+	if status, out := call(t, app, http.MethodPost, base+"/branches", `{"name":"exp"}`); status != http.StatusConflict {
+		t.Errorf("create existing branch = %d %v; want 409", status, out)
+	}
+	if status, out := call(t, app, http.MethodPost, base+"/checkout", `{"target":"exp"}`); status != http.StatusOK {
+		t.Fatalf("checkout exp = %d %v; want 200", status, out)
+	}
+
+	call(t, app, http.MethodPut, keys+"/banana", `{"value":"yellow"}`)
+	if status, out := call(t, app, http.MethodPost, base+"/checkout", `{"target":"main"}`); status != http.StatusConflict {
+		t.Errorf("checkout with local changes = %d %v; want 409", status, out)
+	}
+	call(t, app, http.MethodPost, base+"/commits", `{"message":"banana"}`)
+	if status, out := call(t, app, http.MethodPost, base+"/checkout", `{"target":"main"}`); status != http.StatusOK {
+		t.Fatalf("checkout main = %d %v; want 200", status, out)
+	}
+	if status, out := call(t, app, http.MethodGet, keys+"/banana", ""); status != http.StatusNotFound {
+		t.Errorf("GET banana on main = %d %v; want 404", status, out)
+	}
+
+	_, out = call(t, app, http.MethodGet, base+"/branches", "")
+	branches, _ := out["branches"].([]interface{})
+	if len(branches) != 2 {
+		t.Fatalf("branches = %v; want exp and main", out)
+	}
+	if main := branches[1].(map[string]interface{}); main["name"] != "main" || main["current"] != true {
+		t.Errorf("branches = %v; want main current", branches)
+	}
+	if status, _ := call(t, app, http.MethodDelete, base+"/branches/main", ""); status != http.StatusBadRequest {
+		t.Errorf("deleting the current branch = %d; want 400", status)
+	}
+	if status, _ := call(t, app, http.MethodDelete, base+"/branches/exp", ""); status != http.StatusNoContent {
+		t.Errorf("DELETE branch = %d; want 204", status)
+	}
+}
+
+func TestV1RestoreIntoAndReadAt(t *testing.T) {
+	app := newTestApp(t)
+
+	_, out := call(t, app, http.MethodPost, "/v1/dbs", "")
+	db := out["dbID"].(string)
+	base := "/v1/dbs/" + db
+	keys := base + "/collections/fruits/keys"
+	call(t, app, http.MethodPost, base+"/collections", `{"name":"fruits","order":3}`)
+	call(t, app, http.MethodPut, keys+"/apple", `{"value":"red"}`)
+	call(t, app, http.MethodPost, base+"/repository", "")
+	if status, out := call(t, app, http.MethodPost, base+"/commits", `{"message":"apple"}`); status != http.StatusCreated {
+		t.Fatalf("commit = %d %v; want 201", status, out)
+	}
+	call(t, app, http.MethodPut, keys+"/apple", `{"value":"green"}`)
+
+	if status, out := call(t, app, http.MethodGet, keys+"/apple?at=main", ""); status != http.StatusOK || out["value"] != "red" {
+		t.Errorf("GET apple at main = %d %v; want red", status, out)
+	}
+	if status, out := call(t, app, http.MethodGet, keys+"?at=main", ""); status != http.StatusOK || len(out["keys"].([]interface{})) != 1 {
+		t.Errorf("GET keys at main = %d %v; want one key", status, out)
+	}
+	if status, _ := call(t, app, http.MethodGet, keys+"/apple?at=nope", ""); status != http.StatusNotFound {
+		t.Errorf("GET at unknown revision = %d; want 404", status)
+	}
+	if status, _ := call(t, app, http.MethodGet, base+"/collections/veg/keys?at=main", ""); status != http.StatusNotFound {
+		t.Errorf("GET missing collection at main = %d; want 404", status)
+	}
+
+	status, out := call(t, app, http.MethodPost, base+"/restore-into", `{"commit":"main","into":"db_copy"}`)
+	if status != http.StatusCreated || out["dbID"] != "db_copy" {
+		t.Fatalf("restore-into = %d %v; want 201 db_copy", status, out)
+	}
+	if status, _ := call(t, app, http.MethodPost, base+"/restore-into", `{"commit":"main","into":"db_copy"}`); status != http.StatusConflict {
+		t.Errorf("restore-into an existing database = %d; want 409", status)
+	}
+	if _, out := call(t, app, http.MethodGet, "/v1/dbs/db_copy/collections/fruits/keys/apple", ""); out["value"] != "red" {
+		t.Errorf("restored apple = %v; want red", out)
+	}
+	if _, out := call(t, app, http.MethodGet, keys+"/apple", ""); out["value"] != "green" {
+		t.Errorf("live apple = %v; want green after restore-into", out)
+	}
+
+	if status, _ := call(t, app, http.MethodPost, "/restore", `{"dbID":"`+db+`"}`); status != http.StatusBadRequest {
+		t.Errorf("legacy /restore without a commit = %d; want 400 instead of prompting", status)
+	}
+
+	if _, err := dbcli.CreateTag(basePath(db), "good", "main", "", dbcli.Signature{}); err != nil {
+		t.Fatalf("Failed to tag: %v", err)
+	}
+	if status, _ := call(t, app, http.MethodPost, "/restore-to", `{"dbID":"`+db+`","commit_hash":"nope"}`); status != http.StatusNotFound {
+		t.Errorf("restore-to an unknown revision = %d; want 404", status)
+	}
+	if status, out := call(t, app, http.MethodPost, "/restore-to", `{"dbID":"`+db+`","commit_hash":"good"}`); status != http.StatusOK {
+		t.Fatalf("restore-to a tag = %d %v; want 200", status, out)
+	}
+	if _, out := call(t, app, http.MethodGet, keys+"/apple", ""); out["value"] != "red" {
+		t.Errorf("apple after restoring tag good = %v; want red", out)
+	}
+}
+
+// TestV1RestoreRefusesUnsignedCommit restores an unsigned commit into a
+// database that requires signatures and checks that the refusal is a 409
+// and that the server goes on serving requests.
+func TestV1RestoreRefusesUnsignedCommit(t *testing.T) {
+	app := newTestApp(t)
+
+	_, out := call(t, app, http.MethodPost, "/v1/dbs", "")
+	db := out["dbID"].(string)
+	base := "/v1/dbs/" + db
+	keys := base + "/collections/fruits/keys"
+	call(t, app, http.MethodPost, base+"/collections", `{"name":"fruits","order":3}`)
+	call(t, app, http.MethodPut, keys+"/apple", `{"value":"red"}`)
+	call(t, app, http.MethodPost, base+"/repository", "")
+	status, out := call(t, app, http.MethodPost, base+"/commits", `{"message":"apple"}`)
+	if status != http.StatusCreated {
+		t.Fatalf("commit = %d %v; want 201", status, out)
+	}
+	sha, err := dbcli.ResolveRevision(basePath(db), "main")
+	if err != nil {
+		t.Fatalf("Failed to resolve main: %v", err)
+	}
+	call(t, app, http.MethodPut, keys+"/apple", `{"value":"green"}`)
+	if err := dbcli.RequireSigned(basePath(db), true); err != nil {
+		t.Fatalf("Failed to require signatures: %v", err)
+	}
+
+	if status, out := call(t, app, http.MethodPost, base+"/restore", `{"commit":"`+sha+`"}`); status != http.StatusConflict {
+		t.Errorf("restore of an unsigned commit = %d %v; want 409", status, out)
+	}
+	if status, out := call(t, app, http.MethodPost, "/restore-to", `{"dbID":"`+db+`","commit_hash":"`+sha+`"}`); status != http.StatusConflict {
+		t.Errorf("legacy restore-to of an unsigned commit = %d %v; want 409", status, out)
+	}
+	if status, out := call(t, app, http.MethodGet, keys+"/apple", ""); status != http.StatusOK || out["value"] != "green" {
+		t.Errorf("apple after the refused restores = %d %v; want green", status, out)
+	}
+}
+
+// listen serves app on a random local port and returns its base URL.
+func listen(t *testing.T, app *fiber.App) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go app.Listener(ln)
+	t.Cleanup(func() { app.Shutdown() })
+	return "http://" + ln.Addr().String()
+}
+
+// editLocal writes key in collection fruits of the database at dir and
+// commits it, as the CLI would on a second server.
+func editLocal(t *testing.T, dir, key, value string) {
+	t.Helper()
+	db, err := database.LoadDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to load %s: %v", dir, err)
+	}
+	coll, err := db.GetCollection("fruits")
+	if err != nil {
+		t.Fatalf("Failed to get fruits: %v", err)
+	}
+	if ok, err := coll.Update(key, value); err != nil {
+		t.Fatalf("Failed to update %s: %v", key, err)
+	} else if !ok {
+		if err := coll.Insert(key, value); err != nil {
+			t.Fatalf("Failed to insert %s: %v", key, err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close %s: %v", dir, err)
+	}
+	if _, err := dbcli.CommitWorkingTree(dir, key, dbcli.Signature{}, nil); err != nil {
+		t.Fatalf("Failed to commit %s: %v", key, err)
+	}
+}
+
+func localValue(t *testing.T, dir, key string) interface{} {
+	t.Helper()
+	db, err := database.LoadDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to load %s: %v", dir, err)
+	}
+	defer db.Close()
+	coll, err := db.GetCollection("fruits")
+	if err != nil {
+		t.Fatalf("Failed to get fruits: %v", err)
+	}
+	v, _, err := coll.Find(key)
+	if err != nil {
+		t.Fatalf("Failed to find %s: %v", key, err)
+	}
+	return v
+}
+
+// TestV1PushFetchClone syncs history between the server and a second data
+// root driven through the same functions as the CLI's clone, pull and push.
+func TestV1PushFetchClone(t *testing.T) {
+	app := newTestApp(t)
+	url := listen(t, app)
+
+	_, out := call(t, app, http.MethodPost, "/v1/dbs", "")
+	prod := out["dbID"].(string)
+	base := "/v1/dbs/" + prod
+	keys := base + "/collections/fruits/keys"
+	call(t, app, http.MethodPost, base+"/collections", `{"name":"fruits","order":3}`)
+	call(t, app, http.MethodPut, keys+"/apple", `{"value":"red"}`)
+	call(t, app, http.MethodPost, base+"/repository", "")
+	if status, out := call(t, app, http.MethodPost, base+"/commits", `{"message":"apple"}`); status != http.StatusCreated {
+		t.Fatalf("commit = %d %v; want 201", status, out)
+	}
+
+	root := t.TempDir()
+	staging := filepath.Join(root, "staging")
+	if sha, err := dbcli.Clone(url, prod, root, "staging", ""); err != nil || sha == "" {
+		t.Fatalf("Clone = %q, %v; want the main commit", sha, err)
+	}
+	if v := localValue(t, staging, "apple"); v != "red" {
+		t.Errorf("cloned apple = %v; want red", v)
+	}
+	if _, err := dbcli.Clone(url, prod, root, "staging", ""); !errors.Is(err, dbcli.ErrDatabaseExists) {
+		t.Errorf("Clone over an existing database = %v; want ErrDatabaseExists", err)
+	}
+
+	call(t, app, http.MethodPut, keys+"/banana", `{"value":"yellow"}`)
+	call(t, app, http.MethodPost, base+"/commits", `{"message":"banana"}`)
+	res, changes, err := dbcli.Pull(staging, "origin", "", "")
+	if err != nil || !res.FastForward || len(changes) != 1 || changes[0].Ref != "refs/remotes/origin/main" {
+		t.Fatalf("Pull = %+v, %+v, %v; want a fast-forward of origin/main", res, changes, err)
+	}
+	if v := localValue(t, staging, "banana"); v != "yellow" {
+		t.Errorf("pulled banana = %v; want yellow", v)
+	}
+	if changes, err := dbcli.Fetch(staging, "origin", ""); err != nil || len(changes) != 0 {
+		t.Errorf("Fetch when up to date = %+v, %v; want no changes", changes, err)
+	}
+
+	editLocal(t, staging, "cherry", "dark red")
+	if changes, err := dbcli.Push(staging, "origin", nil, false, ""); err != nil || len(changes) != 1 {
+		t.Fatalf("Push = %+v, %v; want main moved", changes, err)
+	}
+	if _, out := call(t, app, http.MethodGet, keys+"/cherry", ""); out["value"] != "dark red" {
+		t.Errorf("pushed cherry on the server = %v; want dark red", out)
+	}
+	_, out = call(t, app, http.MethodGet, base+"/commits", "")
+	if commits := out["commits"].([]interface{}); len(commits) != 3 {
+		t.Errorf("server commits after push = %d; want 3", len(commits))
+	}
+
+	// Both sides move on: the push must be refused until it is merged.
+	call(t, app, http.MethodPut, keys+"/date", `{"value":"brown"}`)
+	call(t, app, http.MethodPost, base+"/commits", `{"message":"date"}`)
+	editLocal(t, staging, "elder", "black")
+	_, err = dbcli.Push(staging, "origin", nil, false, "")
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusConflict {
+		t.Fatalf("non-fast-forward Push = %v; want 409", err)
+	}
+	if res, _, err := dbcli.Pull(staging, "origin", "", ""); err != nil || res.FastForward || res.Changed != 1 || len(res.Conflicts) != 0 {
+		t.Fatalf("Pull of diverged history = %+v, %v; want one merged key", res, err)
+	}
+	if _, err := dbcli.CommitWorkingTree(staging, "merge", dbcli.Signature{}, nil); err != nil {
+		t.Fatalf("Failed to commit merge: %v", err)
+	}
+	if _, err := dbcli.Push(staging, "origin", nil, false, ""); err != nil {
+		t.Fatalf("Push after merging = %v", err)
+	}
+	for key, want := range map[string]string{"date": "brown", "elder": "black"} {
+		if _, out := call(t, app, http.MethodGet, keys+"/"+key, ""); out["value"] != want {
+			t.Errorf("%s on the server = %v; want %s", key, out, want)
+		}
+	}
+
+	// A pushed branch needs uncommitted server data to be committed first.
+	call(t, app, http.MethodPut, keys+"/fig", `{"value":"purple"}`)
+	editLocal(t, staging, "grape", "green")
+	if _, err := dbcli.Push(staging, "origin", nil, false, ""); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusConflict {
+		t.Errorf("Push over uncommitted server data = %v; want 409", err)
+	}
+
+	// An empty database takes the whole history as an off-box copy.
+	_, out = call(t, app, http.MethodPost, "/v1/dbs", "")
+	backup := out["dbID"].(string)
+	call(t, app, http.MethodPost, "/v1/dbs/"+backup+"/repository", "")
+	if err := dbcli.AddRemote(staging, "backup", url, backup); err != nil {
+		t.Fatalf("Failed to add remote: %v", err)
+	}
+	if _, err := dbcli.Push(staging, "backup", nil, false, ""); err != nil {
+		t.Fatalf("Push to an empty database = %v", err)
+	}
+	if _, out := call(t, app, http.MethodGet, "/v1/dbs/"+backup+"/collections/fruits/keys/grape", ""); out["value"] != "green" {
+		t.Errorf("grape in the backup = %v; want green", out)
+	}
+}
+
+// TestV1Backup downloads a backup of a database the server has open and
+// restores it next to the original.
+func TestV1Backup(t *testing.T) {
+	app := newTestApp(t)
+
+	_, out := call(t, app, http.MethodPost, "/v1/dbs", "")
+	db := out["dbID"].(string)
+	base := "/v1/dbs/" + db
+	call(t, app, http.MethodPost, base+"/collections", `{"name":"fruits","order":3}`)
+	call(t, app, http.MethodPut, base+"/collections/fruits/keys/apple", `{"value":"red"}`)
+
+	c := client.New(listen(t, app))
+	archive, err := c.Backup(context.Background(), db)
+	if err != nil {
+		t.Fatalf("Backup = %v", err)
+	}
+	if _, err := c.Backup(context.Background(), "db_missing"); err == nil {
+		t.Errorf("Backup of a missing database succeeded")
+	}
+
+	res, err := database.RestoreBackup(bytes.NewReader(archive), "files", "db_restored", database.RestoreOptions{})
+	if err != nil {
+		t.Fatalf("RestoreBackup = %v", err)
+	}
+	if res.Backup.DBID != db {
+		t.Errorf("backup names %s; want %s", res.Backup.DBID, db)
+	}
+	if _, out := call(t, app, http.MethodGet, "/v1/dbs/db_restored/collections/fruits/keys/apple", ""); out["value"] != "red" {
+		t.Errorf("restored apple = %v; want red", out)
+	}
+}
+
+// TestV1ExportImport streams a collection out and into another collection,
+// and resumes an import that failed part-way.
+func TestV1ExportImport(t *testing.T) {
+	app := newTestApp(t)
+
+	_, out := call(t, app, http.MethodPost, "/v1/dbs", "")
+	db := out["dbID"].(string)
+	base := "/v1/dbs/" + db
+	call(t, app, http.MethodPost, base+"/collections", `{"name":"fruits","order":3}`)
+	call(t, app, http.MethodPost, base+"/collections", `{"name":"copy","order":3}`)
+	call(t, app, http.MethodPut, base+"/collections/fruits/keys/apple", `{"value":"red"}`)
+	call(t, app, http.MethodPut, base+"/collections/fruits/keys/banana", `{"value":"yellow"}`)
+
+	c := client.New(listen(t, app))
+	ctx := context.Background()
+	csv, err := c.Export(ctx, db, "fruits", client.TransferOptions{Format: "csv", KeyColumn: "name"})
+	if err != nil || string(csv) != "name,value\napple,red\nbanana,yellow\n" {
+		t.Fatalf("Export = %q, %v", csv, err)
+	}
+	if _, err := c.Export(ctx, db, "", client.TransferOptions{Format: "xml"}); err == nil {
+		t.Errorf("Export in an unknown format succeeded")
+	}
+	if _, err := c.Export(ctx, db, "nope", client.TransferOptions{}); !client.IsNotFound(err) {
+		t.Errorf("Export of a missing collection = %v; want not found", err)
+	}
+
+	res, err := c.Import(ctx, db, "copy", csv, client.TransferOptions{Format: "csv", KeyColumn: "name"})
+	if err != nil || res.Imported != 2 {
+		t.Fatalf("Import = %+v, %v; want 2 imported", res, err)
+	}
+	if _, out := call(t, app, http.MethodGet, base+"/collections/copy/keys/banana", ""); out["value"] != "yellow" {
+		t.Errorf("imported banana = %v; want yellow", out)
+	}
+
+	broken := []byte("{\"key\":\"cherry\",\"value\":\"dark\"}\n{\"key\":\n")
+	if _, err := c.Import(ctx, db, "copy", broken, client.TransferOptions{}); err == nil || !strings.Contains(err.Error(), "skip=1") {
+		t.Errorf("Import of a cut-short body = %v; want a hint to retry with skip=1", err)
+	}
+	all, err := c.Export(ctx, db, "", client.TransferOptions{})
+	if err != nil || strings.Count(string(all), "\n") != 5 || !strings.Contains(string(all), `{"collection":"copy","key":"cherry","value":"dark"}`) {
+		t.Errorf("whole database export = %q, %v; want five records including cherry", all, err)
+	}
+}
+
+// TestV1ExportFailureIsDetectable breaks a whole-database export after the
+// status has gone out and checks that the client cannot mistake what it got
+// for a complete export.
+func TestV1ExportFailureIsDetectable(t *testing.T) {
+	app := newTestApp(t)
+
+	_, out := call(t, app, http.MethodPost, "/v1/dbs", "")
+	db := out["dbID"].(string)
+	base := "/v1/dbs/" + db
+	call(t, app, http.MethodPost, base+"/collections", `{"name":"fruits","order":3}`)
+	call(t, app, http.MethodPut, base+"/collections/fruits/keys/apple", `{"value":"red"}`)
+
+	// A manifest entry without pages fails only once the export is streaming.
+	manifest := filepath.Join(basePath(db), "manifest.json")
+	data, err := os.ReadFile(manifest)
+	if err != nil {
+		t.Fatalf("Failed to read manifest: %v", err)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatalf("Failed to parse manifest: %v", err)
+	}
+	m["collections"].(map[string]interface{})["missing"] = "missing"
+	if data, err = json.Marshal(m); err != nil {
+		t.Fatalf("Failed to encode manifest: %v", err)
+	}
+	if err := os.WriteFile(manifest, data, 0644); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+
+	// NDJSON carries the error in the stream; every format ends in a broken
+	// transfer, here before a single byte of CSV was sent.
+	url := listen(t, app)
+	resp, err := http.Get(url + base + "/export")
+	if err != nil {
+		t.Fatalf("GET export: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err == nil || !strings.Contains(string(body), `{"error":`) {
+		t.Errorf("ndjson export = %q, %v; want an error record and a broken body", body, err)
+	}
+	if resp, err := http.Get(url + base + "/export?format=csv"); err == nil {
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil {
+			t.Errorf("csv export = %d %q; want a broken transfer", resp.StatusCode, body)
+		}
+	}
+
+	c := client.New(url, client.WithRetries(0, 0))
+	if out, err := c.Export(context.Background(), db, "", client.TransferOptions{}); err == nil {
+		t.Errorf("client Export = %q; want an error", out)
+	}
+}
@@ -1,22 +1,253 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"db/auth"
+	"db/database"
+	"db/dbcli"
 	routes "db/server/routes"
+	"errors"
+	"fmt"
 	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
+	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/spf13/cobra"
 )
 
-func Server(cmd *cobra.Command) {
-	app := fiber.New()
+// Config controls how the server listens.
+type Config struct {
+	Addr            string                 // TCP address, ignored when UnixSocket is set
+	UnixSocket      string                 // path of a Unix domain socket to listen on
+	TLSCert         string                 // PEM certificate; enables TLS together with TLSKey
+	TLSKey          string                 // PEM private key
+	ClientCA        string                 // PEM CA bundle; when set, clients must present a certificate it signed
+	ShutdownTimeout time.Duration          // how long to wait for in-flight requests on shutdown
+	IdleTimeout     time.Duration          // close databases unused for this long; 0 keeps them open
+	AutoCommit      dbcli.AutoCommitPolicy // when the server commits databases on its own
+}
+
+// RegisterFlags adds the listener flags to cmd.
+func RegisterFlags(cmd *cobra.Command) {
+	cmd.Flags().String("addr", ":3000", "TCP address to listen on")
+	cmd.Flags().String("unix", "", "Listen on this Unix domain socket instead of TCP")
+	cmd.Flags().String("tls-cert", "", "TLS certificate file (PEM)")
+	cmd.Flags().String("tls-key", "", "TLS private key file (PEM)")
+	cmd.Flags().String("tls-client-ca", "", "Require client certificates signed by this CA (PEM)")
+	cmd.Flags().Duration("shutdown-timeout", 30*time.Second, "How long to drain in-flight requests on shutdown")
+	cmd.Flags().Duration("idle-timeout", 10*time.Minute, "Close databases that have not been used for this long (0 disables)")
+	cmd.Flags().Duration("autocommit-interval", 0, "Commit databases written to since their last auto-commit this often (0 disables)")
+	cmd.Flags().Int("autocommit-writes", 0, "Commit a database after this many writes (0 disables)")
+	cmd.Flags().Bool("autocommit-before-destructive", false, "Commit a database before a restore or checkout replaces it")
+	cmd.Flags().Int("keep-hourly", 24, "Auto-commit snapshots to keep, one per hour")
+	cmd.Flags().Int("keep-daily", 7, "Auto-commit snapshots to keep, one per day")
+	cmd.Flags().Int("keep-weekly", 4, "Auto-commit snapshots to keep, one per week")
+}
+
+func configFromFlags(cmd *cobra.Command) Config {
+	cfg := Config{Addr: ":3000", ShutdownTimeout: 30 * time.Second, IdleTimeout: 10 * time.Minute}
+	flags := cmd.Flags()
+	if v, err := flags.GetString("addr"); err == nil {
+		cfg.Addr = v
+	}
+	if v, err := flags.GetString("unix"); err == nil {
+		cfg.UnixSocket = v
+	}
+	if v, err := flags.GetString("tls-cert"); err == nil {
+		cfg.TLSCert = v
+	}
+	if v, err := flags.GetString("tls-key"); err == nil {
+		cfg.TLSKey = v
+	}
+	if v, err := flags.GetString("tls-client-ca"); err == nil {
+		cfg.ClientCA = v
+	}
+	if v, err := flags.GetDuration("shutdown-timeout"); err == nil {
+		cfg.ShutdownTimeout = v
+	}
+	if v, err := flags.GetDuration("idle-timeout"); err == nil {
+		cfg.IdleTimeout = v
+	}
+	if v, err := flags.GetDuration("autocommit-interval"); err == nil {
+		cfg.AutoCommit.Interval = v
+	}
+	if v, err := flags.GetInt("autocommit-writes"); err == nil {
+		cfg.AutoCommit.Writes = v
+	}
+	if v, err := flags.GetBool("autocommit-before-destructive"); err == nil {
+		cfg.AutoCommit.BeforeDestructive = v
+	}
+	if v, err := flags.GetInt("keep-hourly"); err == nil {
+		cfg.AutoCommit.Retention.Hourly = v
+	}
+	if v, err := flags.GetInt("keep-daily"); err == nil {
+		cfg.AutoCommit.Retention.Daily = v
+	}
+	if v, err := flags.GetInt("keep-weekly"); err == nil {
+		cfg.AutoCommit.Retention.Weekly = v
+	}
+	return cfg
+}
+
+// Listen opens the listener described by cfg, wrapping it in TLS when a
+// certificate is configured.
+func Listen(cfg Config) (net.Listener, error) {
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return nil, errors.New("--tls-cert and --tls-key must be given together")
+	}
+	if cfg.ClientCA != "" && cfg.TLSCert == "" {
+		return nil, errors.New("--tls-client-ca requires --tls-cert and --tls-key")
+	}
+
+	var ln net.Listener
+	var err error
+	if cfg.UnixSocket != "" {
+		// A socket left behind by a previous run would make Listen fail.
+		if err := os.Remove(cfg.UnixSocket); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to remove stale socket: %v", err)
+		}
+		ln, err = net.Listen("unix", cfg.UnixSocket)
+	} else {
+		ln, err = net.Listen("tcp", cfg.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.TLSCert == "" {
+		return ln, nil
+	}
+	tlsConfig, err := tlsConfig(cfg)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return tls.NewListener(ln, tlsConfig), nil
+}
+
+func tlsConfig(cfg Config) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS key pair: %v", err)
+	}
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cfg.ClientCA != "" {
+		pem, err := os.ReadFile(cfg.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.ClientCA)
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
+
+// Serve runs app on ln until ctx is cancelled, then stops accepting
+// connections, waits up to cfg.ShutdownTimeout for in-flight requests and
+// closes every open database.
+func Serve(ctx context.Context, app *fiber.App, ln net.Listener, cfg Config) error {
+	errc := make(chan error, 1)
+	go func() { errc <- app.Listener(ln) }()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Println("Shutting down, draining in-flight requests")
+	shutdownErr := app.ShutdownWithTimeout(cfg.ShutdownTimeout)
+	<-errc
+	if err := routes.CloseDatabases(); err != nil {
+		return err
+	}
+	if cfg.UnixSocket != "" {
+		os.Remove(cfg.UnixSocket)
+	}
+	return shutdownErr
+}
+
+// maxBodyBytes bounds request bodies that are read into memory. It is well
+// above Fiber's default so a push can upload the pack of a large history in
+// one request. Larger bodies are streamed to the handler, which lets an
+// import read a file of any size.
+const maxBodyBytes = 512 << 20
+
+// NewApp builds the Fiber app with CORS, auth and every route, serving the
+// databases under ./files. A handler that panics answers 500 instead of
+// taking the server down.
+func NewApp(cfg Config) (*fiber.App, error) {
+	app := fiber.New(fiber.Config{DisableStartupMessage: true, BodyLimit: maxBodyBytes, StreamRequestBody: true})
+	app.Use(recover.New())
 	app.Use(cors.New())
 
+	// The version-control commands chdir while they run, so pin the root.
+	root, err := filepath.Abs(filepath.Join(".", "files"))
+	if err != nil {
+		return nil, err
+	}
+	registry := database.NewRegistry(root, cfg.IdleTimeout)
+	registry.OnInvalidate(func(dbID string) {
+		log.Printf("Database %s was restored or checked out; reloading it on next use", dbID)
+	})
+	routes.UseRegistry(registry)
+	if cfg.AutoCommit.Enabled() {
+		routes.UseAutoCommit(dbcli.NewAutoCommitter(registry, cfg.AutoCommit, log.Printf))
+		log.Printf("Auto-commit enabled (interval %s, every %d writes, before destructive operations: %t)",
+			cfg.AutoCommit.Interval, cfg.AutoCommit.Writes, cfg.AutoCommit.BeforeDestructive)
+	}
+
+	store, err := auth.Open(auth.DefaultPath(root))
+	if err != nil {
+		return nil, err
+	}
+	routes.UseAuth(store)
+	if !store.Enabled() {
+		log.Println("No users configured; authentication is disabled (add one with `user add`)")
+	}
+
 	routes.SetupRoutes(app)
+	return app, nil
+}
+
+func Server(cmd *cobra.Command) {
+	cfg := configFromFlags(cmd)
 
-	log.Println("Fiber listening on :3000")
-	if err := app.Listen(":3000"); err != nil {
+	app, err := NewApp(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ln, err := Listen(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	scheme := "http"
+	if cfg.TLSCert != "" {
+		scheme = "https"
+	}
+	log.Printf("Fiber listening on %s (%s)", ln.Addr(), scheme)
+	if err := Serve(ctx, app, ln, cfg); err != nil {
 		log.Fatal(err)
 	}
+	log.Println("Server stopped")
 }
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func chdirTemp(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	originalDir, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get current directory: %v", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("Failed to change directory: %v", err)
+	}
+	t.Cleanup(func() { os.Chdir(originalDir) })
+	return dir
+}
+
+// TestUnixSocketGracefulShutdown serves over a Unix socket and checks that a
+// request in flight when shutdown starts still completes.
+func TestUnixSocketGracefulShutdown(t *testing.T) {
+	dir := chdirTemp(t)
+	cfg := Config{UnixSocket: filepath.Join(dir, "nutella.sock"), ShutdownTimeout: 5 * time.Second}
+
+	app, err := NewApp(cfg)
+	if err != nil {
+		t.Fatalf("Failed to build app: %v", err)
+	}
+	started := make(chan struct{})
+	app.Get("/slow", func(c *fiber.Ctx) error {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		return c.SendString("done")
+	})
+
+	ln, err := Listen(cfg)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- Serve(ctx, app, ln, cfg) }()
+
+	httpClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", cfg.UnixSocket)
+		},
+	}}
+	result := make(chan error, 1)
+	go func() {
+		resp, err := httpClient.Get("http://nutella/slow")
+		if err == nil {
+			resp.Body.Close()
+		}
+		result <- err
+	}()
+
+	<-started
+	cancel()
+	if err := <-result; err != nil {
+		t.Errorf("in-flight request failed during shutdown: %v", err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Serve returned %v", err)
+	}
+	if _, err := os.Stat(cfg.UnixSocket); !os.IsNotExist(err) {
+		t.Errorf("socket file was not removed: %v", err)
+	}
+}
+
+// TestMutualTLS checks that clients without a certificate from the configured
+// CA are turned away.
+func TestMutualTLS(t *testing.T) {
+	dir := chdirTemp(t)
+	caCert, caKey := newCert(t, nil, nil, "test-ca")
+	serverCert, serverKey := newCert(t, caCert, caKey, "127.0.0.1")
+	clientCert, clientKey := newCert(t, caCert, caKey, "client")
+
+	cfg := Config{
+		Addr:            "127.0.0.1:0",
+		TLSCert:         writePEM(t, dir, "server.crt", "CERTIFICATE", serverCert.Raw),
+		TLSKey:          writeKey(t, dir, "server.key", serverKey),
+		ClientCA:        writePEM(t, dir, "ca.crt", "CERTIFICATE", caCert.Raw),
+		ShutdownTimeout: time.Second,
+	}
+	app, err := NewApp(cfg)
+	if err != nil {
+		t.Fatalf("Failed to build app: %v", err)
+	}
+	ln, err := Listen(cfg)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- Serve(ctx, app, ln, cfg) }()
+	// Later tests build their own app, so wait for this one to shut down.
+	defer func() { cancel(); <-served }()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	get := func(certs []tls.Certificate) error {
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+		resp, err := c.Get("https://" + ln.Addr().String() + "/v1/dbs")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("GET /v1/dbs = %d; want 200", resp.StatusCode)
+			}
+		}
+		return err
+	}
+
+	if err := get(nil); err == nil {
+		t.Errorf("request without a client certificate succeeded")
+	}
+	pair := tls.Certificate{Certificate: [][]byte{clientCert.Raw}, PrivateKey: clientKey}
+	if err := get([]tls.Certificate{pair}); err != nil {
+		t.Errorf("request with a client certificate failed: %v", err)
+	}
+}
+
+// newCert creates a certificate for name, self-signed when parent is nil.
+func newCert(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	return cert, key
+}
+
+func writePEM(t *testing.T, dir, name, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatalf("Failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+func writeKey(t *testing.T, dir, name string, key *ecdsa.PrivateKey) string {
+	t.Helper()
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	return writePEM(t, dir, name, "EC PRIVATE KEY", der)
+}
+
+// TestPanicAnswers500 checks that a panicking handler fails its request
+// without taking the app down.
+func TestPanicAnswers500(t *testing.T) {
+	chdirTemp(t)
+	app, err := NewApp(Config{})
+	if err != nil {
+		t.Fatalf("Failed to build app: %v", err)
+	}
+	app.Get("/panic", func(c *fiber.Ctx) error { panic("corrupt pack") })
+	app.Get("/ok", func(c *fiber.Ctx) error { return c.SendString("ok") })
+
+	for path, want := range map[string]int{"/panic": fiber.StatusInternalServerError, "/ok": fiber.StatusOK} {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, path, nil))
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		if resp.StatusCode != want {
+			t.Errorf("GET %s = %d; want %d", path, resp.StatusCode, want)
+		}
+	}
+}